@@ -1,14 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"strings"
 
 	"github.com/golang/glog"
 	"gopkg.in/gcfg.v1"
 	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
 
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/kubernetes/pkg/cloudprovider"
@@ -26,11 +31,18 @@ type ProviderConfig struct {
 	Filters struct {
 		VmsQuery string `gcfg:"vmsquery"`
 	}
+	// NodeMapping selects how node names are mapped to VMs, by default the node name is the VM name
+	NodeMapping struct {
+		Strategy string `gcfg:"strategy"`
+		Key      string `gcfg:"key"`
+	} `gcfg:"node-mapping"`
 }
 
 type CloudProvider struct {
 	VmsQuery string
 	internal.OvirtApi
+	nodeMapper *internal.NodeMapper
+	kubeClient kubernetes.Interface
 }
 
 func main() {
@@ -46,13 +58,17 @@ func init() {
 			if config == nil {
 				return nil, fmt.Errorf("missing configuration file for ovirt cloud provider")
 			}
-			ovirtClient, err := internal.NewOvirt(config)
+			// the config is parsed twice, for the api connection and for the provider sections
+			configBytes, err := ioutil.ReadAll(config)
+			if err != nil {
+				return nil, err
+			}
+			ovirtClient, err := internal.NewOvirt(bytes.NewReader(configBytes))
 			if err != nil {
 				return nil, err
 			}
 
-			providerConfig := ProviderConfig{}
-			err = gcfg.ReadInto(&providerConfig, config)
+			providerConfig, err := readProviderConfig(string(configBytes))
 			if err != nil {
 				return nil, err
 			}
@@ -60,6 +76,22 @@ func init() {
 		})
 }
 
+// readProviderConfig parses the provider sections of the config. The connection details
+// are top level properties, which gcfg can't parse, so only the sections are passed to it and
+// sections of other components are ignored.
+func readProviderConfig(config string) (ProviderConfig, error) {
+	providerConfig := ProviderConfig{}
+	if !strings.HasPrefix(config, "[") {
+		i := strings.Index(config, "\n[")
+		if i < 0 {
+			return providerConfig, nil
+		}
+		config = config[i+1:]
+	}
+	err := gcfg.ReadStringInto(&providerConfig, config)
+	return providerConfig, gcfg.FatalOnly(err)
+}
+
 func NewOvirtProvider(providerConfig *ProviderConfig, ovirtApi internal.OvirtApi) (*CloudProvider, error) {
 	// TODO consider some basic validations for the search query although it can be tricky
 	if ovirtApi.GetConnectionDetails().Url == "" {
@@ -67,13 +99,35 @@ func NewOvirtProvider(providerConfig *ProviderConfig, ovirtApi internal.OvirtApi
 	}
 
 	vmsQuery := DefaultVMSearchQuery + providerConfig.Filters.VmsQuery
-	return &CloudProvider{vmsQuery, ovirtApi}, nil
+	p := &CloudProvider{VmsQuery: vmsQuery, OvirtApi: ovirtApi}
 
+	strategy := internal.MappingStrategy(providerConfig.NodeMapping.Strategy)
+	if strategy == "" {
+		strategy = internal.MapByVMName
+	}
+	nodeMapper, err := internal.NewNodeMapper(
+		internal.NodeMappingConfig{Strategy: strategy, Key: providerConfig.NodeMapping.Key},
+		ovirtApi,
+		p.getNode)
+	if err != nil {
+		return nil, err
+	}
+	p.nodeMapper = nodeMapper
+	return p, nil
+}
+
+// getNode serves the node mapping strategies which read the node object
+func (p *CloudProvider) getNode(nodeName string) (*v1.Node, error) {
+	if p.kubeClient == nil {
+		return nil, errors.New("the kubernetes client is not initialized yet")
+	}
+	return p.kubeClient.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
 }
 
 // Initialize provides the cloud with a kubernetes client builder and may spawn goroutines
 // to perform housekeeping activities within the cloud provider.
 func (p *CloudProvider) Initialize(clientBuilder controller.ControllerClientBuilder) {
+	p.kubeClient = clientBuilder.ClientOrDie(ProviderName)
 	glog.Info("about to connect to ovirt api")
 	err := p.Authenticate()
 	if err != nil {
@@ -92,20 +146,49 @@ func (p *CloudProvider) Instances() (cloudprovider.Instances, bool) {
 }
 
 // Zones returns a zones interface. Also returns true if the interface is supported, false otherwise.
-func (*CloudProvider) Zones() (cloudprovider.Zones, bool) {
-	return nil, false
+// The zone of a node is the oVirt cluster of its VM, and the region is the data center.
+func (p *CloudProvider) Zones() (cloudprovider.Zones, bool) {
+	return p, true
+}
+
+// GetZone can't be called by the kubelet of an external cloud provider
+func (*CloudProvider) GetZone(context context.Context) (cloudprovider.Zone, error) {
+	return cloudprovider.Zone{}, cloudprovider.NotImplemented
+}
+
+// GetZoneByNodeName returns the cluster and the data center of the VM of the node
+func (p *CloudProvider) GetZoneByNodeName(context context.Context, nodeName types.NodeName) (cloudprovider.Zone, error) {
+	vm, ok, err := p.vmByNodeName(nodeName)
+	if err != nil {
+		return cloudprovider.Zone{}, err
+	}
+	if !ok {
+		return cloudprovider.Zone{}, cloudprovider.InstanceNotFound
+	}
+	return p.zoneOf(vm.Id)
+}
+
+// GetZoneByProviderID returns the cluster and the data center of the VM
+func (p *CloudProvider) GetZoneByProviderID(context context.Context, providerID string) (cloudprovider.Zone, error) {
+	return p.zoneOf(internal.VMIdFromProviderID(providerID))
+}
 
+func (p *CloudProvider) zoneOf(vmId string) (cloudprovider.Zone, error) {
+	topology, err := internal.VMTopology(p.OvirtApi, vmId)
+	if err != nil {
+		return cloudprovider.Zone{}, err
+	}
+	return cloudprovider.Zone{FailureDomain: topology.Zone, Region: topology.Region}, nil
 }
 
 // NodeAddressses returns an hostnames/external-ips of the calling node
 // TODO how to detect a primary external IP? how to pass hostnames if we have it?
 func (p *CloudProvider) NodeAddresses(context context.Context, name types.NodeName) ([]v1.NodeAddress, error) {
-	vms, err := p.getVms()
+	vm, _, err := p.vmByNodeName(name)
 	if err != nil {
 		return nil, err
 	}
 
-	var vm = vms[string(name)]
 	if vm.Id == "" {
 		return nil, fmt.Errorf(
 			"VM by the name %s does not exist."+
@@ -118,15 +201,17 @@ func (p *CloudProvider) NodeAddresses(context context.Context, name types.NodeNa
 	return addresses, nil
 }
 
-// InstanceID returns the ovirt VM id by the vm name which is nodeName.
+// InstanceID returns the ovirt VM id of the node, mapped by the configured node mapping.
 // Note that if the VM does not exist or is no longer running, we must return ("", cloudprovider.InstanceNotFound)
 func (p *CloudProvider) InstanceID(context context.Context, nodeName types.NodeName) (string, error) {
-	vms, err := p.getVms()
-	vm, ok := vms[string(nodeName)]
+	vm, ok, err := p.vmByNodeName(nodeName)
+	if err != nil {
+		return "", err
+	}
 	if !ok || vm.Status == "down" {
 		return "", cloudprovider.InstanceNotFound
 	}
-	return vm.Id, err
+	return vm.Id, nil
 }
 
 // Clusters returns a clusters interface.  Also returns true if the interface is supported, false otherwise.
@@ -152,9 +237,10 @@ func (*CloudProvider) ScrubDNS(nameservers, searches []string) (nsOut, srchOut [
 
 }
 
-// HasClusterID returns true if a ClusterID is required and set
-func (*CloudProvider) HasClusterID() bool {
-	return false
+// HasClusterID returns true if a ClusterID is required and set. The cluster ID is set by
+// clusterId in the config, shared with the provisioner and the flex driver.
+func (p *CloudProvider) HasClusterID() bool {
+	return p.GetConnectionDetails().ClusterId != ""
 }
 
 //AddSSHKeyToAllInstances Not implemented in ovirt - Can be implemented by pushing the keys to
@@ -171,11 +257,10 @@ func (p *CloudProvider) CurrentNodeName(context context.Context, hostname string
 // ExternalID returns the cloud provider ID of the node with the specified NodeName.
 // Note that if the instance does not exist or is no longer running, we must return ("", cloudprovider.InstanceNotFound)
 func (p *CloudProvider) ExternalID(nodeName types.NodeName) (string, error) {
-	vms, err := p.getVms()
+	vm, ok, err := p.vmByNodeName(nodeName)
 	if err != nil {
 		return "", err
 	}
-	vm, ok := vms[string(nodeName)]
 	if !ok {
 		return "", cloudprovider.InstanceNotFound
 	}
@@ -273,6 +358,28 @@ func (p *CloudProvider) getVmsById() (map[string]internal.VM, error) {
 	return vmsById, nil
 }
 
+// vmByNodeName maps the node to its VM out of the VMs matching the search query.
+// The returned bool is false when there is no such VM.
+func (p *CloudProvider) vmByNodeName(nodeName types.NodeName) (internal.VM, bool, error) {
+	vmId, err := p.nodeMapper.VMId(string(nodeName))
+	if err != nil {
+		if _, notMapped := err.(internal.NodeNotMapped); notMapped {
+			return internal.VM{}, false, nil
+		}
+		return internal.VM{}, false, err
+	}
+	vmsById, err := p.getVmsById()
+	if err != nil {
+		return internal.VM{}, false, err
+	}
+	vm, ok := vmsById[vmId]
+	if !ok {
+		// the VM may have been recreated, don't trust the cached id
+		p.nodeMapper.Forget(string(nodeName))
+	}
+	return vm, ok, nil
+}
+
 // extractNodeAddresses will return all addresses of the reported node
 // TODO how to detect a primary external IP? how to pass hostnames if we have it?
 func extractNodeAddresses(vm internal.VM) []v1.NodeAddress {
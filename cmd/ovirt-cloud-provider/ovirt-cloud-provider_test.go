@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"io"
 	"io/ioutil"
 
 	. "github.com/onsi/ginkgo"
@@ -54,6 +55,50 @@ var _ = Describe("ovirt-cloud-provider configuration tests", func() {
 			Expect(underTest.ProviderName()).To(Equal(ProviderName))
 		})
 
+		It("has no cluster ID", func() {
+			Expect(underTest.HasClusterID()).To(BeFalse())
+		})
+
+	})
+
+	Context("With a cluster ID", func() {
+		It("has the cluster ID", func() {
+			connection := testOvirtConfig
+			connection.ClusterId = "prod"
+			underTest, _ = NewOvirtProvider(&ProviderConfig{}, MockApi{connection})
+			Expect(underTest.HasClusterID()).To(BeTrue())
+		})
+	})
+
+	Context("With a node mapping config", func() {
+		It("reads the provider sections and skips the connection properties", func() {
+			conf, err := readProviderConfig(`
+url=https://engine/ovirt-engine/api
+username=admin@internal
+[filters]
+vmsquery=cluster=k8s
+[node-mapping]
+strategy=annotation
+key=ovirt.org/vm-id
+`)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.Filters.VmsQuery).To(Equal("cluster=k8s"))
+			Expect(conf.NodeMapping.Strategy).To(Equal("annotation"))
+			Expect(conf.NodeMapping.Key).To(Equal("ovirt.org/vm-id"))
+		})
+
+		It("reads a config with no provider sections", func() {
+			conf, err := readProviderConfig("url=https://engine/ovirt-engine/api\n")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.NodeMapping.Strategy).To(Equal(""))
+		})
+
+		It("fails on an unknown strategy", func() {
+			conf := ProviderConfig{}
+			conf.NodeMapping.Strategy = "bogus"
+			_, err := NewOvirtProvider(&conf, MockApi{testOvirtConfig})
+			Expect(err).To(HaveOccurred())
+		})
 	})
 
 	Context("With invalid config", func() {
@@ -161,6 +206,23 @@ var _ = Describe("ovirt-cloud-provider node tests", func() {
 			Expect(vmId).To(Equal(""))
 		})
 
+		It("returns the cluster as the zone and the data center as the region of the node", func() {
+			zone, err := underTest.GetZoneByNodeName(nil, vm1NodeName)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(zone).To(Equal(cloudprovider.Zone{FailureDomain: "cluster1", Region: "dc1"}))
+		})
+
+		It("returns the zone by the provider ID", func() {
+			zone, err := underTest.GetZoneByProviderID(nil, "ovirt://"+vm1Id)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(zone.Region).To(Equal("dc1"))
+		})
+
+		It("fails to return the zone of a non-existing node", func() {
+			_, err := underTest.GetZoneByNodeName(nil, "non-existing-VM")
+			Expect(err).Should(Equal(cloudprovider.InstanceNotFound))
+		})
+
 	})
 })
 
@@ -210,6 +272,10 @@ func (MockApi) Post(path string, data interface{}) (string, error) {
 	panic("implement me")
 }
 
+func (MockApi) Put(path string, data interface{}) (string, error) {
+	panic("implement me")
+}
+
 func (MockApi) Delete(path string) ([]byte, error) {
 	panic("implement me")
 }
@@ -240,11 +306,95 @@ func (MockApi) DetachDiskFromVM(vmId string, diskId string) error {
 	panic("implement me")
 }
 
+func (MockApi) ActivateDiskAttachment(vmId string, diskId string) error {
+	panic("implement me")
+}
+
+func (MockApi) DeactivateDiskAttachment(vmId string, diskId string) error {
+	panic("implement me")
+}
+
+func (MockApi) CreateDiskSnapshot(diskId string, description string) (internal.Snapshot, error) {
+	panic("implement me")
+}
+
+func (MockApi) GetDiskSnapshot(vmId string, snapshotId string, diskId string) (internal.Snapshot, error) {
+	panic("implement me")
+}
+
+func (MockApi) ListDiskSnapshots(diskId string) ([]internal.Snapshot, error) {
+	panic("implement me")
+}
+
+func (MockApi) DeleteDiskSnapshot(vmId string, snapshotId string) error {
+	panic("implement me")
+}
+
+func (MockApi) RestoreDiskSnapshot(snapshot internal.Snapshot, diskName string, diskDescription string, storageDomainName string, sizeInBytes int64, thinProvisioning bool) (internal.Disk, error) {
+	panic("implement me")
+}
+
+func (MockApi) CopyDisk(diskId string, diskName string, diskDescription string, storageDomainName string, sizeInBytes int64, thinProvisioning bool) (internal.Disk, error) {
+	panic("implement me")
+}
+
+func (MockApi) ExtendDisk(diskId string, sizeInBytes int64) (internal.Disk, error) {
+	panic("implement me")
+}
+
+func (MockApi) StartImageTransfer(diskId string, direction string) (internal.ImageTransfer, error) {
+	panic("implement me")
+}
+
+func (MockApi) GetImageTransfer(transferId string) (internal.ImageTransfer, error) {
+	panic("implement me")
+}
+
+func (MockApi) FinalizeImageTransfer(transferId string, diskId string) error {
+	panic("implement me")
+}
+
+func (MockApi) CancelImageTransfer(transferId string) error {
+	panic("implement me")
+}
+
+func (MockApi) PutImageChunk(transferUrl string, offset int64, length int64, total int64, data io.Reader) error {
+	panic("implement me")
+}
+
+func (MockApi) GetImageChunk(transferUrl string, offset int64, length int64) (io.ReadCloser, error) {
+	panic("implement me")
+}
+
+func (MockApi) GetImageSize(transferUrl string) (int64, error) {
+	panic("implement me")
+}
+
 func (MockApi) GetDiskByName(diskName string) (internal.DiskResult, error) {
 	panic("implement me")
 }
 
-func (MockApi) CreateUnattachedDisk(diskName string, storageDomainName string, sizeIbBytes int64, readOnly bool, thinProvisioning bool) (internal.Disk, error) {
+func (MockApi) GetDiskById(diskId string) (internal.Disk, error) {
+	panic("implement me")
+}
+
+func (MockApi) GetTemplateDisks(templateName string) ([]internal.Disk, error) {
+	panic("implement me")
+}
+
+func (MockApi) SearchDisks(query string) ([]internal.Disk, error) {
+	panic("implement me")
+}
+
+func (MockApi) UpdateDisk(diskId string, update internal.DiskUpdate) (internal.Disk, error) {
+	panic("implement me")
+}
+
+func (MockApi) MoveDisk(diskId string, storageDomainName string) error {
+	panic("implement me")
+}
+
+func (MockApi) CreateUnattachedDisk(options internal.DiskOptions) (internal.Disk, error) {
 	panic("implement me")
 }
 
@@ -254,7 +404,44 @@ func (MockApi) CreateDisk(
 	readOnly bool,
 	vmId string,
 	diskId string,
-	diskInterface string) (internal.DiskAttachment, error) {
+	diskInterface string,
+	passDiscard bool) (internal.DiskAttachment, error) {
+	panic("implement me")
+}
+
+func (MockApi) GetStorageDomainBy(name string) (internal.StorageDomain, error) {
+	panic("implement me")
+}
+
+func (MockApi) GetCluster(clusterId string) (internal.Cluster, error) {
+	return internal.Cluster{Id: clusterId, Name: "cluster1", DataCenter: internal.Reference{Id: "dc1-id"}}, nil
+}
+
+func (MockApi) GetClusterByName(name string) (internal.Cluster, error) {
+	panic("implement me")
+}
+
+func (MockApi) GetDataCenter(dataCenterId string) (internal.DataCenter, error) {
+	return internal.DataCenter{Id: dataCenterId, Name: "dc1"}, nil
+}
+
+func (MockApi) GetDataCenterByName(name string) (internal.DataCenter, error) {
+	panic("implement me")
+}
+
+func (MockApi) GetDataCenters() ([]internal.DataCenter, error) {
+	panic("implement me")
+}
+
+func (MockApi) GetDataCenterStorageDomains(dataCenterId string) ([]internal.StorageDomain, error) {
+	panic("implement me")
+}
+
+func (MockApi) GetQuotaStorageLimits(dataCenterId string, quotaId string) ([]internal.QuotaStorageLimit, error) {
+	panic("implement me")
+}
+
+func (MockApi) GetDiskProfile(id string) (internal.DiskProfile, error) {
 	panic("implement me")
 }
 
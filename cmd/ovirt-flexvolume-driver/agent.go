@@ -0,0 +1,213 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/syslog"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// defaultAgentSocket is where the agent listens, unless 'agentSocket' is set in the driver config.
+// Both the agent container and the host running kubelet must see the same path.
+const defaultAgentSocket = "/var/run/ovirt-flexvolume-driver/agent.sock"
+
+// agentDialTimeout is kept short - when no agent is listening the call-out is handled standalone
+const agentDialTimeout = time.Second
+
+// agentCallTimeout bounds a forwarded call-out, an attach or a detach waits for the engine
+const agentCallTimeout = 2 * time.Minute
+
+// agentRequestTimeout bounds the read of a request by the agent
+const agentRequestTimeout = 10 * time.Second
+
+// agentOperations are the call-outs served by the agent, those which only talk to the engine. The
+// node local call-outs, i.e. mountdevice, run mkfs and mount, which must run on the host by the
+// flexvolume binary, not in the agent container.
+var agentOperations = map[string]bool{
+	"init":          true,
+	"attach":        true,
+	"detach":        true,
+	"isattached":    true,
+	"getvolumename": true,
+}
+
+// agentRequest is a single flexvolume call-out, forwarded as is to the agent
+type agentRequest struct {
+	Args []string `json:"args"`
+}
+
+// agentResponse carries the call-out output and error back to the thin binary
+type agentResponse struct {
+	Output string `json:"output"`
+	Error  string `json:"error,omitempty"`
+}
+
+// runAgent runs the driver as a long running node agent. It keeps a single authenticated
+// ovirt client, caches the node to VM mappings and serves the call-outs of the flexvolume
+// binary over a unix socket until it is terminated.
+func runAgent() (string, error) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	stop := make(chan struct{})
+	go func() {
+		<-signals
+		close(stop)
+	}()
+	return "", serveAgentUntil(stop)
+}
+
+// serveAgentUntil serves the call-outs over the agent socket till stop is closed
+func serveAgentUntil(stop <-chan struct{}) error {
+	ovirt, err := newOvirt()
+	if err != nil {
+		return err
+	}
+	// from now on every call-out reuses the same client and the node mapper with its cache
+	ovirtClient = ovirt
+
+	socket := agentSocketPath()
+	listener, err := listenAgentSocket(socket)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-stop
+		listener.Close()
+	}()
+
+	logAgentf("ovirt-flexvolume-driver agent is listening on %s", socket)
+	serveAgent(listener, app)
+	os.Remove(socket)
+	return nil
+}
+
+// listenAgentSocket creates the socket directory and listens on the socket, removing
+// a stale socket left by a previous agent.
+func listenAgentSocket(socket string) (net.Listener, error) {
+	err := os.MkdirAll(filepath.Dir(socket), 0700)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Remove(socket)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(socket, 0600)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// serveAgent accepts connections till the listener is closed, every connection is
+// a single call-out handled by the handler.
+func serveAgent(listener net.Listener, handler func(args []string) (string, error)) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go handleAgentConnection(conn, handler)
+	}
+}
+
+func handleAgentConnection(conn net.Conn, handler func(args []string) (string, error)) {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(agentRequestTimeout))
+	request := agentRequest{}
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		logAgentf("failed reading agent request %s", err)
+		return
+	}
+	response := agentResponse{}
+	err = json.Unmarshal(line, &request)
+	if err != nil || len(request.Args) == 0 || !agentOperations[request.Args[0]] {
+		response.Error = errors.New(usage).Error()
+	} else {
+		response.Output, err = handler(request.Args)
+		if err != nil {
+			response.Error = err.Error()
+		}
+	}
+	json.NewEncoder(conn).Encode(response)
+}
+
+// forwardToAgent sends the call-out to the agent. The returned bool is false when no
+// agent is reachable, and the caller should handle the call-out by itself. Once the call-out
+// is sent it is never handled again, an attach or a detach isn't safe to repeat, so a failure
+// to get the reply of the agent fails the call-out.
+func forwardToAgent(socket string, args []string) (string, bool, error) {
+	conn, err := net.DialTimeout("unix", socket, agentDialTimeout)
+	if err != nil {
+		return "", false, nil
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(agentCallTimeout))
+
+	err = json.NewEncoder(conn).Encode(agentRequest{Args: args})
+	if err != nil {
+		return "", true, fmt.Errorf("failed sending %s to the agent: %s", args[0], err)
+	}
+
+	response := agentResponse{}
+	err = json.NewDecoder(conn).Decode(&response)
+	if err != nil {
+		// the agent may have been restarted in the middle of the call-out
+		return "", true, fmt.Errorf("failed getting the reply of the agent to %s: %s", args[0], err)
+	}
+	if response.Error != "" {
+		return response.Output, true, errors.New(response.Error)
+	}
+	return response.Output, true, nil
+}
+
+// agentSocketPath returns the 'agentSocket' from the driver config or the default socket.
+// It only reads the config file, without any api interaction.
+func agentSocketPath() string {
+	conf, err := readDriverConfig()
+	if err != nil {
+		return defaultAgentSocket
+	}
+	if s := conf.GetString("agentSocket"); s != "" {
+		return s
+	}
+	return defaultAgentSocket
+}
+
+func logAgentf(format string, args ...interface{}) {
+	writer, e := syslog.New(syslog.LOG_INFO, "ovirt-flexvolume-driver-agent")
+	if e == nil {
+		defer writer.Close()
+		writer.Info(fmt.Sprintf(format, args...))
+	}
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+}
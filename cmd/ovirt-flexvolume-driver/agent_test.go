@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func startTestAgent(t *testing.T, handler func(args []string) (string, error)) (string, func()) {
+	dir, err := ioutil.TempDir("", "ovirt-flexvolume-driver-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "agent.sock")
+	listener, err := listenAgentSocket(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveAgent(listener, handler)
+	return socket, func() {
+		listener.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestForwardToAgent(t *testing.T) {
+	socket, stop := startTestAgent(t, func(args []string) (string, error) {
+		return `{"status":"Success"}`, nil
+	})
+	defer stop()
+
+	out, forwarded, err := forwardToAgent(socket, []string{"init"})
+	if !forwarded {
+		t.Fatal("expected the call-out to be forwarded")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != `{"status":"Success"}` {
+		t.Errorf("unexpected output %s", out)
+	}
+}
+
+func TestForwardToAgentReturnsTheError(t *testing.T) {
+	socket, stop := startTestAgent(t, func(args []string) (string, error) {
+		return `{"status":"Failure"}`, errors.New("attach failed")
+	})
+	defer stop()
+
+	out, forwarded, err := forwardToAgent(socket, []string{"attach", "{}", "node1"})
+	if !forwarded {
+		t.Fatal("expected the call-out to be forwarded")
+	}
+	if err == nil || err.Error() != "attach failed" {
+		t.Errorf("expected the handler error, got %v", err)
+	}
+	if out != `{"status":"Failure"}` {
+		t.Errorf("unexpected output %s", out)
+	}
+}
+
+func TestForwardToAgentRefusesToStartAnAgent(t *testing.T) {
+	socket, stop := startTestAgent(t, func(args []string) (string, error) {
+		t.Error("handler should not be called")
+		return "", nil
+	})
+	defer stop()
+
+	_, _, err := forwardToAgent(socket, []string{"agent"})
+	if err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestForwardToAgentWithNoAgent(t *testing.T) {
+	_, forwarded, err := forwardToAgent("/non/existing/agent.sock", []string{"init"})
+	if forwarded || err != nil {
+		t.Errorf("expected a standalone fallback, got forwarded %v error %v", forwarded, err)
+	}
+}
+
+func TestAgentRefusesNodeLocalCallOuts(t *testing.T) {
+	socket, stop := startTestAgent(t, func(args []string) (string, error) {
+		t.Errorf("handler should not be called for %s", args[0])
+		return "", nil
+	})
+	defer stop()
+
+	for _, op := range []string{"waitforattach", "mountdevice", "unmountdevice"} {
+		_, _, err := forwardToAgent(socket, []string{op, "/dev/sdb"})
+		if err == nil {
+			t.Errorf("expected the agent to refuse %s", op)
+		}
+	}
+}
+
+func TestForwardToAgentWithLostReply(t *testing.T) {
+	socket, stop := startTestAgent(t, nil)
+	stop()
+	listener, err := listenAgentSocket(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Dir(socket))
+	defer listener.Close()
+	go func() {
+		// the agent is restarted in the middle of the call-out
+		conn, err := listener.Accept()
+		if err == nil {
+			bufio.NewReader(conn).ReadBytes('\n')
+			conn.Close()
+		}
+	}()
+
+	_, forwarded, err := forwardToAgent(socket, []string{"attach", "{}", "node1"})
+	if !forwarded || err == nil {
+		t.Errorf("expected the forwarded attach to fail and not to run again, got forwarded %v error %v", forwarded, err)
+	}
+}
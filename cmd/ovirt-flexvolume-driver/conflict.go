@@ -0,0 +1,178 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log/syslog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+
+	"github.com/ovirt/ovirt-openshift-extensions/internal"
+)
+
+// defaultNotRespondingGracePeriod is how long a VM must be not responding before its disks
+// are taken, unless 'notRespondingGracePeriod' is set in the driver config
+const defaultNotRespondingGracePeriod = 5 * time.Minute
+
+var notRespondingGracePeriod = defaultNotRespondingGracePeriod
+
+// notRespondingDir has a file for every VM the driver saw not responding, modified when it was
+// first seen so. The engine doesn't tell since when a VM is not responding.
+var notRespondingDir = "/var/lib/ovirt-flexvolume-driver/not-responding"
+
+// releaseFromOtherVMs makes sure the disk is not attached to any VM but vmId. Disks held by
+// a dead VM are force detached from it, otherwise the attach fails naming the holding VM.
+// A VM is dead when it is down, or when it is not responding for longer than the grace period
+// and has no Ready node. A shareable disk is left attached to the other VMs.
+func releaseFromOtherVMs(ovirt internal.OvirtApi, disk internal.Disk, vmId string) error {
+	if disk.Vms == nil || disk.Shareable {
+		return nil
+	}
+	for _, holder := range disk.Vms.Vms {
+		if holder.Id == vmId {
+			continue
+		}
+		holderVM, err := ovirt.GetVMById(holder.Id)
+		if err != nil {
+			return err
+		}
+
+		var node *v1.Node
+		now := time.Now()
+		since := now
+		if holderVM.Status == "not_responding" {
+			node, err = nodeOfVM(holderVM, getKubeNode)
+			if err != nil {
+				return err
+			}
+			since = notRespondingSince(holderVM.Id, now)
+		} else {
+			forgetNotResponding(holderVM.Id)
+		}
+		dead, reason := isVMDead(holderVM, node, since, notRespondingGracePeriod, now)
+		if !dead {
+			return fmt.Errorf("disk %s is attached to VM %s (%s) which is %s", disk.Name, holderVM.Name, holderVM.Id, reason)
+		}
+
+		auditf("force detaching disk %s (%s) from VM %s (%s), %s, to attach it to VM %s",
+			disk.Name, disk.Id, holderVM.Name, holderVM.Id, reason, vmId)
+		err = internal.DetachDiskGracefully(ovirt, holderVM.Id, disk.Id, internal.DetachOptions{Force: true})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notRespondingSince returns when the driver first saw the VM not responding, and records now
+// when it is the first time. A record which can't be written restarts the grace period on every
+// attach, so the disks of the VM are not taken.
+func notRespondingSince(vmId string, now time.Time) time.Time {
+	record := filepath.Join(notRespondingDir, vmId)
+	if info, err := os.Stat(record); err == nil {
+		return info.ModTime()
+	}
+	err := os.MkdirAll(notRespondingDir, 0700)
+	if err == nil {
+		err = ioutil.WriteFile(record, nil, 0600)
+	}
+	if err == nil {
+		err = os.Chtimes(record, now, now)
+	}
+	if err != nil {
+		auditf("failed recording VM %s is not responding: %s", vmId, err)
+	}
+	return now
+}
+
+// forgetNotResponding drops the record of a VM which isn't not responding anymore
+func forgetNotResponding(vmId string) {
+	os.Remove(filepath.Join(notRespondingDir, vmId))
+}
+
+// isVMDead decides if the disks of the VM can be taken away from it. since is when the VM was
+// first seen not responding, and node is the kubernetes node of the VM, nil if there is none.
+// A not responding VM without a node is dead once the grace period is over.
+func isVMDead(vm internal.VM, node *v1.Node, since time.Time, gracePeriod time.Duration, now time.Time) (bool, string) {
+	switch vm.Status {
+	case "down":
+		return true, "down"
+	case "not_responding":
+		notRespondingFor := now.Sub(since)
+		if node != nil {
+			ready := nodeReadyCondition(node)
+			if ready == nil || ready.Status == v1.ConditionTrue {
+				return false, fmt.Sprintf("not responding, but node %s is Ready", node.Name)
+			}
+		}
+		if notRespondingFor < gracePeriod {
+			return false, fmt.Sprintf("not responding for %s only", notRespondingFor)
+		}
+		if node == nil {
+			return true, fmt.Sprintf("not responding for %s, and is not a known node", notRespondingFor)
+		}
+		return true, fmt.Sprintf("not responding for %s, and node %s is NotReady", notRespondingFor, node.Name)
+	}
+	return false, vm.Status
+}
+
+func nodeReadyCondition(node *v1.Node) *v1.NodeCondition {
+	for i, c := range node.Status.Conditions {
+		if c.Type == v1.NodeReady {
+			return &node.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// nodeOfVM gets the kubernetes node of the VM, nil if there is none. The node is named after the VM
+// or its FQDN, and is the node of the VM when the node mapping agrees, so only the candidate nodes
+// are fetched and no 'list' on nodes is needed.
+func nodeOfVM(vm internal.VM, getNode internal.NodeGetter) (*v1.Node, error) {
+	for _, name := range []string{vm.Name, vm.Fqdn} {
+		if name == "" {
+			continue
+		}
+		node, err := getNode(name)
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		id, err := nodeMapper.VMId(node.Name)
+		if err == nil && id == vm.Id {
+			return node, nil
+		}
+	}
+	return nil, nil
+}
+
+// auditf records actions taken on other VMs, which an admin would like to know about
+func auditf(format string, args ...interface{}) {
+	writer, e := syslog.New(syslog.LOG_WARNING|syslog.LOG_DAEMON, "ovirt-flexvolume-driver")
+	if e == nil {
+		defer writer.Close()
+		writer.Warning("AUDIT: " + fmt.Sprintf(format, args...))
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/ovirt/ovirt-openshift-extensions/internal"
+)
+
+func nodeWithReady(status v1.ConditionStatus, since time.Time) *v1.Node {
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}
+	node.Status.Conditions = []v1.NodeCondition{
+		{Type: v1.NodeReady, Status: status, LastTransitionTime: metav1.NewTime(since)},
+	}
+	return node
+}
+
+func TestIsVMDead(t *testing.T) {
+	now := time.Now()
+	grace := 5 * time.Minute
+	longAgo := now.Add(-time.Hour)
+	cases := []struct {
+		description string
+		status      string
+		node        *v1.Node
+		since       time.Time
+		dead        bool
+	}{
+		{"down VM", "down", nil, now, true},
+		{"up VM", "up", nodeWithReady(v1.ConditionFalse, longAgo), longAgo, false},
+		{"not responding VM with no node within the grace period", "not_responding", nil, now.Add(-time.Minute), false},
+		{"not responding VM with no node past the grace period", "not_responding", nil, longAgo, true},
+		{"not responding VM with a Ready node", "not_responding", nodeWithReady(v1.ConditionTrue, longAgo), longAgo, false},
+		{"not responding VM within the grace period", "not_responding", nodeWithReady(v1.ConditionUnknown, longAgo), now.Add(-time.Minute), false},
+		{"not responding VM past the grace period", "not_responding", nodeWithReady(v1.ConditionUnknown, now.Add(-time.Minute)), longAgo, true},
+	}
+	for _, c := range cases {
+		dead, reason := isVMDead(internal.VM{Id: "vm1", Status: c.status}, c.node, c.since, grace, now)
+		if dead != c.dead {
+			t.Errorf("%s: expected dead %v got %v (%s)", c.description, c.dead, dead, reason)
+		}
+		if reason == "" {
+			t.Errorf("%s: expected a reason", c.description)
+		}
+	}
+}
+
+func TestNotRespondingSince(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ovirt-flexvolume-driver-not-responding")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	notRespondingDir = filepath.Join(dir, "not-responding")
+	defer func() { notRespondingDir = "/var/lib/ovirt-flexvolume-driver/not-responding" }()
+
+	first := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if since := notRespondingSince("vm1", first); !since.Equal(first) {
+		t.Errorf("expected the VM to be first seen not responding at %s, got %s", first, since)
+	}
+	// a later attach measures from the first time
+	if since := notRespondingSince("vm1", time.Now()); !since.Equal(first) {
+		t.Errorf("expected the VM to be not responding since %s, got %s", first, since)
+	}
+	forgetNotResponding("vm1")
+	now := time.Now().Truncate(time.Second)
+	if since := notRespondingSince("vm1", now); !since.Equal(now) {
+		t.Errorf("expected a VM which responded again to start over at %s, got %s", now, since)
+	}
+}
+
+func TestReleaseFromOtherVMsIgnoresTheSameVM(t *testing.T) {
+	disk := internal.Disk{Id: "disk1", Vms: &internal.VMResult{Vms: []internal.VM{{Id: "vm1"}}}}
+	err := releaseFromOtherVMs(nil, disk, "vm1")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReleaseFromOtherVMsLeavesShareableDisks(t *testing.T) {
+	disk := internal.Disk{Id: "disk1", Shareable: true, Vms: &internal.VMResult{Vms: []internal.VM{{Id: "vm2"}}}}
+	// a nil api panics when the other VM is looked up
+	err := releaseFromOtherVMs(nil, disk, "vm1")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNodeOfVM(t *testing.T) {
+	nodes := map[string]*v1.Node{
+		"vm1.example.com": {ObjectMeta: metav1.ObjectMeta{Name: "vm1.example.com"}, Spec: v1.NodeSpec{ProviderID: "ovirt://vm1-id"}},
+		"vm2":             {ObjectMeta: metav1.ObjectMeta{Name: "vm2"}, Spec: v1.NodeSpec{ProviderID: "ovirt://other-id"}},
+	}
+	getNode := func(name string) (*v1.Node, error) {
+		if node, ok := nodes[name]; ok {
+			return node, nil
+		}
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: "nodes"}, name)
+	}
+	mapper, err := internal.NewNodeMapper(internal.NodeMappingConfig{Strategy: internal.MapByProviderID}, nil, getNode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeMapper = mapper
+	defer func() { nodeMapper = nil }()
+
+	cases := []struct {
+		vm   internal.VM
+		node string
+	}{
+		{internal.VM{Id: "vm1-id", Name: "vm1", Fqdn: "vm1.example.com"}, "vm1.example.com"},
+		// a node of the same name mapped to another VM
+		{internal.VM{Id: "vm2-id", Name: "vm2"}, ""},
+		{internal.VM{Id: "vm3-id", Name: "vm3"}, ""},
+	}
+	for _, c := range cases {
+		node, err := nodeOfVM(c.vm, getNode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if node == nil && c.node != "" || node != nil && node.Name != c.node {
+			t.Errorf("expected node '%s' of VM %s, got %v", c.node, c.vm.Name, node)
+		}
+	}
+}
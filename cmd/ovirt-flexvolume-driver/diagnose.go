@@ -0,0 +1,445 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/ovirt/ovirt-openshift-extensions/internal"
+)
+
+// productUUIDPath is where the OS exposes the VM id
+var productUUIDPath = "/sys/devices/virtual/dmi/id/product_uuid"
+
+// requiredTools are the host binaries used by mountdevice and unmountdevice
+var requiredTools = []string{"mkfs", "mkfs.ext4", "mkfs.xfs", "lsblk", "findmnt", "mount", "umount"}
+
+const (
+	checkOk      = "OK"
+	checkWarning = "WARN"
+	checkFailed  = "FAIL"
+	checkSkipped = "SKIP"
+)
+
+// requiredPermits are the permits the driver needs, by what they are needed on
+var requiredPermits = []struct {
+	permit string
+	on     string
+}{
+	{"configure_vm_storage", "vm"},
+	{"create_disk", "data center"},
+}
+
+// warning is returned by a check which passes, but with something to improve
+type warning struct {
+	message string
+}
+
+func (w warning) Error() string {
+	return w.message
+}
+
+// checkResult is the outcome of a single diagnosis check
+type checkResult struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+	Hint    string `json:"hint,omitempty"`
+}
+
+// diagnosis holds what the checks found so far, later checks depend on it
+type diagnosis struct {
+	configFile string
+	conf       *viper.Viper
+	ovirt      internal.OvirtApi
+	engineUrl  *url.URL
+	vm         internal.VM
+	results    []checkResult
+}
+
+type check struct {
+	name string
+	// run returns an error with a remediation hint, or a message on success
+	run func(d *diagnosis) (message string, hint string, err error)
+	// requires is the name of a check that must pass first
+	requires []string
+}
+
+var checks = []check{
+	{name: "config", run: checkConfig},
+	{name: "engine-url", run: checkEngineUrl, requires: []string{"config"}},
+	{name: "tls", run: checkTLS, requires: []string{"engine-url"}},
+	{name: "sso-login", run: checkLogin, requires: []string{"engine-url"}},
+	{name: "storage-domains", run: checkStorageDomains, requires: []string{"sso-login"}},
+	{name: "vm-id", run: checkVmId, requires: []string{"sso-login"}},
+	{name: "permissions", run: checkPermissions, requires: []string{"vm-id"}},
+	{name: "kubeconfig", run: checkKubeConfig, requires: []string{"config"}},
+	{name: "host-tools", run: checkHostTools},
+}
+
+// diagnose runs all the checks in order and prints a report, as text or as json.
+// It fails if any of the checks failed.
+func diagnose(asJson bool) (string, error) {
+	d := &diagnosis{configFile: driverConfigPath()}
+	failed := 0
+	for _, c := range checks {
+		r := d.run(c)
+		if r.Status == checkFailed {
+			failed++
+		}
+	}
+
+	var out string
+	if asJson {
+		b, err := json.MarshalIndent(d.results, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		out = string(b) + "\n"
+	} else {
+		out = formatResults(d.results)
+	}
+	if failed > 0 {
+		return out, fmt.Errorf("%d checks failed", failed)
+	}
+	return out, nil
+}
+
+func (d *diagnosis) run(c check) checkResult {
+	r := checkResult{Name: c.name}
+	for _, required := range c.requires {
+		if status := d.status(required); status != checkOk && status != checkWarning {
+			r.Status = checkSkipped
+			r.Message = fmt.Sprintf("requires the %s check to pass", required)
+			d.results = append(d.results, r)
+			return r
+		}
+	}
+	message, hint, err := c.run(d)
+	if w, ok := err.(warning); ok {
+		r.Status = checkWarning
+		r.Message = w.message
+		r.Hint = hint
+	} else if err != nil {
+		r.Status = checkFailed
+		r.Message = err.Error()
+		r.Hint = hint
+	} else {
+		r.Status = checkOk
+		r.Message = message
+	}
+	d.results = append(d.results, r)
+	return r
+}
+
+func (d *diagnosis) status(name string) string {
+	for _, r := range d.results {
+		if r.Name == name {
+			return r.Status
+		}
+	}
+	return ""
+}
+
+func formatResults(results []checkResult) string {
+	var b bytes.Buffer
+	for _, r := range results {
+		fmt.Fprintf(&b, "[%4s] %-12s %s\n", r.Status, r.Name, r.Message)
+		if r.Hint != "" {
+			fmt.Fprintf(&b, "       %-12s hint: %s\n", "", r.Hint)
+		}
+	}
+	return b.String()
+}
+
+func checkConfig(d *diagnosis) (string, string, error) {
+	hint := "set OVIRT_FLEXDRIVER_CONF or place ovirt-flexvolume-driver.conf next to the driver binary"
+	file, err := ioutil.ReadFile(d.configFile)
+	if err != nil {
+		return "", hint, err
+	}
+	conf, err := validateDriverConfig(file)
+	if err != nil {
+		return "", "the config is a properties file of key=value lines, with the engine url, username and password", err
+	}
+	d.conf = conf
+	d.ovirt, err = internal.NewOvirt(bytes.NewReader(file))
+	if err != nil {
+		return "", hint, err
+	}
+	return d.configFile, "", nil
+}
+
+func checkEngineUrl(d *diagnosis) (string, string, error) {
+	engineUrl, err := url.Parse(d.conf.GetString("url"))
+	if err == nil && engineUrl.Hostname() == "" {
+		err = fmt.Errorf("'%s' has no host", d.conf.GetString("url"))
+	}
+	if err != nil {
+		return "", "the url should look like https://engine-fqdn/ovirt-engine/api", err
+	}
+	addresses, err := net.LookupHost(engineUrl.Hostname())
+	if err != nil {
+		return "", "make sure the engine FQDN resolves from this node, check /etc/resolv.conf or /etc/hosts", err
+	}
+	d.engineUrl = engineUrl
+	return fmt.Sprintf("%s resolves to %s", engineUrl.Hostname(), strings.Join(addresses, ",")), "", nil
+}
+
+func checkTLS(d *diagnosis) (string, string, error) {
+	if d.engineUrl.Scheme != "https" {
+		return "plain http, no TLS", "", nil
+	}
+	if d.conf.GetBool("insecure") {
+		return "insecure=true, the engine certificate is not verified", "", nil
+	}
+	caFile := d.conf.GetString("cafile")
+	if caFile == "" {
+		return "", "download the engine CA from /ovirt-engine/services/pki-resource?resource=ca-certificate&format=X509-PEM-CA and set cafile",
+			warning{"no cafile is set, the driver downloads the engine CA over plain http"}
+	}
+	pemBytes, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return "", "set cafile to a readable PEM file of the engine CA", err
+	}
+	pool := x509.NewCertPool()
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return "", "set cafile to the PEM file of the engine CA", fmt.Errorf("%s has no PEM certificate", caFile)
+	}
+	ca, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", "set cafile to the PEM file of the engine CA", err
+	}
+	if time.Now().After(ca.NotAfter) {
+		return "", "renew the engine CA and update cafile", fmt.Errorf("the CA in %s expired on %s", caFile, ca.NotAfter)
+	}
+	pool.AddCert(ca)
+
+	port := d.engineUrl.Port()
+	if port == "" {
+		port = "443"
+	}
+	conn, err := tls.DialWithDialer(
+		&net.Dialer{Timeout: 10 * time.Second},
+		"tcp",
+		net.JoinHostPort(d.engineUrl.Hostname(), port),
+		&tls.Config{RootCAs: pool, ServerName: d.engineUrl.Hostname()})
+	if err != nil {
+		return "", "the engine certificate is not signed by the CA in cafile, or doesn't match the url host name", err
+	}
+	defer conn.Close()
+	cert := conn.ConnectionState().PeerCertificates[0]
+	if time.Now().Add(30 * 24 * time.Hour).After(cert.NotAfter) {
+		return fmt.Sprintf("valid, but the engine certificate expires on %s", cert.NotAfter), "", nil
+	}
+	return fmt.Sprintf("engine certificate is valid till %s", cert.NotAfter), "", nil
+}
+
+func checkLogin(d *diagnosis) (string, string, error) {
+	err := d.ovirt.Authenticate()
+	if err != nil {
+		return "", "check the username (user@profile, i.e admin@internal) and password, and that the user is not locked", err
+	}
+	return "logged in as " + d.conf.GetString("username"), "", nil
+}
+
+// checkStorageDomains checks the user sees storage domains, the permissions check tells if the user
+// may create and attach disks
+func checkStorageDomains(d *diagnosis) (string, string, error) {
+	hint := "grant the user StorageAdmin and UserVmManager on the data center, see docs/Creating-an-oVirt-user-how-to.md"
+	b, err := d.ovirt.Get("storagedomains")
+	if err != nil {
+		return "", hint, err
+	}
+	domains := internal.StorageDomains{}
+	err = json.Unmarshal(b, &domains)
+	if err != nil {
+		return "", hint, err
+	}
+	if len(domains.Domains) == 0 {
+		return "", hint, fmt.Errorf("the user sees no storage domains")
+	}
+	return fmt.Sprintf("the user sees %d storage domains", len(domains.Domains)), "", nil
+}
+
+func checkVmId(d *diagnosis) (string, string, error) {
+	vmId := d.conf.GetString("ovirtVmId")
+	if vmId == "" {
+		return "", "append ovirtVmId=$(cat " + productUUIDPath + ") to the config, the driver DaemonSet does it on install",
+			fmt.Errorf("'ovirtVmId' is missing in %s", d.configFile)
+	}
+	productUUID, err := ioutil.ReadFile(productUUIDPath)
+	if err != nil {
+		return "", "run the diagnosis on the node itself, as root", err
+	}
+	if !strings.EqualFold(strings.TrimSpace(string(productUUID)), vmId) {
+		return "", "the config was copied from another node, reinstall the driver on this node",
+			fmt.Errorf("ovirtVmId %s doesn't match the product uuid %s", vmId, strings.TrimSpace(string(productUUID)))
+	}
+	vm, err := d.ovirt.GetVMById(vmId)
+	if err != nil {
+		return "", "the VM doesn't exist on the engine, or the user has no permission on it", err
+	}
+	d.vm = vm
+	return fmt.Sprintf("VM %s (%s) is %s", vm.Name, vm.Id, vm.Status), "", nil
+}
+
+// userPermissions are the permissions of the user, with the permits of their roles
+type userPermissions struct {
+	Permissions []struct {
+		Role struct {
+			Name    string `json:"name"`
+			Permits struct {
+				Permits []struct {
+					Name string `json:"name"`
+				} `json:"permit"`
+			} `json:"permits"`
+		} `json:"role"`
+		Vm            *internal.Reference `json:"vm"`
+		Cluster       *internal.Reference `json:"cluster"`
+		DataCenter    *internal.Reference `json:"data_center"`
+		StorageDomain *internal.Reference `json:"storage_domain"`
+		Host          *internal.Reference `json:"host"`
+		Template      *internal.Reference `json:"template"`
+		Disk          *internal.Reference `json:"disk"`
+		VmPool        *internal.Reference `json:"vm_pool"`
+	} `json:"permission"`
+}
+
+// checkPermissions checks the user has the permits to create disks in the data center of the VM and
+// to attach them to the VM, by the roles of the user on the VM, its cluster, its data center, a storage
+// domain or the whole system. When the permissions of the user can't be read, it checks the user reads
+// the disks of the VM, and warns.
+func checkPermissions(d *diagnosis) (string, string, error) {
+	hint := "grant the user StorageAdmin and UserVmManager on the data center, see docs/Creating-an-oVirt-user-how-to.md"
+	cluster, err := d.ovirt.GetCluster(d.vm.Cluster.Id)
+	if err != nil {
+		return "", hint, fmt.Errorf("failed reading the cluster of VM %s: %s", d.vm.Name, err)
+	}
+	permits, err := userPermits(d.ovirt, d.vm, cluster)
+	if err != nil {
+		_, readErr := d.ovirt.Get("vms/" + d.vm.Id + "/diskattachments")
+		if readErr != nil {
+			return "", hint, fmt.Errorf("the user can't read the disks of VM %s, missing the permit configure_vm_storage: %s", d.vm.Name, readErr)
+		}
+		return "", "grant the user permission to read its own permissions, to check the permits",
+			warning{fmt.Sprintf("the permissions of the user can't be read (%s), it reads the disks of VM %s", err, d.vm.Name)}
+	}
+	var missing []string
+	for _, required := range requiredPermits {
+		if !permits[required.on][required.permit] {
+			missing = append(missing, required.permit+" on the "+required.on)
+		}
+	}
+	if len(missing) > 0 {
+		return "", hint, fmt.Errorf("the user is missing the permits %s", strings.Join(missing, ", "))
+	}
+	return fmt.Sprintf("the user may create disks and attach them to VM %s", d.vm.Name), "", nil
+}
+
+// userPermits returns the permits of the authenticated user which apply to the VM and to the data center
+// of its cluster
+func userPermits(ovirt internal.OvirtApi, vm internal.VM, cluster internal.Cluster) (map[string]map[string]bool, error) {
+	b, err := ovirt.Get("")
+	if err != nil {
+		return nil, err
+	}
+	api := struct {
+		AuthenticatedUser internal.Reference `json:"authenticated_user"`
+	}{}
+	err = json.Unmarshal(b, &api)
+	if err != nil {
+		return nil, err
+	}
+	if api.AuthenticatedUser.Id == "" {
+		return nil, fmt.Errorf("the engine doesn't report the authenticated user")
+	}
+	b, err = ovirt.Get("users/" + api.AuthenticatedUser.Id + "/permissions?follow=role.permits")
+	if err != nil {
+		return nil, err
+	}
+	permissions := userPermissions{}
+	err = json.Unmarshal(b, &permissions)
+	if err != nil {
+		return nil, err
+	}
+
+	permits := map[string]map[string]bool{"vm": {}, "data center": {}}
+	for _, p := range permissions.Permissions {
+		system := p.Vm == nil && p.Cluster == nil && p.DataCenter == nil && p.StorageDomain == nil &&
+			p.Host == nil && p.Template == nil && p.Disk == nil && p.VmPool == nil
+		dataCenter := system || p.DataCenter != nil && p.DataCenter.Id == cluster.DataCenter.Id
+		onVM := dataCenter || p.Cluster != nil && p.Cluster.Id == cluster.Id || p.Vm != nil && p.Vm.Id == vm.Id
+		onStorage := dataCenter || p.StorageDomain != nil
+		for _, permit := range p.Role.Permits.Permits {
+			if onVM {
+				permits["vm"][permit.Name] = true
+			}
+			if onStorage {
+				permits["data center"][permit.Name] = true
+			}
+		}
+	}
+	return permits, nil
+}
+
+func checkKubeConfig(d *diagnosis) (string, string, error) {
+	kubeConfigFile = d.conf.GetString("kubeconfig")
+	hint := "set kubeconfig in the driver config or KUBECONFIG, the node kubeconfig is enough"
+	config, err := kubeClientConfig()
+	if err != nil {
+		return "", hint, err
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return "", hint, err
+	}
+	version, err := clientset.Discovery().ServerVersion()
+	if err != nil {
+		return "", "the API server " + config.Host + " is not reachable with this kubeconfig", err
+	}
+	return fmt.Sprintf("API server %s version %s", config.Host, version.GitVersion), "", nil
+}
+
+func checkHostTools(d *diagnosis) (string, string, error) {
+	var missing []string
+	for _, tool := range requiredTools {
+		if _, err := exec.LookPath(tool); err != nil {
+			missing = append(missing, tool)
+		}
+	}
+	if len(missing) > 0 {
+		return "", "install util-linux, e2fsprogs and xfsprogs on the node",
+			fmt.Errorf("missing %s", strings.Join(missing, ", "))
+	}
+	return strings.Join(requiredTools, ", "), "", nil
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+
+	"github.com/ovirt/ovirt-openshift-extensions/internal"
+)
+
+func TestDiagnoseSkipsChecksOfMissingConfig(t *testing.T) {
+	os.Setenv("OVIRT_FLEXDRIVER_CONF", "/nonexisting/ovirt-flexvolume-driver.conf")
+	defer os.Unsetenv("OVIRT_FLEXDRIVER_CONF")
+
+	out, err := diagnose(true)
+	if err == nil {
+		t.Fatal("expected the diagnosis to fail")
+	}
+	var results []checkResult
+	if e := json.Unmarshal([]byte(out), &results); e != nil {
+		t.Fatal(e)
+	}
+	if results[0].Name != "config" || results[0].Status != checkFailed || results[0].Hint == "" {
+		t.Fatalf("expected the config check to fail with a hint, got %+v", results[0])
+	}
+	for _, r := range results[1:] {
+		if r.Name != "host-tools" && r.Status != checkSkipped {
+			t.Errorf("expected %s to be skipped, got %s", r.Name, r.Status)
+		}
+	}
+}
+
+func TestCheckVmIdMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ovirt-flexvolume-driver-diagnose")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	productUUIDPath = filepath.Join(dir, "product_uuid")
+	defer func() { productUUIDPath = "/sys/devices/virtual/dmi/id/product_uuid" }()
+	ioutil.WriteFile(productUUIDPath, []byte("AAAA-BBBB\n"), 0644)
+
+	conf := viper.New()
+	conf.Set("ovirtVmId", "cccc-dddd")
+	_, hint, err := checkVmId(&diagnosis{conf: conf})
+	if err == nil || !strings.Contains(err.Error(), "doesn't match") {
+		t.Fatalf("expected a mismatch, got %v", err)
+	}
+	if hint == "" {
+		t.Fatal("expected a remediation hint")
+	}
+}
+
+func TestCheckHostToolsMissing(t *testing.T) {
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", "/nonexisting")
+
+	_, _, err := checkHostTools(&diagnosis{})
+	if err == nil || !strings.Contains(err.Error(), "mkfs.xfs") {
+		t.Fatalf("expected mkfs.xfs to be missing, got %v", err)
+	}
+}
+
+func TestCheckTLSWarnsWithoutCAFile(t *testing.T) {
+	engineUrl, _ := url.Parse("https://engine.example.com/ovirt-engine/api")
+	d := &diagnosis{conf: viper.New(), engineUrl: engineUrl, results: []checkResult{{Name: "engine-url", Status: checkOk}}}
+	r := d.run(check{name: "tls", run: checkTLS, requires: []string{"engine-url"}})
+	if r.Status != checkWarning || r.Hint == "" {
+		t.Fatalf("expected a warning with a hint, got %+v", r)
+	}
+	// a warning doesn't skip the checks requiring it
+	r = d.run(check{name: "after-tls", run: checkHostTools, requires: []string{"tls"}})
+	if r.Status == checkSkipped {
+		t.Errorf("expected the check requiring tls to run, got %+v", r)
+	}
+}
+
+// permissionsOvirt serves the engine responses by path, the other calls panic
+type permissionsOvirt struct {
+	internal.OvirtApi
+	responses map[string]string
+}
+
+func (o permissionsOvirt) Get(path string) ([]byte, error) {
+	if r, ok := o.responses[path]; ok {
+		return []byte(r), nil
+	}
+	return nil, errors.New("403 Forbidden")
+}
+
+func (o permissionsOvirt) GetCluster(clusterId string) (internal.Cluster, error) {
+	return internal.Cluster{Id: clusterId, DataCenter: internal.Reference{Id: "dc1"}}, nil
+}
+
+func TestCheckPermissions(t *testing.T) {
+	const userVmManager = `{"role": {"name": "UserVmManager", "permits": {"permit": [{"name": "configure_vm_storage"}]}}, "vm": {"id": "vm1"}}`
+	const storageAdmin = `{"role": {"name": "StorageAdmin", "permits": {"permit": [{"name": "create_disk"}]}}, "data_center": {"id": "dc1"}}`
+	const otherStorageAdmin = `{"role": {"name": "StorageAdmin", "permits": {"permit": [{"name": "create_disk"}]}}, "data_center": {"id": "dc2"}}`
+	const superUser = `{"role": {"name": "SuperUser", "permits": {"permit": [{"name": "configure_vm_storage"}, {"name": "create_disk"}]}}}`
+	permissions := "users/user1/permissions?follow=role.permits"
+	cases := []struct {
+		description string
+		responses   map[string]string
+		status      string
+		missing     string
+	}{
+		{"roles on the VM and its data center", map[string]string{permissions: `{"permission": [` + userVmManager + `,` + storageAdmin + `]}`}, checkOk, ""},
+		{"role on the system", map[string]string{permissions: `{"permission": [` + superUser + `]}`}, checkOk, ""},
+		{"no role on the data center of the VM", map[string]string{permissions: `{"permission": [` + userVmManager + `,` + otherStorageAdmin + `]}`}, checkFailed, "create_disk"},
+		{"no role on the VM", map[string]string{permissions: `{"permission": [` + storageAdmin + `]}`}, checkFailed, "configure_vm_storage"},
+		{"unreadable permissions", map[string]string{"vms/vm1/diskattachments": `{}`}, checkWarning, ""},
+		{"unreadable disks", map[string]string{}, checkFailed, "configure_vm_storage"},
+	}
+	for _, c := range cases {
+		if _, ok := c.responses[permissions]; ok {
+			c.responses[""] = `{"authenticated_user": {"id": "user1"}}`
+		}
+		d := &diagnosis{ovirt: permissionsOvirt{responses: c.responses}, vm: internal.VM{Id: "vm1", Name: "node1", Cluster: internal.Reference{Id: "cluster1"}}}
+		r := d.run(check{name: "permissions", run: checkPermissions})
+		if r.Status != c.status || !strings.Contains(r.Message, c.missing) {
+			t.Errorf("%s: expected %s naming '%s', got %+v", c.description, c.status, c.missing, r)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// historyFilter selects journal records, empty fields match everything
+type historyFilter struct {
+	volume string
+	since  time.Time
+	until  time.Time
+}
+
+// matches tells if the record is of the volume, by its name or by a prefix of its disk id. A record
+// may have only the start of the disk id, as read from the serial of the device, the full id matches it.
+func (f historyFilter) matches(r journalRecord) bool {
+	if f.volume != "" && r.Volume != f.volume && r.Volume != fromk8sNameToOvirt(f.volume) &&
+		(r.DiskId == "" || !strings.HasPrefix(r.DiskId, f.volume) && !strings.HasPrefix(f.volume, r.DiskId)) {
+		return false
+	}
+	if !f.since.IsZero() && r.Time.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && r.Time.After(f.until) {
+		return false
+	}
+	return true
+}
+
+// parseHistoryTime accepts an RFC3339 time, or a duration which is taken as that long ago
+func parseHistoryTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, fmt.Errorf("invalid time '%s', expected RFC3339 i.e 2019-01-02T15:04:05Z or a duration i.e 2h", s)
+	}
+	return t, nil
+}
+
+// history prints the journal records of a volume, by its name or disk id, or of a time range
+func history(args []string) (string, error) {
+	var volume, since, until string
+	var asJson bool
+	flags := flag.NewFlagSet("history", flag.ContinueOnError)
+	flags.StringVar(&volume, "volume", "", "the volume name or the disk id")
+	flags.StringVar(&since, "since", "", "records from this time, RFC3339 or a duration ago i.e 2h")
+	flags.StringVar(&until, "until", "", "records till this time, RFC3339 or a duration ago")
+	flags.BoolVar(&asJson, "json", false, "print the records as json lines")
+	err := flags.Parse(args)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	filter := historyFilter{volume: volume}
+	filter.since, err = parseHistoryTime(since, now)
+	if err != nil {
+		return "", err
+	}
+	filter.until, err = parseHistoryTime(until, now)
+	if err != nil {
+		return "", err
+	}
+
+	records, err := readJournal(journalConfigFromDriver())
+	if err != nil {
+		return "", err
+	}
+
+	var b bytes.Buffer
+	if asJson {
+		encoder := json.NewEncoder(&b)
+		for _, r := range records {
+			if filter.matches(r) {
+				encoder.Encode(r)
+			}
+		}
+		return b.String(), nil
+	}
+
+	w := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tOPERATION\tVOLUME\tNODE\tDISK\tDEVICE\tDURATION\tRESULT\tERROR")
+	for _, r := range records {
+		if !filter.matches(r) {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			r.Time.Format(time.RFC3339), r.Operation, r.Volume, r.Node, r.DiskId, r.Device,
+			time.Duration(r.DurationMs)*time.Millisecond, r.Result, r.Error)
+	}
+	w.Flush()
+	return b.String(), nil
+}
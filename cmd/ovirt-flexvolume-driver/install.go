@@ -0,0 +1,321 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// driverDirName is the plugin directory of the driver, the 'ovirt~' prefix is added per flex specification
+	driverDirName    = "ovirt~ovirt-flexvolume-driver"
+	driverBinaryName = "ovirt-flexvolume-driver"
+	driverConfigName = "ovirt-flexvolume-driver.conf"
+)
+
+// installOptions are the flags of the install subcommand
+type installOptions struct {
+	sourceBinary string
+	sourceDir    string
+	pluginDir    string
+	watch        bool
+	interval     time.Duration
+	readyFile    string
+	uninstall    bool
+	agent        bool
+}
+
+// installFile is a file to be placed in the driver plugin directory
+type installFile struct {
+	data []byte
+	mode os.FileMode
+}
+
+func parseInstallOptions(args []string) (installOptions, error) {
+	o := installOptions{}
+	flags := flag.NewFlagSet("install", flag.ContinueOnError)
+	flags.StringVar(&o.sourceBinary, "source-binary", "/usr/bin/ovirt-flexvolume-driver", "the driver binary to install")
+	flags.StringVar(&o.sourceDir, "source-dir", "/opt/ovirt-flexvolume-driver",
+		"directory with the driver config and any other file to install next to it, i.e the mounted ConfigMap and Secret")
+	flags.StringVar(&o.pluginDir, "plugin-dir", "/usr/libexec/kubernetes/kubelet-plugins/volume/exec", "the kubelet flexvolume plugin directory")
+	flags.BoolVar(&o.watch, "watch", true, "keep running and reinstall when the source files change")
+	flags.DurationVar(&o.interval, "interval", 10*time.Second, "how often to check the source files for changes")
+	flags.StringVar(&o.readyFile, "ready-file", "/tmp/ovirt-flexvolume-driver-ready", "created while the installed driver is up to date")
+	flags.BoolVar(&o.uninstall, "uninstall-on-exit", false, "remove the driver from the plugin directory on SIGTERM")
+	flags.BoolVar(&o.agent, "agent", os.Getenv("OVIRT_FLEXDRIVER_AGENT") == "true", "run the node agent from the installed config")
+	err := flags.Parse(args)
+	return o, err
+}
+
+// runInstall installs the driver into the kubelet plugin directory and, unless told otherwise,
+// keeps it in sync with the source files till it is terminated.
+func runInstall(args []string) error {
+	o, err := parseInstallOptions(args)
+	if err != nil {
+		return err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer os.Remove(o.readyFile)
+
+	err = syncInstall(o)
+	if err != nil && !o.watch {
+		return err
+	}
+	if !o.watch {
+		return nil
+	}
+
+	var agentDone chan struct{}
+	stopAgent := make(chan struct{})
+	startAgent := func() {
+		if !o.agent || agentDone != nil || err != nil {
+			return
+		}
+		agentDone = make(chan struct{})
+		os.Setenv("OVIRT_FLEXDRIVER_CONF", filepath.Join(o.pluginDir, driverDirName, driverConfigName))
+		go func() {
+			defer close(agentDone)
+			e := serveAgentUntil(stopAgent)
+			if e != nil {
+				logInstallf("agent failed: %s", e)
+			}
+		}()
+	}
+	startAgent()
+
+	ticker := time.NewTicker(o.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-signals:
+			if o.uninstall {
+				logInstallf("removing %s", filepath.Join(o.pluginDir, driverDirName))
+				if e := os.RemoveAll(filepath.Join(o.pluginDir, driverDirName)); e != nil {
+					return e
+				}
+			}
+			close(stopAgent)
+			if agentDone != nil {
+				<-agentDone
+			}
+			return nil
+		case <-agentDone:
+			return errors.New("the agent stopped")
+		case <-ticker.C:
+			changed, e := installOnce(o)
+			err = e
+			if err != nil {
+				logInstallf("install failed: %s", err)
+				os.Remove(o.readyFile)
+				continue
+			}
+			ioutil.WriteFile(o.readyFile, nil, 0644)
+			if changed && agentDone != nil {
+				// the agent holds the client and settings of the old config, a restart of
+				// the container starts it with the new one
+				return errors.New("the driver config changed, restarting the agent")
+			}
+			startAgent()
+		}
+	}
+}
+
+// syncInstall installs the driver and updates the ready file accordingly
+func syncInstall(o installOptions) error {
+	_, err := installOnce(o)
+	if err != nil {
+		logInstallf("install failed: %s", err)
+		os.Remove(o.readyFile)
+		return err
+	}
+	return ioutil.WriteFile(o.readyFile, nil, 0644)
+}
+
+// installOnce renders and installs the driver files, and tells if anything changed
+func installOnce(o installOptions) (bool, error) {
+	files, err := renderInstall(o)
+	if err != nil {
+		return false, err
+	}
+	changed, err := installFiles(filepath.Join(o.pluginDir, driverDirName), files)
+	if err != nil {
+		return false, err
+	}
+	if changed {
+		logInstallf("installed the driver into %s", filepath.Join(o.pluginDir, driverDirName))
+	}
+	return changed, nil
+}
+
+// renderInstall collects the files to install - the binary, the files of the source
+// directory, and the driver config with the per node 'ovirtVmId' appended. The config
+// must pass the validation of the driver itself.
+func renderInstall(o installOptions) (map[string]installFile, error) {
+	binary, err := ioutil.ReadFile(o.sourceBinary)
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]installFile{driverBinaryName: {data: binary, mode: 0755}}
+
+	// ConfigMap and Secret volumes keep their content in hidden directories, and
+	// expose it with symlinks, which Stat follows
+	entries, err := ioutil.ReadDir(o.sourceDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") || e.Name() == driverBinaryName {
+			continue
+		}
+		path := filepath.Join(o.sourceDir, e.Name())
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		files[e.Name()] = installFile{data: data, mode: 0600}
+	}
+
+	config, ok := files[driverConfigName]
+	if !ok {
+		return nil, fmt.Errorf("%s is missing in %s", driverConfigName, o.sourceDir)
+	}
+	conf, err := validateDriverConfig(config.data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid driver config %s: %s", filepath.Join(o.sourceDir, driverConfigName), err)
+	}
+	if conf.GetString("ovirtVmId") == "" {
+		vmId, err := ioutil.ReadFile(productUUIDPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to extract the VM id: %s", err)
+		}
+		id := strings.ToLower(strings.TrimSpace(string(vmId)))
+		if id == "" {
+			return nil, fmt.Errorf("failed to extract the VM id, %s is empty", productUUIDPath)
+		}
+		data := append([]byte{}, config.data...)
+		if len(data) > 0 && data[len(data)-1] != '\n' {
+			data = append(data, '\n')
+		}
+		config.data = append(data, "ovirtVmId="+id+"\n"...)
+		files[driverConfigName] = config
+	}
+	return files, nil
+}
+
+// installFiles brings the driver directory to hold exactly the given files.
+// A new directory is prepared aside and moved into place, so kubelet never probes a
+// half written driver. An existing directory is updated file by file with renames,
+// the binary last, and only when the content differs.
+func installFiles(dest string, files map[string]installFile) (bool, error) {
+	if _, err := os.Stat(dest); os.IsNotExist(err) {
+		tmp, err := ioutil.TempDir(filepath.Dir(dest), "."+filepath.Base(dest))
+		if err != nil {
+			return false, err
+		}
+		for name, f := range files {
+			err = ioutil.WriteFile(filepath.Join(tmp, name), f.data, f.mode)
+			if err != nil {
+				os.RemoveAll(tmp)
+				return false, err
+			}
+		}
+		err = os.Chmod(tmp, 0755)
+		if err == nil {
+			err = os.Rename(tmp, dest)
+		}
+		if err != nil {
+			os.RemoveAll(tmp)
+			return false, err
+		}
+		return true, nil
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		if name != driverBinaryName {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if _, ok := files[driverBinaryName]; ok {
+		names = append(names, driverBinaryName)
+	}
+
+	changed := false
+	for _, name := range names {
+		f := files[name]
+		path := filepath.Join(dest, name)
+		current, err := ioutil.ReadFile(path)
+		if err == nil && bytes.Equal(current, f.data) {
+			continue
+		}
+		tmp := filepath.Join(dest, "."+name+".tmp")
+		err = ioutil.WriteFile(tmp, f.data, f.mode)
+		if err == nil {
+			err = os.Chmod(tmp, f.mode)
+		}
+		if err == nil {
+			err = os.Rename(tmp, path)
+		}
+		if err != nil {
+			os.Remove(tmp)
+			return changed, err
+		}
+		changed = true
+	}
+
+	// files removed from the source go away too
+	entries, err := ioutil.ReadDir(dest)
+	if err != nil {
+		return changed, err
+	}
+	for _, e := range entries {
+		if _, ok := files[e.Name()]; ok || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		err = os.Remove(filepath.Join(dest, e.Name()))
+		if err != nil {
+			return changed, err
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+func logInstallf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testDriverConfig = "url=https://engine/ovirt-engine/api\nusername=admin@internal\npassword=123\ninsecure=true"
+
+// prepareInstall creates the source files and an empty plugin dir under a temp dir
+func prepareInstall(t *testing.T, config string) (installOptions, func()) {
+	dir, err := ioutil.TempDir("", "ovirt-flexvolume-driver-install")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := installOptions{
+		sourceBinary: filepath.Join(dir, "bin", driverBinaryName),
+		sourceDir:    filepath.Join(dir, "conf"),
+		pluginDir:    filepath.Join(dir, "exec"),
+	}
+	for _, d := range []string{"bin", "conf", "exec"} {
+		os.MkdirAll(filepath.Join(dir, d), 0755)
+	}
+	ioutil.WriteFile(o.sourceBinary, []byte("binary"), 0755)
+	ioutil.WriteFile(filepath.Join(o.sourceDir, driverConfigName), []byte(config), 0644)
+	productUUIDPath = filepath.Join(dir, "product_uuid")
+	ioutil.WriteFile(productUUIDPath, []byte("AAAA-BBBB\n"), 0644)
+	return o, func() {
+		productUUIDPath = "/sys/devices/virtual/dmi/id/product_uuid"
+		os.RemoveAll(dir)
+	}
+}
+
+func TestInstallRendersTheVmId(t *testing.T) {
+	o, cleanup := prepareInstall(t, testDriverConfig)
+	defer cleanup()
+
+	changed, err := installOnce(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Fatal("expected a fresh install to change the plugin dir")
+	}
+	config, err := ioutil.ReadFile(filepath.Join(o.pluginDir, driverDirName, driverConfigName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(config), "\novirtVmId=aaaa-bbbb\n") {
+		t.Fatalf("expected the lower cased VM id appended to the config, got %s", config)
+	}
+	info, err := os.Stat(filepath.Join(o.pluginDir, driverDirName, driverBinaryName))
+	if err != nil || info.Mode().Perm()&0100 == 0 {
+		t.Fatalf("expected an executable driver binary, got %v %v", info, err)
+	}
+}
+
+func TestInstallRejectsAnInvalidConfig(t *testing.T) {
+	o, cleanup := prepareInstall(t, "url=https://engine/ovirt-engine/api")
+	defer cleanup()
+
+	_, err := installOnce(o)
+	if err == nil {
+		t.Fatal("expected the config without credentials to be rejected")
+	}
+	if _, e := os.Stat(filepath.Join(o.pluginDir, driverDirName)); !os.IsNotExist(e) {
+		t.Fatal("expected nothing to be installed")
+	}
+}
+
+func TestInstallUpdatesOnChange(t *testing.T) {
+	o, cleanup := prepareInstall(t, testDriverConfig)
+	defer cleanup()
+	ioutil.WriteFile(filepath.Join(o.sourceDir, "stale.pem"), []byte("stale"), 0644)
+	if _, err := installOnce(o); err != nil {
+		t.Fatal(err)
+	}
+
+	changed, err := installOnce(o)
+	if err != nil || changed {
+		t.Fatalf("expected no change on a second install, got %v %v", changed, err)
+	}
+
+	os.Remove(filepath.Join(o.sourceDir, "stale.pem"))
+	ioutil.WriteFile(filepath.Join(o.sourceDir, driverConfigName), []byte(testDriverConfig+"\nforceDetach=true"), 0644)
+	changed, err = installOnce(o)
+	if err != nil || !changed {
+		t.Fatalf("expected the config change to be installed, got %v %v", changed, err)
+	}
+	config, _ := ioutil.ReadFile(filepath.Join(o.pluginDir, driverDirName, driverConfigName))
+	if !strings.Contains(string(config), "forceDetach=true") {
+		t.Fatalf("expected the new config, got %s", config)
+	}
+	if _, e := os.Stat(filepath.Join(o.pluginDir, driverDirName, "stale.pem")); !os.IsNotExist(e) {
+		t.Fatal("expected the file removed from the source to be removed")
+	}
+}
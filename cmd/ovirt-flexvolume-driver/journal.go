@@ -0,0 +1,248 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/ovirt/ovirt-openshift-extensions/internal"
+)
+
+const (
+	// defaultJournalFile keeps a record of every call-out on the node, unless 'journalFile' is set in the driver config
+	defaultJournalFile = "/var/log/ovirt-flexvolume-driver/journal.log"
+	// defaultJournalMaxSize in bytes, unless 'journalMaxSize' is set. The journal is rotated when it grows over it.
+	defaultJournalMaxSize = 10 * 1024 * 1024
+	// defaultJournalMaxFiles is the number of rotated files kept, unless 'journalMaxFiles' is set
+	defaultJournalMaxFiles = 5
+)
+
+// journaledOperations are the call-outs recorded in the journal
+var journaledOperations = map[string]bool{
+	"attach":        true,
+	"detach":        true,
+	"waitforattach": true,
+	"mountdevice":   true,
+	"unmountdevice": true,
+	"unmount":       true,
+	"isattached":    true,
+}
+
+// journalRecord is a single call-out in the journal. Only the fields listed here are
+// recorded, the volume options and secrets passed by kubelet never make it to the journal.
+type journalRecord struct {
+	Time        time.Time `json:"time"`
+	Operation   string    `json:"operation"`
+	Volume      string    `json:"volume,omitempty"`
+	Node        string    `json:"node,omitempty"`
+	DiskId      string    `json:"diskId,omitempty"`
+	Device      string    `json:"device,omitempty"`
+	MountDir    string    `json:"mountDir,omitempty"`
+	DurationMs  int64     `json:"durationMs"`
+	Result      string    `json:"result"`
+	Error       string    `json:"error,omitempty"`
+	EngineError string    `json:"engineError,omitempty"`
+}
+
+// journalConfig is where the journal is kept and how it is rotated
+type journalConfig struct {
+	file     string
+	maxSize  int64
+	maxFiles int
+}
+
+// setDiskId records the disk the call-out resolved the volume to, a nil record is ignored
+func (r *journalRecord) setDiskId(diskId string) {
+	if r != nil {
+		r.DiskId = diskId
+	}
+}
+
+// newJournalRecord picks the volume, node, device and mount dir out of the call-out arguments
+func newJournalRecord(args []string) *journalRecord {
+	r := &journalRecord{Time: time.Now().UTC(), Operation: args[0]}
+	arg := func(i int) string {
+		if i < len(args) {
+			return args[i]
+		}
+		return ""
+	}
+	volumeOf := func(jsonOpts string) string {
+		req, err := internal.AttachRequestFrom(jsonOpts)
+		if err != nil {
+			return ""
+		}
+		return req.VolumeName
+	}
+
+	switch r.Operation {
+	case "attach", "isattached":
+		r.Volume = volumeOf(arg(1))
+		r.Node = arg(2)
+	case "detach":
+		r.Volume = arg(1)
+		r.Node = arg(2)
+	case "waitforattach":
+		r.Device = arg(1)
+		r.Volume = volumeOf(arg(2))
+	case "mountdevice":
+		r.MountDir = arg(1)
+		r.Device = arg(2)
+		r.Volume = volumeOf(arg(3))
+	case "unmountdevice", "unmount":
+		r.MountDir = arg(1)
+	}
+	return r
+}
+
+// finish records the outcome of the call-out
+func (r *journalRecord) finish(result internal.Response, err error) {
+	r.DurationMs = int64(time.Since(r.Time) / time.Millisecond)
+	r.Result = string(result.Status)
+	if result.Device != "" {
+		r.Device = result.Device
+	}
+	if r.DiskId == "" {
+		r.DiskId = extractDeviceId(r.Device)
+	}
+	if err != nil {
+		r.Error = err.Error()
+		if fault, ok := err.(internal.Fault); ok {
+			r.EngineError = fmt.Sprintf("%s %s", fault.Reason, fault.Detail)
+		}
+	}
+}
+
+// journalConfigFromDriver reads the journal settings from the driver config
+func journalConfigFromDriver() journalConfig {
+	c := journalConfig{file: defaultJournalFile, maxSize: defaultJournalMaxSize, maxFiles: defaultJournalMaxFiles}
+	conf, err := readDriverConfig()
+	if err != nil {
+		return c
+	}
+	if conf.IsSet("journalFile") {
+		c.file = conf.GetString("journalFile")
+	}
+	if conf.IsSet("journalMaxSize") {
+		c.maxSize = conf.GetInt64("journalMaxSize")
+	}
+	if conf.IsSet("journalMaxFiles") {
+		c.maxFiles = conf.GetInt("journalMaxFiles")
+	}
+	return c
+}
+
+// appendJournal writes the record as a json line. Call-outs run as separate processes,
+// so the rotation and the write are done under a file lock.
+func appendJournal(c journalConfig, r *journalRecord) error {
+	if c.file == "" {
+		return nil
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	err = os.MkdirAll(filepath.Dir(c.file), 0700)
+	if err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(c.file+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	if info, err := os.Stat(c.file); err == nil && c.maxSize > 0 && info.Size()+int64(len(line)) > c.maxSize {
+		rotateJournal(c)
+	}
+
+	f, err := os.OpenFile(c.file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(line)
+	return err
+}
+
+// rotateJournal shifts journal.log.1 to journal.log.2 and so on, dropping the oldest,
+// and moves the journal to journal.log.1
+func rotateJournal(c journalConfig) {
+	if c.maxFiles < 1 {
+		os.Remove(c.file)
+		return
+	}
+	os.Remove(fmt.Sprintf("%s.%d", c.file, c.maxFiles))
+	for i := c.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", c.file, i), fmt.Sprintf("%s.%d", c.file, i+1))
+	}
+	os.Rename(c.file, c.file+".1")
+}
+
+// readJournal returns the records of the rotated files and the journal, oldest first
+func readJournal(c journalConfig) ([]journalRecord, error) {
+	var files []string
+	for i := c.maxFiles; i >= 1; i-- {
+		files = append(files, fmt.Sprintf("%s.%d", c.file, i))
+	}
+	files = append(files, c.file)
+
+	var records []journalRecord
+	for _, name := range files {
+		f, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			r := journalRecord{}
+			// a line cut by a crash is skipped
+			if json.Unmarshal(scanner.Bytes(), &r) == nil {
+				records = append(records, r)
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// invocationName is the call-out name without its arguments, safe to log
+func invocationName(args []string) string {
+	if len(args) < 2 {
+		return filepath.Base(args[0])
+	}
+	return filepath.Base(args[0]) + " " + args[1]
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ovirt/ovirt-openshift-extensions/internal"
+)
+
+func TestJournalRecordIsRedacted(t *testing.T) {
+	opts := `{"kubernetes.io/pvOrVolumeName": "pv1", "kubernetes.io/secret/password": "s3cret", "kubernetes.io/fsType": "ext4"}`
+	r := newJournalRecord([]string{"attach", opts, "node1"})
+	r.setDiskId("disk-id")
+	r.finish(internal.Response{Status: internal.Success, Device: "/dev/disk/by-id/virtio-abcdef"}, nil)
+
+	if r.Volume != "pv1" || r.Node != "node1" || r.DiskId != "disk-id" || r.Result != "Success" {
+		t.Fatalf("unexpected record %+v", r)
+	}
+
+	c := journalConfig{file: filepath.Join(tempDir(t), "journal.log"), maxSize: 1024, maxFiles: 2}
+	defer os.RemoveAll(filepath.Dir(c.file))
+	if err := appendJournal(c, r); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadFile(c.file)
+	if strings.Contains(string(b), "s3cret") {
+		t.Fatalf("the journal exposes the volume options: %s", b)
+	}
+}
+
+func TestJournalRecordsTheEngineFault(t *testing.T) {
+	r := newJournalRecord([]string{"detach", "pv1", "node1"})
+	fault := internal.Fault{Status: "409 Conflict", Reason: "Operation Failed", Detail: "[Cannot hot unplug disk]"}
+	r.finish(internal.FailedResponseFromError(fault), fault)
+	if r.Result != "Failure" || r.EngineError != "Operation Failed [Cannot hot unplug disk]" {
+		t.Fatalf("unexpected record %+v", r)
+	}
+}
+
+func TestJournalRotation(t *testing.T) {
+	c := journalConfig{file: filepath.Join(tempDir(t), "journal.log"), maxSize: 300, maxFiles: 2}
+	defer os.RemoveAll(filepath.Dir(c.file))
+
+	for i := 0; i < 20; i++ {
+		r := newJournalRecord([]string{"detach", fmt.Sprintf("pv%d", i), "node1"})
+		r.finish(internal.FailedResponse, errors.New("failed"))
+		if err := appendJournal(c, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(c.file + ".3"); !os.IsNotExist(err) {
+		t.Fatal("expected only 2 rotated files to be kept")
+	}
+	records, err := readJournal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) == 0 || len(records) == 20 {
+		t.Fatalf("expected the oldest records to be dropped, got %d", len(records))
+	}
+	if records[len(records)-1].Volume != "pv19" {
+		t.Fatalf("expected the records oldest first, got %+v", records)
+	}
+}
+
+func TestHistoryFilter(t *testing.T) {
+	now := time.Now()
+	r := journalRecord{Time: now.Add(-time.Hour), Volume: "pv1", DiskId: "abcdef"}
+
+	tests := []struct {
+		name    string
+		filter  historyFilter
+		matches bool
+	}{
+		{"no filter", historyFilter{}, true},
+		{"by volume", historyFilter{volume: "pv1"}, true},
+		{"by disk id", historyFilter{volume: "abcdef-1234"}, true},
+		{"by disk id prefix", historyFilter{volume: "abc"}, true},
+		{"by another disk id", historyFilter{volume: "abd"}, false},
+		{"other volume", historyFilter{volume: "pv2"}, false},
+		{"since before", historyFilter{since: now.Add(-2 * time.Hour)}, true},
+		{"since after", historyFilter{since: now.Add(-time.Minute)}, false},
+		{"until before", historyFilter{until: now.Add(-2 * time.Hour)}, false},
+	}
+	for _, test := range tests {
+		if test.filter.matches(r) != test.matches {
+			t.Errorf("%s: expected %v", test.name, test.matches)
+		}
+	}
+
+	since, err := parseHistoryTime("2h", now)
+	if err != nil || !since.Equal(now.Add(-2*time.Hour)) {
+		t.Fatalf("expected 2 hours ago, got %s %v", since, err)
+	}
+	if _, err := parseHistoryTime("yesterday", now); err == nil {
+		t.Fatal("expected an invalid time")
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "ovirt-flexvolume-driver-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestJournalRecordsUsageErrors(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	conf := filepath.Join(dir, "ovirt-flexvolume-driver.conf")
+	journal := filepath.Join(dir, "journal.log")
+	ioutil.WriteFile(conf, []byte("journalFile="+journal+"\n"), 0600)
+	os.Setenv("OVIRT_FLEXDRIVER_CONF", conf)
+	defer os.Unsetenv("OVIRT_FLEXDRIVER_CONF")
+
+	_, err := app([]string{"attach", "{}"})
+	if err == nil {
+		t.Fatal("expected a usage error")
+	}
+	records, err := readJournal(journalConfig{file: journal, maxFiles: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Result != string(internal.Failure) || records[0].Error == "" {
+		t.Errorf("expected the usage error to be journaled as a failure, got %+v", records)
+	}
+}
@@ -17,39 +17,27 @@ limitations under the License.
 package main
 
 import (
-	"fmt"
 	"os"
 	"path/filepath"
 
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/kubernetes/pkg/util/file"
 )
 
-func getSystemUUIDByNodeName(nodeName string) (string, error) {
-	nodes, e := getKubeNodes()
-	if e != nil {
-		return "", e
-	}
-	for _, n := range nodes {
-		if n.Name == nodeName {
-			return n.Status.NodeInfo.SystemUUID, nil
-		}
-	}
-	return "", fmt.Errorf("node name %s was not found", nodeName)
-}
-
-func getKubeNodes() ([]v1.Node, error) {
-	kubeconfig, err := locateKubeConfig()
+// nodeKubeConfig is the kubeconfig of the node itself. Its identity is enough to get
+// the node objects, so there is no need for cluster admin credentials.
+const nodeKubeConfig = "/etc/origin/node/node.kubeconfig"
 
-	if err != nil {
-		return nil, err
-	}
+// kubeConfigFile is the 'kubeconfig' set in the driver config, if any
+var kubeConfigFile string
 
-	// use the current context in kubeconfig
-	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+// getKubeNode fetches a single node, which needs only a 'get' on nodes
+func getKubeNode(nodeName string) (*v1.Node, error) {
+	config, err := kubeClientConfig()
 	if err != nil {
 		return nil, err
 	}
@@ -59,20 +47,33 @@ func getKubeNodes() ([]v1.Node, error) {
 	if err != nil {
 		return nil, err
 	}
-	nodes, err := clientset.CoreV1().Nodes().List(metav1.ListOptions{})
+	return clientset.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+}
+
+// kubeClientConfig uses the located kubeconfig, and falls back to the in-cluster
+// config when running as the agent inside the driver pod
+func kubeClientConfig() (*rest.Config, error) {
+	kubeconfig, err := locateKubeConfig()
 	if err != nil {
+		if config, inClusterErr := rest.InClusterConfig(); inClusterErr == nil {
+			return config, nil
+		}
 		return nil, err
 	}
 
-	return nodes.Items, nil
+	// use the current context in kubeconfig
+	return clientcmd.BuildConfigFromFlags("", kubeconfig)
 }
 
+// locateKubeConfig looks for the least privileged kubeconfig available - the one set in the
+// driver config, then KUBECONFIG, then the node's kubeconfig and last the user's kubeconfig
 func locateKubeConfig() (string, error) {
-	defaultKubeConfig := "/etc/origin/master/admin.kubeconfig"
 	var err = os.ErrNotExist
 	var ok bool
-	if ok, err = file.FileOrSymlinkExists(defaultKubeConfig); ok {
-		return defaultKubeConfig, nil
+	if kubeConfigFile != "" {
+		if ok, err = file.FileOrSymlinkExists(kubeConfigFile); ok {
+			return kubeConfigFile, nil
+		}
 	}
 
 	if k := os.Getenv("KUBECONFIG"); k != "" {
@@ -81,6 +82,10 @@ func locateKubeConfig() (string, error) {
 		}
 	}
 
+	if ok, err = file.FileOrSymlinkExists(nodeKubeConfig); ok {
+		return nodeKubeConfig, nil
+	}
+
 	if home := homeDir(); home != "" {
 		kubeconfig := filepath.Join(home, ".kube", "config")
 		if ok, err = file.FileOrSymlinkExists(kubeconfig); ok {
@@ -88,6 +93,9 @@ func locateKubeConfig() (string, error) {
 		}
 	}
 
+	if err == nil {
+		err = os.ErrNotExist
+	}
 	return "", err
 }
 
@@ -31,11 +31,16 @@ import (
 	"time"
 
 	"github.com/spf13/viper"
+	"k8s.io/apimachinery/pkg/api/resource"
 
 	"github.com/ovirt/ovirt-openshift-extensions/internal"
 )
 
 const usage = `Usage:
+	ovirt-flexdriver agent
+	ovirt-flexdriver diagnose [--json]
+	ovirt-flexdriver install [flags]
+	ovirt-flexdriver history [--volume <name or disk id>] [--since <time>] [--until <time>] [--json]
 	ovirt-flexdriver init
 	ovirt-flexdriver attach <json params> <nodename>
 	ovirt-flexdriver detach <mount device> <nodename>
@@ -46,8 +51,23 @@ const usage = `Usage:
 	ovirt-flexdriver getvolumename <json params>
 `
 
+// deleteOnDetachMarker is set as the description of disks created by an inline attach
+// with the 'deleteOnDetach' option, so detach, which gets no volume options, can tell
+// them apart
+const deleteOnDetachMarker = "ovirt-flexvolume-driver: delete on detach"
+
 var driverConfigFile string
 
+// ovirtClient is the long lived, authenticated client of the agent. When it is nil
+// every call-out creates and authenticates a client of its own.
+var ovirtClient internal.OvirtApi
+
+// nodeMapper resolves the node names passed by attach, detach and isattached to VM ids
+var nodeMapper *internal.NodeMapper
+
+// detachOptions are set by 'detachTimeout' and 'forceDetach' in the driver config
+var detachOptions internal.DetachOptions
+
 /*
 Use the vmId extracted from the OS only for api interaction which doesn't include the nodeName.
 For example Attach/Detach uses the node name, which waitForAttach does not.
@@ -57,11 +77,58 @@ var ovirtVmId string
 func main() {
 	writer, e := syslog.New(syslog.LOG_INFO, os.Args[0])
 	if e == nil {
-		writer.Info(fmt.Sprintf("invoking with args %s", os.Args))
-		defer writer.Info(fmt.Sprintf("invoking with args %s", os.Args))
+		// the volume options may carry secrets, the details of a call-out go to the journal only
+		writer.Info(fmt.Sprintf("invoking %s", invocationName(os.Args)))
+		defer writer.Info(fmt.Sprintf("invoked %s", invocationName(os.Args)))
 	}
 
-	s, e := app(os.Args[1:])
+	if len(os.Args) > 1 && os.Args[1] == "agent" {
+		_, e := runAgent()
+		if e != nil {
+			fmt.Fprint(os.Stderr, e.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "install" {
+		e := runInstall(os.Args[2:])
+		if e != nil {
+			fmt.Fprint(os.Stderr, e.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "history" {
+		s, e := history(os.Args[2:])
+		if e != nil {
+			fmt.Fprint(os.Stderr, e.Error())
+			os.Exit(1)
+		}
+		fmt.Fprint(os.Stdout, s)
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "diagnose" {
+		s, e := diagnose(len(os.Args) > 2 && os.Args[2] == "--json")
+		fmt.Fprint(os.Stdout, s)
+		if e != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// prefer the agent for the call-outs to the engine, it saves the authentication and the node
+	// lookups per call-out. The node local call-outs always run here, on the host.
+	var s string
+	forwarded := false
+	if len(os.Args) > 1 && agentOperations[os.Args[1]] {
+		s, forwarded, e = forwardToAgent(agentSocketPath(), os.Args[1:])
+	}
+	if !forwarded {
+		s, e = app(os.Args[1:])
+	}
 	if e != nil {
 		fmt.Fprint(os.Stderr, e.Error())
 		os.Exit(1)
@@ -79,53 +146,71 @@ func app(args []string) (string, error) {
 	var result internal.Response
 	var err error
 
+	var record *journalRecord
+	if journaledOperations[args[0]] {
+		record = newJournalRecord(args)
+		defer func() {
+			record.finish(result, err)
+			if e := appendJournal(journalConfigFromDriver(), record); e != nil {
+				fmt.Fprintf(os.Stderr, "failed writing the journal %s\n", e)
+			}
+		}()
+	}
+
+	// a usage error is journaled as a failure too
+	usageError := func() (string, error) {
+		err = errors.New(usage)
+		result = internal.FailedResponseFromError(err)
+		return "", err
+	}
+
 	switch args[0] {
 	case "init":
 		result, err = initialize()
 	case "attach":
 		if len(args) < 3 {
-			return "", errors.New(usage)
+			return usageError()
 		}
-		result, err = Attach(args[1], args[2])
+		result, err = Attach(args[1], args[2], record)
 	case "waitforattach":
 		if len(args) < 3 {
-			return "", errors.New(usage)
+			return usageError()
 		}
 		result, err = WaitForAttach(args[1], args[2])
 	case "isattached":
 		if len(args) < 3 {
-			return "", errors.New(usage)
+			return usageError()
 		}
-		result, err = IsAttached(args[1], args[2])
+		result, err = IsAttached(args[1], args[2], record)
 	case "detach":
 		if len(args) < 3 {
-			return "", errors.New(usage)
+			return usageError()
 		}
-		result, err = Detach(args[1], args[2])
+		result, err = Detach(args[1], args[2], record)
 	case "mountdevice":
 		if len(args) < 4 {
-			return "", errors.New(usage)
+			return usageError()
 		}
 		result, err = MountDevice(args[1], args[2], args[3])
 	case "provision":
 		if len(args) < 3 {
-			return "", errors.New(usage)
+			return usageError()
 		}
 		result, err = Provision(args[1])
 	case "delete":
 		if len(args) < 3 {
-			return "", errors.New(usage)
+			return usageError()
 		}
 		result, err = Delete(args[1])
 	case "unmountdevice", "unmount":
 		if len(args) != 2 {
-			return "", errors.New(usage)
+			return usageError()
 		}
 		result, err = UnmountDevice(args[1])
 	case "getvolumename", "mount":
 		result, err = internal.NotSupportedResponse, nil
 	default:
-		return "", errors.New(usage)
+		return usageError()
 	}
 
 	b, marshalingErr := json.Marshal(result)
@@ -145,14 +230,57 @@ func initialize() (internal.Response, error) {
 	return r, nil
 }
 
-func newOvirt() (internal.OvirtApi, error) {
+// driverConfigPath returns the config file set by OVIRT_FLEXDRIVER_CONF, or the one
+// next to the binary
+func driverConfigPath() string {
 	value, exist := os.LookupEnv("OVIRT_FLEXDRIVER_CONF")
 	if exist {
-		driverConfigFile = value
-	} else {
-		dir, _ := filepath.Abs(filepath.Dir(os.Args[0]))
-		driverConfigFile = dir + "/ovirt-flexvolume-driver.conf"
+		return value
+	}
+	dir, _ := filepath.Abs(filepath.Dir(os.Args[0]))
+	return dir + "/ovirt-flexvolume-driver.conf"
+}
+
+// readDriverConfig parses the driver config file without any api interaction
+func readDriverConfig() (*viper.Viper, error) {
+	file, err := ioutil.ReadFile(driverConfigPath())
+	if err != nil {
+		return nil, err
+	}
+	return parseDriverConfig(file)
+}
+
+// parseDriverConfig parses the content of a driver config, a properties file
+func parseDriverConfig(data []byte) (*viper.Viper, error) {
+	conf := viper.New()
+	conf.SetConfigType("props")
+	err := conf.ReadConfig(bytes.NewReader(data))
+	return conf, err
+}
+
+// validateDriverConfig makes sure the driver can load the config and has the engine connection details
+func validateDriverConfig(data []byte) (*viper.Viper, error) {
+	conf, err := parseDriverConfig(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range []string{"url", "username", "password"} {
+		if conf.GetString(key) == "" {
+			return nil, fmt.Errorf("'%s' is missing in the driver config", key)
+		}
 	}
+	_, err = internal.NewOvirt(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+func newOvirt() (internal.OvirtApi, error) {
+	if ovirtClient != nil {
+		return ovirtClient, nil
+	}
+	driverConfigFile = driverConfigPath()
 	file, err := ioutil.ReadFile(driverConfigFile)
 	if err != nil {
 		return nil, errors.New(err.Error() + " file is " + driverConfigFile)
@@ -166,6 +294,26 @@ func newOvirt() (internal.OvirtApi, error) {
 	viper.SetConfigType("props")
 	viper.ReadConfig(bytes.NewReader(file))
 	ovirtVmId = viper.GetString("ovirtVmId")
+	kubeConfigFile = viper.GetString("kubeconfig")
+	detachOptions = internal.DetachOptions{
+		Timeout: viper.GetDuration("detachTimeout"),
+		Force:   viper.GetBool("forceDetach"),
+	}
+	if viper.IsSet("notRespondingGracePeriod") {
+		notRespondingGracePeriod = viper.GetDuration("notRespondingGracePeriod")
+	}
+
+	nodeMapper, err = internal.NewNodeMapper(
+		internal.NodeMappingConfig{
+			Strategy: internal.MappingStrategy(viper.GetString("nodeMapping")),
+			Key:      viper.GetString("nodeMappingKey"),
+			CacheTTL: viper.GetDuration("nodeMappingCacheTTL"),
+		},
+		driver,
+		getKubeNode)
+	if err != nil {
+		return nil, err
+	}
 
 	err = driver.Authenticate()
 	if err != nil {
@@ -175,11 +323,13 @@ func newOvirt() (internal.OvirtApi, error) {
 }
 
 // Attach will attach the volume to the nodeName.
-// If the volume(ovirt's disk) doesn't exist, create it.
+// If the volume(ovirt's disk) doesn't exist, create it using the storage domain and size
+// of the volume spec. That makes inline flexVolume specs usable without a PVC.
 // If it exist, try to attach it to the VM
 // jsonOpts - contains the volume spec, like name, size etc
 // nodeName - k8s nodeName, needs conversion into ovirt's VM
-func Attach(jsonOpts string, nodeName string) (internal.Response, error) {
+// record - the journal record of the call-out, gets the id of the disk, may be nil
+func Attach(jsonOpts string, nodeName string, record *journalRecord) (internal.Response, error) {
 	ovirt, err := newOvirt()
 	if err != nil {
 		return internal.FailedResponseFromError(err), err
@@ -188,13 +338,14 @@ func Attach(jsonOpts string, nodeName string) (internal.Response, error) {
 	if e != nil {
 		return internal.FailedResponse, e
 	}
-
-	vmId, err := getSystemUUIDByNodeName(nodeName)
-	if err != nil {
-		return internal.FailedResponseFromError(err), err
+	if r.DiskInterface != "" {
+		err = internal.ValidateDiskInterface(r.DiskInterface)
+		if err != nil {
+			return internal.FailedResponseFromError(err), err
+		}
 	}
 
-	vm, err := ovirt.GetVMById(vmId)
+	vm, err := vmOfNode(ovirt, nodeName)
 	// 0. validation - Attach size is legal?
 	// 1. query if the disk exists
 	// 2. if it exist, is it already attached to a VM (perhaps a detach is in progress)
@@ -204,41 +355,151 @@ func Attach(jsonOpts string, nodeName string) (internal.Response, error) {
 	if err != nil {
 		return internal.FailedResponseFromError(err), err
 	}
-	// vm exist?
-	if vm.Id == "" {
-		e := fmt.Errorf("VM %s doesn't exist", nodeName)
-		return internal.FailedResponseFromError(e), e
-	}
 
-	diskResult, err := ovirt.GetDiskByName(fromk8sNameToOvirt(r.VolumeName))
+	disk, found, err := diskOfVolume(ovirt, r)
 	if err != nil {
 		return internal.FailedResponseFromError(err), err
 	}
 
-	if len(diskResult.Disks) == 0 {
-		return internal.FailedResponseFromError(fmt.Errorf("disk %s doesn't exist", r.VolumeName)), err
+	if !found {
+		// an inline volume, not backed by a PV, is created on first attach
+		disk, err = createInlineDisk(ovirt, r)
+		if err != nil {
+			return internal.FailedResponseFromError(err), err
+		}
+	} else {
+		// fetch the disk by id, for an up to date list of the VMs using it
+		disk, err = ovirt.GetDiskById(disk.Id)
+		if err != nil {
+			return internal.FailedResponseFromError(err), err
+		}
+		err = releaseFromOtherVMs(ovirt, disk, vm.Id)
+		if err != nil {
+			return internal.FailedResponseFromError(err), err
+		}
 	}
+	record.setDiskId(disk.Id)
 
 	// fetch the disk attachment on the VM
-	attachment, err := ovirt.GetDiskAttachment(vm.Id, diskResult.Disks[0].Id)
+	attachment, err := ovirt.GetDiskAttachment(vm.Id, disk.Id)
 	if err != nil {
 		_, noAttachment := err.(internal.NotFound)
 		if noAttachment {
 			attachment, err =
-				ovirt.CreateDisk(fromk8sNameToOvirt(r.VolumeName), r.StorageDomain, r.Mode == "ro", vm.Id, diskResult.Disks[0].Id, "virtio_scsi")
+				ovirt.CreateDisk(fromk8sNameToOvirt(r.VolumeName), r.StorageDomain, r.Mode == "ro", vm.Id, disk.Id, r.DiskInterface, r.PassDiscard)
 			if err != nil {
 				return internal.FailedResponseFromError(err), err
 			}
 		} else {
 			return internal.FailedResponseFromError(err), err
 		}
+	} else if !attachment.Active {
+		// left attached by a previous detach which didn't complete, plug it back
+		err = ovirt.ActivateDiskAttachment(vm.Id, disk.Id)
+		if err != nil {
+			return internal.FailedResponseFromError(err), err
+		}
 	}
 	return responseFromDiskAttachment(attachment.Id, attachment.Interface), err
 }
 
+// vmOfNode returns the VM of the node. When the VM the node is mapped to doesn't exist, i.e. it was
+// recreated, the mapping is forgotten so the next call-out resolves the node again.
+func vmOfNode(ovirt internal.OvirtApi, nodeName string) (internal.VM, error) {
+	vmId, err := nodeMapper.VMId(nodeName)
+	if err != nil {
+		return internal.VM{}, err
+	}
+	vm, err := ovirt.GetVMById(vmId)
+	_, notFound := err.(internal.NotFound)
+	if notFound || err == nil && vm.Id == "" {
+		nodeMapper.Forget(nodeName)
+		return internal.VM{}, fmt.Errorf("VM %s of node %s doesn't exist", vmId, nodeName)
+	}
+	return vm, err
+}
+
+// createInlineDisk creates an unattached disk out of the volume spec of an inline
+// flexVolume and waits for it to be unlocked.
+// The storage domain and the size (either 'size' or 'capacity') are mandatory.
+func createInlineDisk(ovirt internal.OvirtApi, r internal.AttachRequest) (internal.Disk, error) {
+	if r.StorageDomain == "" {
+		return internal.Disk{}, fmt.Errorf("disk %s doesn't exist and no storage domain was specified to create it", r.VolumeName)
+	}
+	size, err := diskSizeFrom(r)
+	if err != nil {
+		return internal.Disk{}, err
+	}
+
+	var description string
+	if r.DeleteOnDetach {
+		description = deleteOnDetachMarker
+	}
+	description = internal.WithBackReference(description, internal.BackReference{
+		ClusterId: ovirt.GetConnectionDetails().ClusterId,
+		Volume:    r.VolumeName,
+	})
+	disk, err := ovirt.CreateUnattachedDisk(internal.DiskOptions{
+		Name:             fromk8sNameToOvirt(r.VolumeName),
+		StorageDomain:    r.StorageDomain,
+		SizeInBytes:      size,
+		ReadOnly:         r.Mode == "ro",
+		ThinProvisioning: true,
+		Description:      description,
+	})
+	if err != nil {
+		return disk, err
+	}
+	return waitForDiskStatusOk(ovirt, disk.Id)
+}
+
+// diskSizeFrom parses the requested size of the volume as a kubernetes quantity i.e 1Gi, 500M.
+// The 'size' option takes precedence over 'capacity'
+func diskSizeFrom(r internal.AttachRequest) (int64, error) {
+	size := r.CustomSize
+	if size == "" {
+		size = r.Size
+	}
+	if size == "" {
+		return 0, fmt.Errorf("disk %s doesn't exist and no size was specified to create it", r.VolumeName)
+	}
+	quantity, err := resource.ParseQuantity(size)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size '%s' for disk %s: %s", size, r.VolumeName, err)
+	}
+	if quantity.Value() <= 0 {
+		return 0, fmt.Errorf("invalid size '%s' for disk %s", size, r.VolumeName)
+	}
+	return quantity.Value(), nil
+}
+
+// waitForDiskStatusOk polls the disk until it is not locked anymore.
+// A newly created disk is locked till the storage finishes allocating it.
+func waitForDiskStatusOk(ovirt internal.OvirtApi, diskId string) (internal.Disk, error) {
+	retries := 10
+	timeout := time.Second * 3
+	for {
+		disk, err := ovirt.GetDiskById(diskId)
+		if err != nil {
+			return disk, err
+		}
+		if disk.Status == "ok" {
+			return disk, nil
+		}
+		if disk.Status != "locked" {
+			return disk, fmt.Errorf("disk %s is in status '%s'", diskId, disk.Status)
+		}
+		retries--
+		if retries == 0 {
+			return disk, fmt.Errorf("disk %s is still locked", diskId)
+		}
+		time.Sleep(timeout)
+	}
+}
+
 // IsAttached will check if the disk exists on the VM attachments collections.
 // it will also reply with false in case the vm or the disk do not exist.
-func IsAttached(jsonOpts string, nodeName string) (internal.Response, error) {
+func IsAttached(jsonOpts string, nodeName string, record *journalRecord) (internal.Response, error) {
 	ovirt, err := newOvirt()
 	if err != nil {
 		return internal.FailedResponseFromError(err), err
@@ -248,42 +509,36 @@ func IsAttached(jsonOpts string, nodeName string) (internal.Response, error) {
 		return internal.FailedResponse, e
 	}
 
-	vmId, err := getSystemUUIDByNodeName(nodeName)
-	if err != nil {
-		return internal.FailedResponseFromError(err), err
-	}
-
-	vm, err := ovirt.GetVMById(vmId)
+	vm, err := vmOfNode(ovirt, nodeName)
 	if err != nil {
 		return internal.FailedResponseFromError(err), err
 	}
-	// vm exist?
-	if vm.Id == "" {
-		e := fmt.Errorf("VM %s doesn't exist", nodeName)
-		return internal.FailedResponseFromError(e), e
-	}
 
 	// disk exists?
-	diskResult, err := ovirt.GetDiskByName(fromk8sNameToOvirt(r.VolumeName))
+	disk, found, err := diskOfVolume(ovirt, r)
 	if err != nil {
 		return internal.FailedResponseFromError(err), err
 	}
+	result := internal.SuccessfulResponse
+	if !found {
+		return result, nil
+	}
 
 	// fetch attachment
-	attachment, err := ovirt.GetDiskAttachment(vm.Id, diskResult.Disks[0].Id)
+	record.setDiskId(disk.Id)
+	attachment, err := ovirt.GetDiskAttachment(vm.Id, disk.Id)
 	if err != nil {
 		return internal.FailedResponseFromError(err), err
 	}
 
-	result := internal.SuccessfulResponse
 	result.Attached = attachment.Id != ""
 	return result, nil
 }
 
-// Detach will detach the disk from the VM.
+// Detach will deactivate the disk and then detach it from the VM, see internal.DetachDiskGracefully
 // volumeName is a cluster wide unique name of the volume and needs to be converted to ovirt's disk name/id
 // nodeName - the hostname with the volume attached.
-func Detach(volumeName string, nodeName string) (internal.Response, error) {
+func Detach(volumeName string, nodeName string, record *journalRecord) (internal.Response, error) {
 	if nodeName == "" {
 		e := fmt.Errorf("invalid node name '%s'", nodeName)
 		return internal.FailedResponseFromError(e), e
@@ -300,30 +555,48 @@ func Detach(volumeName string, nodeName string) (internal.Response, error) {
 
 	ovirtDiskName := fromk8sNameToOvirt(volumeName)
 
-	vmId, err := getSystemUUIDByNodeName(nodeName)
+	vm, err := vmOfNode(ovirt, nodeName)
 	if err != nil {
 		return internal.FailedResponseFromError(err), err
 	}
 
-	vm, err := ovirt.GetVMById(vmId)
+	diskResult, err := getDiskByName(ovirt, ovirtDiskName)
 	if err != nil {
 		return internal.FailedResponseFromError(err), err
 	}
 
-	diskResult, err := ovirt.GetDiskByName(ovirtDiskName)
-	if err != nil {
-		return internal.FailedResponseFromError(err), err
+	var disk internal.Disk
+	if len(diskResult.Disks) > 0 {
+		disk = diskResult.Disks[0]
+	} else {
+		// the disk of a provisioned volume may be named by a template, or renamed in the engine
+		var found bool
+		disk, found, err = attachedDiskOfVolume(ovirt, vm.Id, volumeName)
+		if err != nil {
+			return internal.FailedResponseFromError(err), err
+		}
+		if !found {
+			//TODO is this an error or ok state for detach?
+			err = fmt.Errorf("disk by name %s does not exist", ovirtDiskName)
+			return internal.FailedResponseFromError(err), err
+		}
 	}
-
-	if len(diskResult.Disks) == 0 {
-		//TODO is this an error or ok state for detach?
-		err = fmt.Errorf("disk by name %s does not exist", ovirtDiskName)
+	record.setDiskId(disk.Id)
+	err = internal.DetachDiskGracefully(ovirt, vm.Id, disk.Id, detachOptions)
+	if err != nil {
 		return internal.FailedResponseFromError(err), err
 	}
 
-	err = ovirt.DetachDiskFromVM(vm.Id, diskResult.Disks[0].Id)
-	if err != nil {
-		return internal.FailedResponseFromError(err), err
+	// scratch volumes created by an inline attach go away with the detach
+	if strings.HasPrefix(disk.Description, deleteOnDetachMarker) {
+		_, err = waitForDiskStatusOk(ovirt, disk.Id)
+		if err != nil {
+			return internal.FailedResponseFromError(err), err
+		}
+		_, err = ovirt.Delete("disks/" + disk.Id)
+		if err != nil {
+			return internal.FailedResponseFromError(err), err
+		}
 	}
 	return internal.SuccessfulResponse, nil
 }
@@ -536,12 +809,12 @@ func GetVolumeName(jsonOpts string) (internal.Response, error) {
 		e := fmt.Errorf("VM %s doesn't exist", ovirtVmId)
 		return internal.FailedResponseFromError(e), e
 	}
-	diskResult, err := ovirt.GetDiskByName(fromk8sNameToOvirt(jsonArgs.VolumeName))
+	disk, found, err := diskOfVolume(ovirt, jsonArgs)
 	if err != nil {
 		return internal.FailedResponseFromError(err), err
 	}
 
-	if len(diskResult.Disks) == 0 {
+	if !found {
 		//noDisk := errors.New(fmt.Sprintf("Volume with name %s doesn't exist in ovirt", jsonArgs.VolumeName))
 		//return internal.FailedResponseFromError(noDisk), noDisk
 		// maybe just return the name of the disk as is to indicate it is free?
@@ -549,7 +822,7 @@ func GetVolumeName(jsonOpts string) (internal.Response, error) {
 	}
 
 	// fetch the disk attachment on the VM
-	attachment, err := ovirt.GetDiskAttachment(vm.Id, diskResult.Disks[0].Id)
+	attachment, err := ovirt.GetDiskAttachment(vm.Id, disk.Id)
 	if err != nil {
 		err = fmt.Errorf("the volume %s is not attached to the node %s", jsonArgs.VolumeName, ovirtVmId)
 		return internal.FailedResponseFromError(err), err
@@ -564,6 +837,68 @@ func Provision(_ string) (internal.Response, error) {
 	return internal.SuccessfulResponse, nil
 }
 
+// diskOfVolume returns the disk of the volume of the request, and false when it doesn't exist. A
+// provisioned volume has the id of its disk in its options, so it doesn't depend on the name of the
+// disk, which may be templated or changed in the engine. Other volumes are found by their name.
+func diskOfVolume(ovirt internal.OvirtApi, r internal.AttachRequest) (internal.Disk, bool, error) {
+	if r.VolumeId == "" {
+		result, err := getDiskByName(ovirt, fromk8sNameToOvirt(r.VolumeName))
+		if err != nil || len(result.Disks) == 0 {
+			return internal.Disk{}, false, err
+		}
+		return result.Disks[0], true, nil
+	}
+	disk, err := ovirt.GetDiskById(r.VolumeId)
+	if _, notFound := err.(internal.NotFound); notFound {
+		return internal.Disk{}, false, fmt.Errorf("disk %s of volume %s doesn't exist", r.VolumeId, r.VolumeName)
+	}
+	if err != nil {
+		return internal.Disk{}, false, err
+	}
+	if internal.IsForeignDisk(disk, ovirt.GetConnectionDetails().ClusterId) {
+		return internal.Disk{}, false, fmt.Errorf("disk %s of volume %s belongs to another cluster", r.VolumeId, r.VolumeName)
+	}
+	return disk, true, nil
+}
+
+// attachedDiskOfVolume returns the disk of the VM whose back reference names the volume, and false
+// when there is none. Detach gets only the name of the volume, this finds the disks not named after it.
+func attachedDiskOfVolume(ovirt internal.OvirtApi, vmId string, volumeName string) (internal.Disk, bool, error) {
+	attachments, err := ovirt.GetDiskAttachments(vmId)
+	if err != nil {
+		return internal.Disk{}, false, err
+	}
+	clusterId := ovirt.GetConnectionDetails().ClusterId
+	for _, a := range attachments {
+		ref, ok := internal.BackReferenceOf(a.Disk)
+		if ok && ref.Volume == volumeName && !internal.IsForeignDisk(a.Disk, clusterId) {
+			return a.Disk, true, nil
+		}
+	}
+	return internal.Disk{}, false, nil
+}
+
+// getDiskByName returns the disks of the volume, leaving out the disks of the other clusters sharing
+// the engine, see internal.IsForeignDisk
+func getDiskByName(ovirt internal.OvirtApi, name string) (internal.DiskResult, error) {
+	result, err := ovirt.GetDiskByName(name)
+	if err != nil {
+		return result, err
+	}
+	return disksOfCluster(result, ovirt.GetConnectionDetails().ClusterId), nil
+}
+
+func disksOfCluster(result internal.DiskResult, clusterId string) internal.DiskResult {
+	var disks []internal.Disk
+	for _, d := range result.Disks {
+		if !internal.IsForeignDisk(d, clusterId) {
+			disks = append(disks, d)
+		}
+	}
+	result.Disks = disks
+	return result
+}
+
 // fromk8sNameToOvirt takes name with '~' and replaces it with '_'
 func fromk8sNameToOvirt(s string) string {
 	return strings.Replace(s, "~", "_", -1)
@@ -2,6 +2,11 @@ package main
 
 import (
 	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/ovirt/ovirt-openshift-extensions/internal"
 )
 
 func TestExtractDeviceIdForVIRTIO(t *testing.T) {
@@ -30,3 +35,170 @@ func TestExtractDeviceIdForUnknown(t *testing.T) {
 		t.Errorf("expected %s got %s", expected, id)
 	}
 }
+
+func TestDiskSizeFromPrefersSize(t *testing.T) {
+	r := internal.AttachRequest{VolumeName: "vol1", Size: "1Gi", CustomSize: "2Gi"}
+	size, err := diskSizeFrom(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 2*1024*1024*1024 {
+		t.Errorf("expected %d got %d", 2*1024*1024*1024, size)
+	}
+}
+
+func TestDiskSizeFromCapacity(t *testing.T) {
+	r := internal.AttachRequest{VolumeName: "vol1", Size: "500M"}
+	size, err := diskSizeFrom(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 500*1000*1000 {
+		t.Errorf("expected %d got %d", 500*1000*1000, size)
+	}
+}
+
+func TestDiskSizeFromInvalid(t *testing.T) {
+	for _, s := range []string{"", "1GG", "0", "-1Gi"} {
+		_, err := diskSizeFrom(internal.AttachRequest{VolumeName: "vol1", Size: s})
+		if err == nil {
+			t.Errorf("expected an error for size '%s'", s)
+		}
+	}
+}
+
+func TestAttachRequestDiskAttachmentOptions(t *testing.T) {
+	r, err := internal.AttachRequestFrom(`{"kubernetes.io/pvOrVolumeName": "vol1", "ovirtDiskInterface": "virtio", "ovirtDiskPassDiscard": "true"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.DiskInterface != "virtio" || !r.PassDiscard {
+		t.Errorf("expected the virtio interface with pass discard, got %+v", r)
+	}
+}
+
+func TestDisksOfCluster(t *testing.T) {
+	result := internal.DiskResult{Disks: []internal.Disk{
+		{Id: "prod", Description: internal.WithBackReference("", internal.BackReference{ClusterId: "prod"})},
+		{Id: "test", Description: internal.WithBackReference("", internal.BackReference{ClusterId: "test"})},
+		{Id: "unmarked"},
+	}}
+	disks := disksOfCluster(result, "prod").Disks
+	if len(disks) != 2 || disks[0].Id != "prod" || disks[1].Id != "unmarked" {
+		t.Errorf("expected the disks of cluster prod and the unmarked disk, got %+v", disks)
+	}
+}
+
+// fakeOvirt serves the disks of the engine, the other calls panic
+type fakeOvirt struct {
+	internal.OvirtApi
+	disks       []internal.Disk
+	attachments []internal.DiskAttachment
+	vms         []internal.VM
+}
+
+func (f fakeOvirt) GetVMById(id string) (internal.VM, error) {
+	for _, vm := range f.vms {
+		if vm.Id == id {
+			return vm, nil
+		}
+	}
+	return internal.VM{}, internal.NotFound{}
+}
+
+func (f fakeOvirt) GetConnectionDetails() internal.Connection {
+	return internal.Connection{ClusterId: "prod"}
+}
+
+func (f fakeOvirt) GetDiskById(id string) (internal.Disk, error) {
+	for _, d := range f.disks {
+		if d.Id == id {
+			return d, nil
+		}
+	}
+	return internal.Disk{}, internal.NotFound{}
+}
+
+func (f fakeOvirt) GetDiskByName(name string) (internal.DiskResult, error) {
+	result := internal.DiskResult{}
+	for _, d := range f.disks {
+		if d.Name == name {
+			result.Disks = append(result.Disks, d)
+		}
+	}
+	return result, nil
+}
+
+func (f fakeOvirt) GetDiskAttachments(vmId string) ([]internal.DiskAttachment, error) {
+	return f.attachments, nil
+}
+
+func TestDiskOfVolume(t *testing.T) {
+	ovirt := fakeOvirt{disks: []internal.Disk{
+		{Id: "renamed-id", Name: "prod-default-claim", Description: internal.WithBackReference("", internal.BackReference{ClusterId: "prod", Volume: "pvc-1"})},
+		{Id: "inline-id", Name: "inline"},
+		{Id: "test-id", Name: "pvc-2", Description: internal.WithBackReference("", internal.BackReference{ClusterId: "test", Volume: "pvc-2"})},
+	}}
+	tests := []struct {
+		name    string
+		request internal.AttachRequest
+		diskId  string
+		err     bool
+	}{
+		{"by id", internal.AttachRequest{VolumeName: "pvc-1", VolumeId: "renamed-id"}, "renamed-id", false},
+		{"by name", internal.AttachRequest{VolumeName: "inline"}, "inline-id", false},
+		{"new inline volume", internal.AttachRequest{VolumeName: "scratch"}, "", false},
+		{"missing disk", internal.AttachRequest{VolumeName: "pvc-1", VolumeId: "removed-id"}, "", true},
+		{"disk of another cluster", internal.AttachRequest{VolumeName: "pvc-2", VolumeId: "test-id"}, "", true},
+	}
+	for _, test := range tests {
+		disk, found, err := diskOfVolume(ovirt, test.request)
+		if disk.Id != test.diskId || found != (test.diskId != "") || (err != nil) != test.err {
+			t.Errorf("%s: expected disk '%s' and error %v, got '%s' %v %v", test.name, test.diskId, test.err, disk.Id, found, err)
+		}
+	}
+}
+
+func TestAttachedDiskOfVolume(t *testing.T) {
+	reference := internal.BackReference{Namespace: "default", Claim: "claim", Volume: "pvc-1"}
+	foreign := internal.BackReference{ClusterId: "test", Volume: "pvc-2"}
+	// the attachments carry their disks, which aren't looked up by id
+	ovirt := fakeOvirt{attachments: []internal.DiskAttachment{
+		{Id: "os-id", Disk: internal.Disk{Id: "os-id", Name: "os"}},
+		{Id: "renamed-id", Disk: internal.Disk{Id: "renamed-id", Name: "prod-default-claim", Description: internal.WithBackReference("", reference)}},
+		{Id: "test-id", Disk: internal.Disk{Id: "test-id", Name: "pvc-2", Description: internal.WithBackReference("", foreign)}},
+	}}
+	disk, found, err := attachedDiskOfVolume(ovirt, "vm1", "pvc-1")
+	if err != nil || !found || disk.Id != "renamed-id" {
+		t.Errorf("expected the disk referring to volume pvc-1, got '%s' %v %v", disk.Id, found, err)
+	}
+	_, found, err = attachedDiskOfVolume(ovirt, "vm1", "pvc-2")
+	if err != nil || found {
+		t.Errorf("expected no disk of volume pvc-2, got %v %v", found, err)
+	}
+}
+
+func TestVMOfNodeForgetsMissingVM(t *testing.T) {
+	vmId := "removed-vm"
+	mapper, err := internal.NewNodeMapper(internal.NodeMappingConfig{Strategy: internal.MapByAnnotation, Key: "vm"}, nil,
+		func(nodeName string) (*v1.Node, error) {
+			return &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: nodeName, Annotations: map[string]string{"vm": vmId}}}, nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeMapper = mapper
+	defer func() { nodeMapper = nil }()
+	ovirt := fakeOvirt{vms: []internal.VM{{Id: "recreated-vm"}}}
+
+	_, err = vmOfNode(ovirt, "node1")
+	if err == nil {
+		t.Fatal("expected the missing VM to fail")
+	}
+	// the node was mapped again to its recreated VM
+	vmId = "recreated-vm"
+	vm, err := vmOfNode(ovirt, "node1")
+	if err != nil || vm.Id != "recreated-vm" {
+		t.Errorf("expected the recreated VM, got %v %v", vm.Id, err)
+	}
+}
@@ -0,0 +1,413 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/ovirt/ovirt-openshift-extensions/internal"
+)
+
+const (
+	// SnapshotterName is the snapshotter of the VolumeSnapshotClasses handled by this controller,
+	// the same name as the provisioner of the volumes
+	SnapshotterName = "ovirt-volume-provisioner"
+
+	defaultSyncInterval = 15 * time.Second
+)
+
+// snapshotController takes oVirt snapshots of the disks of PVs for VolumeSnapshots of our
+// snapshotter, binds them to VolumeSnapshotContents and keeps them as floating disks once
+// ready. Contents whose VolumeSnapshot was deleted are removed with their disk,
+// unless their deletion policy is Retain.
+type snapshotController struct {
+	ovirt     internal.OvirtApi
+	kube      kubernetes.Interface
+	snapshots *internal.SnapshotClient
+}
+
+func newSnapshotController(ovirt internal.OvirtApi, kube kubernetes.Interface) *snapshotController {
+	return &snapshotController{
+		ovirt:     ovirt,
+		kube:      kube,
+		snapshots: internal.NewSnapshotClient(kube.CoreV1().RESTClient()),
+	}
+}
+
+// Run syncs all the snapshots every interval till stop is closed
+func (c *snapshotController) Run(interval time.Duration, stop <-chan struct{}) {
+	wait.Until(c.sync, interval, stop)
+}
+
+func (c *snapshotController) sync() {
+	snapshots, err := c.snapshots.ListVolumeSnapshots()
+	if err != nil {
+		glog.Errorf("failed listing volume snapshots: %s", err)
+		return
+	}
+	for i := range snapshots {
+		s := &snapshots[i]
+		ours, err := c.isOurs(s)
+		if err != nil {
+			glog.Errorf("failed reading the class of volume snapshot %s/%s: %s", s.Namespace, s.Name, err)
+			continue
+		}
+		if !ours {
+			continue
+		}
+		err = c.syncSnapshot(s)
+		if err != nil {
+			glog.Errorf("failed syncing volume snapshot %s/%s: %s", s.Namespace, s.Name, err)
+			c.setError(s, err)
+		}
+	}
+
+	contents, err := c.snapshots.ListVolumeSnapshotContents()
+	if err != nil {
+		glog.Errorf("failed listing volume snapshot contents: %s", err)
+		return
+	}
+	for i := range contents {
+		err = c.syncContent(&contents[i])
+		if err != nil {
+			glog.Errorf("failed syncing volume snapshot content %s: %s", contents[i].Name, err)
+		}
+	}
+}
+
+// isOurs tells if the snapshot belongs to a class of our snapshotter
+func (c *snapshotController) isOurs(s *internal.VolumeSnapshot) (bool, error) {
+	if s.Spec.VolumeSnapshotClassName == nil || *s.Spec.VolumeSnapshotClassName == "" {
+		return false, nil
+	}
+	class, err := c.snapshots.GetVolumeSnapshotClass(*s.Spec.VolumeSnapshotClassName)
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return class.Snapshotter == SnapshotterName, nil
+}
+
+func (c *snapshotController) syncSnapshot(s *internal.VolumeSnapshot) error {
+	if s.DeletionTimestamp != nil {
+		return nil
+	}
+	if s.Spec.SnapshotContentName == "" {
+		return c.createSnapshot(s)
+	}
+	if !s.Status.ReadyToUse {
+		return c.updateReadiness(s)
+	}
+	return nil
+}
+
+// contentName is derived from the snapshot UID, so a crashed sync finds what it created
+func contentName(s *internal.VolumeSnapshot) string {
+	return "snapcontent-" + string(s.UID)
+}
+
+// snapshotDescription marks the oVirt snapshot with the VolumeSnapshot it was taken for
+func snapshotDescription(s *internal.VolumeSnapshot) string {
+	return fmt.Sprintf("kubernetes volume snapshot %s/%s %s", s.Namespace, s.Name, s.UID)
+}
+
+// createSnapshot takes the oVirt snapshot of the disk of the source PVC, unless one was
+// already taken, and binds the VolumeSnapshot to a new VolumeSnapshotContent
+func (c *snapshotController) createSnapshot(s *internal.VolumeSnapshot) error {
+	pv, err := c.sourceVolume(s)
+	if err != nil {
+		return err
+	}
+	diskId := pv.Annotations[internal.AnnVolumeID]
+	if diskId == "" {
+		return fmt.Errorf("PV %s has no %s annotation, it was not provisioned by %s", pv.Name, internal.AnnVolumeID, SnapshotterName)
+	}
+
+	content, err := c.snapshots.GetVolumeSnapshotContent(contentName(s))
+	if apierrors.IsNotFound(err) {
+		content, err = c.createContent(s, pv, diskId)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.Spec.SnapshotContentName = content.Name
+	if content.Spec.CSI != nil && content.Spec.CSI.RestoreSize != nil {
+		s.Status.RestoreSize = resource.NewQuantity(*content.Spec.CSI.RestoreSize, resource.BinarySI)
+	}
+	s.Status.Error = nil
+	_, err = c.snapshots.UpdateVolumeSnapshot(s)
+	return err
+}
+
+func (c *snapshotController) createContent(s *internal.VolumeSnapshot, pv *v1.PersistentVolume, diskId string) (*internal.VolumeSnapshotContent, error) {
+	snapshot, err := c.findSnapshot(diskId, snapshotDescription(s))
+	if err != nil {
+		return nil, err
+	}
+	if snapshot.Id == "" {
+		glog.Infof("Taking a snapshot of disk %s for volume snapshot %s/%s", diskId, s.Namespace, s.Name)
+		snapshot, err = c.ovirt.CreateDiskSnapshot(diskId, snapshotDescription(s))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	capacity := pv.Spec.Capacity[v1.ResourceStorage]
+	restoreSize := capacity.Value()
+	deletionPolicy := internal.SnapshotDeletionPolicyDelete
+	content := &internal.VolumeSnapshotContent{
+		ObjectMeta: metav1.ObjectMeta{Name: contentName(s)},
+		Spec: internal.VolumeSnapshotContentSpec{
+			CSI: &internal.SnapshotSource{
+				Driver:         SnapshotterName,
+				SnapshotHandle: internal.SnapshotHandle(snapshot),
+				RestoreSize:    &restoreSize,
+			},
+			VolumeSnapshotRef: &v1.ObjectReference{
+				Kind:       "VolumeSnapshot",
+				APIVersion: internal.SnapshotGroup + "/" + internal.SnapshotVersion,
+				Namespace:  s.Namespace,
+				Name:       s.Name,
+				UID:        s.UID,
+			},
+			PersistentVolumeRef:     &v1.ObjectReference{Kind: "PersistentVolume", Name: pv.Name},
+			VolumeSnapshotClassName: s.Spec.VolumeSnapshotClassName,
+			DeletionPolicy:          &deletionPolicy,
+		},
+	}
+	return c.snapshots.CreateVolumeSnapshotContent(content)
+}
+
+// findSnapshot looks for an oVirt snapshot of the disk taken for the VolumeSnapshot
+// by a previous sync. It returns an empty snapshot if there is none.
+func (c *snapshotController) findSnapshot(diskId string, description string) (internal.Snapshot, error) {
+	snapshots, err := c.ovirt.ListDiskSnapshots(diskId)
+	if err != nil {
+		return internal.Snapshot{}, err
+	}
+	for _, s := range snapshots {
+		if s.Description == description {
+			return s, nil
+		}
+	}
+	return internal.Snapshot{}, nil
+}
+
+// sourceVolume returns the bound PV of the PVC the VolumeSnapshot is taken of
+func (c *snapshotController) sourceVolume(s *internal.VolumeSnapshot) (*v1.PersistentVolume, error) {
+	source := s.Spec.Source
+	if source == nil || source.Kind != "PersistentVolumeClaim" {
+		return nil, fmt.Errorf("the source of the snapshot must be a PersistentVolumeClaim")
+	}
+	claim, err := c.kube.CoreV1().PersistentVolumeClaims(s.Namespace).Get(source.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if claim.Status.Phase != v1.ClaimBound || claim.Spec.VolumeName == "" {
+		return nil, fmt.Errorf("PVC %s/%s is not bound", claim.Namespace, claim.Name)
+	}
+	return c.kube.CoreV1().PersistentVolumes().Get(claim.Spec.VolumeName, metav1.GetOptions{})
+}
+
+// snapshotDiskName names the floating disk a snapshot is kept as, derived from the
+// snapshot UID so a crashed sync finds the disk it made
+func snapshotDiskName(s *internal.VolumeSnapshot) string {
+	return "snapshot-" + string(s.UID)
+}
+
+// updateReadiness marks the snapshot ready once the engine completed the oVirt snapshot
+// and it is kept as a floating disk. The VM snapshot pins the disk of the PV to its VM,
+// the engine doesn't detach a disk of a VM snapshot, so it is removed once the disk is made.
+func (c *snapshotController) updateReadiness(s *internal.VolumeSnapshot) error {
+	content, err := c.snapshots.GetVolumeSnapshotContent(s.Spec.SnapshotContentName)
+	if err != nil {
+		return err
+	}
+	if content.Spec.CSI == nil || content.Spec.CSI.Driver != SnapshotterName {
+		return nil
+	}
+	handle, err := internal.SnapshotFromHandle(content.Spec.CSI.SnapshotHandle)
+	if err != nil {
+		return err
+	}
+	if handle.KeptAsDisk() {
+		// a previous sync made the disk and failed removing the VM snapshot
+		err = c.removeVmSnapshot(s, content)
+		if err != nil {
+			return err
+		}
+		return c.markReady(s, internal.Snapshot{})
+	}
+
+	snapshot, err := c.ovirt.GetDiskSnapshot(handle.VmId, handle.Id, handle.DiskId)
+	if err != nil {
+		return err
+	}
+	switch snapshot.Status {
+	case internal.SnapshotStatusOk:
+		err = c.keepAsDisk(s, content, snapshot)
+		if err != nil {
+			return err
+		}
+		return c.markReady(s, snapshot)
+	case "locked":
+		// the engine is still taking it
+		return nil
+	default:
+		return fmt.Errorf("oVirt snapshot %s is in status '%s'", snapshot.Id, snapshot.Status)
+	}
+}
+
+// keepAsDisk restores the oVirt snapshot into a floating disk, unless a previous sync did,
+// points the content to the disk and removes the oVirt snapshot
+func (c *snapshotController) keepAsDisk(s *internal.VolumeSnapshot, content *internal.VolumeSnapshotContent, snapshot internal.Snapshot) error {
+	name := snapshotDiskName(s)
+	existing, err := c.ovirt.GetDiskByName(name)
+	if err != nil {
+		return err
+	}
+	var disk internal.Disk
+	if len(existing.Disks) > 0 {
+		disk = existing.Disks[0]
+	} else {
+		if content.Spec.PersistentVolumeRef == nil {
+			return fmt.Errorf("content %s has no PV to keep snapshot %s in the storage domain of", content.Name, snapshot.Id)
+		}
+		pv, err := c.kube.CoreV1().PersistentVolumes().Get(content.Spec.PersistentVolumeRef.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		storageDomain := pv.Annotations[internal.AnnStorageDomain]
+		if storageDomain == "" {
+			return fmt.Errorf("PV %s has no %s annotation, it was not provisioned by %s", pv.Name, internal.AnnStorageDomain, SnapshotterName)
+		}
+		glog.Infof("Keeping snapshot %s of disk %s as disk %s", snapshot.Id, snapshot.DiskId, name)
+		disk, err = c.ovirt.RestoreDiskSnapshot(snapshot, name, snapshotDescription(s), storageDomain, 0, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	content.Spec.CSI.SnapshotHandle = internal.SnapshotHandle(internal.Snapshot{DiskId: disk.Id})
+	_, err = c.snapshots.UpdateVolumeSnapshotContent(content)
+	if err != nil {
+		return err
+	}
+	glog.Infof("Deleting snapshot %s of VM %s, it is kept as disk %s", snapshot.Id, snapshot.VmId, disk.Id)
+	return c.ovirt.DeleteDiskSnapshot(snapshot.VmId, snapshot.Id)
+}
+
+// removeVmSnapshot removes the oVirt snapshot taken for the VolumeSnapshot, if still there
+func (c *snapshotController) removeVmSnapshot(s *internal.VolumeSnapshot, content *internal.VolumeSnapshotContent) error {
+	if content.Spec.PersistentVolumeRef == nil {
+		return nil
+	}
+	pv, err := c.kube.CoreV1().PersistentVolumes().Get(content.Spec.PersistentVolumeRef.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	diskId := pv.Annotations[internal.AnnVolumeID]
+	if diskId == "" {
+		return nil
+	}
+	snapshot, err := c.findSnapshot(diskId, snapshotDescription(s))
+	if err != nil || snapshot.Id == "" {
+		return err
+	}
+	return c.ovirt.DeleteDiskSnapshot(snapshot.VmId, snapshot.Id)
+}
+
+// markReady sets the snapshot ready, created at the date of the oVirt snapshot when known
+func (c *snapshotController) markReady(s *internal.VolumeSnapshot, snapshot internal.Snapshot) error {
+	s.Status.ReadyToUse = true
+	s.Status.Error = nil
+	if snapshot.Date > 0 {
+		t := metav1.NewTime(time.Unix(0, snapshot.Date*int64(time.Millisecond)))
+		s.Status.CreationTime = &t
+	} else if s.Status.CreationTime == nil {
+		t := metav1.Now()
+		s.Status.CreationTime = &t
+	}
+	_, err := c.snapshots.UpdateVolumeSnapshot(s)
+	return err
+}
+
+// syncContent removes a content of ours whose VolumeSnapshot is gone, with its
+// oVirt snapshot unless the deletion policy is Retain
+func (c *snapshotController) syncContent(content *internal.VolumeSnapshotContent) error {
+	if content.Spec.CSI == nil || content.Spec.CSI.Driver != SnapshotterName || content.Spec.VolumeSnapshotRef == nil {
+		return nil
+	}
+	ref := content.Spec.VolumeSnapshotRef
+	s, err := c.snapshots.GetVolumeSnapshot(ref.Namespace, ref.Name)
+	if err == nil && s.UID == ref.UID {
+		return nil
+	}
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	if content.Spec.DeletionPolicy == nil || *content.Spec.DeletionPolicy != internal.SnapshotDeletionPolicyRetain {
+		handle, err := internal.SnapshotFromHandle(content.Spec.CSI.SnapshotHandle)
+		if err != nil {
+			return err
+		}
+		if handle.KeptAsDisk() {
+			glog.Infof("Deleting snapshot disk %s, volume snapshot %s/%s is gone", handle.DiskId, ref.Namespace, ref.Name)
+			_, err = c.ovirt.Delete("disks/" + handle.DiskId)
+			if _, notFound := err.(internal.NotFound); notFound {
+				err = nil
+			}
+		} else {
+			glog.Infof("Deleting snapshot %s of VM %s, volume snapshot %s/%s is gone", handle.Id, handle.VmId, ref.Namespace, ref.Name)
+			err = c.ovirt.DeleteDiskSnapshot(handle.VmId, handle.Id)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err = c.snapshots.DeleteVolumeSnapshotContent(content.Name)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// setError reports the failure on the snapshot status, best effort
+func (c *snapshotController) setError(s *internal.VolumeSnapshot, err error) {
+	now := metav1.Now()
+	s.Status.Error = &internal.VolumeSnapshotError{Time: &now, Message: err.Error()}
+	_, e := c.snapshots.UpdateVolumeSnapshot(s)
+	if e != nil {
+		glog.Errorf("failed updating the status of volume snapshot %s/%s: %s", s.Namespace, s.Name, e)
+	}
+}
@@ -0,0 +1,369 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/ovirt/ovirt-openshift-extensions/internal"
+)
+
+const snapshotsPath = "/apis/snapshot.storage.k8s.io/v1alpha1"
+
+// fakeKube is a minimal kube api server keeping objects by their path
+type fakeKube struct {
+	sync.Mutex
+	objects map[string]map[string]interface{}
+}
+
+func (f *fakeKube) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	p := r.URL.Path
+	switch r.Method {
+	case http.MethodGet:
+		if o, ok := f.objects[p]; ok {
+			json.NewEncoder(w).Encode(o)
+			return
+		}
+		// a cluster wide list, i.e /apis/<group>/<version>/volumesnapshots
+		if strings.HasPrefix(p, snapshotsPath+"/") && strings.Count(p, "/") == 4 {
+			resource := p[len(snapshotsPath)+1:]
+			items := []interface{}{}
+			for k, o := range f.objects {
+				parts := strings.Split(k, "/")
+				if strings.HasPrefix(k, snapshotsPath) && parts[len(parts)-2] == resource {
+					items = append(items, o)
+				}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"items": items})
+			return
+		}
+		notFound(w)
+	case http.MethodPut:
+		if _, ok := f.objects[p]; !ok {
+			notFound(w)
+			return
+		}
+		f.objects[p] = readObject(r)
+		json.NewEncoder(w).Encode(f.objects[p])
+	case http.MethodPost:
+		o := readObject(r)
+		name := o["metadata"].(map[string]interface{})["name"].(string)
+		f.objects[p+"/"+name] = o
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(o)
+	case http.MethodDelete:
+		if _, ok := f.objects[p]; !ok {
+			notFound(w)
+			return
+		}
+		delete(f.objects, p)
+		w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Success"}`))
+	}
+}
+
+func readObject(r *http.Request) map[string]interface{} {
+	b, _ := ioutil.ReadAll(r.Body)
+	o := map[string]interface{}{}
+	json.Unmarshal(b, &o)
+	return o
+}
+
+func notFound(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNotFound)
+	w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404}`))
+}
+
+func (f *fakeKube) add(p string, o string) {
+	parsed := map[string]interface{}{}
+	err := json.Unmarshal([]byte(o), &parsed)
+	if err != nil {
+		panic(err)
+	}
+	f.objects[p] = parsed
+}
+
+// fakeOvirt implements the snapshot calls, any other call panics
+type fakeOvirt struct {
+	internal.OvirtApi
+	snapshots []internal.Snapshot
+	disks     []internal.Disk
+	created   int
+	restored  int
+	deleted   []string
+	status    string
+}
+
+func (f *fakeOvirt) CreateDiskSnapshot(diskId string, description string) (internal.Snapshot, error) {
+	f.created++
+	s := internal.Snapshot{Id: "snap1", VmId: "vm1", DiskId: diskId, Description: description, Status: "locked"}
+	f.snapshots = append(f.snapshots, s)
+	return s, nil
+}
+
+func (f *fakeOvirt) GetDiskSnapshot(vmId string, snapshotId string, diskId string) (internal.Snapshot, error) {
+	return internal.Snapshot{Id: snapshotId, VmId: vmId, DiskId: diskId, Status: f.status, Date: 1546300800000}, nil
+}
+
+func (f *fakeOvirt) ListDiskSnapshots(diskId string) ([]internal.Snapshot, error) {
+	return f.snapshots, nil
+}
+
+func (f *fakeOvirt) DeleteDiskSnapshot(vmId string, snapshotId string) error {
+	f.deleted = append(f.deleted, vmId+"/"+snapshotId)
+	for i, s := range f.snapshots {
+		if s.VmId == vmId && s.Id == snapshotId {
+			f.snapshots = append(f.snapshots[:i], f.snapshots[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (f *fakeOvirt) RestoreDiskSnapshot(snapshot internal.Snapshot, diskName string, diskDescription string, storageDomainName string, sizeInBytes int64, thinProvisioning bool) (internal.Disk, error) {
+	f.restored++
+	disk := internal.Disk{Id: "snapdisk1", Name: diskName, Status: "ok"}
+	f.disks = append(f.disks, disk)
+	return disk, nil
+}
+
+func (f *fakeOvirt) GetDiskByName(diskName string) (internal.DiskResult, error) {
+	result := internal.DiskResult{}
+	for _, d := range f.disks {
+		if d.Name == diskName {
+			result.Disks = append(result.Disks, d)
+		}
+	}
+	return result, nil
+}
+
+func (f *fakeOvirt) Delete(path string) ([]byte, error) {
+	f.deleted = append(f.deleted, path)
+	return nil, nil
+}
+
+// DetachDiskFromVM fails like the engine while a VM snapshot holds the disk
+func (f *fakeOvirt) DetachDiskFromVM(vmId string, diskId string) error {
+	for _, s := range f.snapshots {
+		if s.VmId == vmId && s.DiskId == diskId {
+			return fmt.Errorf("cannot detach disk %s, it is included in snapshot %s", diskId, s.Id)
+		}
+	}
+	return nil
+}
+
+func newTestController(t *testing.T, snapshotter string) (*snapshotController, *fakeKube, *fakeOvirt) {
+	kube := &fakeKube{objects: map[string]map[string]interface{}{}}
+	server := httptest.NewServer(kube)
+	clientSet, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL, QPS: 1000, Burst: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kube.add(snapshotsPath+"/volumesnapshotclasses/ovirt",
+		`{"metadata":{"name":"ovirt"},"snapshotter":"`+snapshotter+`"}`)
+	kube.add(snapshotsPath+"/namespaces/default/volumesnapshots/snap",
+		`{"metadata":{"name":"snap","namespace":"default","uid":"uid1"},
+		  "spec":{"snapshotClassName":"ovirt","source":{"kind":"PersistentVolumeClaim","name":"claim"}}}`)
+	kube.add("/api/v1/namespaces/default/persistentvolumeclaims/claim",
+		`{"metadata":{"name":"claim","namespace":"default"},"spec":{"volumeName":"pv1"},"status":{"phase":"Bound"}}`)
+	kube.add("/api/v1/persistentvolumes/pv1",
+		`{"metadata":{"name":"pv1","annotations":{"`+internal.AnnVolumeID+`":"disk1","`+internal.AnnStorageDomain+`":"data1"}},"spec":{"capacity":{"storage":"1Gi"}}}`)
+
+	ovirt := &fakeOvirt{status: "locked"}
+	return newSnapshotController(ovirt, clientSet), kube, ovirt
+}
+
+func TestSyncTakesSnapshot(t *testing.T) {
+	c, _, ovirt := newTestController(t, SnapshotterName)
+
+	c.sync()
+	if ovirt.created != 1 {
+		t.Fatalf("expected a single oVirt snapshot, got %d", ovirt.created)
+	}
+	content, err := c.snapshots.GetVolumeSnapshotContent("snapcontent-uid1")
+	if err != nil {
+		t.Fatalf("expected the content to be created: %s", err)
+	}
+	if content.Spec.CSI.SnapshotHandle != "vm1/snap1/disk1" || *content.Spec.CSI.RestoreSize != 1<<30 {
+		t.Errorf("unexpected content source %+v", content.Spec.CSI)
+	}
+	s, _ := c.snapshots.GetVolumeSnapshot("default", "snap")
+	if s.Spec.SnapshotContentName != content.Name || s.Status.ReadyToUse {
+		t.Errorf("expected an unready bound snapshot, got %+v", s)
+	}
+
+	c.sync()
+	s, _ = c.snapshots.GetVolumeSnapshot("default", "snap")
+	if s.Status.ReadyToUse {
+		t.Errorf("expected the snapshot to wait for the locked oVirt snapshot")
+	}
+
+	ovirt.status = internal.SnapshotStatusOk
+	c.sync()
+	s, _ = c.snapshots.GetVolumeSnapshot("default", "snap")
+	if !s.Status.ReadyToUse || s.Status.CreationTime == nil {
+		t.Errorf("expected a ready snapshot, got %+v", s.Status)
+	}
+	if ovirt.created != 1 {
+		t.Errorf("expected no more snapshots, got %d", ovirt.created)
+	}
+	content, _ = c.snapshots.GetVolumeSnapshotContent("snapcontent-uid1")
+	if content.Spec.CSI.SnapshotHandle != "snapdisk1" {
+		t.Errorf("expected the snapshot kept as a disk, got handle %s", content.Spec.CSI.SnapshotHandle)
+	}
+	if len(ovirt.snapshots) != 0 {
+		t.Errorf("expected the oVirt snapshot removed, got %v", ovirt.snapshots)
+	}
+
+	c.sync()
+	if ovirt.restored != 1 {
+		t.Errorf("expected a single restore, got %d", ovirt.restored)
+	}
+}
+
+func TestSyncReleasesTheVolumeForDetach(t *testing.T) {
+	c, _, ovirt := newTestController(t, SnapshotterName)
+
+	c.sync()
+	if err := ovirt.DetachDiskFromVM("vm1", "disk1"); err == nil {
+		t.Fatalf("expected the engine to refuse the detach while the snapshot is taken")
+	}
+
+	ovirt.status = internal.SnapshotStatusOk
+	c.sync()
+	if err := ovirt.DetachDiskFromVM("vm1", "disk1"); err != nil {
+		t.Errorf("expected the volume to detach after the snapshot, got %s", err)
+	}
+	s, _ := c.snapshots.GetVolumeSnapshot("default", "snap")
+	if !s.Status.ReadyToUse {
+		t.Errorf("expected a ready snapshot, got %+v", s.Status)
+	}
+}
+
+func TestSyncRemovesTheVmSnapshotOfAKeptDisk(t *testing.T) {
+	c, kube, ovirt := newTestController(t, SnapshotterName)
+	c.sync()
+	// a sync which made the disk and crashed before removing the oVirt snapshot
+	content, _ := c.snapshots.GetVolumeSnapshotContent("snapcontent-uid1")
+	content.Spec.CSI.SnapshotHandle = "snapdisk1"
+	kube.add(snapshotsPath+"/volumesnapshotcontents/snapcontent-uid1", mustMarshal(content))
+
+	c.sync()
+	if len(ovirt.snapshots) != 0 || ovirt.restored != 0 {
+		t.Errorf("expected only the oVirt snapshot removed, got %v and %d restores", ovirt.snapshots, ovirt.restored)
+	}
+	s, _ := c.snapshots.GetVolumeSnapshot("default", "snap")
+	if !s.Status.ReadyToUse || s.Status.CreationTime == nil {
+		t.Errorf("expected a ready snapshot, got %+v", s.Status)
+	}
+}
+
+func TestSyncAdoptsExistingSnapshot(t *testing.T) {
+	c, _, ovirt := newTestController(t, SnapshotterName)
+	ovirt.snapshots = []internal.Snapshot{
+		{Id: "other", VmId: "vm1", DiskId: "disk1", Description: "something else"},
+		{Id: "snap2", VmId: "vm1", DiskId: "disk1", Description: "kubernetes volume snapshot default/snap uid1"},
+	}
+
+	c.sync()
+	if ovirt.created != 0 {
+		t.Fatalf("expected the existing snapshot to be adopted")
+	}
+	content, err := c.snapshots.GetVolumeSnapshotContent("snapcontent-uid1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content.Spec.CSI.SnapshotHandle != "vm1/snap2/disk1" {
+		t.Errorf("unexpected handle %s", content.Spec.CSI.SnapshotHandle)
+	}
+}
+
+func TestSyncIgnoresOtherSnapshotters(t *testing.T) {
+	c, _, ovirt := newTestController(t, "some-csi-driver")
+
+	c.sync()
+	if ovirt.created != 0 {
+		t.Errorf("expected no oVirt snapshot for another snapshotter")
+	}
+	s, _ := c.snapshots.GetVolumeSnapshot("default", "snap")
+	if s.Spec.SnapshotContentName != "" || s.Status.Error != nil {
+		t.Errorf("expected the snapshot untouched, got %+v", s)
+	}
+}
+
+func TestSyncReportsUnprovisionedVolumes(t *testing.T) {
+	c, kube, ovirt := newTestController(t, SnapshotterName)
+	kube.add("/api/v1/persistentvolumes/pv1", `{"metadata":{"name":"pv1"}}`)
+
+	c.sync()
+	if ovirt.created != 0 {
+		t.Errorf("expected no oVirt snapshot")
+	}
+	s, _ := c.snapshots.GetVolumeSnapshot("default", "snap")
+	if s.Status.Error == nil || !strings.Contains(s.Status.Error.Message, "pv1") {
+		t.Errorf("expected an error on the snapshot status, got %+v", s.Status)
+	}
+}
+
+func TestSyncRemovesContentOfDeletedSnapshot(t *testing.T) {
+	tests := []struct {
+		policy  string
+		deleted []string
+	}{
+		{internal.SnapshotDeletionPolicyDelete, []string{"vm1/snap1", "disks/snapdisk1"}},
+		{internal.SnapshotDeletionPolicyRetain, []string{"vm1/snap1"}},
+	}
+	for _, test := range tests {
+		c, kube, ovirt := newTestController(t, SnapshotterName)
+		ovirt.status = internal.SnapshotStatusOk
+		c.sync()
+		c.sync()
+		delete(kube.objects, snapshotsPath+"/namespaces/default/volumesnapshots/snap")
+		content, _ := c.snapshots.GetVolumeSnapshotContent("snapcontent-uid1")
+		content.Spec.DeletionPolicy = &test.policy
+		kube.add(snapshotsPath+"/volumesnapshotcontents/snapcontent-uid1", mustMarshal(content))
+
+		c.sync()
+		if !reflect.DeepEqual(ovirt.deleted, test.deleted) {
+			t.Errorf("policy %s: expected the deletions %v, got %v", test.policy, test.deleted, ovirt.deleted)
+		}
+		if _, ok := kube.objects[snapshotsPath+"/volumesnapshotcontents/snapcontent-uid1"]; ok {
+			t.Errorf("policy %s: expected the content to be removed", test.policy)
+		}
+	}
+}
+
+func mustMarshal(o interface{}) string {
+	b, err := json.Marshal(o)
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
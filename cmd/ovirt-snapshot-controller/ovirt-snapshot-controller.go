@@ -0,0 +1,95 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/ovirt/ovirt-openshift-extensions/internal"
+)
+
+var (
+	master     = flag.String("master", "", "Master URL to build a client config from. Either this or kubeconfig needs to be set if the controller is being run out of cluster.")
+	kubeconfig = flag.String("kubeconfig", "", "Absolute path to the kubeconfig file. Either this or master needs to be set if the controller is being run out of cluster.")
+	interval   = flag.Duration("interval", defaultSyncInterval, "How often the snapshots are synced")
+)
+
+func main() {
+	flag.Set("logtostderr", "true")
+	flag.Parse()
+
+	glog.Infof("Snapshot controller for snapshotter %s", SnapshotterName)
+
+	clientSet := getClientSet()
+	ovirtApi, err := newOvirt()
+	if err != nil {
+		glog.Fatalf("Failed to initialize ovirt client: %v", err)
+	}
+
+	c := newSnapshotController(ovirtApi, clientSet)
+	c.Run(*interval, wait.NeverStop)
+}
+
+func getClientSet() kubernetes.Interface {
+	var config *rest.Config
+	var err error
+	if *master != "" || *kubeconfig != "" {
+		glog.Infof("Either master or kubeconfig specified. building kube config from that..")
+		config, err = clientcmd.BuildConfigFromFlags(*master, *kubeconfig)
+	} else {
+		glog.Infof("Building kube configs for running in cluster...")
+		config, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		glog.Fatalf("Failed to create config: %v", err)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		glog.Fatalf("Failed to create client: %v", err)
+	}
+	return clientset
+}
+
+func newOvirt() (internal.OvirtApi, error) {
+	var conf string
+	value, exist := os.LookupEnv("OVIRT_API_CONF")
+	if exist {
+		conf = value
+	} else {
+		conf = "/etc/ovirt/ovirt-api.conf"
+	}
+	file, e := os.Open(conf)
+	if e != nil {
+		return nil, e
+	}
+	ovirt, err := internal.NewOvirt(file)
+	if err != nil {
+		return nil, err
+	}
+	err = ovirt.Authenticate()
+	if err != nil {
+		return nil, err
+	}
+	return ovirt, nil
+}
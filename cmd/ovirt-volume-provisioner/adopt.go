@@ -0,0 +1,101 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/ovirt/ovirt-openshift-extensions/internal"
+)
+
+// createdForClaim tells if the disk was created for the claim in this cluster, by its back reference
+func (p ovirtProvisioner) createdForClaim(disk internal.Disk, uid types.UID) bool {
+	ref, ok := internal.BackReferenceOf(disk)
+	return ok && uid != "" && ref.ClaimUID == string(uid) && ref.ClusterId == p.clusterId
+}
+
+// existingDisk returns the disk an earlier attempt to provision the claim created, when the
+// provisioner restarted before its PV was saved. A disk which fits the volume is adopted, with its
+// storage domain and topology. A disk of the claim which doesn't fit is removed, since no PV refers
+// to it, and an empty disk is returned to create a new one. A disk still being created fails the
+// provisioning, which is retried.
+func (p ovirtProvisioner) existingDisk(name string, uid types.UID, s domainSelector, sizeInBytes int64, topologies []internal.Topology) (internal.Disk, internal.StorageDomain, internal.Topology, error) {
+	if uid == "" {
+		return internal.Disk{}, internal.StorageDomain{}, internal.Topology{}, nil
+	}
+	result, err := p.ovirtApi.GetDiskByName(name)
+	if err != nil {
+		return internal.Disk{}, internal.StorageDomain{}, internal.Topology{}, err
+	}
+	for _, disk := range result.Disks {
+		if disk.Name != name || !p.createdForClaim(disk, uid) {
+			continue
+		}
+		if disk.Status == "locked" {
+			return internal.Disk{}, internal.StorageDomain{}, internal.Topology{},
+				fmt.Errorf("disk %s (%s) of the claim is still being created", disk.Name, disk.Id)
+		}
+		reason := ""
+		domain, topology, found, err := p.domainOfDisk(disk, topologies)
+		switch {
+		case err != nil:
+			return internal.Disk{}, internal.StorageDomain{}, internal.Topology{}, err
+		case disk.Status != "ok":
+			reason = "it is " + disk.Status
+		case disk.ProvisionedSize != uint64(sizeInBytes):
+			reason = fmt.Sprintf("its size is %d instead of %d", disk.ProvisionedSize, sizeInBytes)
+		case !found || !s.matches(domain):
+			reason = "its storage domain doesn't match the parameters"
+		default:
+			glog.Infof("Adopting disk %s (%s) created by an earlier attempt to provision the claim", disk.Name, disk.Id)
+			return disk, domain, topology, nil
+		}
+		glog.Warningf("Removing disk %s (%s) created by an earlier attempt to provision the claim, %s", disk.Name, disk.Id, reason)
+		err = p.removeDisk(disk.Id)
+		if err != nil {
+			return internal.Disk{}, internal.StorageDomain{}, internal.Topology{}, err
+		}
+	}
+	return internal.Disk{}, internal.StorageDomain{}, internal.Topology{}, nil
+}
+
+// domainOfDisk returns the storage domain of the disk and its topology, and false when the disk
+// isn't in one of the topologies
+func (p ovirtProvisioner) domainOfDisk(disk internal.Disk, topologies []internal.Topology) (internal.StorageDomain, internal.Topology, bool, error) {
+	if len(disk.StorageDomains.Domains) == 0 {
+		return internal.StorageDomain{}, internal.Topology{}, false, nil
+	}
+	topologies, err := p.dataCenterTopologies(topologies)
+	if err != nil {
+		return internal.StorageDomain{}, internal.Topology{}, false, err
+	}
+	for _, t := range topologies {
+		domains, err := p.ovirtApi.GetDataCenterStorageDomains(t.DataCenterId)
+		if err != nil {
+			return internal.StorageDomain{}, internal.Topology{}, false, err
+		}
+		for _, d := range domains {
+			if d.Id == disk.StorageDomains.Domains[0].Id {
+				return d, t, true, nil
+			}
+		}
+	}
+	return internal.StorageDomain{}, internal.Topology{}, false, nil
+}
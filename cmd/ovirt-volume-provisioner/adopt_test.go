@@ -0,0 +1,204 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kubernetes-incubator/external-storage/lib/controller"
+
+	"github.com/ovirt/ovirt-openshift-extensions/internal"
+)
+
+const claimUID = "claim-uid"
+
+// ofClaim marks the disk as created for the claim
+func ofClaim(disk internal.Disk, uid string) internal.Disk {
+	disk.Description = internal.WithBackReference(disk.Description, internal.BackReference{ClaimUID: uid, Volume: disk.Name})
+	return disk
+}
+
+func claimOptions(parameters map[string]string) controller.VolumeOptions {
+	options := volumeOptions(parameters, nil)
+	options.PVC.UID = claimUID
+	return options
+}
+
+// disksNamed returns the ids of the disks of the engine with the name
+func disksNamed(f *fakeOvirt, name string) []string {
+	var ids []string
+	for _, d := range f.disks {
+		if d.Name == name {
+			ids = append(ids, d.Id)
+		}
+	}
+	return ids
+}
+
+func TestProvisionAfterCrash(t *testing.T) {
+	tests := []struct {
+		name string
+		// crash makes the first attempt to provision the claim fail after the given step
+		crash   func(f *fakeOvirt)
+		removed string
+		diskId  string
+	}{
+		{"before creating the disk", func(f *fakeOvirt) { f.crashBefore = true }, "", "new"},
+		{"after the engine created the disk", func(f *fakeOvirt) { f.crash = true }, "", "new"},
+		{"before saving the PV", nil, "", "new"},
+		{"after the engine failed creating the disk", func(f *fakeOvirt) { f.crash = true; f.status = "illegal" }, "new", "new"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ovirt := newFakeOvirt()
+			p := NewOvirtProvisioner(ovirt, nil, nil)
+			if test.crash != nil {
+				test.crash(ovirt)
+				if _, err := p.Provision(claimOptions(map[string]string{})); err == nil {
+					t.Fatal("expected the first attempt to fail")
+				}
+				if disks := disksNamed(ovirt, "pvc-1"); ovirt.crashBefore && len(disks) != 0 {
+					t.Fatalf("expected the first attempt to fail before creating the disk, got %v", disks)
+				}
+			} else if _, err := p.Provision(claimOptions(map[string]string{})); err != nil {
+				t.Fatal(err)
+			}
+
+			ovirt.crash, ovirt.crashBefore, ovirt.status = false, false, ""
+			pv, err := p.Provision(claimOptions(map[string]string{}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pv.Annotations[annVolumeID] != test.diskId {
+				t.Errorf("expected the PV of disk %s, got %s", test.diskId, pv.Annotations[annVolumeID])
+			}
+			if disks := disksNamed(ovirt, "pvc-1"); len(disks) != 1 {
+				t.Errorf("expected a single disk of the claim, got %v", disks)
+			}
+			if strings.Join(ovirt.removed, ",") != test.removed {
+				t.Errorf("expected the removed disks '%s', got %v", test.removed, ovirt.removed)
+			}
+		})
+	}
+}
+
+func TestProvisionWaitsForLockedDisk(t *testing.T) {
+	ovirt := newFakeOvirt()
+	ovirt.crash, ovirt.status = true, "locked"
+	p := NewOvirtProvisioner(ovirt, nil, nil)
+	if _, err := p.Provision(claimOptions(map[string]string{})); err == nil {
+		t.Fatal("expected the first attempt to fail")
+	}
+	ovirt.crash = false
+
+	_, err := p.Provision(claimOptions(map[string]string{}))
+	if err == nil || !strings.Contains(err.Error(), "still being created") {
+		t.Fatalf("expected the locked disk to fail the provisioning, got %v", err)
+	}
+
+	ovirt.disks[len(ovirt.disks)-1].Status = "ok"
+	pv, err := p.Provision(claimOptions(map[string]string{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pv.Annotations[annVolumeID] != "new" || len(disksNamed(ovirt, "pvc-1")) != 1 {
+		t.Errorf("expected the disk to be adopted, got %s and disks %v", pv.Annotations[annVolumeID], disksNamed(ovirt, "pvc-1"))
+	}
+}
+
+func TestProvisionReplacesMismatchingDisk(t *testing.T) {
+	marked := func(id string, size uint64, domainId string) internal.Disk {
+		disk := ofClaim(internal.Disk{Id: id, Name: "pvc-1", Status: "ok", ProvisionedSize: size}, claimUID)
+		disk.StorageDomains.Domains = []internal.StorageDomain{{Id: domainId}}
+		return disk
+	}
+	tests := []struct {
+		name    string
+		disk    internal.Disk
+		removed string
+	}{
+		{"other size", marked("old", 2*gib, "data1-id"), "old"},
+		{"other storage domain", marked("old", gib, "data3-id"), "old"},
+		{"other claim", ofClaim(internal.Disk{Id: "old", Name: "pvc-1", Status: "ok", ProvisionedSize: gib}, "other"), ""},
+		{"no back reference", internal.Disk{Id: "old", Name: "pvc-1", Status: "ok", ProvisionedSize: gib}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ovirt := newFakeOvirt()
+			ovirt.disks = append(ovirt.disks, test.disk)
+			pv, err := NewOvirtProvisioner(ovirt, nil, nil).Provision(claimOptions(map[string]string{}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ovirt.created || pv.Annotations[annVolumeID] != "new" {
+				t.Errorf("expected a new disk, got %s", pv.Annotations[annVolumeID])
+			}
+			if strings.Join(ovirt.removed, ",") != test.removed {
+				t.Errorf("expected the removed disks '%s', got %v", test.removed, ovirt.removed)
+			}
+		})
+	}
+}
+
+func TestProvisionMarksCopy(t *testing.T) {
+	ovirt := newFakeOvirt()
+	p := NewOvirtProvisioner(ovirt, nil, nil)
+	options := claimOptions(map[string]string{parameterSourceDiskName: "golden", parameterDiskDescription: "${pvc.name}"})
+	_, err := p.Provision(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied := ovirt.disks[len(ovirt.disks)-1]
+	if len(ovirt.updates) != 0 || copied.Description != `claim {"namespace":"default","pvc":"claim","claimUid":"claim-uid","pv":"pvc-1"}` {
+		t.Fatalf("expected the copy to be made marked, got %+v and updates %+v", copied, ovirt.updates)
+	}
+
+	// the provisioner died before saving the PV of the copy
+	ovirt.copiedId = ""
+	pv, err := p.Provision(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ovirt.copiedId != "" || pv.Annotations[annVolumeID] != "copy" {
+		t.Errorf("expected the copy to be adopted, got copied %s and PV of %s", ovirt.copiedId, pv.Annotations[annVolumeID])
+	}
+}
+
+func TestProvisionAfterCrashOfCopy(t *testing.T) {
+	ovirt := newFakeOvirt()
+	p := NewOvirtProvisioner(ovirt, nil, nil)
+	options := claimOptions(map[string]string{parameterSourceDiskName: "golden"})
+	// the engine made the copy and the provisioner died before it returned
+	ovirt.crash = true
+	if _, err := p.Provision(options); err == nil {
+		t.Fatal("expected the first attempt to fail")
+	}
+	ovirt.crash = false
+
+	ovirt.copiedId = ""
+	pv, err := p.Provision(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ovirt.copiedId != "" || pv.Annotations[annVolumeID] != "copy" {
+		t.Errorf("expected the copy to be adopted, got copied %s and PV of %s", ovirt.copiedId, pv.Annotations[annVolumeID])
+	}
+	if disks := disksNamed(ovirt, "pvc-1"); len(disks) != 1 || len(ovirt.removed) != 0 {
+		t.Errorf("expected a single disk of the claim, got %v and removed %v", disks, ovirt.removed)
+	}
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/lib/controller"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/ovirt/ovirt-openshift-extensions/internal"
+)
+
+const (
+	// the size limits of the volumes of a StorageClass
+	parameterMinSize           = "minSize"
+	parameterMaxSize           = "maxSize"
+	parameterSizeGranularity   = "sizeGranularity"
+	parameterNamespaceCapacity = "namespaceCapacity"
+
+	// the reasons of the events of a rejected claim
+	reasonSizeRejected      = "VolumeSizeRejected"
+	reasonNamespaceCapacity = "NamespaceCapacityExceeded"
+	reasonNoStorageDomain   = "NoStorageDomain"
+	reasonQuotaExceeded     = "QuotaExceeded"
+)
+
+// rejection is an error of a claim which can't be provisioned as it is, recorded as an event on the claim
+type rejection struct {
+	reason  string
+	message string
+}
+
+func (r rejection) Error() string {
+	return r.message
+}
+
+// invalidParameters returns the error of invalid claim or StorageClass parameters as a rejection
+func invalidParameters(err error) error {
+	if _, ok := err.(rejection); ok || err == nil {
+		return err
+	}
+	return rejection{reasonInvalidParameters, err.Error()}
+}
+
+// rejected records the rejection as an event of the claim, and returns the error
+func (p ovirtProvisioner) rejected(claim *v1.PersistentVolumeClaim, err error) error {
+	if r, ok := err.(rejection); ok && p.recorder != nil {
+		p.recorder.Event(claimReference(claim), v1.EventTypeWarning, r.reason, r.message)
+	}
+	return err
+}
+
+// volumeSize returns the size of the disk of the claim: the requested size raised to the minSize
+// and rounded up to the sizeGranularity of the StorageClass, which may not exceed its maxSize.
+func volumeSize(options controller.VolumeOptions) (int64, error) {
+	requested := options.PVC.Spec.Resources.Requests[v1.ResourceStorage]
+	size := requested.Value()
+	minSize, err := sizeParameter(options.Parameters, parameterMinSize)
+	if err != nil {
+		return 0, err
+	}
+	maxSize, err := sizeParameter(options.Parameters, parameterMaxSize)
+	if err != nil {
+		return 0, err
+	}
+	granularity, err := sizeParameter(options.Parameters, parameterSizeGranularity)
+	if err != nil {
+		return 0, err
+	}
+	if maxSize > 0 && minSize > maxSize {
+		return 0, fmt.Errorf("invalid parameters, %s is larger than %s", parameterMinSize, parameterMaxSize)
+	}
+
+	if size < minSize {
+		size = minSize
+	}
+	if granularity > 0 && size%granularity != 0 {
+		size = (size/granularity + 1) * granularity
+	}
+	if maxSize > 0 && size > maxSize {
+		return 0, rejection{reasonSizeRejected, fmt.Sprintf("the requested size %s is larger than the %s %s",
+			resource.NewQuantity(size, resource.BinarySI).String(), parameterMaxSize, options.Parameters[parameterMaxSize])}
+	}
+	return size, nil
+}
+
+// sizeParameter returns the size set by the parameter, or 0 when it isn't set
+func sizeParameter(params map[string]string, name string) (int64, error) {
+	v, ok := params[name]
+	if !ok {
+		return 0, nil
+	}
+	quantity, err := resource.ParseQuantity(v)
+	if err != nil || quantity.Sign() <= 0 {
+		return 0, fmt.Errorf("invalid parameter %s '%s', expected a size like 10Gi", name, v)
+	}
+	return quantity.Value(), nil
+}
+
+// checkNamespaceCapacity refuses a volume which gets the PVs of the StorageClass in the namespace
+// of the claim over the namespaceCapacity of the StorageClass.
+func (p ovirtProvisioner) checkNamespaceCapacity(options controller.VolumeOptions, sizeInBytes int64) error {
+	limit, err := sizeParameter(options.Parameters, parameterNamespaceCapacity)
+	if err != nil || limit == 0 {
+		return err
+	}
+	if p.client == nil {
+		return fmt.Errorf("parameter %s requires the provisioner to access the kubernetes API", parameterNamespaceCapacity)
+	}
+	className := claimClass(options.PVC)
+	namespace := options.PVC.Namespace
+	pvs, err := p.client.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed listing the volumes of namespace %s: %s", namespace, err)
+	}
+	used := int64(0)
+	for _, pv := range pvs.Items {
+		if pv.Spec.StorageClassName != className || pv.Spec.ClaimRef == nil || pv.Spec.ClaimRef.Namespace != namespace {
+			continue
+		}
+		capacity := pv.Spec.Capacity[v1.ResourceStorage]
+		used += capacity.Value()
+	}
+	if used+sizeInBytes > limit {
+		return rejection{reasonNamespaceCapacity, fmt.Sprintf("namespace %s uses %s of StorageClass %s, another %s exceeds its %s %s",
+			namespace, resource.NewQuantity(used, resource.BinarySI), className, resource.NewQuantity(sizeInBytes, resource.BinarySI),
+			parameterNamespaceCapacity, options.Parameters[parameterNamespaceCapacity])}
+	}
+	return nil
+}
+
+// checkQuota refuses a disk over the oVirt quota it is counted on, when the data center enforces quotas
+func (p ovirtProvisioner) checkQuota(quotaId string, domain internal.StorageDomain, topology internal.Topology, sizeInBytes int64) error {
+	if quotaId == "" {
+		return nil
+	}
+	dataCenter, err := p.ovirtApi.GetDataCenter(topology.DataCenterId)
+	if err != nil {
+		return err
+	}
+	if dataCenter.QuotaMode != internal.QuotaModeEnabled {
+		glog.Infof("Data center %s doesn't enforce quota %s, its quota mode is %s", dataCenter.Name, quotaId, dataCenter.QuotaMode)
+		return nil
+	}
+	limits, err := p.ovirtApi.GetQuotaStorageLimits(dataCenter.Id, quotaId)
+	if err != nil {
+		return fmt.Errorf("failed getting quota %s of data center %s: %s", quotaId, dataCenter.Name, err)
+	}
+	limit, ok := internal.StorageLimitOf(limits, domain.Id)
+	if !ok {
+		return rejection{reasonQuotaExceeded, fmt.Sprintf("quota %s has no storage limit on storage domain %s", quotaId, domain.Name)}
+	}
+	if limit.Limit < 0 {
+		return nil
+	}
+	usage := limit.Usage + float64(sizeInBytes)/(1<<30)
+	if usage > float64(limit.Limit) {
+		return rejection{reasonQuotaExceeded, fmt.Sprintf("quota %s uses %.2fGiB of its %dGiB on storage domain %s, another %s exceeds it",
+			quotaId, limit.Usage, limit.Limit, domain.Name, resource.NewQuantity(sizeInBytes, resource.BinarySI))}
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/ovirt/ovirt-openshift-extensions/internal"
+)
+
+func TestVolumeSize(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		expected   int64
+		err        string
+	}{
+		{"as requested", map[string]string{}, gib, ""},
+		{"raised to the minimum", map[string]string{parameterMinSize: "5Gi"}, 5 * gib, ""},
+		{"rounded up", map[string]string{parameterSizeGranularity: "4Gi"}, 4 * gib, ""},
+		{"raised and rounded", map[string]string{parameterMinSize: "5Gi", parameterSizeGranularity: "2Gi"}, 6 * gib, ""},
+		{"a multiple of the granularity", map[string]string{parameterSizeGranularity: "512Mi"}, gib, ""},
+		{"up to the maximum", map[string]string{parameterMaxSize: "1Gi"}, gib, ""},
+		{"over the maximum", map[string]string{parameterMaxSize: "512Mi"}, 0, "the requested size 1Gi is larger than the maxSize 512Mi"},
+		{"rounded over the maximum", map[string]string{parameterMaxSize: "3Gi", parameterSizeGranularity: "4Gi"}, 0, "the requested size 4Gi is larger"},
+		{"minimum over the maximum", map[string]string{parameterMinSize: "3Gi", parameterMaxSize: "2Gi"}, 0, "minSize is larger than maxSize"},
+		{"invalid size", map[string]string{parameterMinSize: "big"}, 0, "invalid parameter minSize"},
+		{"zero granularity", map[string]string{parameterSizeGranularity: "0"}, 0, "invalid parameter sizeGranularity"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			size, err := volumeSize(volumeOptions(test.parameters, nil))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size != test.expected {
+				t.Errorf("expected size %d, got %d", test.expected, size)
+			}
+		})
+	}
+}
+
+// kubeWithVolumes serves the PVs, of the claims of namespace default of class ovirt with capacity 2Gi and 3Gi,
+// of another namespace and of another class, the claim and the StorageClass ovirt
+func kubeWithVolumes(t *testing.T) (kubernetes.Interface, func()) {
+	pv := func(name string, namespace string, class string, capacity string) string {
+		return fmt.Sprintf(`{"metadata": {"name": "%s"}, "spec": {"capacity": {"storage": "%s"}, "storageClassName": "%s",
+			"claimRef": {"namespace": "%s", "name": "claim-%s"}}}`, name, capacity, class, namespace, name)
+	}
+	return kubeWithRoutes(t, map[string]http.HandlerFunc{
+		"/api/v1/persistentvolumes": kubeObject(fmt.Sprintf(`{"kind": "PersistentVolumeList", "apiVersion": "v1", "items": [%s, %s, %s, %s]}`,
+			pv("pv-1", "default", "ovirt", "2Gi"), pv("pv-2", "default", "ovirt", "3Gi"),
+			pv("pv-3", "other", "ovirt", "10Gi"), pv("pv-4", "default", "fast", "10Gi"))),
+		"/api/v1/namespaces/default/persistentvolumeclaims/claim": kubeObject(
+			`{"kind": "PersistentVolumeClaim", "apiVersion": "v1", "spec": {}}`),
+		"/apis/storage.k8s.io/v1/storageclasses/ovirt": kubeObject(
+			`{"kind": "StorageClass", "apiVersion": "storage.k8s.io/v1", "metadata": {"name": "ovirt"}, "provisioner": "ovirt-volume-provisioner"}`),
+	})
+}
+
+func TestNamespaceCapacity(t *testing.T) {
+	client, stop := kubeWithVolumes(t)
+	defer stop()
+	tests := []struct {
+		limit string
+		err   string
+	}{
+		{"6Gi", ""},
+		{"5Gi", "namespace default uses 5Gi of StorageClass ovirt, another 1Gi exceeds its namespaceCapacity 5Gi"},
+	}
+	for _, test := range tests {
+		ovirt := newFakeOvirt()
+		p := NewOvirtProvisioner(ovirt, client, nil)
+		recorder := record.NewFakeRecorder(10)
+		p.(*ovirtProvisioner).recorder = recorder
+		options := volumeOptions(map[string]string{parameterNamespaceCapacity: test.limit}, nil)
+		options.PVC.Annotations = map[string]string{annStorageClass: "ovirt"}
+		_, err := p.Provision(options)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("limit %s: %s", test.limit, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != test.err {
+			t.Errorf("limit %s: expected error %q, got %v", test.limit, test.err, err)
+		}
+		if ovirt.created {
+			t.Errorf("limit %s: expected no disk", test.limit)
+		}
+		expected := v1.EventTypeWarning + " " + reasonNamespaceCapacity + " " + test.err
+		if event := <-recorder.Events; event != expected {
+			t.Errorf("limit %s: expected event %q, got %q", test.limit, expected, event)
+		}
+	}
+}
+
+func TestInvalidParametersAreRejected(t *testing.T) {
+	tests := []map[string]string{
+		{parameterFsType: "ntfs"},
+		{parameterDiskThinProvisioning: "maybe"},
+		{parameterSizeGranularity: "a lot"},
+	}
+	for _, parameters := range tests {
+		p := NewOvirtProvisioner(newFakeOvirt(), nil, nil)
+		recorder := record.NewFakeRecorder(10)
+		p.(*ovirtProvisioner).recorder = recorder
+		_, err := p.Provision(volumeOptions(parameters, nil))
+		if err == nil {
+			t.Errorf("%v: expected an error", parameters)
+			continue
+		}
+		expected := v1.EventTypeWarning + " " + reasonInvalidParameters + " " + err.Error()
+		if event := <-recorder.Events; event != expected {
+			t.Errorf("%v: expected event %q, got %q", parameters, expected, event)
+		}
+	}
+}
+
+func TestQuotaAndOvercommit(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		quotas     map[string][]internal.QuotaStorageLimit
+		err        string
+		reason     string
+	}{
+		{"no quota", map[string]string{}, nil, "", ""},
+		{"quota not enforced", map[string]string{parameterQuotaId: "q1"}, nil, "", ""},
+		{"unlimited quota", map[string]string{parameterQuotaId: "q1"},
+			map[string][]internal.QuotaStorageLimit{"q1": {{Limit: -1}}}, "", ""},
+		{"quota of the domain", map[string]string{parameterQuotaId: "q1"},
+			map[string][]internal.QuotaStorageLimit{"q1": {{Limit: 1, Usage: 10}, {Limit: 10, Usage: 9, StorageDomain: &internal.Reference{Id: "data1-id"}}}}, "", ""},
+		{"over the quota", map[string]string{parameterQuotaId: "q1"},
+			map[string][]internal.QuotaStorageLimit{"q1": {{Limit: 10, Usage: 9.5}}},
+			"quota q1 uses 9.50GiB of its 10GiB on storage domain data1, another 1Gi exceeds it", reasonQuotaExceeded},
+		{"quota of another domain", map[string]string{parameterQuotaId: "q1"},
+			map[string][]internal.QuotaStorageLimit{"q1": {{Limit: 10, StorageDomain: &internal.Reference{Id: "data3-id"}}}},
+			"quota q1 has no storage limit on storage domain data1", reasonQuotaExceeded},
+		{"within the overcommit", map[string]string{parameterStorageDomainOvercommit: "1.5"}, nil, "", ""},
+		{"over the overcommit", map[string]string{parameterStorageDomainOvercommit: "1.25"}, nil,
+			"data1 would have 151Gi committed out of the 150Gi allowed by overcommit 1.25", reasonNoStorageDomain},
+		{"invalid overcommit", map[string]string{parameterStorageDomainOvercommit: "-1"}, nil,
+			"invalid parameter " + parameterStorageDomainOvercommit, reasonInvalidParameters},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ovirt := newFakeOvirt()
+			ovirt.quotas = test.quotas
+			domain := &ovirt.dataCenters["dc1-id"][0]
+			domain.Id = "data1-id"
+			domain.Used = 20 * gib
+			domain.Committed = 150 * gib
+			p := NewOvirtProvisioner(ovirt, nil, nil)
+			recorder := record.NewFakeRecorder(10)
+			p.(*ovirtProvisioner).recorder = recorder
+			_, err := p.Provision(volumeOptions(test.parameters, nil))
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected error %q, got %v", test.err, err)
+			}
+			select {
+			case event := <-recorder.Events:
+				if !strings.HasPrefix(event, v1.EventTypeWarning+" "+test.reason+" ") || test.reason == "" {
+					t.Errorf("expected a %s event, got %q", test.reason, event)
+				}
+			default:
+				if test.reason != "" {
+					t.Errorf("expected a %s event", test.reason)
+				}
+			}
+		})
+	}
+}
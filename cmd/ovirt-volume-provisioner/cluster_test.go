@@ -0,0 +1,118 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ovirt/ovirt-openshift-extensions/internal"
+)
+
+// ofCluster marks the disk as created for the cluster
+func ofCluster(disk internal.Disk, clusterId string) internal.Disk {
+	disk.Description = internal.WithBackReference(disk.Description, internal.BackReference{ClusterId: clusterId, Volume: disk.Name, ReclaimPolicy: "Delete"})
+	return disk
+}
+
+func TestProvisionMarksClusterId(t *testing.T) {
+	ovirt := newFakeOvirt()
+	ovirt.clusterId = "prod"
+	_, err := NewOvirtProvisioner(ovirt, nil, nil).Provision(claimOptions(map[string]string{parameterDiskDescription: "${pvc.name}"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ovirt.options.Description != `claim {"clusterId":"prod","namespace":"default","pvc":"claim","claimUid":"claim-uid","pv":"pvc-1"}` {
+		t.Errorf("expected the disk to be marked with the cluster ID, got '%s'", ovirt.options.Description)
+	}
+}
+
+func TestProvisionIgnoresDisksOfOtherClusters(t *testing.T) {
+	ovirt := newFakeOvirt()
+	ovirt.clusterId = "prod"
+	other := internal.Disk{Id: "other", Name: "pvc-1", Status: "ok", ProvisionedSize: gib,
+		Description: internal.WithBackReference("", internal.BackReference{ClusterId: "test", ClaimUID: claimUID, Volume: "pvc-1"})}
+	other.StorageDomains.Domains = []internal.StorageDomain{{Id: "data1-id"}}
+	ovirt.disks = append(ovirt.disks, other)
+
+	pv, err := NewOvirtProvisioner(ovirt, nil, nil).Provision(claimOptions(map[string]string{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pv.Annotations[annVolumeID] != "new" || len(ovirt.removed) != 0 {
+		t.Errorf("expected a new disk and the disk of the other cluster untouched, got %s removed %v", pv.Annotations[annVolumeID], ovirt.removed)
+	}
+}
+
+func TestDeleteIgnoresDisksOfOtherClusters(t *testing.T) {
+	ovirt := &fakeOvirt{clusterId: "prod", disks: []internal.Disk{ofCluster(internal.Disk{Id: "disk1-id", Name: "pvc-1"}, "test")}}
+	p := NewOvirtProvisioner(ovirt, nil, nil)
+
+	err := p.Delete(volumeOfDisk("disk1-id"))
+	if err == nil || !strings.Contains(err.Error(), "belongs to cluster test") {
+		t.Errorf("expected the disk of the other cluster to fail the delete, got %v", err)
+	}
+	// a volume without the annotation has no disk of its own
+	err = p.Delete(volumeOfDisk(""))
+	if err != nil {
+		t.Error(err)
+	}
+	if len(ovirt.removed) != 0 {
+		t.Errorf("expected the disk of the other cluster to be kept, got removed %v", ovirt.removed)
+	}
+}
+
+func TestReconcileIgnoresDisksOfOtherClusters(t *testing.T) {
+	client, stop := kubeWithProvisionedVolumes(t)
+	defer stop()
+	ovirt := &fakeOvirt{clusterId: "prod", disks: []internal.Disk{
+		ofCluster(internal.Disk{Id: "disk1-id", Name: "pvc-1"}, "prod"),
+		ofCluster(internal.Disk{Id: "disk2-id", Name: "pvc-2"}, "prod"),
+		ofCluster(internal.Disk{Id: "orphan-id", Name: "pvc-5"}, "prod"),
+		ofCluster(internal.Disk{Id: "other-id", Name: "pvc-6"}, "test"),
+		{Id: "unmarked-id", Name: "pvc-7"},
+	}}
+	r := newReconciler(NewOvirtProvisioner(ovirt, client, nil).(*ovirtProvisioner), "", time.Hour, nil)
+
+	now := time.Now()
+	for _, at := range []time.Time{now, now.Add(time.Hour)} {
+		orphans, _, err := r.reconcile(at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if orphans != 1 {
+			t.Errorf("expected only the orphan of the cluster, got %d orphans", orphans)
+		}
+	}
+	if strings.Join(ovirt.removed, ",") != "orphan-id" {
+		t.Errorf("expected only the orphan of the cluster to be removed, got %v", ovirt.removed)
+	}
+}
+
+func TestSweepArchiveIgnoresDisksOfOtherClusters(t *testing.T) {
+	expired := func(id string, clusterId string) internal.Disk {
+		until := time.Now().Add(-time.Hour).Format(time.RFC3339)
+		disk := internal.Disk{Id: id, Name: "archived-" + id, Description: archiveMarker + " pv=" + id + " claim=default/claim until=" + until}
+		return ofCluster(disk, clusterId)
+	}
+	ovirt := &fakeOvirt{clusterId: "prod", disks: []internal.Disk{expired("prod", "prod"), expired("test", "test"), expired("unmarked", "")}}
+	NewOvirtProvisioner(ovirt, nil, nil).(*ovirtProvisioner).sweepArchive(time.Now())
+	if strings.Join(ovirt.removed, ",") != "prod" {
+		t.Errorf("expected only the archived disk of the cluster to be removed, got %v", ovirt.removed)
+	}
+}
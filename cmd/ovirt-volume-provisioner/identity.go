@@ -0,0 +1,138 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/lib/controller"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	// identityKey holds the identity of the provisioner in its ConfigMap, which is also the lock
+	// of the leader election
+	identityKey = "identity"
+
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+)
+
+// provisionerIdentity returns the identity of the provisioner, which is recorded on the PVs it
+// provisions and shared by its replicas. The configured identity is used when set, otherwise the
+// identity saved in the ConfigMap, which the first provisioner to start generates.
+func provisionerIdentity(client kubernetes.Interface, namespace string, name string, configured string) (types.UID, error) {
+	configMaps := client.CoreV1().ConfigMaps(namespace)
+	// the replicas may start together, the one which fails to save its identity reads it again
+	for attempt := 0; attempt < 3; attempt++ {
+		configMap, err := configMaps.Get(name, metav1.GetOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return "", fmt.Errorf("failed getting the identity in ConfigMap %s/%s: %s", namespace, name, err)
+		}
+		saved := ""
+		if err == nil {
+			saved = configMap.Data[identityKey]
+		}
+		switch {
+		case configured != "":
+			if saved != "" && saved != configured {
+				glog.Warningf("The identity %s replaces the identity %s saved in ConfigMap %s/%s, the volumes of %s are left alone",
+					configured, saved, namespace, name, saved)
+			}
+			return types.UID(configured), nil
+		case saved != "":
+			return types.UID(saved), nil
+		}
+
+		identity := string(uuid.NewUUID())
+		if errors.IsNotFound(err) {
+			_, err = configMaps.Create(&v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+				Data:       map[string]string{identityKey: identity},
+			})
+		} else {
+			// the leader election created the ConfigMap
+			if configMap.Data == nil {
+				configMap.Data = map[string]string{}
+			}
+			configMap.Data[identityKey] = identity
+			_, err = configMaps.Update(configMap)
+		}
+		if errors.IsAlreadyExists(err) || errors.IsConflict(err) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed saving the identity in ConfigMap %s/%s: %s", namespace, name, err)
+		}
+		glog.Infof("Generated the identity %s of the provisioner, saved in ConfigMap %s/%s", identity, namespace, name)
+		return types.UID(identity), nil
+	}
+	return "", fmt.Errorf("failed saving the identity in ConfigMap %s/%s, it keeps changing", namespace, name)
+}
+
+// owns tells if the provisioner provisioned the volume. The volumes of a provisioner of another
+// identity are left to it, a volume without an identity, provisioned by an older version, is owned.
+func (p ovirtProvisioner) owns(volume *v1.PersistentVolume) bool {
+	identity := volume.Annotations[annProvisionerID]
+	return identity == "" || identity == string(p.identity)
+}
+
+// notOwned is returned by Delete for a volume of another provisioner, which the controller ignores
+func notOwned(volume *v1.PersistentVolume, identity types.UID) error {
+	return &controller.IgnoredError{Reason: fmt.Sprintf("volume %s was provisioned by %s, not by %s",
+		volume.Name, volume.Annotations[annProvisionerID], identity)}
+}
+
+// runAsLeader runs the provisioner once it is elected leader among its replicas, by the lock
+// of the ConfigMap. A replica which stops leading exits, to be restarted as a candidate.
+func runAsLeader(p *ovirtProvisioner, namespace string, name string, candidate string, run func(stop <-chan struct{})) {
+	lock, err := resourcelock.New(resourcelock.ConfigMapsResourceLock, namespace, name, p.client.CoreV1(),
+		resourcelock.ResourceLockConfig{Identity: candidate, EventRecorder: p.recorder})
+	if err != nil {
+		glog.Fatalf("Failed creating the leader election lock: %v", err)
+	}
+	leaderelection.RunOrDie(leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: leaseDuration,
+		RenewDeadline: renewDeadline,
+		RetryPeriod:   retryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(stop <-chan struct{}) {
+				glog.Infof("%s is the leader of the provisioners of ConfigMap %s/%s", candidate, namespace, name)
+				run(stop)
+			},
+			OnStoppedLeading: func() {
+				glog.Fatalf("%s stopped leading the provisioners", candidate)
+			},
+			OnNewLeader: func(identity string) {
+				if identity != candidate {
+					glog.Infof("%s waits for leader %s", candidate, identity)
+				}
+			},
+		},
+	})
+}
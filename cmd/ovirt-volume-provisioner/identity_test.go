@@ -0,0 +1,121 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/kubernetes-incubator/external-storage/lib/controller"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/ovirt/ovirt-openshift-extensions/internal"
+)
+
+// kubeWithConfigMap serves the ConfigMap kube-system/ovirt-volume-provisioner, which is created
+// and updated as is. It doesn't exist when configMap is "".
+func kubeWithConfigMap(t *testing.T, configMap *string) (kubernetes.Interface, func()) {
+	save := func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		*configMap = string(body)
+		fmt.Fprint(w, *configMap)
+	}
+	return kubeWithRoutes(t, map[string]http.HandlerFunc{
+		"/api/v1/namespaces/kube-system/configmaps": save,
+		"/api/v1/namespaces/kube-system/configmaps/ovirt-volume-provisioner": func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.Method == http.MethodPut:
+				save(w, r)
+			case *configMap == "":
+				kubeNotFound(w)
+			default:
+				fmt.Fprint(w, *configMap)
+			}
+		},
+	})
+}
+
+func TestProvisionerIdentity(t *testing.T) {
+	configMap := ""
+	client, stop := kubeWithConfigMap(t, &configMap)
+	defer stop()
+
+	identity, err := provisionerIdentity(client, "kube-system", ProvisionerName, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity == "" {
+		t.Fatal("expected an identity to be generated")
+	}
+	// a restarted provisioner, or another replica, gets the saved identity
+	again, err := provisionerIdentity(client, "kube-system", ProvisionerName, "")
+	if err != nil || again != identity {
+		t.Errorf("expected the saved identity %s, got %s %v", identity, again, err)
+	}
+	configured, err := provisionerIdentity(client, "kube-system", ProvisionerName, "configured")
+	if err != nil || configured != "configured" {
+		t.Errorf("expected the configured identity, got %s %v", configured, err)
+	}
+}
+
+func TestProvisionerIdentityOfLock(t *testing.T) {
+	// the ConfigMap was created by the leader election of a replica
+	configMap := `{"kind": "ConfigMap", "apiVersion": "v1", "metadata": {"name": "ovirt-volume-provisioner", "namespace": "kube-system",
+		"annotations": {"control-plane.alpha.kubernetes.io/leader": "{}"}}}`
+	client, stop := kubeWithConfigMap(t, &configMap)
+	defer stop()
+
+	identity, err := provisionerIdentity(client, "kube-system", ProvisionerName, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := provisionerIdentity(client, "kube-system", ProvisionerName, "")
+	if err != nil || identity == "" || again != identity {
+		t.Errorf("expected the identity to be saved in the ConfigMap of the lock, got %s and %s %v", identity, again, err)
+	}
+}
+
+func TestDeleteOwnedVolumes(t *testing.T) {
+	tests := []struct {
+		name     string
+		identity string
+		removed  bool
+	}{
+		{"volume of the provisioner", "me", true},
+		{"volume of an older version", "", true},
+		{"volume of another provisioner", "other", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ovirt := &fakeOvirt{disks: []internal.Disk{{Id: "disk1-id", Name: "pvc-1"}}}
+			p := NewOvirtProvisioner(ovirt, nil, nil)
+			p.(*ovirtProvisioner).identity = "me"
+			volume := volumeOfDisk("disk1-id")
+			volume.Annotations[annProvisionerID] = test.identity
+
+			err := p.Delete(volume)
+			if _, ignored := err.(*controller.IgnoredError); test.removed && err != nil || !test.removed && !ignored {
+				t.Errorf("expected the delete to be ignored %v, got %v", !test.removed, err)
+			}
+			if removed := len(ovirt.removed) > 0; removed != test.removed {
+				t.Errorf("expected the disk removed %v, got %v", test.removed, ovirt.removed)
+			}
+		})
+	}
+}
@@ -19,9 +19,12 @@ package main
 import (
 	"flag"
 	"os"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/kubernetes-incubator/external-storage/lib/controller"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/apimachinery/pkg/version"
 	"k8s.io/client-go/kubernetes"
@@ -37,8 +40,22 @@ import (
 const ProvisionerName = "ovirt-volume-provisioner"
 
 var (
-	master      = flag.String("master", "", "Master URL to build a client config from. Either this or kubeconfig needs to be set if the provisioner is being run out of cluster.")
-	kubeconfig  = flag.String("kubeconfig", "", "Absolute path to the kubeconfig file. Either this or master needs to be set if the provisioner is being run out of cluster.")
+	master         = flag.String("master", "", "Master URL to build a client config from. Either this or kubeconfig needs to be set if the provisioner is being run out of cluster.")
+	kubeconfig     = flag.String("kubeconfig", "", "Absolute path to the kubeconfig file. Either this or master needs to be set if the provisioner is being run out of cluster.")
+	nodeMapping    = flag.String("node-mapping", string(internal.MapBySystemUUID), "How the node selected for a WaitForFirstConsumer claim is mapped to its VM, as in the flex driver config")
+	nodeMappingKey = flag.String("node-mapping-key", "", "The annotation, label or custom property of the node mapping")
+	archiveSweep   = flag.Duration("archive-sweep-interval", time.Hour, "How often the archived disks are checked for the end of their retention")
+	reconcileEvery = flag.Duration("reconcile-interval", 10*time.Minute, "How often the disks are compared to the PVs to find orphaned disks and dangling PVs, 0 disables it")
+	orphanSearch   = flag.String("orphan-disk-search", "", "The engine search query of the disks created by the provisioner, by default the disks whose description holds its identity")
+	orphanGrace    = flag.Duration("orphan-disk-grace-period", 0, "How long a disk is an orphan before it is removed, 0 keeps the orphans")
+	metricsPort    = flag.Int("metrics-port", 0, "The port of the prometheus metrics, 0 disables them")
+	identity       = flag.String("identity", "", "The identity of the provisioner recorded on its PVs, by default the one generated and saved in the ConfigMap")
+	namespace      = flag.String("namespace", namespaceOfPod(), "The namespace of the ConfigMap of the identity and of the leader election, by default the one of the pod")
+	configMap      = flag.String("configmap", ProvisionerName, "The ConfigMap of the identity and of the leader election")
+	leaderElect    = flag.Bool("leader-elect", true, "Elect a leader among the replicas of the provisioner, only the leader provisions")
+	webhookAddr    = flag.String("webhook-addr", "", "Serve the validating admission webhook of the StorageClasses and claims on this address, like :8443, instead of provisioning")
+	tlsCertFile    = flag.String("tls-cert-file", "", "The certificate of the admission webhook")
+	tlsKeyFile     = flag.String("tls-private-key-file", "", "The private key of the certificate of the admission webhook")
 )
 
 func main() {
@@ -47,6 +64,15 @@ func main() {
 
 	glog.Infof("Provisioner %s specified", ProvisionerName)
 
+	if *webhookAddr != "" {
+		ovirtApi, err := newOvirt()
+		if err != nil {
+			glog.Fatalf("Failed to initialize ovirt client: %v", err)
+		}
+		err = serveWebhook(NewOvirtProvisioner(ovirtApi, nil, nil).(*ovirtProvisioner), *webhookAddr, *tlsCertFile, *tlsKeyFile)
+		glog.Fatalf("Failed serving the admission webhook: %v", err)
+	}
+
 	clientSet, serverVersion := getClientSet()
 	ovirtApi, err := newOvirt()
 	if err != nil {
@@ -54,17 +80,60 @@ func main() {
 	}
 	// Create the provisioner: it implements the Provisioner interface expected by
 	// the controller
-	ovirtProvisioner := NewOvirtProvisioner(ovirtApi)
-
-	// Start the provision controller which will dynamically provision NFS PVs
-	pc := controller.NewProvisionController(
-		clientSet,
-		ProvisionerName,
-		ovirtProvisioner,
-		serverVersion.GitVersion,
-	)
+	nodeMapper, err := internal.NewNodeMapper(
+		internal.NodeMappingConfig{Strategy: internal.MappingStrategy(*nodeMapping), Key: *nodeMappingKey},
+		ovirtApi,
+		func(nodeName string) (*v1.Node, error) {
+			return clientSet.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+		})
+	if err != nil {
+		glog.Fatalf("Failed to initialize the node mapping: %v", err)
+	}
+	provisioner := NewOvirtProvisioner(ovirtApi, clientSet, nodeMapper).(*ovirtProvisioner)
+	provisioner.identity, err = provisionerIdentity(clientSet, *namespace, *configMap, *identity)
+	if err != nil {
+		glog.Fatalf("Failed to initialize the identity of the provisioner: %v", err)
+	}
+	glog.Infof("The identity of the provisioner is %s", provisioner.identity)
+
+	// the leader provisions, deletes and cleans up, the other replicas wait to take over
+	run := func(stop <-chan struct{}) {
+		go wait.Until(func() {
+			provisioner.sweepArchive(time.Now())
+		}, *archiveSweep, stop)
+		if *reconcileEvery > 0 {
+			identityConfigMap := &v1.ObjectReference{Kind: "ConfigMap", APIVersion: "v1", Namespace: *namespace, Name: *configMap}
+			go wait.Until(newReconciler(provisioner, *orphanSearch, *orphanGrace, identityConfigMap).run, *reconcileEvery, stop)
+		}
+
+		// Start the provision controller which will dynamically provision NFS PVs
+		pc := controller.NewProvisionController(
+			clientSet,
+			ProvisionerName,
+			provisioner,
+			serverVersion.GitVersion,
+			controller.MetricsPort(int32(*metricsPort)),
+		)
+		pc.Run(stop)
+	}
+	if !*leaderElect {
+		run(wait.NeverStop)
+		return
+	}
+	candidate, err := os.Hostname()
+	if err != nil {
+		glog.Fatalf("Failed getting the hostname, the leader election candidate: %v", err)
+	}
+	runAsLeader(provisioner, *namespace, *configMap, candidate, run)
+}
 
-	pc.Run(wait.NeverStop)
+// namespaceOfPod returns the namespace of the pod of the provisioner, set as POD_NAMESPACE by
+// the downward API, or kube-system
+func namespaceOfPod() string {
+	if namespace, ok := os.LookupEnv("POD_NAMESPACE"); ok {
+		return namespace
+	}
+	return metav1.NamespaceSystem
 }
 func getClientSet() (kubernetes.Interface, version.Info) {
 	// Create the client according to whether we are running in or out-of-cluster
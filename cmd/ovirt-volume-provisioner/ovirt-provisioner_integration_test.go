@@ -34,5 +34,5 @@ func TestNewProivisioner(t *testing.T) {
 	if e != nil {
 		t.Error(e)
 	}
-	NewOvirtProvisioner(ovirt)
+	NewOvirtProvisioner(ovirt, nil, nil)
 }
@@ -0,0 +1,160 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/kubernetes-incubator/external-storage/lib/controller"
+
+	"github.com/ovirt/ovirt-openshift-extensions/internal"
+)
+
+// diskParameters parses the StorageClass parameters of the disk. It returns the options of
+// the new disk, and the flex volume options which the flex driver uses to attach it.
+// The storage domain of the disk is left for storageDomainFor to select.
+func diskParameters(options controller.VolumeOptions, sizeInBytes int64, thinProvisioning bool) (internal.DiskOptions, map[string]string, error) {
+	params := options.Parameters
+	diskOptions := internal.DiskOptions{
+		Name:             options.PVName,
+		SizeInBytes:      sizeInBytes,
+		ReadOnly:         false, // TODO support the PV Spec access mode?
+		ThinProvisioning: thinProvisioning,
+		Format:           internal.DiskFormat(params[parameterDiskFormat]),
+		DiskProfileId:    params[parameterDiskProfileId],
+		QuotaId:          params[parameterQuotaId],
+	}
+	attachOptions := map[string]string{}
+	var err error
+
+	if v, ok := params[parameterDiskInterface]; ok {
+		err = internal.ValidateDiskInterface(v)
+		if err != nil {
+			return diskOptions, nil, err
+		}
+		attachOptions[parameterDiskInterface] = v
+	}
+	if v, ok := params[parameterDiskPassDiscard]; ok {
+		passDiscard, err := parseBool(parameterDiskPassDiscard, v)
+		if err != nil {
+			return diskOptions, nil, err
+		}
+		attachOptions[parameterDiskPassDiscard] = strconv.FormatBool(passDiscard)
+	}
+	if v, ok := params[parameterDiskWipeAfterDelete]; ok {
+		diskOptions.WipeAfterDelete, err = parseBool(parameterDiskWipeAfterDelete, v)
+		if err != nil {
+			return diskOptions, nil, err
+		}
+	}
+	if v, ok := params[parameterDiskIncrementalBackup]; ok {
+		diskOptions.IncrementalBackup, err = parseBool(parameterDiskIncrementalBackup, v)
+		if err != nil {
+			return diskOptions, nil, err
+		}
+	}
+	if v, ok := params[parameterDiskQcowCompat]; ok {
+		diskOptions.QcowVersion, err = internal.QcowVersionOf(v)
+		if err != nil {
+			return diskOptions, nil, err
+		}
+	}
+	if v, ok := params[parameterDiskDescription]; ok {
+		diskOptions.Description, err = expandDescription(v, options)
+		if err != nil {
+			return diskOptions, nil, err
+		}
+	}
+	return diskOptions, attachOptions, diskOptions.Validate()
+}
+
+func parseBool(name string, value string) (bool, error) {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid value '%s' for parameter %s, expected true or false", value, name)
+	}
+	return b, nil
+}
+
+// expandDescription replaces ${pvc.namespace}, ${pvc.name} and ${pv.name} in the description template
+func expandDescription(template string, options controller.VolumeOptions) (string, error) {
+	return expandVariables(parameterDiskDescription, template,
+		"pvc.namespace", options.PVC.Namespace,
+		"pvc.name", options.PVC.Name,
+		"pv.name", options.PVName,
+	)
+}
+
+// expandVariables replaces the ${...} variables of the template of the parameter, given as pairs of
+// a variable name and its value. Any other ${...} is invalid.
+func expandVariables(parameter string, template string, variables ...string) (string, error) {
+	var names []string
+	var replacements []string
+	for i := 0; i < len(variables); i += 2 {
+		names = append(names, "${"+variables[i]+"}")
+		replacements = append(replacements, "${"+variables[i]+"}", variables[i+1])
+	}
+	expanded := strings.NewReplacer(replacements...).Replace(template)
+	if strings.Contains(expanded, "${") {
+		return "", fmt.Errorf("invalid parameter %s '%s', the supported variables are %s and %s",
+			parameter, template, strings.Join(names[:len(names)-1], ", "), names[len(names)-1])
+	}
+	return expanded, nil
+}
+
+const (
+	// defaultDiskNameTemplate names a disk after its PV
+	defaultDiskNameTemplate = "${pv.name}"
+	// maxDiskNameLength is the longest alias the engine accepts
+	maxDiskNameLength = 255
+)
+
+// invalidDiskNameChars are replaced in a disk name, the engine accepts only letters, digits, '.', '_' and '-'
+var invalidDiskNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// diskName expands the ovirtDiskNameTemplate parameter into the name of the disk of the claim. Besides
+// the variables of the description, ${cluster} and ${storageclass} are replaced by the cluster ID and
+// the StorageClass of the claim. The name is sanitized and truncated
+// to the constraints of the engine.
+func diskName(options controller.VolumeOptions, clusterId string) (string, error) {
+	template, ok := options.Parameters[parameterDiskNameTemplate]
+	if !ok {
+		template = defaultDiskNameTemplate
+	}
+	name, err := expandVariables(parameterDiskNameTemplate, template,
+		"cluster", clusterId,
+		"pvc.namespace", options.PVC.Namespace,
+		"pvc.name", options.PVC.Name,
+		"pv.name", options.PVName,
+		"storageclass", claimClass(options.PVC),
+	)
+	if err != nil {
+		return "", err
+	}
+	name = strings.Trim(invalidDiskNameChars.ReplaceAllString(name, "_"), "._-")
+	if len(name) > maxDiskNameLength {
+		name = strings.Trim(name[:maxDiskNameLength], "._-")
+	}
+	if name == "" {
+		return "", fmt.Errorf("invalid parameter %s '%s', the disk name of claim %s/%s is empty",
+			parameterDiskNameTemplate, template, options.PVC.Namespace, options.PVC.Name)
+	}
+	return name, nil
+}
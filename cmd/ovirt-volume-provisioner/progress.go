@@ -0,0 +1,95 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/ovirt/ovirt-openshift-extensions/internal"
+)
+
+const (
+	// annClaimDiskID is set on a claim to the id of its disk once the engine creates it, before its PV exists
+	annClaimDiskID = "ovirt.external-storage.incubator.kubernetes.io/DiskID"
+
+	// the reasons of the events of the progress of a claim
+	reasonStorageDomainSelected = "StorageDomainSelected"
+	reasonCreatingDisk          = "CreatingDisk"
+	reasonDiskLocked            = "DiskLocked"
+	reasonDiskReady             = "DiskReady"
+	reasonDiskAdopted           = "DiskAdopted"
+	reasonDiskCreationFailed    = "DiskCreationFailed"
+)
+
+// progress records a normal event of the claim, when there is a recorder
+func (p ovirtProvisioner) progress(claim *v1.PersistentVolumeClaim, reason string, messageFmt string, args ...interface{}) {
+	if p.recorder != nil {
+		p.recorder.Eventf(claimReference(claim), v1.EventTypeNormal, reason, messageFmt, args...)
+	}
+}
+
+// claimReference refers to the claim in its events, which may lack the self link the recorder needs otherwise
+func claimReference(claim *v1.PersistentVolumeClaim) *v1.ObjectReference {
+	return &v1.ObjectReference{Kind: "PersistentVolumeClaim", APIVersion: "v1", Namespace: claim.Namespace, Name: claim.Name,
+		UID: claim.UID, ResourceVersion: claim.ResourceVersion}
+}
+
+// diskCreated records the status of the new disk of the claim, and annotates the claim with its id
+func (p ovirtProvisioner) diskCreated(claim *v1.PersistentVolumeClaim, disk internal.Disk) {
+	if disk.Status == "ok" {
+		p.progress(claim, reasonDiskReady, "Disk %s (%s) is ready", disk.Name, disk.Id)
+	} else {
+		p.progress(claim, reasonDiskLocked, "Disk %s (%s) is %s, the engine is still preparing it", disk.Name, disk.Id, disk.Status)
+	}
+	p.annotateDiskId(claim, disk.Id)
+}
+
+// annotateDiskId sets the id of the disk of the claim on the claim. It only informs the users, a
+// failure is logged.
+func (p ovirtProvisioner) annotateDiskId(claim *v1.PersistentVolumeClaim, diskId string) {
+	if p.client == nil || claim.Annotations[annClaimDiskID] == diskId {
+		return
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": map[string]string{annClaimDiskID: diskId}},
+	})
+	if err == nil {
+		_, err = p.client.CoreV1().PersistentVolumeClaims(claim.Namespace).Patch(claim.Name, types.MergePatchType, patch)
+	}
+	if err != nil {
+		glog.Warningf("Failed annotating claim %s/%s with disk %s: %v", claim.Namespace, claim.Name, diskId, err)
+	}
+}
+
+// diskFailed records the failure to create the disk of the claim, with the detail of the fault
+// of the engine, and returns the error
+func (p ovirtProvisioner) diskFailed(claim *v1.PersistentVolumeClaim, diskName string, err error) error {
+	if p.recorder == nil {
+		return err
+	}
+	message := fmt.Sprintf("Failed creating disk %s: %s", diskName, err)
+	if fault, ok := err.(internal.Fault); ok && fault.Detail != "" {
+		message = fmt.Sprintf("The engine failed creating disk %s: %s, %s", diskName, fault.Reason, fault.Detail)
+	}
+	p.recorder.Event(claimReference(claim), v1.EventTypeWarning, reasonDiskCreationFailed, message)
+	return err
+}
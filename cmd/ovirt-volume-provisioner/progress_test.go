@@ -0,0 +1,140 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/ovirt/ovirt-openshift-extensions/internal"
+)
+
+// faultyOvirt fails the creation of disks like the engine
+type faultyOvirt struct {
+	*fakeOvirt
+}
+
+func (f faultyOvirt) CreateUnattachedDisk(options internal.DiskOptions) (internal.Disk, error) {
+	return internal.Disk{}, internal.Fault{Status: "400 Bad Request", Code: http.StatusBadRequest, Reason: "Operation Failed",
+		Detail: "[Cannot add Virtual Disk. Low disk space on Storage Domain data1.]"}
+}
+
+// kubeWithClaim serves the claim default/claim, and records its patches
+func kubeWithClaim(t *testing.T, patches *[]string) (kubernetes.Interface, func()) {
+	return kubeWithRoutes(t, map[string]http.HandlerFunc{
+		"/api/v1/namespaces/default/persistentvolumeclaims/claim": func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPatch {
+				body, _ := ioutil.ReadAll(r.Body)
+				*patches = append(*patches, string(body))
+			}
+			fmt.Fprint(w, `{"kind": "PersistentVolumeClaim", "apiVersion": "v1", "metadata": {"name": "claim", "namespace": "default"}}`)
+		},
+	})
+}
+
+// eventsOf returns the reasons of the recorded events
+func eventsOf(recorder *record.FakeRecorder) string {
+	var reasons []string
+	for {
+		select {
+		case event := <-recorder.Events:
+			reasons = append(reasons, strings.Fields(event)[1])
+		default:
+			return strings.Join(reasons, ",")
+		}
+	}
+}
+
+func TestProvisionProgress(t *testing.T) {
+	tests := []struct {
+		name   string
+		status string
+		events string
+	}{
+		{"ready disk", "ok", "StorageDomainSelected,CreatingDisk,DiskReady"},
+		{"locked disk", "locked", "StorageDomainSelected,CreatingDisk,DiskLocked"},
+	}
+	for _, test := range tests {
+		var patches []string
+		client, stop := kubeWithClaim(t, &patches)
+		ovirt := newFakeOvirt()
+		ovirt.status = test.status
+		p := NewOvirtProvisioner(ovirt, client, nil)
+		recorder := record.NewFakeRecorder(10)
+		p.(*ovirtProvisioner).recorder = recorder
+
+		_, err := p.Provision(volumeOptions(map[string]string{}, nil))
+		stop()
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if events := eventsOf(recorder); events != test.events {
+			t.Errorf("%s: expected the events %s, got %s", test.name, test.events, events)
+		}
+		expected := `{"metadata":{"annotations":{"` + annClaimDiskID + `":"new"}}}`
+		if len(patches) != 1 || patches[0] != expected {
+			t.Errorf("%s: expected the claim to be annotated with the disk, got %v", test.name, patches)
+		}
+	}
+}
+
+func TestProvisionFailureDetail(t *testing.T) {
+	p := NewOvirtProvisioner(faultyOvirt{newFakeOvirt()}, nil, nil)
+	recorder := record.NewFakeRecorder(10)
+	p.(*ovirtProvisioner).recorder = recorder
+
+	_, err := p.Provision(volumeOptions(map[string]string{}, nil))
+	if err == nil {
+		t.Fatal("expected the engine to fail the provisioning")
+	}
+	<-recorder.Events
+	<-recorder.Events
+	expected := "Warning DiskCreationFailed The engine failed creating disk pvc-1: Operation Failed, [Cannot add Virtual Disk. Low disk space on Storage Domain data1.]"
+	if event := <-recorder.Events; event != expected {
+		t.Errorf("expected event %q, got %q", expected, event)
+	}
+}
+
+func TestProvisionAdoptionProgress(t *testing.T) {
+	var patches []string
+	client, stop := kubeWithClaim(t, &patches)
+	defer stop()
+	ovirt := newFakeOvirt()
+	adopted := ofClaim(internal.Disk{Id: "adopted", Name: "pvc-1", Status: "ok", ProvisionedSize: gib}, claimUID)
+	adopted.StorageDomains.Domains = []internal.StorageDomain{{Id: "data1-id"}}
+	ovirt.disks = append(ovirt.disks, adopted)
+	p := NewOvirtProvisioner(ovirt, client, nil)
+	recorder := record.NewFakeRecorder(10)
+	p.(*ovirtProvisioner).recorder = recorder
+
+	_, err := p.Provision(claimOptions(map[string]string{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if events := eventsOf(recorder); events != reasonDiskAdopted {
+		t.Errorf("expected the adoption event, got %s", events)
+	}
+	if len(patches) != 1 || !strings.Contains(patches[0], `"adopted"`) {
+		t.Errorf("expected the claim to be annotated with the adopted disk, got %v", patches)
+	}
+}
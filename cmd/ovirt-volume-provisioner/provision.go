@@ -18,7 +18,6 @@ package main
 
 import (
 	"fmt"
-	"strconv"
 
 	"github.com/golang/glog"
 	"github.com/kubernetes-incubator/external-storage/lib/controller"
@@ -26,6 +25,11 @@ import (
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/kubernetes/pkg/kubelet/apis"
 
 	"github.com/ovirt/ovirt-openshift-extensions/internal"
@@ -38,41 +42,99 @@ const (
 	// are we allowed to set this? else make up our own
 	annCreatedBy = "kubernetes.io/createdby"
 	createdBy    = "ovirt-provisioner"
-	annVolumeID = "ovirt.external-storage.incubator.kubernetes.io/VolumeID"
+	annVolumeID = internal.AnnVolumeID
 	annProvisionerID = "Provisioner_Id"
 
 	parameterStorageDomainName = "ovirtStorageDomain"
 	parameterDiskThinProvisioning = "ovirtDiskThinProvisioning"
 	parameterFsType = "fsType"
+
+	// the properties of the disk and of its attachment, see diskParameters
+	parameterDiskInterface         = "ovirtDiskInterface"
+	parameterDiskProfileId         = "ovirtDiskProfileId"
+	parameterDiskWipeAfterDelete   = "ovirtDiskWipeAfterDelete"
+	parameterDiskPassDiscard       = "ovirtDiskPassDiscard"
+	parameterDiskFormat            = "ovirtDiskFormat"
+	parameterDiskQcowCompat        = "ovirtDiskQcowCompat"
+	parameterDiskDescription       = "ovirtDiskDescription"
+	parameterDiskNameTemplate      = "ovirtDiskNameTemplate"
+	parameterQuotaId               = "ovirtQuotaId"
+	parameterDiskIncrementalBackup = "ovirtDiskIncrementalBackup"
+
+	// the disk a volume is a copy of, set as StorageClass parameters or as claim annotations
+	parameterSourceDiskId   = "ovirtSourceDiskId"
+	parameterSourceDiskName = "ovirtSourceDiskName"
+	parameterSourceTemplate = "ovirtSourceTemplate"
+
+	// the annotations and the labels of a provisioned PV, besides the id of its disk
+	annStorageDomain   = internal.AnnStorageDomain
+	annEngineUrl       = "ovirt.external-storage.incubator.kubernetes.io/EngineUrl"
+	labelStorageDomain = "ovirt.external-storage.incubator.kubernetes.io/storage-domain"
+	labelDataCenter    = "ovirt.external-storage.incubator.kubernetes.io/data-center"
+
+	// the flex options which locate the disk of a provisioned PV, see internal.AttachRequest
+	flexOptionVolumeId      = "volumeID"
+	flexOptionStorageDomain = "ovirtStorageDomain"
+	flexOptionEngineUrl     = "ovirtEngineUrl"
 )
 
 // NewOvirtProvisioner creates a new Ovirt provisioner
-func NewOvirtProvisioner(ovirtApi internal.OvirtApi) controller.Provisioner {
-	var identity types.UID
+// The node mapper resolves the node selected by the scheduler to its VM, it may be nil.
+func NewOvirtProvisioner(ovirtApi internal.OvirtApi, client kubernetes.Interface, nodeMapper *internal.NodeMapper) controller.Provisioner {
 	provisioner := &ovirtProvisioner{
-		ovirtApi: ovirtApi,
-		identity: identity,
+		ovirtApi:    ovirtApi,
+		client:      client,
+		nodeMapper:  nodeMapper,
+		roundRobin:  new(uint64),
+		validations: newClassValidations(),
+		clusterId:   ovirtApi.GetConnectionDetails().ClusterId,
+	}
+	if client != nil {
+		broadcaster := record.NewBroadcaster()
+		broadcaster.StartRecordingToSink(&corev1.EventSinkImpl{Interface: client.CoreV1().Events(v1.NamespaceAll)})
+		provisioner.recorder = broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: ProvisionerName})
 	}
 	return provisioner
 }
 
 type ovirtProvisioner struct {
-	ovirtApi internal.OvirtApi
+	ovirtApi   internal.OvirtApi
+	client     kubernetes.Interface
+	nodeMapper *internal.NodeMapper
+	// identity is recorded on the PVs of the provisioner, see provisionerIdentity
 	identity types.UID
+	// roundRobin counts the volumes placed by the roundRobin storage domain policy
+	roundRobin *uint64
+	// validations caches the validations of the StorageClasses of the claims, see ShouldProvision
+	validations *classValidations
+	// recorder records the rejections of claims, it is nil without a kubernetes client
+	recorder record.EventRecorder
+	// clusterId marks the disks of the cluster, the provisioner leaves the disks of other clusters alone
+	clusterId string
 }
 
 // Provision creates a volume i.e. the storage asset and returns a PV object for
 // the volume.
 func (p ovirtProvisioner) Provision(options controller.VolumeOptions) (*v1.PersistentVolume, error) {
 	// call ovirt api, create an unattached disk
-	capacity := options.PVC.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)]
-	volSizeBytes := capacity.Value()
+	volSizeBytes, err := volumeSize(options)
+	if err != nil {
+		return nil, p.rejected(options.PVC, invalidParameters(err))
+	}
+	err = p.checkNamespaceCapacity(options, volSizeBytes)
+	if err != nil {
+		return nil, p.rejected(options.PVC, err)
+	}
 	fsType, exists := options.Parameters[parameterFsType]
 	if !exists || fsType == "" {
 		fsType = "ext4"
 	}
+	err = validateFsType(fsType)
+	if err != nil {
+		return nil, p.rejected(options.PVC, invalidParameters(err))
+	}
 
-	glog.Infof("About to provision a disk name: %s domain: %s size: %v thin provisioned: %s file system: %s",
+	glog.Infof("About to provision a disk of PV: %s domain: %s size: %v thin provisioned: %s file system: %s",
 		options.PVName,
 		options.Parameters[parameterStorageDomainName],
 		volSizeBytes,
@@ -80,40 +142,302 @@ func (p ovirtProvisioner) Provision(options controller.VolumeOptions) (*v1.Persi
 		fsType,
 	)
 
-	thinProvisioning := true
-	val, ok := options.Parameters[parameterDiskThinProvisioning]
-	if ok {
-		b, e := strconv.ParseBool(val)
-		if e != nil {
-			glog.Warningf("wrong value for parameter %s. Using default %v", parameterDiskThinProvisioning, thinProvisioning)
-		} else {
-			thinProvisioning = b
-		}
+	thinProvisioning, err := thinProvisioningParameter(options.Parameters)
+	if err != nil {
+		return nil, p.rejected(options.PVC, invalidParameters(err))
 	}
 
-	vol, err := p.ovirtApi.CreateUnattachedDisk(
-		options.PVName,
-		options.Parameters[parameterStorageDomainName],
-		volSizeBytes,
-		false, // TODO support the PV Spec access mode?
-		thinProvisioning,
-	)
+	diskOptions, attachOptions, err := diskParameters(options, volSizeBytes, thinProvisioning)
+	if err != nil {
+		return nil, p.rejected(options.PVC, invalidParameters(err))
+	}
+	diskOptions.Name, err = diskName(options, p.clusterId)
+	if err != nil {
+		return nil, p.rejected(options.PVC, invalidParameters(err))
+	}
+	// the reclaim parameters are used by Delete, a volume which can't be deleted isn't created
+	_, err = reclaimParameters(options.Parameters)
+	if err != nil {
+		return nil, p.rejected(options.PVC, invalidParameters(err))
+	}
+	topologies, err := p.volumeTopologies(options)
+	if err != nil {
+		return nil, p.rejected(options.PVC, invalidParameters(err))
+	}
+	selector, err := domainSelectorFrom(options.Parameters)
+	if err != nil {
+		return nil, p.rejected(options.PVC, invalidParameters(err))
+	}
+	backReference := internal.BackReference{
+		ClusterId:     p.clusterId,
+		Provisioner:   string(p.identity),
+		Namespace:     options.PVC.Namespace,
+		Claim:         options.PVC.Name,
+		ClaimUID:      string(options.PVC.UID),
+		Volume:        options.PVName,
+		StorageClass:  claimClass(options.PVC),
+		ReclaimPolicy: string(options.PersistentVolumeReclaimPolicy),
+	}
+	diskOptions.Description = internal.WithBackReference(diskOptions.Description, backReference)
+
+	// the disk of the claim may exist already, when the provisioner restarted before saving its PV
+	vol, storageDomain, topology, err := p.existingDisk(diskOptions.Name, options.PVC.UID, selector, volSizeBytes, topologies)
 	if err != nil {
 		return nil, err
 	}
+	if vol.Id == "" {
+		storageDomain, topology, err = p.storageDomainFor(selector, volSizeBytes, topologies)
+		if err != nil {
+			return nil, p.rejected(options.PVC, err)
+		}
+		err = p.checkQuota(diskOptions.QuotaId, storageDomain, topology, volSizeBytes)
+		if err != nil {
+			return nil, p.rejected(options.PVC, err)
+		}
+		p.progress(options.PVC, reasonStorageDomainSelected, "Selected storage domain %s of data center %s by policy %s",
+			storageDomain.Name, topology.Region, selector.policy)
+		diskOptions.StorageDomain = storageDomain.Name
+
+		p.progress(options.PVC, reasonCreatingDisk, "Creating disk %s of %s on storage domain %s",
+			diskOptions.Name, resource.NewQuantity(volSizeBytes, resource.BinarySI), storageDomain.Name)
+		vol, err = p.createDisk(options, diskOptions)
+		if err != nil {
+			return nil, p.diskFailed(options.PVC, diskOptions.Name, err)
+		}
+		p.diskCreated(options.PVC, vol)
+	} else {
+		p.progress(options.PVC, reasonDiskAdopted, "Adopted disk %s (%s) created by an earlier attempt", vol.Name, vol.Id)
+		p.annotateDiskId(options.PVC, vol.Id)
+	}
 
-	pv := pvFromDisk(p.identity, vol, options, fsType)
+	// the first mount of a new empty disk makes its file system, only a volume with data is attached read only
+	attachReadOnly := readOnly(options.PVC.Spec.AccessModes)
+	if attachReadOnly {
+		attachReadOnly, err = p.hasSource(options)
+		if err != nil {
+			return nil, err
+		}
+	}
+	pv := p.pvFromDisk(vol, storageDomain, topology, options, fsType, attachOptions, volSizeBytes, attachReadOnly)
+	if topology.Region != "" {
+		pv.Labels[apis.LabelZoneRegion] = topology.Region
+		// a volume of a topology aware claim can be used only by the nodes of its data center
+		if topologies != nil {
+			pv.Spec.NodeAffinity = nodeAffinity(topology)
+		}
+	}
 	return pv, nil
 }
 
+// createDisk creates the disk of the volume, empty or out of the data source of the claim.
+// A copy keeps the format and the properties of its source, only the new empty disk gets all the options.
+// Every disk is made with the description, which marks the disk of the claim, so a disk the engine
+// made before the provisioner died is adopted by the next attempt.
+func (p ovirtProvisioner) createDisk(options controller.VolumeOptions, diskOptions internal.DiskOptions) (internal.Disk, error) {
+	storageDomain := diskOptions.StorageDomain
+	sizeInBytes := diskOptions.SizeInBytes
+	thinProvisioning := diskOptions.ThinProvisioning
+	dataSource, err := p.dataSource(options.PVC)
+	if err != nil {
+		return internal.Disk{}, err
+	}
+	sourceDiskId, err := p.sourceDisk(options)
+	if err != nil {
+		return internal.Disk{}, err
+	}
+
+	switch {
+	case sourceDiskId != "":
+		if dataSource != nil {
+			return internal.Disk{}, fmt.Errorf("a volume with a source disk can't have a data source")
+		}
+		glog.Infof("Copying disk %s to disk %s", sourceDiskId, diskOptions.Name)
+		return p.ovirtApi.CopyDisk(sourceDiskId, diskOptions.Name, diskOptions.Description, storageDomain, sizeInBytes, thinProvisioning)
+	case dataSource == nil:
+		return p.ovirtApi.CreateUnattachedDisk(diskOptions)
+	case dataSource.Kind == "VolumeSnapshot":
+		snapshot, err := p.snapshotSource(options.PVC, dataSource, sizeInBytes)
+		if err != nil {
+			return internal.Disk{}, err
+		}
+		if snapshot.KeptAsDisk() {
+			glog.Infof("Restoring disk %s from snapshot disk %s", diskOptions.Name, snapshot.DiskId)
+			return p.ovirtApi.CopyDisk(snapshot.DiskId, diskOptions.Name, diskOptions.Description, storageDomain, sizeInBytes, thinProvisioning)
+		}
+		glog.Infof("Restoring disk %s from snapshot %s of disk %s", diskOptions.Name, snapshot.Id, snapshot.DiskId)
+		return p.ovirtApi.RestoreDiskSnapshot(*snapshot, diskOptions.Name, diskOptions.Description, storageDomain, sizeInBytes, thinProvisioning)
+	default:
+		diskId, err := p.cloneSource(options.PVC, dataSource)
+		if err != nil {
+			return internal.Disk{}, err
+		}
+		glog.Infof("Cloning disk %s of PVC %s/%s to disk %s", diskId, options.PVC.Namespace, dataSource.Name, diskOptions.Name)
+		return p.ovirtApi.CopyDisk(diskId, diskOptions.Name, diskOptions.Description, storageDomain, sizeInBytes, thinProvisioning)
+	}
+}
+
+// sourceDisk returns the id of the disk to copy into the volume, or "" for an empty volume.
+// The source is set by the claim annotations, or else by the StorageClass parameters:
+// a disk id, a disk name, or a template with a single disk or with a disk of that name.
+func (p ovirtProvisioner) sourceDisk(options controller.VolumeOptions) (string, error) {
+	source := options.Parameters
+	for _, key := range []string{parameterSourceDiskId, parameterSourceDiskName, parameterSourceTemplate} {
+		if options.PVC.Annotations[key] != "" {
+			source = options.PVC.Annotations
+			break
+		}
+	}
+	diskId := source[parameterSourceDiskId]
+	diskName := source[parameterSourceDiskName]
+	template := source[parameterSourceTemplate]
+
+	var candidates []internal.Disk
+	switch {
+	case diskId != "":
+		if diskName != "" || template != "" {
+			return "", fmt.Errorf("%s can't be set with %s or %s", parameterSourceDiskId, parameterSourceDiskName, parameterSourceTemplate)
+		}
+		return diskId, nil
+	case template != "":
+		disks, err := p.ovirtApi.GetTemplateDisks(template)
+		if err != nil {
+			return "", fmt.Errorf("failed getting the disks of template %s: %s", template, err)
+		}
+		if diskName == "" && len(disks) > 1 {
+			return "", fmt.Errorf("template %s has %d disks, set %s to choose one", template, len(disks), parameterSourceDiskName)
+		}
+		candidates = disks
+	case diskName != "":
+		result, err := p.ovirtApi.GetDiskByName(diskName)
+		if err != nil {
+			return "", err
+		}
+		candidates = result.Disks
+	default:
+		return "", nil
+	}
+
+	var found []internal.Disk
+	for _, d := range candidates {
+		if diskName == "" || d.Name == diskName {
+			found = append(found, d)
+		}
+	}
+	switch len(found) {
+	case 0:
+		if template != "" {
+			return "", fmt.Errorf("template %s has no disk named %s", template, diskName)
+		}
+		return "", fmt.Errorf("source disk %s not found", diskName)
+	case 1:
+		return found[0].Id, nil
+	default:
+		return "", fmt.Errorf("there are %d disks named %s, set %s instead", len(found), diskName, parameterSourceDiskId)
+	}
+}
+
+// dataSource returns the supported data source of the claim, a VolumeSnapshot or a
+// PersistentVolumeClaim, or nil when the claim has none
+func (p ovirtProvisioner) dataSource(claim *v1.PersistentVolumeClaim) (*internal.TypedReference, error) {
+	if p.client == nil {
+		return nil, nil
+	}
+	dataSource, err := internal.DataSourceOf(p.client.CoreV1().RESTClient(), claim)
+	if err != nil || dataSource == nil {
+		return nil, err
+	}
+	apiGroup := ""
+	if dataSource.APIGroup != nil {
+		apiGroup = *dataSource.APIGroup
+	}
+	switch {
+	case dataSource.Kind == "VolumeSnapshot" && (apiGroup == "" || apiGroup == internal.SnapshotGroup):
+	case dataSource.Kind == "PersistentVolumeClaim" && apiGroup == "":
+	default:
+		return nil, fmt.Errorf("unsupported data source %s %s", dataSource.Kind, dataSource.Name)
+	}
+	return dataSource, nil
+}
+
+// cloneSource returns the disk id of the PVC the claim is cloned from
+func (p ovirtProvisioner) cloneSource(claim *v1.PersistentVolumeClaim, dataSource *internal.TypedReference) (string, error) {
+	source, err := p.client.CoreV1().PersistentVolumeClaims(claim.Namespace).Get(dataSource.Name, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	if source.Status.Phase != v1.ClaimBound || source.Spec.VolumeName == "" {
+		return "", fmt.Errorf("PVC %s/%s is not bound", source.Namespace, source.Name)
+	}
+	pv, err := p.client.CoreV1().PersistentVolumes().Get(source.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	diskId := pv.Annotations[annVolumeID]
+	if diskId == "" {
+		return "", fmt.Errorf("PV %s of PVC %s/%s was not provisioned by %s", pv.Name, source.Namespace, source.Name, ProvisionerName)
+	}
+	return diskId, nil
+}
+
+// snapshotSource returns the oVirt snapshot of the VolumeSnapshot the claim is restored from
+func (p ovirtProvisioner) snapshotSource(claim *v1.PersistentVolumeClaim, dataSource *internal.TypedReference, sizeInBytes int64) (*internal.Snapshot, error) {
+	snapshots := internal.NewSnapshotClient(p.client.CoreV1().RESTClient())
+	volumeSnapshot, err := snapshots.GetVolumeSnapshot(claim.Namespace, dataSource.Name)
+	if err != nil {
+		return nil, err
+	}
+	if !volumeSnapshot.Status.ReadyToUse {
+		return nil, fmt.Errorf("volume snapshot %s/%s is not ready", claim.Namespace, dataSource.Name)
+	}
+	content, err := snapshots.GetVolumeSnapshotContent(volumeSnapshot.Spec.SnapshotContentName)
+	if err != nil {
+		return nil, err
+	}
+	if content.Spec.CSI == nil || content.Spec.CSI.Driver != ProvisionerName {
+		return nil, fmt.Errorf("volume snapshot %s/%s was not taken by %s", claim.Namespace, dataSource.Name, ProvisionerName)
+	}
+	if content.Spec.CSI.RestoreSize != nil && *content.Spec.CSI.RestoreSize > sizeInBytes {
+		return nil, fmt.Errorf("the requested size %d is smaller than the size %d of volume snapshot %s/%s",
+			sizeInBytes, *content.Spec.CSI.RestoreSize, claim.Namespace, dataSource.Name)
+	}
+	snapshot, err := internal.SnapshotFromHandle(content.Spec.CSI.SnapshotHandle)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
 // pvFromDisk takes an ovirt disk details and created a PersistentVolume object
-func pvFromDisk(provisionerId types.UID, disk internal.Disk, options controller.VolumeOptions, fsType string) *v1.PersistentVolume {
+// The flex options are passed to the flex driver on attach, with the id of the disk, its storage
+// domain and the engine. The capacity is the size of the disk, or the requested size when the
+// engine doesn't report it yet.
+func (p ovirtProvisioner) pvFromDisk(disk internal.Disk, domain internal.StorageDomain, topology internal.Topology,
+	options controller.VolumeOptions, fsType string, flexOptions map[string]string, sizeInBytes int64, readOnly bool) *v1.PersistentVolume {
+	engineUrl := p.ovirtApi.GetConnectionDetails().Url
 	annotations := make(map[string]string)
 	annotations[annCreatedBy] = createdBy
-	annotations[annProvisionerID] = string(provisionerId)
+	annotations[annProvisionerID] = string(p.identity)
 	annotations[annVolumeID] = disk.Id
+	annotations[annStorageDomain] = domain.Name
+	annotations[annEngineUrl] = engineUrl
 	labels := make(map[string]string)
-	labels[apis.LabelZoneFailureDomain] = "" // TODO A Zone is ovirt cluster?
+	for key, value := range map[string]string{labelStorageDomain: domain.Name, labelDataCenter: topology.Region} {
+		// oVirt names are valid label values, unless they are too long
+		if value != "" && len(validation.IsValidLabelValue(value)) == 0 {
+			labels[key] = value
+		}
+	}
+
+	if flexOptions == nil {
+		flexOptions = make(map[string]string)
+	}
+	flexOptions[flexOptionVolumeId] = disk.Id
+	flexOptions[flexOptionStorageDomain] = domain.Name
+	flexOptions[flexOptionEngineUrl] = engineUrl
+
+	if disk.ProvisionedSize > 0 {
+		sizeInBytes = int64(disk.ProvisionedSize)
+	}
 
 	pv := &v1.PersistentVolume{
 		ObjectMeta: metav1.ObjectMeta{
@@ -125,15 +449,16 @@ func pvFromDisk(provisionerId types.UID, disk internal.Disk, options controller.
 
 			PersistentVolumeReclaimPolicy: options.PersistentVolumeReclaimPolicy,
 			AccessModes:                   options.PVC.Spec.AccessModes,
+			MountOptions:                  options.MountOptions,
 			Capacity: v1.ResourceList{
-				v1.ResourceName(v1.ResourceStorage): *resource.NewQuantity(int64(disk.ProvisionedSize), "gi"),
+				v1.ResourceName(v1.ResourceStorage): *resource.NewQuantity(sizeInBytes, resource.BinarySI),
 			},
 			PersistentVolumeSource: v1.PersistentVolumeSource{
 
 				FlexVolume: &v1.FlexPersistentVolumeSource{
 					Driver:   fmt.Sprintf("%s/%s", flexvolumeVendor, flexvolumeDriver),
-					Options:  map[string]string{},
-					ReadOnly: false, // TODO support PV spec access mode?
+					Options:  flexOptions,
+					ReadOnly: readOnly,
 					FSType:   fsType,
 				},
 			},
@@ -142,11 +467,64 @@ func pvFromDisk(provisionerId types.UID, disk internal.Disk, options controller.
 	return pv
 }
 
-// Provision creates a volume i.e. the storage asset and returns a PV object for
-// the volume.
+// hasSource tells if the volume is made out of a source disk or a data source, rather than an empty disk
+func (p ovirtProvisioner) hasSource(options controller.VolumeOptions) (bool, error) {
+	sourceDiskId, err := p.sourceDisk(options)
+	if err != nil || sourceDiskId != "" {
+		return sourceDiskId != "", err
+	}
+	dataSource, err := p.dataSource(options.PVC)
+	return dataSource != nil, err
+}
+
+// readOnly tells if the volume is attached read only, when it can only be mounted read only
+func readOnly(accessModes []v1.PersistentVolumeAccessMode) bool {
+	for _, mode := range accessModes {
+		if mode != v1.ReadOnlyMany {
+			return false
+		}
+	}
+	return len(accessModes) > 0
+}
+
+// Delete removes the disk of the volume, or archives it when the StorageClass says so. The disk is
+// detached from the VMs which don't use it anymore first, a disk in use by a running VM fails the
+// delete. A disk which is already gone is deleted. The volumes of other provisioners are ignored.
 func (p ovirtProvisioner) Delete(volume *v1.PersistentVolume) error {
+	if !p.owns(volume) {
+		return notOwned(volume, p.identity)
+	}
 	glog.Infof("About to delete disk %s id %s", volume.Name, volume.Annotations[annVolumeID])
-	// Remove the disk from the storage domain - TODO consider wipe-after-delete and the rest of the options later
-	_, err := p.ovirtApi.Delete("disks/" + volume.Annotations[annVolumeID])
-	return err
+	disk, err := p.diskOfVolume(volume)
+	if err != nil {
+		return err
+	}
+	if disk.Id == "" {
+		glog.Infof("The disk of volume %s doesn't exist anymore", volume.Name)
+		return nil
+	}
+	params, err := p.classParameters(volume)
+	if err != nil {
+		return err
+	}
+	reclaim, err := reclaimParameters(params)
+	if err != nil {
+		return err
+	}
+
+	err = p.detachForDelete(disk)
+	if err != nil {
+		return err
+	}
+	if reclaim.archive {
+		return p.archiveDisk(volume, disk, reclaim)
+	}
+	if reclaim.wipeAfterDelete && !disk.WipeAfterDelete {
+		wipe := true
+		_, err = p.ovirtApi.UpdateDisk(disk.Id, internal.DiskUpdate{WipeAfterDelete: &wipe})
+		if err != nil {
+			return err
+		}
+	}
+	return p.removeDisk(disk.Id)
 }
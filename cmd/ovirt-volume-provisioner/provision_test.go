@@ -0,0 +1,486 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kubernetes-incubator/external-storage/lib/controller"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/ovirt/ovirt-openshift-extensions/internal"
+)
+
+// fakeOvirt implements the disk calls of the provisioner, any other call panics
+type fakeOvirt struct {
+	internal.OvirtApi
+	disks     []internal.Disk
+	templates map[string][]internal.Disk
+	copiedId  string
+	created   bool
+	options   internal.DiskOptions
+	// the data centers, their clusters and storage domains, see newFakeOvirt
+	dataCenters map[string][]internal.StorageDomain
+	clusters    []internal.Cluster
+	vms         map[string]string
+	// dataCenterLookups counts the lookups of the data centers, see validation_test.go
+	dataCenterLookups int
+	// quotas are the storage limits of the quotas, which the data centers enforce when set
+	quotas map[string][]internal.QuotaStorageLimit
+	// the attachments and the status of the VMs, and the changes made to the disks, see reclaim_test.go
+	attachments map[string]*internal.DiskAttachment
+	vmStatus    map[string]string
+	busy        bool
+	removed     []string
+	updates     []internal.DiskUpdate
+	movedTo     string
+	// the disks the engine creates are added to the disks, with the status when set, and their
+	// creation fails when crash is set as if the provisioner died, see adopt_test.go. With crashBefore
+	// the provisioner dies before the engine gets the disk.
+	status      string
+	crash       bool
+	crashBefore bool
+	// clusterId is the cluster ID of the provisioner, see cluster_test.go
+	clusterId string
+}
+
+func (f *fakeOvirt) GetConnectionDetails() internal.Connection {
+	return internal.Connection{Url: engineUrl, ClusterId: f.clusterId}
+}
+
+func (f *fakeOvirt) GetDiskByName(diskName string) (internal.DiskResult, error) {
+	return internal.DiskResult{Disks: f.disks}, nil
+}
+
+func (f *fakeOvirt) GetTemplateDisks(templateName string) ([]internal.Disk, error) {
+	disks, ok := f.templates[templateName]
+	if !ok {
+		return nil, internal.ErrNotExist
+	}
+	return disks, nil
+}
+
+func (f *fakeOvirt) CopyDisk(diskId string, diskName string, diskDescription string, storageDomainName string, sizeInBytes int64, thinProvisioning bool) (internal.Disk, error) {
+	f.copiedId = diskId
+	if f.crashBefore {
+		return internal.Disk{}, fmt.Errorf("the provisioner died")
+	}
+	return f.engineCreates(internal.Disk{Id: "copy", Name: diskName, ProvisionedSize: uint64(sizeInBytes), Description: diskDescription}, storageDomainName)
+}
+
+func (f *fakeOvirt) CreateUnattachedDisk(options internal.DiskOptions) (internal.Disk, error) {
+	if f.crashBefore {
+		return internal.Disk{}, fmt.Errorf("the provisioner died")
+	}
+	f.created = true
+	f.options = options
+	disk := internal.Disk{Id: "new", Name: options.Name, ProvisionedSize: uint64(options.SizeInBytes), Description: options.Description}
+	return f.engineCreates(disk, options.StorageDomain)
+}
+
+// engineCreates adds the disk to the disks of the engine
+func (f *fakeOvirt) engineCreates(disk internal.Disk, storageDomainName string) (internal.Disk, error) {
+	disk.Status = "ok"
+	if f.status != "" {
+		disk.Status = f.status
+	}
+	disk.StorageDomains.Domains = []internal.StorageDomain{{Id: storageDomainName + "-id"}}
+	f.disks = append(f.disks, disk)
+	if f.crash {
+		return internal.Disk{}, fmt.Errorf("the provisioner died")
+	}
+	return disk, nil
+}
+
+func (f *fakeOvirt) GetDataCenters() ([]internal.DataCenter, error) {
+	f.dataCenterLookups++
+	var dataCenters []internal.DataCenter
+	for id := range f.dataCenters {
+		dc, _ := f.GetDataCenter(id)
+		dataCenters = append(dataCenters, dc)
+	}
+	return dataCenters, nil
+}
+
+func (f *fakeOvirt) GetDataCenter(dataCenterId string) (internal.DataCenter, error) {
+	if _, ok := f.dataCenters[dataCenterId]; !ok {
+		return internal.DataCenter{}, internal.ErrNotExist
+	}
+	dataCenter := internal.DataCenter{Id: dataCenterId, Name: strings.TrimSuffix(dataCenterId, "-id"), QuotaMode: "disabled"}
+	if f.quotas != nil {
+		dataCenter.QuotaMode = internal.QuotaModeEnabled
+	}
+	return dataCenter, nil
+}
+
+func (f *fakeOvirt) GetQuotaStorageLimits(dataCenterId string, quotaId string) ([]internal.QuotaStorageLimit, error) {
+	limits, ok := f.quotas[quotaId]
+	if !ok {
+		return nil, internal.ErrNotExist
+	}
+	return limits, nil
+}
+
+func (f *fakeOvirt) GetDataCenterByName(name string) (internal.DataCenter, error) {
+	return f.GetDataCenter(name + "-id")
+}
+
+func (f *fakeOvirt) GetDataCenterStorageDomains(dataCenterId string) ([]internal.StorageDomain, error) {
+	return f.dataCenters[dataCenterId], nil
+}
+
+func (f *fakeOvirt) GetCluster(clusterId string) (internal.Cluster, error) {
+	for _, c := range f.clusters {
+		if c.Id == clusterId {
+			return c, nil
+		}
+	}
+	return internal.Cluster{}, internal.ErrNotExist
+}
+
+func (f *fakeOvirt) GetClusterByName(name string) (internal.Cluster, error) {
+	return f.GetCluster(name + "-id")
+}
+
+func (f *fakeOvirt) GetVM(name string) (internal.VM, error) {
+	return f.GetVMById(name + "-id")
+}
+
+func (f *fakeOvirt) GetVMById(id string) (internal.VM, error) {
+	vm := internal.VM{Id: id, Name: strings.TrimSuffix(id, "-id"), Status: f.vmStatus[id]}
+	vm.Cluster.Id = f.vms[id]
+	return vm, nil
+}
+
+func volumeOptions(parameters map[string]string, annotations map[string]string) controller.VolumeOptions {
+	if _, ok := parameters[parameterStorageDomainName]; !ok {
+		parameters[parameterStorageDomainName] = "data1"
+	}
+	return controller.VolumeOptions{
+		PVName:     "pvc-1",
+		Parameters: parameters,
+		PVC: &v1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "claim", Namespace: "default", Annotations: annotations},
+			Spec: v1.PersistentVolumeClaimSpec{
+				Resources: v1.ResourceRequirements{
+					Requests: v1.ResourceList{v1.ResourceStorage: resource.MustParse("1Gi")},
+				},
+			},
+		},
+	}
+}
+
+const gib = 1 << 30
+
+const engineUrl = "https://engine/ovirt-engine/api"
+
+func newFakeOvirt() *fakeOvirt {
+	active := internal.StorageDomainStatusActive
+	return &fakeOvirt{
+		dataCenters: map[string][]internal.StorageDomain{
+			"dc1-id": {{Id: "data1-id", Name: "data1", Type: "data", Status: active, Available: 100 * gib}},
+			"dc2-id": {
+				{Id: "iso2-id", Name: "iso2", Type: "iso", Status: active, Available: 100 * gib},
+				{Id: "data2-id", Name: "data2", Type: "data", Status: "maintenance", Available: 100 * gib},
+				{Id: "data3-id", Name: "data3", Type: "data", Status: active, Available: 50 * gib},
+			},
+		},
+		clusters: []internal.Cluster{
+			{Id: "cluster1-id", Name: "cluster1", DataCenter: internal.Reference{Id: "dc1-id"}},
+			{Id: "cluster2-id", Name: "cluster2", DataCenter: internal.Reference{Id: "dc2-id"}},
+		},
+		vms:   map[string]string{"node1-id": "cluster1-id", "node2-id": "cluster2-id"},
+		disks: []internal.Disk{{Id: "golden-id", Name: "golden"}, {Id: "golden-2-id", Name: "golden-2"}},
+		templates: map[string][]internal.Disk{
+			"centos": {{Id: "centos-disk-id", Name: "centos-disk"}},
+			"multi":  {{Id: "multi-1-id", Name: "multi-1"}, {Id: "multi-2-id", Name: "multi-2"}},
+		},
+	}
+}
+
+func TestProvisionFromSourceDisk(t *testing.T) {
+	tests := []struct {
+		name        string
+		parameters  map[string]string
+		annotations map[string]string
+		copiedId    string
+	}{
+		{"disk id", map[string]string{parameterSourceDiskId: "some-id"}, nil, "some-id"},
+		{"disk name", map[string]string{parameterSourceDiskName: "golden"}, nil, "golden-id"},
+		{"template", map[string]string{parameterSourceTemplate: "centos"}, nil, "centos-disk-id"},
+		{"template disk", map[string]string{parameterSourceTemplate: "multi", parameterSourceDiskName: "multi-2"}, nil, "multi-2-id"},
+		{"annotation", map[string]string{parameterSourceDiskName: "golden"}, map[string]string{parameterSourceDiskName: "golden-2"}, "golden-2-id"},
+	}
+	for _, test := range tests {
+		ovirt := newFakeOvirt()
+		p := NewOvirtProvisioner(ovirt, nil, nil)
+		pv, err := p.Provision(volumeOptions(test.parameters, test.annotations))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if ovirt.copiedId != test.copiedId || ovirt.created {
+			t.Errorf("%s: expected a copy of %s, got %s", test.name, test.copiedId, ovirt.copiedId)
+		}
+		if pv.Annotations[annVolumeID] != "copy" {
+			t.Errorf("%s: expected the PV of the copy, got %s", test.name, pv.Annotations[annVolumeID])
+		}
+	}
+}
+
+func TestProvisionEmptyDisk(t *testing.T) {
+	ovirt := newFakeOvirt()
+	p := NewOvirtProvisioner(ovirt, nil, nil)
+	_, err := p.Provision(volumeOptions(map[string]string{parameterStorageDomainName: "data1"}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ovirt.created || ovirt.copiedId != "" {
+		t.Errorf("expected an empty disk")
+	}
+}
+
+func TestProvisionFromInvalidSourceDisk(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		errMessage string
+	}{
+		{"id and name", map[string]string{parameterSourceDiskId: "some-id", parameterSourceDiskName: "golden"}, "can't be set"},
+		{"ambiguous template", map[string]string{parameterSourceTemplate: "multi"}, "has 2 disks"},
+		{"missing template disk", map[string]string{parameterSourceTemplate: "multi", parameterSourceDiskName: "other"}, "no disk named"},
+		{"missing template", map[string]string{parameterSourceTemplate: "other"}, "template other"},
+		{"missing disk", map[string]string{parameterSourceDiskName: "other"}, "not found"},
+	}
+	for _, test := range tests {
+		ovirt := newFakeOvirt()
+		p := NewOvirtProvisioner(ovirt, nil, nil)
+		_, err := p.Provision(volumeOptions(test.parameters, nil))
+		if err == nil || !strings.Contains(err.Error(), test.errMessage) {
+			t.Errorf("%s: expected an error with '%s', got %v", test.name, test.errMessage, err)
+		}
+		if ovirt.created || ovirt.copiedId != "" {
+			t.Errorf("%s: expected no disk", test.name)
+		}
+	}
+}
+
+func TestProvisionDiskParameters(t *testing.T) {
+	ovirt := newFakeOvirt()
+	p := NewOvirtProvisioner(ovirt, nil, nil)
+	pv, err := p.Provision(volumeOptions(map[string]string{
+		parameterStorageDomainName:     "data1",
+		parameterDiskInterface:         "virtio",
+		parameterDiskPassDiscard:       "true",
+		parameterDiskProfileId:         "profile-id",
+		parameterDiskWipeAfterDelete:   "true",
+		parameterDiskFormat:            "cow",
+		parameterDiskQcowCompat:        "1.1",
+		parameterDiskDescription:       "${pvc.namespace}/${pvc.name}",
+		parameterQuotaId:               "quota-id",
+		parameterDiskIncrementalBackup: "true",
+	}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := internal.DiskOptions{
+		Name:              "pvc-1",
+		StorageDomain:     "data1",
+		SizeInBytes:       1024 * 1024 * 1024,
+		ThinProvisioning:  true,
+		Format:            "cow",
+		QcowVersion:       internal.QcowVersionV3,
+		Description:       `default/claim {"namespace":"default","pvc":"claim","pv":"pvc-1"}`,
+		WipeAfterDelete:   true,
+		DiskProfileId:     "profile-id",
+		QuotaId:           "quota-id",
+		IncrementalBackup: true,
+	}
+	if ovirt.options != expected {
+		t.Errorf("expected the disk options %+v, got %+v", expected, ovirt.options)
+	}
+	flexOptions := pv.Spec.FlexVolume.Options
+	if flexOptions[parameterDiskInterface] != "virtio" || flexOptions[parameterDiskPassDiscard] != "true" {
+		t.Errorf("expected the attachment options in the flex volume, got %v", flexOptions)
+	}
+}
+
+func TestProvisionInvalidDiskParameters(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		errMessage string
+	}{
+		{"interface", map[string]string{parameterDiskInterface: "ide"}, "invalid disk interface"},
+		{"pass discard", map[string]string{parameterDiskPassDiscard: "maybe"}, parameterDiskPassDiscard},
+		{"wipe after delete", map[string]string{parameterDiskWipeAfterDelete: "yes please"}, parameterDiskWipeAfterDelete},
+		{"backup", map[string]string{parameterDiskIncrementalBackup: "1.1"}, parameterDiskIncrementalBackup},
+		{"format", map[string]string{parameterDiskFormat: "qcow2"}, "invalid format"},
+		{"compat", map[string]string{parameterDiskQcowCompat: "2"}, "invalid qcow compat"},
+		{"raw compat", map[string]string{parameterDiskFormat: "raw", parameterDiskQcowCompat: "1.1"}, "a raw disk"},
+		{"raw backup", map[string]string{parameterDiskFormat: "raw", parameterDiskIncrementalBackup: "true"}, "a raw disk"},
+		{"description", map[string]string{parameterDiskDescription: "${pvc.uid}"}, "supported variables"},
+	}
+	for _, test := range tests {
+		ovirt := newFakeOvirt()
+		p := NewOvirtProvisioner(ovirt, nil, nil)
+		_, err := p.Provision(volumeOptions(test.parameters, nil))
+		if err == nil || !strings.Contains(err.Error(), test.errMessage) {
+			t.Errorf("%s: expected an error with '%s', got %v", test.name, test.errMessage, err)
+		}
+		if ovirt.created {
+			t.Errorf("%s: expected no disk", test.name)
+		}
+	}
+}
+
+func TestProvisionedVolume(t *testing.T) {
+	options := volumeOptions(map[string]string{parameterDiskInterface: "virtio"}, nil)
+	options.PVC.Spec.AccessModes = []v1.PersistentVolumeAccessMode{v1.ReadOnlyMany}
+	options.PVC.Spec.Resources.Requests[v1.ResourceStorage] = resource.MustParse("1500Mi")
+	options.MountOptions = []string{"noatime"}
+	p := NewOvirtProvisioner(newFakeOvirt(), nil, nil)
+	p.(*ovirtProvisioner).identity = "me"
+
+	pv, err := p.Provision(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	capacity := pv.Spec.Capacity[v1.ResourceStorage]
+	if capacity.String() != "1500Mi" {
+		t.Errorf("expected the capacity 1500Mi, got %s", capacity.String())
+	}
+	expectedOptions := map[string]string{
+		parameterDiskInterface:  "virtio",
+		flexOptionVolumeId:      "new",
+		flexOptionStorageDomain: "data1",
+		flexOptionEngineUrl:     engineUrl,
+	}
+	if !reflect.DeepEqual(pv.Spec.FlexVolume.Options, expectedOptions) {
+		t.Errorf("expected the flex options %v, got %v", expectedOptions, pv.Spec.FlexVolume.Options)
+	}
+	// the empty disk gets its file system on the first mount
+	if pv.Spec.FlexVolume.ReadOnly || strings.Join(pv.Spec.MountOptions, ",") != "noatime" {
+		t.Errorf("expected a writable volume mounted with noatime, got %v %v", pv.Spec.FlexVolume.ReadOnly, pv.Spec.MountOptions)
+	}
+	expectedAnnotations := map[string]string{
+		annCreatedBy:     createdBy,
+		annProvisionerID: "me",
+		annVolumeID:      "new",
+		annStorageDomain: "data1",
+		annEngineUrl:     engineUrl,
+	}
+	if !reflect.DeepEqual(pv.Annotations, expectedAnnotations) {
+		t.Errorf("expected the annotations %v, got %v", expectedAnnotations, pv.Annotations)
+	}
+	if pv.Labels[labelStorageDomain] != "data1" || pv.Labels[labelDataCenter] != "dc1" {
+		t.Errorf("expected the labels of storage domain data1 and data center dc1, got %v", pv.Labels)
+	}
+}
+
+func TestProvisionedCopyIsReadOnly(t *testing.T) {
+	options := volumeOptions(map[string]string{parameterSourceDiskId: "golden-id"}, nil)
+	options.PVC.Spec.AccessModes = []v1.PersistentVolumeAccessMode{v1.ReadOnlyMany}
+	pv, err := NewOvirtProvisioner(newFakeOvirt(), nil, nil).Provision(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pv.Spec.FlexVolume.ReadOnly {
+		t.Error("expected the copy of a disk to be attached read only")
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	tests := []struct {
+		modes    []v1.PersistentVolumeAccessMode
+		readOnly bool
+	}{
+		{nil, false},
+		{[]v1.PersistentVolumeAccessMode{v1.ReadWriteOnce}, false},
+		{[]v1.PersistentVolumeAccessMode{v1.ReadOnlyMany}, true},
+		{[]v1.PersistentVolumeAccessMode{v1.ReadOnlyMany, v1.ReadWriteOnce}, false},
+	}
+	for _, test := range tests {
+		if readOnly(test.modes) != test.readOnly {
+			t.Errorf("expected access modes %v read only %v", test.modes, test.readOnly)
+		}
+	}
+}
+
+func TestDiskName(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		expected string
+		err      string
+	}{
+		{"default", "", "pvc-1", ""},
+		{"all the variables", "${cluster}-${pvc.namespace}-${pvc.name}-${pv.name}-${storageclass}", "prod-default-claim-pvc-1-fast", ""},
+		{"invalid characters", "${pvc.namespace}/${pvc.name} data", "default_claim_data", ""},
+		{"trimmed", "--${pvc.name}..", "claim", ""},
+		{"truncated", strings.Repeat("a", 300), strings.Repeat("a", maxDiskNameLength), ""},
+		{"unknown variable", "${pvc.uid}", "", "the supported variables are"},
+		{"empty", "//", "", "the disk name of claim default/claim is empty"},
+	}
+	for _, test := range tests {
+		params := map[string]string{}
+		if test.template != "" {
+			params[parameterDiskNameTemplate] = test.template
+		}
+		options := volumeOptions(params, nil)
+		class := "fast"
+		options.PVC.Spec.StorageClassName = &class
+		name, err := diskName(options, "prod")
+		if name != test.expected || test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: expected name '%s' and error '%s', got '%s' %v", test.name, test.expected, test.err, name, err)
+		}
+	}
+}
+
+func TestProvisionNamesDiskByTemplate(t *testing.T) {
+	ovirt := newFakeOvirt()
+	ovirt.clusterId = "prod"
+	options := claimOptions(map[string]string{parameterDiskNameTemplate: "${cluster}-${pvc.namespace}-${pvc.name}"})
+	p := NewOvirtProvisioner(ovirt, nil, nil)
+	pv, err := p.Provision(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ovirt.options.Name != "prod-default-claim" || pv.Name != "pvc-1" {
+		t.Errorf("expected disk prod-default-claim of volume pvc-1, got disk %s of volume %s", ovirt.options.Name, pv.Name)
+	}
+	reference, ok := internal.BackReferenceOf(internal.Disk{Description: ovirt.options.Description})
+	expected := internal.BackReference{ClusterId: "prod", Namespace: "default", Claim: "claim", ClaimUID: claimUID, Volume: "pvc-1"}
+	if !ok || reference != expected {
+		t.Errorf("expected the back reference %+v in the description, got %+v from '%s'", expected, reference, ovirt.options.Description)
+	}
+
+	// the provisioner died before saving the PV, the disk is found by its templated name
+	ovirt.created = false
+	pv, err = p.Provision(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ovirt.created || pv.Spec.FlexVolume.Options[flexOptionVolumeId] != "new" {
+		t.Errorf("expected the disk to be adopted, got created %v volume %v", ovirt.created, pv.Spec.FlexVolume.Options)
+	}
+}
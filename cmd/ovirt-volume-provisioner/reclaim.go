@@ -0,0 +1,259 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/ovirt/ovirt-openshift-extensions/internal"
+)
+
+const (
+	// how the disk of a deleted volume is reclaimed, delete or archive
+	parameterReclaimMode          = "ovirtReclaimMode"
+	parameterArchiveStorageDomain = "ovirtArchiveStorageDomain"
+	parameterArchiveRetention     = "ovirtArchiveRetention"
+
+	reclaimDelete  = "delete"
+	reclaimArchive = "archive"
+
+	// archivedDiskPrefix is prepended to the name of an archived disk
+	archivedDiskPrefix = "archived-"
+	// archiveMarker starts the description of an archived disk, followed by pv=, claim= and until=
+	archiveMarker = "archived by " + ProvisionerName
+)
+
+// reclaimOptions tell what becomes of the disk of a deleted volume
+type reclaimOptions struct {
+	archive              bool
+	archiveStorageDomain string
+	// retention is how long an archived disk is kept, forever when 0
+	retention       time.Duration
+	wipeAfterDelete bool
+}
+
+func reclaimParameters(params map[string]string) (reclaimOptions, error) {
+	reclaim := reclaimOptions{}
+	switch v := params[parameterReclaimMode]; v {
+	case "", reclaimDelete:
+	case reclaimArchive:
+		reclaim.archive = true
+	default:
+		return reclaim, fmt.Errorf("invalid parameter %s '%s', expected %s or %s", parameterReclaimMode, v, reclaimDelete, reclaimArchive)
+	}
+	for _, name := range []string{parameterArchiveStorageDomain, parameterArchiveRetention} {
+		if _, ok := params[name]; ok && !reclaim.archive {
+			return reclaim, fmt.Errorf("parameter %s is set, but the %s is not %s", name, parameterReclaimMode, reclaimArchive)
+		}
+	}
+	reclaim.archiveStorageDomain = params[parameterArchiveStorageDomain]
+	if v, ok := params[parameterArchiveRetention]; ok {
+		retention, err := time.ParseDuration(v)
+		if err != nil || retention <= 0 {
+			return reclaim, fmt.Errorf("invalid parameter %s '%s', expected a duration like 720h", parameterArchiveRetention, v)
+		}
+		reclaim.retention = retention
+	}
+	if v, ok := params[parameterDiskWipeAfterDelete]; ok {
+		wipe, err := parseBool(parameterDiskWipeAfterDelete, v)
+		if err != nil {
+			return reclaim, err
+		}
+		reclaim.wipeAfterDelete = wipe
+	}
+	return reclaim, nil
+}
+
+// classParameters returns the parameters of the StorageClass of the volume, or nil when
+// the class is unknown or doesn't exist anymore
+func (p ovirtProvisioner) classParameters(volume *v1.PersistentVolume) (map[string]string, error) {
+	className := volume.Spec.StorageClassName
+	if className == "" {
+		className = volume.Annotations[annStorageClass]
+	}
+	if className == "" || p.client == nil {
+		return nil, nil
+	}
+	class, err := p.client.StorageV1().StorageClasses().Get(className, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		glog.Warningf("StorageClass %s of volume %s doesn't exist, its disk is deleted", className, volume.Name)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return class.Parameters, nil
+}
+
+// diskOfVolume returns the disk of the volume, or an empty disk when it doesn't exist
+func (p ovirtProvisioner) diskOfVolume(volume *v1.PersistentVolume) (internal.Disk, error) {
+	diskId := volume.Annotations[annVolumeID]
+	if diskId == "" {
+		// a volume without the annotation has a disk named after it
+		result, err := p.ovirtApi.GetDiskByName(volume.Name)
+		if err != nil {
+			return internal.Disk{}, err
+		}
+		var disks []internal.Disk
+		for _, d := range result.Disks {
+			if d.Name == volume.Name && !internal.IsForeignDisk(d, p.clusterId) {
+				disks = append(disks, d)
+			}
+		}
+		if len(disks) > 1 {
+			return internal.Disk{}, fmt.Errorf("volume %s has no %s annotation, and there are %d disks named after it", volume.Name, annVolumeID, len(disks))
+		}
+		if len(disks) == 0 {
+			return internal.Disk{}, nil
+		}
+		return disks[0], nil
+	}
+	disk, err := p.ovirtApi.GetDiskById(diskId)
+	if _, notFound := err.(internal.NotFound); notFound {
+		return internal.Disk{}, nil
+	}
+	if err == nil && internal.IsForeignDisk(disk, p.clusterId) {
+		return internal.Disk{}, fmt.Errorf("disk %s of volume %s belongs to cluster %s", diskId, volume.Name, internal.ClusterIdOf(disk))
+	}
+	return disk, err
+}
+
+// detachForDelete detaches the disk from the VMs it is attached to. The disk of a down VM is
+// force detached, otherwise it is hot unplugged only when the guest doesn't use it anymore.
+func (p ovirtProvisioner) detachForDelete(disk internal.Disk) error {
+	if disk.Vms == nil {
+		return nil
+	}
+	for _, holder := range disk.Vms.Vms {
+		vm, err := p.ovirtApi.GetVMById(holder.Id)
+		if _, notFound := err.(internal.NotFound); notFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		glog.Infof("Detaching disk %s from VM %s which is %s", disk.Name, vm.Name, vm.Status)
+		err = internal.DetachDiskGracefully(p.ovirtApi, vm.Id, disk.Id, internal.DetachOptions{Force: vm.Status == "down"})
+		if err != nil {
+			return fmt.Errorf("failed detaching disk %s from VM %s, it may still be in use: %s", disk.Name, vm.Name, err)
+		}
+	}
+	return nil
+}
+
+// removeDisk removes the disk, a disk which doesn't exist is removed
+func (p ovirtProvisioner) removeDisk(diskId string) error {
+	_, err := p.ovirtApi.Delete("disks/" + diskId)
+	if _, notFound := err.(internal.NotFound); notFound {
+		return nil
+	}
+	return err
+}
+
+// archiveDisk renames the disk of the volume, marks it in its description and moves it to the
+// archive storage domain. The disk is removed by sweepArchive once its retention is over.
+func (p ovirtProvisioner) archiveDisk(volume *v1.PersistentVolume, disk internal.Disk, reclaim reclaimOptions) error {
+	until := "never"
+	if reclaim.retention > 0 {
+		until = time.Now().Add(reclaim.retention).UTC().Format(time.RFC3339)
+	}
+	claim := ""
+	if volume.Spec.ClaimRef != nil {
+		claim = volume.Spec.ClaimRef.Namespace + "/" + volume.Spec.ClaimRef.Name
+	}
+	update := internal.DiskUpdate{
+		Name:        archivedDiskPrefix + volume.Name,
+		Description: fmt.Sprintf("%s pv=%s claim=%s until=%s", archiveMarker, volume.Name, claim, until),
+	}
+	// the archived disk keeps only the cluster of its back reference, it is no orphan of the provisioner
+	if p.clusterId != "" {
+		update.Description = internal.WithBackReference(update.Description, internal.BackReference{ClusterId: p.clusterId})
+	}
+	if reclaim.wipeAfterDelete {
+		update.WipeAfterDelete = &reclaim.wipeAfterDelete
+	}
+	// a retried delete keeps the retention of the disk it already archived
+	if !strings.HasPrefix(disk.Description, archiveMarker+" ") {
+		_, err := p.ovirtApi.UpdateDisk(disk.Id, update)
+		if err != nil {
+			return err
+		}
+		glog.Infof("Archived disk %s of volume %s as %s, kept until %s", disk.Id, volume.Name, update.Name, until)
+	}
+
+	if reclaim.archiveStorageDomain == "" {
+		return nil
+	}
+	domain, err := p.ovirtApi.GetStorageDomainBy(reclaim.archiveStorageDomain)
+	if err != nil {
+		return fmt.Errorf("failed getting the archive storage domain %s: %s", reclaim.archiveStorageDomain, err)
+	}
+	for _, d := range disk.StorageDomains.Domains {
+		if d.Id == domain.Id {
+			return nil
+		}
+	}
+	glog.Infof("Moving archived disk %s to storage domain %s", disk.Id, domain.Name)
+	return p.ovirtApi.MoveDisk(disk.Id, domain.Name)
+}
+
+// archivedUntil returns the end of the retention of a disk archived by the provisioner, and
+// false if it isn't one or it is kept forever
+func archivedUntil(disk internal.Disk) (time.Time, bool) {
+	if !strings.HasPrefix(disk.Name, archivedDiskPrefix) || !strings.HasPrefix(disk.Description, archiveMarker+" ") {
+		return time.Time{}, false
+	}
+	for _, field := range strings.Fields(strings.TrimPrefix(disk.Description, archiveMarker)) {
+		if strings.HasPrefix(field, "until=") {
+			until, err := time.Parse(time.RFC3339, strings.TrimPrefix(field, "until="))
+			return until, err == nil
+		}
+	}
+	return time.Time{}, false
+}
+
+// sweepArchive removes the archived disks whose retention is over, unless they were attached
+// to a VM to be inspected or restored.
+func (p ovirtProvisioner) sweepArchive(now time.Time) {
+	disks, err := p.ovirtApi.SearchDisks("name=" + archivedDiskPrefix + "*")
+	if err != nil {
+		glog.Errorf("Failed listing the archived disks: %s", err)
+		return
+	}
+	for _, disk := range disks {
+		until, ok := archivedUntil(disk)
+		if !ok || now.Before(until) || internal.ClusterIdOf(disk) != p.clusterId {
+			continue
+		}
+		if disk.Vms != nil && len(disk.Vms.Vms) > 0 {
+			glog.Infof("Keeping archived disk %s (%s), it is attached to a VM", disk.Name, disk.Id)
+			continue
+		}
+		glog.Infof("Removing archived disk %s (%s), its retention ended at %s", disk.Name, disk.Id, until)
+		err = p.removeDisk(disk.Id)
+		if err != nil {
+			glog.Errorf("Failed removing archived disk %s: %s", disk.Id, err)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/ovirt/ovirt-openshift-extensions/internal"
+)
+
+func (f *fakeOvirt) GetDiskById(diskId string) (internal.Disk, error) {
+	for _, d := range f.disks {
+		if d.Id == diskId {
+			return d, nil
+		}
+	}
+	return internal.Disk{}, internal.NotFound{}
+}
+
+func (f *fakeOvirt) SearchDisks(query string) ([]internal.Disk, error) {
+	return f.disks, nil
+}
+
+func (f *fakeOvirt) GetDiskAttachment(vmId, diskId string) (internal.DiskAttachment, error) {
+	attachment, ok := f.attachments[vmId]
+	if !ok {
+		return internal.DiskAttachment{}, internal.NotFound{}
+	}
+	return *attachment, nil
+}
+
+func (f *fakeOvirt) DeactivateDiskAttachment(vmId string, diskId string) error {
+	if f.busy {
+		return internal.Fault{Status: "409 Conflict", Code: http.StatusConflict, Detail: "the device is busy"}
+	}
+	f.attachments[vmId].Active = false
+	return nil
+}
+
+func (f *fakeOvirt) DetachDiskFromVM(vmId string, diskId string) error {
+	delete(f.attachments, vmId)
+	return nil
+}
+
+func (f *fakeOvirt) Delete(path string) ([]byte, error) {
+	diskId := strings.TrimPrefix(path, "disks/")
+	f.removed = append(f.removed, diskId)
+	for i, d := range f.disks {
+		if d.Id == diskId {
+			f.disks = append(f.disks[:i], f.disks[i+1:]...)
+			break
+		}
+	}
+	return nil, nil
+}
+
+func (f *fakeOvirt) UpdateDisk(diskId string, update internal.DiskUpdate) (internal.Disk, error) {
+	f.updates = append(f.updates, update)
+	for i, d := range f.disks {
+		if d.Id != diskId {
+			continue
+		}
+		if update.Name != "" {
+			f.disks[i].Name = update.Name
+		}
+		if update.Description != "" {
+			f.disks[i].Description = update.Description
+		}
+		return f.disks[i], nil
+	}
+	return internal.Disk{}, internal.NotFound{}
+}
+
+func (f *fakeOvirt) MoveDisk(diskId string, storageDomainName string) error {
+	f.movedTo = storageDomainName
+	return nil
+}
+
+func (f *fakeOvirt) GetStorageDomainBy(name string) (internal.StorageDomain, error) {
+	return internal.StorageDomain{Id: name + "-id", Name: name}, nil
+}
+
+// kubeWithClass serves the StorageClass ovirt with the parameters
+func kubeWithClass(t *testing.T, parameters map[string]string) (kubernetes.Interface, func()) {
+	params, _ := json.Marshal(parameters)
+	return kubeWithRoutes(t, map[string]http.HandlerFunc{
+		"/apis/storage.k8s.io/v1/storageclasses/ovirt": kubeObject(fmt.Sprintf(
+			`{"kind": "StorageClass", "apiVersion": "storage.k8s.io/v1", "metadata": {"name": "ovirt"},
+			"provisioner": "ovirt-volume-provisioner", "parameters": %s}`, params)),
+	})
+}
+
+func volumeOfDisk(diskId string) *v1.PersistentVolume {
+	annotations := map[string]string{}
+	if diskId != "" {
+		annotations[annVolumeID] = diskId
+	}
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pvc-1", Annotations: annotations},
+		Spec: v1.PersistentVolumeSpec{
+			StorageClassName: "ovirt",
+			ClaimRef:         &v1.ObjectReference{Namespace: "default", Name: "claim"},
+		},
+	}
+}
+
+// fakeOvirtWithAttachment has disk disk1-id attached to VM node1-id, active when the VM is up
+func fakeOvirtWithAttachment(vmStatus string) *fakeOvirt {
+	ovirt := newFakeOvirt()
+	ovirt.disks = []internal.Disk{{Id: "disk1-id", Name: "pvc-1", Vms: &internal.VMResult{Vms: []internal.VM{{Id: "node1-id"}}}}}
+	ovirt.vmStatus = map[string]string{"node1-id": vmStatus}
+	ovirt.attachments = map[string]*internal.DiskAttachment{"node1-id": {Id: "disk1-id", Active: vmStatus == "up"}}
+	return ovirt
+}
+
+func TestDelete(t *testing.T) {
+	tests := []struct {
+		name     string
+		ovirt    *fakeOvirt
+		diskId   string
+		removed  string
+		detached bool
+		err      string
+	}{
+		{"floating disk", &fakeOvirt{disks: []internal.Disk{{Id: "disk1-id", Name: "pvc-1"}}}, "disk1-id", "disk1-id", false, ""},
+		{"disk already removed", &fakeOvirt{}, "disk1-id", "", false, ""},
+		{"disk of a volume without the annotation", &fakeOvirt{disks: []internal.Disk{{Id: "disk1-id", Name: "pvc-1"}}}, "", "disk1-id", false, ""},
+		{"disk of a down VM", fakeOvirtWithAttachment("down"), "disk1-id", "disk1-id", true, ""},
+		{"disk of a running VM which isn't used", fakeOvirtWithAttachment("up"), "disk1-id", "disk1-id", true, ""},
+		{"disk used by a running VM", func() *fakeOvirt { f := fakeOvirtWithAttachment("up"); f.busy = true; return f }(),
+			"disk1-id", "", false, "failed detaching disk pvc-1 from VM node1, it may still be in use"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := NewOvirtProvisioner(test.ovirt, nil, nil)
+			err := p.Delete(volumeOfDisk(test.diskId))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(test.ovirt.removed, ",") != test.removed {
+				t.Errorf("expected the removed disks '%s', got %v", test.removed, test.ovirt.removed)
+			}
+			if _, attached := test.ovirt.attachments["node1-id"]; attached == test.detached && test.ovirt.attachments != nil {
+				t.Errorf("expected the disk detached %v, got attachments %v", test.detached, test.ovirt.attachments)
+			}
+		})
+	}
+}
+
+func TestDeleteWipesAfterDelete(t *testing.T) {
+	client, stop := kubeWithClass(t, map[string]string{parameterDiskWipeAfterDelete: "true"})
+	defer stop()
+	ovirt := &fakeOvirt{disks: []internal.Disk{{Id: "disk1-id", Name: "pvc-1"}}}
+	p := NewOvirtProvisioner(ovirt, client, nil)
+	err := p.Delete(volumeOfDisk("disk1-id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ovirt.updates) != 1 || ovirt.updates[0].WipeAfterDelete == nil || !*ovirt.updates[0].WipeAfterDelete {
+		t.Errorf("expected wipe after delete to be set, got %+v", ovirt.updates)
+	}
+	if len(ovirt.removed) != 1 {
+		t.Errorf("expected the disk to be removed, got %v", ovirt.removed)
+	}
+}
+
+func TestDeleteArchives(t *testing.T) {
+	client, stop := kubeWithClass(t, map[string]string{
+		parameterReclaimMode:          reclaimArchive,
+		parameterArchiveStorageDomain: "archive",
+		parameterArchiveRetention:     "24h",
+	})
+	defer stop()
+	ovirt := fakeOvirtWithAttachment("down")
+	p := NewOvirtProvisioner(ovirt, client, nil)
+	err := p.Delete(volumeOfDisk("disk1-id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ovirt.removed) != 0 || len(ovirt.attachments) != 0 {
+		t.Errorf("expected the disk to be detached and kept, got removed %v attachments %v", ovirt.removed, ovirt.attachments)
+	}
+	if len(ovirt.updates) != 1 || ovirt.updates[0].Name != "archived-pvc-1" ||
+		!strings.HasPrefix(ovirt.updates[0].Description, archiveMarker+" pv=pvc-1 claim=default/claim until=") {
+		t.Fatalf("expected the disk to be renamed and marked, got %+v", ovirt.updates)
+	}
+	if ovirt.movedTo != "archive" {
+		t.Errorf("expected the disk to be moved to the archive domain, got '%s'", ovirt.movedTo)
+	}
+
+	archived := internal.Disk{Name: ovirt.updates[0].Name, Description: ovirt.updates[0].Description}
+	until, ok := archivedUntil(archived)
+	if !ok || until.Sub(time.Now()) < 23*time.Hour {
+		t.Errorf("expected the disk to be kept for a day, got %s", until)
+	}
+
+	// a retried delete doesn't extend the retention
+	ovirt.disks[0].Description = archived.Description
+	ovirt.updates = nil
+	err = p.Delete(volumeOfDisk("disk1-id"))
+	if err != nil || len(ovirt.updates) != 0 {
+		t.Errorf("expected the archived disk to be left as is, got %+v %v", ovirt.updates, err)
+	}
+}
+
+func TestSweepArchive(t *testing.T) {
+	now := time.Now()
+	archived := func(id string, until string) internal.Disk {
+		return internal.Disk{Id: id, Name: "archived-" + id, Description: archiveMarker + " pv=" + id + " claim=default/claim until=" + until}
+	}
+	attached := archived("attached", now.Add(-time.Hour).Format(time.RFC3339))
+	attached.Vms = &internal.VMResult{Vms: []internal.VM{{Id: "node1-id"}}}
+	ovirt := &fakeOvirt{disks: []internal.Disk{
+		archived("expired", now.Add(-time.Hour).Format(time.RFC3339)),
+		archived("retained", now.Add(time.Hour).Format(time.RFC3339)),
+		archived("forever", "never"),
+		attached,
+		{Id: "foreign", Name: "archived-foreign", Description: "archived by hand"},
+	}}
+	p := NewOvirtProvisioner(ovirt, nil, nil)
+	p.(*ovirtProvisioner).sweepArchive(now)
+	if strings.Join(ovirt.removed, ",") != "expired" {
+		t.Errorf("expected only the expired disk to be removed, got %v", ovirt.removed)
+	}
+}
+
+func TestReclaimParameters(t *testing.T) {
+	tests := []struct {
+		parameters map[string]string
+		err        string
+	}{
+		{map[string]string{parameterReclaimMode: reclaimDelete}, ""},
+		{map[string]string{parameterReclaimMode: reclaimArchive, parameterArchiveRetention: "720h"}, ""},
+		{map[string]string{parameterReclaimMode: "keep"}, "invalid parameter " + parameterReclaimMode},
+		{map[string]string{parameterArchiveStorageDomain: "archive"}, "parameter " + parameterArchiveStorageDomain + " is set"},
+		{map[string]string{parameterReclaimMode: reclaimArchive, parameterArchiveRetention: "a month"}, "invalid parameter " + parameterArchiveRetention},
+	}
+	for _, test := range tests {
+		_, err := NewOvirtProvisioner(newFakeOvirt(), nil, nil).Provision(volumeOptions(test.parameters, nil))
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%v: expected error '%s', got %v", test.parameters, test.err, err)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/ovirt/ovirt-openshift-extensions/internal"
+)
+
+const (
+	// annProvisionedBy is set by the provision controller on the PVs it provisioned
+	annProvisionedBy = "pv.kubernetes.io/provisioned-by"
+
+	reasonOrphanedDisk   = "OrphanedDisk"
+	reasonDiskRemoved    = "OrphanedDiskRemoved"
+	reasonVolumeDiskGone = "VolumeDiskMissing"
+)
+
+var (
+	orphanedDisks = prometheus.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "ovirt_provisioner",
+		Name:      "orphaned_disks",
+		Help:      "Number of disks created by the provisioner which no PV refers to.",
+	})
+	danglingVolumes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "ovirt_provisioner",
+		Name:      "dangling_volumes",
+		Help:      "Number of PVs provisioned by the provisioner whose disk doesn't exist.",
+	})
+	orphanedDisksRemoved = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "ovirt_provisioner",
+		Name:      "orphaned_disks_removed_total",
+		Help:      "Total number of orphaned disks removed after their grace period.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(orphanedDisks, danglingVolumes, orphanedDisksRemoved)
+}
+
+// reconciler compares the disks of the provisioner to the PVs. A disk no PV refers to is an orphan,
+// left by a crash between the creation of the disk and of its PV. A PV whose disk doesn't exist
+// dangles, its disk was removed behind the back of kubernetes.
+type reconciler struct {
+	provisioner *ovirtProvisioner
+	// search is the engine query of the disks of the provisioner
+	search string
+	// gracePeriod is how long a disk stays an orphan before it is removed, they are kept when 0
+	gracePeriod time.Duration
+	// orphanedSince is when each orphan was found, the grace period starts over on a restart
+	orphanedSince map[string]time.Time
+	// dangling are the PVs already reported as dangling
+	dangling map[string]bool
+	// configMap is the ConfigMap of the identity of the provisioner, the orphans whose claim
+	// doesn't exist are reported on it
+	configMap *v1.ObjectReference
+}
+
+func newReconciler(provisioner *ovirtProvisioner, search string, gracePeriod time.Duration, configMap *v1.ObjectReference) *reconciler {
+	if search == "" {
+		search = identitySearch(provisioner.identity)
+	}
+	return &reconciler{
+		provisioner:   provisioner,
+		search:        search,
+		gracePeriod:   gracePeriod,
+		orphanedSince: map[string]time.Time{},
+		dangling:      map[string]bool{},
+		configMap:     configMap,
+	}
+}
+
+// identitySearch is the engine search of the disks whose back reference holds the identity of the provisioner
+func identitySearch(identity types.UID) string {
+	return "description=*" + string(identity) + "*"
+}
+
+// reconcile reports the orphaned disks and the dangling PVs, removes the orphans whose grace
+// period is over, and returns the number of each.
+func (r *reconciler) reconcile(now time.Time) (orphans int, dangling int, err error) {
+	p := r.provisioner
+	if p.client == nil {
+		return 0, 0, fmt.Errorf("the reconciler requires the provisioner to access the kubernetes API")
+	}
+	disks, err := p.ovirtApi.SearchDisks(r.search)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed listing the disks by '%s': %s", r.search, err)
+	}
+	pvs, err := p.client.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed listing the volumes: %s", err)
+	}
+
+	// a volume without the disk id annotation refers to the disk named after it, a disk named after
+	// a volume with the annotation may be left by an interrupted attempt to provision it
+	referenced := map[string]bool{}
+	for _, pv := range pvs.Items {
+		if id := pv.Annotations[annVolumeID]; id != "" {
+			referenced[id] = true
+		} else {
+			referenced[pv.Name] = true
+		}
+	}
+
+	existing := map[string]bool{}
+	orphaned := map[string]time.Time{}
+	for _, disk := range disks {
+		existing[disk.Id] = true
+		if referenced[disk.Id] || referenced[disk.Name] || !p.createdDisk(disk) {
+			continue
+		}
+		if !r.isOrphan(disk) {
+			continue
+		}
+		orphans++
+		since, known := r.orphanedSince[disk.Id]
+		if !known {
+			since = now
+			glog.Warningf("Disk %s (%s) is an orphan, no PV refers to it", disk.Name, disk.Id)
+			r.event(r.orphanEventTarget(disk), v1.EventTypeWarning, reasonOrphanedDisk,
+				fmt.Sprintf("disk %s (%s) was created for PV %s which doesn't exist", disk.Name, disk.Id, pvNameOfDisk(disk)))
+		}
+		orphaned[disk.Id] = since
+		if r.gracePeriod == 0 || now.Sub(since) < r.gracePeriod || !removable(disk) {
+			continue
+		}
+		glog.Infof("Removing orphaned disk %s (%s), an orphan since %s", disk.Name, disk.Id, since)
+		err = p.removeDisk(disk.Id)
+		if err != nil {
+			glog.Errorf("Failed removing orphaned disk %s: %s", disk.Id, err)
+			continue
+		}
+		orphanedDisksRemoved.Inc()
+		delete(orphaned, disk.Id)
+		r.event(r.orphanEventTarget(disk), v1.EventTypeNormal, reasonDiskRemoved,
+			fmt.Sprintf("removed orphaned disk %s (%s) of PV %s after %s", disk.Name, disk.Id, pvNameOfDisk(disk), r.gracePeriod))
+	}
+	r.orphanedSince = orphaned
+
+	reported := map[string]bool{}
+	for _, pv := range pvs.Items {
+		diskId := pv.Annotations[annVolumeID]
+		if pv.Annotations[annProvisionedBy] != ProvisionerName || diskId == "" || existing[diskId] {
+			continue
+		}
+		// the disk may just not match the search, i.e a copy named after its source
+		_, err := p.ovirtApi.GetDiskById(diskId)
+		if _, notFound := err.(internal.NotFound); !notFound {
+			if err != nil {
+				glog.Errorf("Failed checking disk %s of volume %s: %s", diskId, pv.Name, err)
+			}
+			continue
+		}
+		dangling++
+		reported[pv.Name] = true
+		if !r.dangling[pv.Name] {
+			glog.Warningf("Volume %s dangles, its disk %s doesn't exist", pv.Name, diskId)
+			ref := &v1.ObjectReference{Kind: "PersistentVolume", APIVersion: "v1", Name: pv.Name, UID: pv.UID}
+			r.event(ref, v1.EventTypeWarning, reasonVolumeDiskGone, fmt.Sprintf("disk %s of the volume doesn't exist", diskId))
+		}
+	}
+	r.dangling = reported
+
+	orphanedDisks.Set(float64(orphans))
+	danglingVolumes.Set(float64(dangling))
+	return orphans, dangling, nil
+}
+
+// createdDisk tells if the provisioner created the disk, by the identity and the cluster ID of its back
+// reference. The disks of other provisioners and clusters, or without a back reference, are never orphans.
+func (p ovirtProvisioner) createdDisk(disk internal.Disk) bool {
+	ref, ok := internal.BackReferenceOf(disk)
+	return ok && ref.Provisioner == string(p.identity) && ref.ClusterId == p.clusterId
+}
+
+// isOrphan tells if a disk no PV refers to was left by the provisioner. A locked disk may still be
+// under creation, and a disk attached to a VM is used by someone.
+func (r *reconciler) isOrphan(disk internal.Disk) bool {
+	if disk.Status == "locked" {
+		return false
+	}
+	return disk.Vms == nil || len(disk.Vms.Vms) == 0
+}
+
+// removable tells if the orphan is removed once its grace period is over. Only the disks of PVs whose
+// reclaim policy was Delete are: the disk of a Retain PV is left behind on purpose when an admin deletes
+// the PV, and the policy of the disks made before it was recorded is unknown.
+func removable(disk internal.Disk) bool {
+	ref, _ := internal.BackReferenceOf(disk)
+	return ref.ReclaimPolicy == string(v1.PersistentVolumeReclaimDelete)
+}
+
+// pvNameOfDisk returns the name of the PV the disk was created for, by its back reference, or else
+// by its name
+func pvNameOfDisk(disk internal.Disk) string {
+	if ref, ok := internal.BackReferenceOf(disk); ok && ref.Volume != "" {
+		return ref.Volume
+	}
+	return disk.Name
+}
+
+// orphanEventTarget returns the claim the orphan was created for while it exists, or else the ConfigMap
+// of the provisioner. The PV of an orphan doesn't exist.
+func (r *reconciler) orphanEventTarget(disk internal.Disk) *v1.ObjectReference {
+	ref, ok := internal.BackReferenceOf(disk)
+	if ok && ref.Namespace != "" && ref.Claim != "" {
+		claim, err := r.provisioner.client.CoreV1().PersistentVolumeClaims(ref.Namespace).Get(ref.Claim, metav1.GetOptions{})
+		if err == nil && (ref.ClaimUID == "" || string(claim.UID) == ref.ClaimUID) {
+			return &v1.ObjectReference{Kind: "PersistentVolumeClaim", APIVersion: "v1", Namespace: claim.Namespace, Name: claim.Name, UID: claim.UID}
+		}
+	}
+	return r.configMap
+}
+
+// event records an event on the object, when there is one
+func (r *reconciler) event(ref *v1.ObjectReference, eventType string, reason string, message string) {
+	if r.provisioner.recorder == nil || ref == nil {
+		return
+	}
+	r.provisioner.recorder.Event(ref, eventType, reason, message)
+}
+
+// run reconciles and logs the outcome
+func (r *reconciler) run() {
+	orphans, dangling, err := r.reconcile(time.Now())
+	if err != nil {
+		glog.Errorf("Failed reconciling the disks and the volumes: %s", err)
+		return
+	}
+	glog.Infof("Reconciled the disks and the volumes, %d orphaned disks and %d dangling volumes", orphans, dangling)
+}
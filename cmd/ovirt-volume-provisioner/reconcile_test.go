@@ -0,0 +1,223 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/ovirt/ovirt-openshift-extensions/internal"
+)
+
+// kubeWithProvisionedVolumes serves the PVs pvc-1 of disk disk1-id, pvc-2 of disk disk2-id, pvc-3
+// without a disk id, and pvc-4 of disk disk4-id which another provisioner made
+func kubeWithProvisionedVolumes(t *testing.T) (kubernetes.Interface, func()) {
+	pv := func(name string, annotations string) string {
+		return fmt.Sprintf(`{"metadata": {"name": "%s", "annotations": {%s}}, "spec": {}}`, name, annotations)
+	}
+	provisioned := func(diskId string) string {
+		return fmt.Sprintf(`"%s": "%s", "%s": "%s"`, annProvisionedBy, ProvisionerName, annVolumeID, diskId)
+	}
+	return kubeWithRoutes(t, map[string]http.HandlerFunc{
+		"/api/v1/persistentvolumes": kubeObject(fmt.Sprintf(`{"kind": "PersistentVolumeList", "apiVersion": "v1", "items": [%s, %s, %s, %s]}`,
+			pv("pvc-1", provisioned("disk1-id")), pv("pvc-2", provisioned("disk2-id")), pv("pvc-3", ""),
+			pv("pvc-4", fmt.Sprintf(`"%s": "other", "%s": "disk4-id"`, annProvisionedBy, annVolumeID)))),
+	})
+}
+
+// ofProvisioner returns the disk with the back reference of the provisioner of the identity, to its Delete PV of the disk name
+func ofProvisioner(disk internal.Disk, identity string) internal.Disk {
+	disk.Description = internal.WithBackReference(disk.Description,
+		internal.BackReference{Provisioner: identity, Volume: disk.Name, ReclaimPolicy: "Delete"})
+	return disk
+}
+
+// objectRecorder records the objects of the events besides the events
+type objectRecorder struct {
+	*record.FakeRecorder
+	objects []string
+}
+
+func (r *objectRecorder) Event(object runtime.Object, eventType string, reason string, message string) {
+	ref := object.(*v1.ObjectReference)
+	r.objects = append(r.objects, ref.Kind+" "+ref.Namespace+"/"+ref.Name)
+	r.FakeRecorder.Event(object, eventType, reason, message)
+}
+
+func TestReconcile(t *testing.T) {
+	client, stop := kubeWithProvisionedVolumes(t)
+	defer stop()
+	attached := &internal.VMResult{Vms: []internal.VM{{Id: "node1-id"}}}
+	ovirt := &fakeOvirt{disks: []internal.Disk{
+		ofProvisioner(internal.Disk{Id: "disk1-id", Name: "pvc-1"}, ""),
+		ofProvisioner(internal.Disk{Id: "disk3-id", Name: "pvc-3"}, ""),
+		ofProvisioner(internal.Disk{Id: "orphan-id", Name: "pvc-5"}, ""),
+		ofProvisioner(internal.Disk{Id: "creating-id", Name: "pvc-6", Status: "locked"}, ""),
+		ofProvisioner(internal.Disk{Id: "attached-id", Name: "pvc-7", Vms: attached}, ""),
+	}}
+	p := NewOvirtProvisioner(ovirt, client, nil).(*ovirtProvisioner)
+	recorder := &objectRecorder{FakeRecorder: record.NewFakeRecorder(10)}
+	p.recorder = recorder
+	r := newReconciler(p, "", time.Hour, &v1.ObjectReference{Kind: "ConfigMap", Namespace: "kube-system", Name: ProvisionerName})
+
+	now := time.Now()
+	orphans, dangling, err := r.reconcile(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orphans != 1 || dangling != 1 {
+		t.Errorf("expected the orphan pvc-5 and the dangling pvc-2, got %d orphans and %d dangling", orphans, dangling)
+	}
+	events := []string{<-recorder.Events, <-recorder.Events}
+	if !strings.Contains(strings.Join(events, "\n"), reasonOrphanedDisk+" disk pvc-5 (orphan-id)") ||
+		!strings.Contains(strings.Join(events, "\n"), reasonVolumeDiskGone+" disk disk2-id") {
+		t.Errorf("expected an event of the orphan and of the dangling volume, got %v", events)
+	}
+	// the orphan has no claim, it is reported on the ConfigMap of the provisioner
+	if strings.Join(recorder.objects, ",") != "ConfigMap kube-system/"+ProvisionerName+",PersistentVolume /pvc-2" {
+		t.Errorf("expected the events on the ConfigMap and the dangling PV, got %v", recorder.objects)
+	}
+
+	// the orphan is removed once its grace period is over, and is reported once
+	_, _, err = r.reconcile(now.Add(30 * time.Minute))
+	if err != nil || len(ovirt.removed) != 0 || len(recorder.Events) != 0 {
+		t.Fatalf("expected nothing new within the grace period, got removed %v events %d %v", ovirt.removed, len(recorder.Events), err)
+	}
+	_, _, err = r.reconcile(now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(ovirt.removed, ",") != "orphan-id" {
+		t.Errorf("expected the orphan to be removed, got %v", ovirt.removed)
+	}
+	if event := <-recorder.Events; !strings.Contains(event, reasonDiskRemoved) {
+		t.Errorf("expected an event of the removal, got %s", event)
+	}
+}
+
+func TestReconcileKeepsOrphans(t *testing.T) {
+	client, stop := kubeWithProvisionedVolumes(t)
+	defer stop()
+	// duplicate-id was created by an interrupted attempt to provision pvc-1, which got disk1-id
+	ovirt := &fakeOvirt{disks: []internal.Disk{
+		ofProvisioner(internal.Disk{Id: "disk1-id", Name: "pvc-1"}, ""),
+		ofProvisioner(internal.Disk{Id: "duplicate-id", Name: "pvc-1"}, ""),
+		ofProvisioner(internal.Disk{Id: "disk2-id", Name: "pvc-2"}, ""),
+		ofProvisioner(internal.Disk{Id: "orphan-id", Name: "pvc-5"}, ""),
+	}}
+	r := newReconciler(NewOvirtProvisioner(ovirt, client, nil).(*ovirtProvisioner), "", 0, nil)
+
+	now := time.Now()
+	for _, at := range []time.Time{now, now.Add(24 * time.Hour)} {
+		orphans, dangling, err := r.reconcile(at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if orphans != 2 || dangling != 0 || len(ovirt.removed) != 0 {
+			t.Errorf("expected the orphans to be kept, got %d orphans %d dangling removed %v", orphans, dangling, ovirt.removed)
+		}
+	}
+}
+
+func TestReconcileIgnoresDisksOfOthers(t *testing.T) {
+	client, stop := kubeWithProvisionedVolumes(t)
+	defer stop()
+	// the disks named as volumes, of another provisioner or of none, aren't orphans
+	ovirt := &fakeOvirt{disks: []internal.Disk{
+		ofProvisioner(internal.Disk{Id: "orphan-id", Name: "pvc-5"}, "p1"),
+		ofProvisioner(internal.Disk{Id: "other-id", Name: "pvc-6"}, "p2"),
+		{Id: "unmarked-id", Name: "pvc-7"},
+	}}
+	p := NewOvirtProvisioner(ovirt, client, nil).(*ovirtProvisioner)
+	p.identity = "p1"
+	r := newReconciler(p, "", time.Hour, nil)
+	if r.search != "description=*p1*" {
+		t.Errorf("expected the search of the disks of the identity, got %s", r.search)
+	}
+
+	now := time.Now()
+	for _, at := range []time.Time{now, now.Add(time.Hour)} {
+		_, _, err := r.reconcile(at)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if strings.Join(ovirt.removed, ",") != "orphan-id" {
+		t.Errorf("expected only the orphan of the provisioner to be removed, got %v", ovirt.removed)
+	}
+}
+
+func TestReconcileKeepsDisksOfRetainedVolumes(t *testing.T) {
+	client, stop := kubeWithRoutes(t, map[string]http.HandlerFunc{
+		"/api/v1/persistentvolumes": kubeObject(`{"kind": "PersistentVolumeList", "apiVersion": "v1", "items": []}`),
+		"/api/v1/namespaces/default/persistentvolumeclaims/claim": kubeObject(
+			`{"metadata": {"name": "claim", "namespace": "default", "uid": "claim-uid"}}`),
+	})
+	defer stop()
+	marked := func(id string, name string, policy string) internal.Disk {
+		ref := internal.BackReference{Namespace: "default", Claim: "claim", ClaimUID: "claim-uid", Volume: name, ReclaimPolicy: policy}
+		return internal.Disk{Id: id, Name: name, Description: internal.WithBackReference("", ref)}
+	}
+	// an admin deleted the Retain PV to keep its disk, the policy of an older disk is unknown
+	ovirt := &fakeOvirt{disks: []internal.Disk{
+		marked("retained-id", "pvc-1", "Retain"),
+		marked("older-id", "pvc-2", ""),
+		marked("deleted-id", "pvc-3", "Delete"),
+	}}
+	p := NewOvirtProvisioner(ovirt, client, nil).(*ovirtProvisioner)
+	recorder := &objectRecorder{FakeRecorder: record.NewFakeRecorder(10)}
+	p.recorder = recorder
+	r := newReconciler(p, "", time.Hour, nil)
+
+	now := time.Now()
+	for _, at := range []time.Time{now, now.Add(time.Hour)} {
+		orphans, _, err := r.reconcile(at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if orphans != 3 {
+			t.Errorf("expected the orphans to be reported, got %d", orphans)
+		}
+	}
+	if strings.Join(ovirt.removed, ",") != "deleted-id" {
+		t.Errorf("expected only the disk of the Delete PV to be removed, got %v", ovirt.removed)
+	}
+	// the claim still exists, the events are recorded on it
+	for _, object := range recorder.objects {
+		if object != "PersistentVolumeClaim default/claim" {
+			t.Errorf("expected the events on the claim, got %v", recorder.objects)
+			break
+		}
+	}
+}
+
+func TestPvNameOfDisk(t *testing.T) {
+	named := internal.Disk{Name: "pvc-1"}
+	templated := internal.Disk{Name: "prod-default-claim",
+		Description: internal.WithBackReference("", internal.BackReference{Namespace: "default", Claim: "claim", Volume: "pvc-2"})}
+	if pvNameOfDisk(named) != "pvc-1" || pvNameOfDisk(templated) != "pvc-2" {
+		t.Errorf("expected the volumes pvc-1 and pvc-2, got %s and %s", pvNameOfDisk(named), pvNameOfDisk(templated))
+	}
+}
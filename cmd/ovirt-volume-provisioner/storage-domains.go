@@ -0,0 +1,286 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/ovirt/ovirt-openshift-extensions/internal"
+)
+
+const (
+	// the candidate storage domains of a volume, and how one is chosen
+	parameterStorageDomainRegex    = "ovirtStorageDomainRegex"
+	parameterStorageDomainTag      = "ovirtStorageDomainTag"
+	parameterStorageDomainPolicy   = "ovirtStorageDomainPolicy"
+	parameterStorageDomainWeights  = "ovirtStorageDomainWeights"
+	parameterStorageDomainHeadroom = "ovirtStorageDomainHeadroom"
+	// the ratio of the committed space to the size of a domain it may not exceed, as 1.5
+	parameterStorageDomainOvercommit = "ovirtStorageDomainOvercommit"
+
+	policyMostFree   = "mostFree"
+	policyRoundRobin = "roundRobin"
+	policyWeighted   = "weighted"
+)
+
+// domainSelector picks the storage domain of a volume out of the data domains which are active in
+// the data centers of the volume, match all the set filters and have room for the volume.
+type domainSelector struct {
+	// names is the ovirtStorageDomain parameter, a single domain or a comma separated list
+	names []string
+	regex *regexp.Regexp
+	// tag is looked for in the comment of the domain, oVirt doesn't tag storage domains
+	tag     string
+	policy  string
+	weights map[string]int
+	// headroom is the space left free on the domain, in bytes or in percents of its size
+	headroom        int64
+	headroomPercent int64
+	// overcommit, when not 0, limits the virtual size of the disks of the domain
+	overcommit float64
+}
+
+// candidate is a storage domain the volume can be created on
+type candidate struct {
+	domain   internal.StorageDomain
+	topology internal.Topology
+}
+
+func domainSelectorFrom(params map[string]string) (domainSelector, error) {
+	s := domainSelector{policy: policyMostFree}
+	for _, name := range strings.Split(params[parameterStorageDomainName], ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			s.names = append(s.names, name)
+		}
+	}
+	if v := params[parameterStorageDomainRegex]; v != "" {
+		regex, err := regexp.Compile("^(?:" + v + ")$")
+		if err != nil {
+			return s, fmt.Errorf("invalid parameter %s: %s", parameterStorageDomainRegex, err)
+		}
+		s.regex = regex
+	}
+	s.tag = strings.TrimSpace(params[parameterStorageDomainTag])
+
+	switch v := params[parameterStorageDomainPolicy]; v {
+	case "", policyMostFree:
+	case policyRoundRobin, policyWeighted:
+		s.policy = v
+	default:
+		return s, fmt.Errorf("invalid parameter %s '%s', expected %s, %s or %s",
+			parameterStorageDomainPolicy, v, policyMostFree, policyRoundRobin, policyWeighted)
+	}
+	if v := params[parameterStorageDomainWeights]; v != "" {
+		if s.policy != policyWeighted {
+			return s, fmt.Errorf("parameter %s is set, but the %s is not %s", parameterStorageDomainWeights, parameterStorageDomainPolicy, policyWeighted)
+		}
+		s.weights = map[string]int{}
+		for _, pair := range strings.Split(v, ",") {
+			kv := strings.Split(pair, "=")
+			weight, err := strconv.Atoi(strings.TrimSpace(kv[len(kv)-1]))
+			if len(kv) != 2 || err != nil || weight < 0 {
+				return s, fmt.Errorf("invalid parameter %s '%s', expected <domain>=<weight>,...", parameterStorageDomainWeights, v)
+			}
+			s.weights[strings.TrimSpace(kv[0])] = weight
+		}
+	}
+
+	if v := params[parameterStorageDomainHeadroom]; v != "" {
+		var err error
+		if strings.HasSuffix(v, "%") {
+			s.headroomPercent, err = strconv.ParseInt(strings.TrimSuffix(v, "%"), 10, 64)
+			if err == nil && (s.headroomPercent < 0 || s.headroomPercent >= 100) {
+				err = fmt.Errorf("out of range")
+			}
+		} else {
+			var quantity resource.Quantity
+			quantity, err = resource.ParseQuantity(v)
+			s.headroom = quantity.Value()
+			if err == nil && s.headroom < 0 {
+				err = fmt.Errorf("negative")
+			}
+		}
+		if err != nil {
+			return s, fmt.Errorf("invalid parameter %s '%s', expected a size like 10Gi or a percentage like 10%%", parameterStorageDomainHeadroom, v)
+		}
+	}
+	if v := params[parameterStorageDomainOvercommit]; v != "" {
+		ratio, err := strconv.ParseFloat(v, 64)
+		if err != nil || ratio <= 0 {
+			return s, fmt.Errorf("invalid parameter %s '%s', expected a positive ratio like 1.5", parameterStorageDomainOvercommit, v)
+		}
+		s.overcommit = ratio
+	}
+	return s, nil
+}
+
+// any tells if the selector has no filter, any data domain matches it
+func (s domainSelector) any() bool {
+	return len(s.names) == 0 && s.regex == nil && s.tag == ""
+}
+
+func (s domainSelector) matches(d internal.StorageDomain) bool {
+	if len(s.names) > 0 && !contains(s.names, d.Name) {
+		return false
+	}
+	if s.regex != nil && !s.regex.MatchString(d.Name) {
+		return false
+	}
+	if s.tag != "" {
+		var tags []string
+		for _, t := range strings.Split(d.Comment, ",") {
+			tags = append(tags, strings.TrimSpace(t))
+		}
+		if !contains(tags, s.tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// required is the free space a domain needs for the volume
+func (s domainSelector) required(d internal.StorageDomain, sizeInBytes int64) int64 {
+	return sizeInBytes + s.headroom + int64(d.Available+d.Used)*s.headroomPercent/100
+}
+
+// storageDomainFor picks the storage domain of the volume out of the data centers of the topologies,
+// or out of all the data centers when the volume isn't constrained. When no domain can hold the
+// volume the error is a rejection.
+func (p ovirtProvisioner) storageDomainFor(s domainSelector, sizeInBytes int64, topologies []internal.Topology) (internal.StorageDomain, internal.Topology, error) {
+	if topologies == nil && s.any() {
+		return internal.StorageDomain{}, internal.Topology{}, fmt.Errorf("one of the parameters %s, %s or %s is required",
+			parameterStorageDomainName, parameterStorageDomainRegex, parameterStorageDomainTag)
+	}
+	topologies, err := p.dataCenterTopologies(topologies)
+	if err != nil {
+		return internal.StorageDomain{}, internal.Topology{}, err
+	}
+
+	var candidates []candidate
+	var rejected, regions []string
+	for _, t := range topologies {
+		regions = append(regions, t.Region)
+		domains, err := p.ovirtApi.GetDataCenterStorageDomains(t.DataCenterId)
+		if err != nil {
+			return internal.StorageDomain{}, internal.Topology{}, err
+		}
+		for _, d := range domains {
+			if d.Type != "data" || !s.matches(d) {
+				continue
+			}
+			if d.Status != internal.StorageDomainStatusActive {
+				rejected = append(rejected, fmt.Sprintf("%s is %s in data center %s", d.Name, d.Status, t.Region))
+				continue
+			}
+			if required := s.required(d, sizeInBytes); int64(d.Available) < required {
+				rejected = append(rejected, fmt.Sprintf("%s has %s free out of the %s needed",
+					d.Name, resource.NewQuantity(int64(d.Available), resource.BinarySI), resource.NewQuantity(required, resource.BinarySI)))
+				continue
+			}
+			if s.overcommit > 0 {
+				allowed := int64(s.overcommit * float64(d.Available+d.Used))
+				if committed := int64(d.Committed) + sizeInBytes; committed > allowed {
+					rejected = append(rejected, fmt.Sprintf("%s would have %s committed out of the %s allowed by overcommit %v",
+						d.Name, resource.NewQuantity(committed, resource.BinarySI), resource.NewQuantity(allowed, resource.BinarySI), s.overcommit))
+					continue
+				}
+			}
+			if s.policy == policyWeighted && s.weight(d.Name) == 0 {
+				continue
+			}
+			candidates = append(candidates, candidate{domain: d, topology: t})
+		}
+	}
+	if len(candidates) == 0 {
+		message := fmt.Sprintf("no storage domain in data centers %v can hold a volume of %s",
+			regions, resource.NewQuantity(sizeInBytes, resource.BinarySI))
+		if len(rejected) > 0 {
+			message += ": " + strings.Join(rejected, ", ")
+		}
+		return internal.StorageDomain{}, internal.Topology{}, rejection{reasonNoStorageDomain, message}
+	}
+
+	chosen := p.choose(s, candidates)
+	glog.Infof("Selected storage domain %s of data center %s by policy %s out of %d candidates",
+		chosen.domain.Name, chosen.topology.Region, s.policy, len(candidates))
+	return chosen.domain, chosen.topology, nil
+}
+
+// dataCenterTopologies returns the topologies of the volume, or of all the data centers when
+// the claim doesn't restrict them
+func (p ovirtProvisioner) dataCenterTopologies(topologies []internal.Topology) ([]internal.Topology, error) {
+	if topologies != nil {
+		return topologies, nil
+	}
+	dataCenters, err := p.ovirtApi.GetDataCenters()
+	if err != nil {
+		return nil, err
+	}
+	for _, dc := range dataCenters {
+		topologies = append(topologies, internal.Topology{Region: dc.Name, DataCenterId: dc.Id})
+	}
+	return topologies, nil
+}
+
+// choose applies the policy of the selector to the candidates
+func (p ovirtProvisioner) choose(s domainSelector, candidates []candidate) candidate {
+	// a stable order, the same for every volume
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].domain.Name < candidates[j].domain.Name
+	})
+	switch s.policy {
+	case policyRoundRobin:
+		next := atomic.AddUint64(p.roundRobin, 1) - 1
+		return candidates[next%uint64(len(candidates))]
+	case policyWeighted:
+		total := 0
+		for _, c := range candidates {
+			total += s.weight(c.domain.Name)
+		}
+		r := rand.Intn(total)
+		for _, c := range candidates {
+			r -= s.weight(c.domain.Name)
+			if r < 0 {
+				return c
+			}
+		}
+	}
+	chosen := candidates[0]
+	for _, c := range candidates[1:] {
+		if c.domain.Available > chosen.domain.Available {
+			chosen = c
+		}
+	}
+	return chosen
+}
+
+// weight of a domain, a domain missing from the weights has weight 1
+func (s domainSelector) weight(name string) int {
+	if w, ok := s.weights[name]; ok {
+		return w
+	}
+	return 1
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ovirt/ovirt-openshift-extensions/internal"
+)
+
+// fakeOvirtWithDomains has three active data domains in dc1, gold-1 and gold-2 tagged gold
+func fakeOvirtWithDomains() *fakeOvirt {
+	ovirt := newFakeOvirt()
+	active := internal.StorageDomainStatusActive
+	ovirt.dataCenters["dc1-id"] = []internal.StorageDomain{
+		{Name: "gold-1", Type: "data", Status: active, Comment: "gold, fast", Available: 20 * gib, Used: 80 * gib},
+		{Name: "gold-2", Type: "data", Status: active, Comment: "gold", Available: 40 * gib, Used: 60 * gib},
+		{Name: "silver", Type: "data", Status: active, Available: 90 * gib, Used: 10 * gib},
+	}
+	return ovirt
+}
+
+func TestStorageDomainSelection(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		expected   string
+		err        string
+	}{
+		{"a single domain", map[string]string{parameterStorageDomainName: "gold-1"}, "gold-1", ""},
+		{"the most free of a list", map[string]string{parameterStorageDomainName: "gold-1, gold-2"}, "gold-2", ""},
+		{"the most free of a regex", map[string]string{parameterStorageDomainName: "", parameterStorageDomainRegex: "gold-.*"}, "gold-2", ""},
+		{"by tag", map[string]string{parameterStorageDomainName: "", parameterStorageDomainTag: "fast"}, "gold-1", ""},
+		{"by tag and regex", map[string]string{parameterStorageDomainName: "", parameterStorageDomainTag: "gold", parameterStorageDomainRegex: ".*-1"}, "gold-1", ""},
+		{"the most free of all", map[string]string{parameterStorageDomainName: "", parameterStorageDomainRegex: ".*"}, "silver", ""},
+		{"only weighted domains", map[string]string{parameterStorageDomainName: "", parameterStorageDomainRegex: "gold-.*|silver",
+			parameterStorageDomainPolicy: policyWeighted, parameterStorageDomainWeights: "gold-1=0,gold-2=0"}, "silver", ""},
+		{"headroom in bytes", map[string]string{parameterStorageDomainName: "gold-1,gold-2", parameterStorageDomainHeadroom: "40Gi"}, "", "gold-2 has 40Gi free out of the 41Gi needed"},
+		{"headroom in percents", map[string]string{parameterStorageDomainName: "gold-1,gold-2", parameterStorageDomainHeadroom: "20%"}, "gold-2", ""},
+		{"headroom too large", map[string]string{parameterStorageDomainName: "gold-1", parameterStorageDomainHeadroom: "20%"}, "", "gold-1 has 20Gi free out of the 21Gi needed"},
+		{"no match", map[string]string{parameterStorageDomainName: "bronze"}, "", "no storage domain in data centers"},
+		{"no criteria", map[string]string{parameterStorageDomainName: ""}, "", "one of the parameters"},
+		{"invalid regex", map[string]string{parameterStorageDomainRegex: "("}, "", "invalid parameter " + parameterStorageDomainRegex},
+		{"invalid policy", map[string]string{parameterStorageDomainPolicy: "random"}, "", "invalid parameter " + parameterStorageDomainPolicy},
+		{"weights without policy", map[string]string{parameterStorageDomainWeights: "gold-1=1"}, "", "parameter " + parameterStorageDomainWeights + " is set"},
+		{"invalid weights", map[string]string{parameterStorageDomainPolicy: policyWeighted, parameterStorageDomainWeights: "gold-1"}, "", "invalid parameter " + parameterStorageDomainWeights},
+		{"invalid headroom", map[string]string{parameterStorageDomainHeadroom: "100%"}, "", "invalid parameter " + parameterStorageDomainHeadroom},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ovirt := fakeOvirtWithDomains()
+			p := NewOvirtProvisioner(ovirt, nil, nil)
+			_, err := p.Provision(volumeOptions(test.parameters, nil))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ovirt.options.StorageDomain != test.expected {
+				t.Errorf("expected storage domain %s, got %s", test.expected, ovirt.options.StorageDomain)
+			}
+		})
+	}
+}
+
+func TestStorageDomainRoundRobin(t *testing.T) {
+	ovirt := fakeOvirtWithDomains()
+	p := NewOvirtProvisioner(ovirt, nil, nil)
+	var chosen []string
+	for i := 0; i < 4; i++ {
+		_, err := p.Provision(volumeOptions(map[string]string{
+			parameterStorageDomainName:   "silver,gold-1",
+			parameterStorageDomainPolicy: policyRoundRobin,
+		}, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		chosen = append(chosen, ovirt.options.StorageDomain)
+	}
+	expected := "gold-1,silver,gold-1,silver"
+	if strings.Join(chosen, ",") != expected {
+		t.Errorf("expected the domains %s in turn, got %v", expected, chosen)
+	}
+}
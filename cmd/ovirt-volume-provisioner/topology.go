@@ -0,0 +1,148 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/kubernetes-incubator/external-storage/lib/controller"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/kubernetes/pkg/kubelet/apis"
+
+	"github.com/ovirt/ovirt-openshift-extensions/internal"
+)
+
+const (
+	// annSelectedNode is set by the scheduler on a claim of a WaitForFirstConsumer StorageClass
+	annSelectedNode = "volume.kubernetes.io/selected-node"
+	// annStorageClass is the beta form of the claim storage class
+	annStorageClass = "volume.beta.kubernetes.io/storage-class"
+)
+
+// volumeTopologies returns the topologies the disk of the volume may be reachable from: the one of the
+// node selected by the scheduler, or else the ones allowed by the StorageClass. It returns nil when
+// the volume isn't constrained.
+func (p ovirtProvisioner) volumeTopologies(options controller.VolumeOptions) ([]internal.Topology, error) {
+	if node := options.PVC.Annotations[annSelectedNode]; node != "" {
+		if p.nodeMapper == nil {
+			return nil, fmt.Errorf("claim %s/%s has a selected node, but the provisioner has no node mapping", options.PVC.Namespace, options.PVC.Name)
+		}
+		vmId, err := p.nodeMapper.VMId(node)
+		if err != nil {
+			return nil, err
+		}
+		topology, err := internal.VMTopology(p.ovirtApi, vmId)
+		if err != nil {
+			return nil, fmt.Errorf("failed getting the topology of node %s: %s", node, err)
+		}
+		return []internal.Topology{topology}, nil
+	}
+	if p.client == nil {
+		return nil, nil
+	}
+
+	className := claimClass(options.PVC)
+	if className == "" {
+		return nil, nil
+	}
+	class, err := p.client.StorageV1().StorageClasses().Get(className, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var topologies []internal.Topology
+	for _, term := range class.AllowedTopologies {
+		t, err := p.termTopologies(term)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowedTopologies of StorageClass %s: %s", className, err)
+		}
+		topologies = append(topologies, t...)
+	}
+	if len(class.AllowedTopologies) > 0 && len(topologies) == 0 {
+		return nil, fmt.Errorf("no oVirt cluster or data center matches the allowedTopologies of StorageClass %s", className)
+	}
+	return topologies, nil
+}
+
+// termTopologies returns the topologies matching all the requirements of the term
+func (p ovirtProvisioner) termTopologies(term v1.TopologySelectorTerm) ([]internal.Topology, error) {
+	var zones, regions []string
+	for _, requirement := range term.MatchLabelExpressions {
+		switch requirement.Key {
+		case apis.LabelZoneFailureDomain:
+			zones = requirement.Values
+		case apis.LabelZoneRegion:
+			regions = requirement.Values
+		default:
+			return nil, fmt.Errorf("unsupported topology key %s, only %s and %s are supported",
+				requirement.Key, apis.LabelZoneFailureDomain, apis.LabelZoneRegion)
+		}
+	}
+
+	var topologies []internal.Topology
+	for _, zone := range zones {
+		t, err := internal.ZoneTopology(p.ovirtApi, zone)
+		if err != nil {
+			return nil, err
+		}
+		if len(regions) == 0 || contains(regions, t.Region) {
+			topologies = append(topologies, t)
+		}
+	}
+	if len(zones) == 0 {
+		for _, region := range regions {
+			t, err := internal.RegionTopology(p.ovirtApi, region)
+			if err != nil {
+				return nil, err
+			}
+			topologies = append(topologies, t)
+		}
+	}
+	return topologies, nil
+}
+
+// claimClass returns the name of the StorageClass of the claim
+func claimClass(claim *v1.PersistentVolumeClaim) string {
+	if claim.Spec.StorageClassName != nil {
+		return *claim.Spec.StorageClassName
+	}
+	return claim.Annotations[annStorageClass]
+}
+
+// nodeAffinity binds the volume to the nodes of the region
+func nodeAffinity(topology internal.Topology) *v1.VolumeNodeAffinity {
+	return &v1.VolumeNodeAffinity{
+		Required: &v1.NodeSelector{
+			NodeSelectorTerms: []v1.NodeSelectorTerm{{
+				MatchExpressions: []v1.NodeSelectorRequirement{{
+					Key:      apis.LabelZoneRegion,
+					Operator: v1.NodeSelectorOpIn,
+					Values:   []string{topology.Region},
+				}},
+			}},
+		},
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/kubernetes/pkg/kubelet/apis"
+
+	"github.com/ovirt/ovirt-openshift-extensions/internal"
+)
+
+// kubeWithStorageClass serves the claim and a StorageClass named ovirt with the allowed topologies
+func kubeWithStorageClass(t *testing.T, allowedTopologies string) (kubernetes.Interface, func()) {
+	return kubeWithRoutes(t, map[string]http.HandlerFunc{
+		"/api/v1/namespaces/default/persistentvolumeclaims/claim": kubeObject(
+			`{"kind": "PersistentVolumeClaim", "apiVersion": "v1", "spec": {}}`),
+		"/apis/storage.k8s.io/v1/storageclasses/ovirt": kubeObject(fmt.Sprintf(
+			`{"kind": "StorageClass", "apiVersion": "storage.k8s.io/v1", "metadata": {"name": "ovirt"},
+				"provisioner": "ovirt-volume-provisioner", "allowedTopologies": %s}`, allowedTopologies)),
+	})
+}
+
+// kubeWithRoutes serves the routes by the request path as a kube API server, any other path
+// is not found
+func kubeWithRoutes(t *testing.T, routes map[string]http.HandlerFunc) (kubernetes.Interface, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		route, ok := routes[r.URL.Path]
+		if !ok {
+			kubeNotFound(w)
+			return
+		}
+		route(w, r)
+	}))
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL, QPS: 1000, Burst: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server.Close
+}
+
+// kubeObject serves the object json on any method
+func kubeObject(object string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, object)
+	}
+}
+
+func kubeNotFound(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprint(w, `{"kind": "Status", "apiVersion": "v1", "status": "Failure", "message": "not found", "reason": "NotFound", "code": 404}`)
+}
+
+func nodeMapperOf(t *testing.T, ovirt internal.OvirtApi) *internal.NodeMapper {
+	mapper, err := internal.NewNodeMapper(internal.NodeMappingConfig{Strategy: internal.MapByVMName}, ovirt, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mapper
+}
+
+func TestProvisionForSelectedNode(t *testing.T) {
+	ovirt := newFakeOvirt()
+	p := NewOvirtProvisioner(ovirt, nil, nodeMapperOf(t, ovirt))
+	pv, err := p.Provision(volumeOptions(map[string]string{parameterStorageDomainName: ""}, map[string]string{annSelectedNode: "node2"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ovirt.options.StorageDomain != "data3" {
+		t.Errorf("expected the active data domain of the node data center, got %s", ovirt.options.StorageDomain)
+	}
+	if pv.Labels[apis.LabelZoneRegion] != "dc2" {
+		t.Errorf("expected the region of the node, got %v", pv.Labels)
+	}
+	if pv.Spec.NodeAffinity == nil ||
+		pv.Spec.NodeAffinity.Required.NodeSelectorTerms[0].MatchExpressions[0].Values[0] != "dc2" {
+		t.Errorf("expected a node affinity to the region of the node, got %+v", pv.Spec.NodeAffinity)
+	}
+
+	_, err = p.Provision(volumeOptions(map[string]string{parameterStorageDomainName: "data1"}, map[string]string{annSelectedNode: "node2"}))
+	if err == nil || !strings.Contains(err.Error(), "no storage domain in data centers [dc2]") {
+		t.Errorf("expected the domain of another data center to be refused, got %v", err)
+	}
+}
+
+func TestProvisionWithoutTopology(t *testing.T) {
+	ovirt := newFakeOvirt()
+	p := NewOvirtProvisioner(ovirt, nil, nil)
+	pv, err := p.Provision(volumeOptions(map[string]string{}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pv.Labels[apis.LabelZoneRegion] != "dc1" || pv.Spec.NodeAffinity != nil {
+		t.Errorf("expected only the region label of the domain data center, got %v %+v", pv.Labels, pv.Spec.NodeAffinity)
+	}
+	if _, ok := pv.Labels[apis.LabelZoneFailureDomain]; ok {
+		t.Errorf("expected no zone label, a disk is reachable from all the clusters of its data center")
+	}
+
+	_, err = p.Provision(volumeOptions(map[string]string{parameterStorageDomainName: ""}, nil))
+	if err == nil || !strings.Contains(err.Error(), "is required") {
+		t.Errorf("expected the storage domain to be required, got %v", err)
+	}
+}
+
+func TestProvisionWithAllowedTopologies(t *testing.T) {
+	tests := []struct {
+		name          string
+		topologies    string
+		parameter     string
+		storageDomain string
+		region        string
+		errMessage    string
+	}{
+		{"zone", `[{"matchLabelExpressions": [{"key": "failure-domain.beta.kubernetes.io/zone", "values": ["cluster2"]}]}]`, "", "data3", "dc2", ""},
+		{"region", `[{"matchLabelExpressions": [{"key": "failure-domain.beta.kubernetes.io/region", "values": ["dc1"]}]}]`, "data1", "data1", "dc1", ""},
+		{"second term", `[{"matchLabelExpressions": [{"key": "failure-domain.beta.kubernetes.io/region", "values": ["dc2"]}]},
+			{"matchLabelExpressions": [{"key": "failure-domain.beta.kubernetes.io/zone", "values": ["cluster1"]}]}]`, "data1", "data1", "dc1", ""},
+		{"zone out of region", `[{"matchLabelExpressions": [{"key": "failure-domain.beta.kubernetes.io/zone", "values": ["cluster1"]},
+			{"key": "failure-domain.beta.kubernetes.io/region", "values": ["dc2"]}]}]`, "data1", "", "", "no oVirt cluster or data center matches"},
+		{"unsupported key", `[{"matchLabelExpressions": [{"key": "kubernetes.io/hostname", "values": ["node1"]}]}]`, "data1", "", "", "unsupported topology key"},
+		{"unknown zone", `[{"matchLabelExpressions": [{"key": "failure-domain.beta.kubernetes.io/zone", "values": ["other"]}]}]`, "data1", "", "", "zone other"},
+	}
+	for _, test := range tests {
+		client, stop := kubeWithStorageClass(t, test.topologies)
+		ovirt := newFakeOvirt()
+		p := NewOvirtProvisioner(ovirt, client, nil)
+		options := volumeOptions(map[string]string{parameterStorageDomainName: test.parameter}, nil)
+		className := "ovirt"
+		options.PVC.Spec.StorageClassName = &className
+		pv, err := p.Provision(options)
+		stop()
+		if test.errMessage != "" {
+			if err == nil || !strings.Contains(err.Error(), test.errMessage) {
+				t.Errorf("%s: expected an error with '%s', got %v", test.name, test.errMessage, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if ovirt.options.StorageDomain != test.storageDomain || pv.Labels[apis.LabelZoneRegion] != test.region || pv.Spec.NodeAffinity == nil {
+			t.Errorf("%s: expected domain %s in region %s, got %s %v", test.name, test.storageDomain, test.region, ovirt.options.StorageDomain, pv.Labels)
+		}
+	}
+}
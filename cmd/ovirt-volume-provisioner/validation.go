@@ -0,0 +1,329 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/lib/controller"
+	"k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/ovirt/ovirt-openshift-extensions/internal"
+)
+
+const (
+	// annStorageProvisioner is set on a claim by kubernetes to the provisioner of its StorageClass
+	annStorageProvisioner = "volume.beta.kubernetes.io/storage-provisioner"
+
+	reasonInvalidParameters = "InvalidParameters"
+)
+
+// supportedFsTypes are the file systems the flex driver can make on a volume
+var supportedFsTypes = []string{"ext2", "ext3", "ext4", "xfs"}
+
+// knownParameters are all the StorageClass parameters of the provisioner
+var knownParameters = []string{
+	parameterMinSize, parameterMaxSize, parameterSizeGranularity, parameterNamespaceCapacity,
+	parameterStorageDomainName, parameterDiskThinProvisioning, parameterFsType,
+	parameterDiskInterface, parameterDiskProfileId, parameterDiskWipeAfterDelete, parameterDiskPassDiscard,
+	parameterDiskFormat, parameterDiskQcowCompat, parameterDiskDescription, parameterQuotaId, parameterDiskIncrementalBackup,
+	parameterSourceDiskId, parameterSourceDiskName, parameterSourceTemplate,
+	parameterReclaimMode, parameterArchiveStorageDomain, parameterArchiveRetention,
+	parameterStorageDomainRegex, parameterStorageDomainTag, parameterStorageDomainPolicy, parameterStorageDomainWeights,
+	parameterStorageDomainHeadroom, parameterStorageDomainOvercommit, parameterDiskNameTemplate,
+}
+
+// validationError lists all the problems of the parameters of a StorageClass or of a claim
+type validationError []string
+
+func (e validationError) Error() string {
+	return strings.Join(e, "; ")
+}
+
+// orNil returns the error, or nil when there is no problem
+func (e validationError) orNil() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+func (e *validationError) add(err error) {
+	if err != nil {
+		*e = append(*e, err.Error())
+	}
+}
+
+// validateParameters checks the StorageClass parameters without the engine, as Provision parses them
+func validateParameters(params map[string]string) error {
+	var errs validationError
+	var unknown []string
+	for key := range params {
+		if !contains(knownParameters, key) {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	for _, key := range unknown {
+		errs.add(fmt.Errorf("unknown parameter %s", key))
+	}
+
+	if v, ok := params[parameterFsType]; ok {
+		errs.add(validateFsType(v))
+	}
+	thinProvisioning, err := thinProvisioningParameter(params)
+	errs.add(err)
+	// the description and the disk name of a claim are validated with any claim, their variables are known
+	anyClaim := controller.VolumeOptions{
+		PVName:     "validation",
+		PVC:        &v1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "claim", Namespace: "namespace"}},
+		Parameters: params,
+	}
+	_, _, err = diskParameters(anyClaim, 1, thinProvisioning)
+	errs.add(err)
+	_, err = diskName(anyClaim, "cluster")
+	errs.add(err)
+	_, err = domainSelectorFrom(params)
+	errs.add(err)
+	_, err = reclaimParameters(params)
+	errs.add(err)
+
+	sizes := map[string]int64{}
+	for _, name := range []string{parameterMinSize, parameterMaxSize, parameterSizeGranularity, parameterNamespaceCapacity} {
+		sizes[name], err = sizeParameter(params, name)
+		errs.add(err)
+	}
+	if sizes[parameterMaxSize] > 0 && sizes[parameterMinSize] > sizes[parameterMaxSize] {
+		errs.add(fmt.Errorf("invalid parameters, %s is larger than %s", parameterMinSize, parameterMaxSize))
+	}
+	errs.add(validateSource(params))
+	return errs.orNil()
+}
+
+// validateClaimAnnotations checks the source disk annotations of a claim
+func validateClaimAnnotations(annotations map[string]string) error {
+	var errs validationError
+	errs.add(validateSource(annotations))
+	return errs.orNil()
+}
+
+// validateSource refuses a source disk id set with a disk name or a template
+func validateSource(source map[string]string) error {
+	if source[parameterSourceDiskId] != "" && (source[parameterSourceDiskName] != "" || source[parameterSourceTemplate] != "") {
+		return fmt.Errorf("%s can't be set with %s or %s", parameterSourceDiskId, parameterSourceDiskName, parameterSourceTemplate)
+	}
+	return nil
+}
+
+func validateFsType(fsType string) error {
+	if !contains(supportedFsTypes, fsType) {
+		return fmt.Errorf("unsupported parameter %s '%s', expected one of %s", parameterFsType, fsType, strings.Join(supportedFsTypes, ", "))
+	}
+	return nil
+}
+
+// thinProvisioningParameter returns the thin provisioning of the disk, true when it isn't set
+func thinProvisioningParameter(params map[string]string) (bool, error) {
+	v, ok := params[parameterDiskThinProvisioning]
+	if !ok {
+		return true, nil
+	}
+	return parseBool(parameterDiskThinProvisioning, v)
+}
+
+// validateWithEngine checks that the storage domains and the disk profile of the parameters exist
+// in the engine. The named storage domains must be data domains, the regex and the tag must match
+// at least one data domain. The problems are a validationError, any other error is a failure to ask
+// the engine. The status of a domain is left to the provisioning of each claim, since a domain in
+// maintenance comes back without a change of the class.
+func (p ovirtProvisioner) validateWithEngine(params map[string]string) error {
+	selector, err := domainSelectorFrom(params)
+	if err != nil {
+		return err
+	}
+	topologies, err := p.dataCenterTopologies(nil)
+	if err != nil {
+		return err
+	}
+	domains := map[string]internal.StorageDomain{}
+	var dataDomains []internal.StorageDomain
+	for _, t := range topologies {
+		inDataCenter, err := p.ovirtApi.GetDataCenterStorageDomains(t.DataCenterId)
+		if err != nil {
+			return err
+		}
+		for _, d := range inDataCenter {
+			domains[d.Name] = d
+			if d.Type == "data" {
+				dataDomains = append(dataDomains, d)
+			}
+		}
+	}
+
+	var errs validationError
+	for _, name := range selector.names {
+		d, ok := domains[name]
+		switch {
+		case !ok:
+			errs.add(fmt.Errorf("storage domain %s of parameter %s doesn't exist", name, parameterStorageDomainName))
+		case d.Type != "data":
+			errs.add(fmt.Errorf("storage domain %s of parameter %s is a %s domain, not a data domain", name, parameterStorageDomainName, d.Type))
+		}
+	}
+	if selector.regex != nil || selector.tag != "" {
+		matching := false
+		for _, d := range dataDomains {
+			matching = matching || selector.matches(d)
+		}
+		if !matching {
+			errs.add(fmt.Errorf("no data storage domain matches the parameters %s '%s' and %s '%s'",
+				parameterStorageDomainRegex, params[parameterStorageDomainRegex], parameterStorageDomainTag, params[parameterStorageDomainTag]))
+		}
+	}
+	if name := params[parameterArchiveStorageDomain]; name != "" {
+		if d, ok := domains[name]; !ok || d.Type != "data" {
+			errs.add(fmt.Errorf("storage domain %s of parameter %s is not a data domain", name, parameterArchiveStorageDomain))
+		}
+	}
+	if id := params[parameterDiskProfileId]; id != "" {
+		err = p.validateDiskProfile(id, selector, domains, &errs)
+		if err != nil {
+			return err
+		}
+	}
+	return errs.orNil()
+}
+
+// validateDiskProfile checks that the disk profile exists and belongs to the named storage domains.
+// The problems are added to errs, the error is a failure to get the profile.
+func (p ovirtProvisioner) validateDiskProfile(id string, selector domainSelector, domains map[string]internal.StorageDomain, errs *validationError) error {
+	profile, err := p.ovirtApi.GetDiskProfile(id)
+	if _, notFound := err.(internal.NotFound); notFound {
+		errs.add(fmt.Errorf("disk profile %s of parameter %s doesn't exist", id, parameterDiskProfileId))
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed getting disk profile %s: %s", id, err)
+	}
+	if profile.StorageDomain == nil {
+		return nil
+	}
+	for _, name := range selector.names {
+		if d, ok := domains[name]; ok && d.Id != profile.StorageDomain.Id {
+			errs.add(fmt.Errorf("disk profile %s of parameter %s doesn't belong to storage domain %s", profile.Name, parameterDiskProfileId, name))
+		}
+	}
+	return nil
+}
+
+// classValidations caches the validations of the StorageClasses by their resource version. ShouldProvision
+// is called on every sync of a pending claim, the engine is asked once per version of a class, and an
+// invalid claim is reported once per version of the claim.
+type classValidations struct {
+	sync.Mutex
+	classes map[string]*classValidation
+}
+
+type classValidation struct {
+	resourceVersion string
+	err             error
+	// reported are the resource versions of the claims the invalid parameters were reported on
+	reported map[types.UID]string
+}
+
+func newClassValidations() *classValidations {
+	return &classValidations{classes: map[string]*classValidation{}}
+}
+
+// validateClass validates the parameters of the StorageClass, statically and with the engine. An error of
+// the engine, which then can't tell, isn't cached.
+func (p ovirtProvisioner) validateClass(class *storagev1.StorageClass) error {
+	p.validations.Lock()
+	cached, ok := p.validations.classes[class.Name]
+	p.validations.Unlock()
+	if ok && cached.resourceVersion == class.ResourceVersion {
+		return cached.err
+	}
+
+	err := validateParameters(class.Parameters)
+	if err == nil {
+		err = p.validateWithEngine(class.Parameters)
+	}
+	if _, invalid := err.(validationError); invalid || err == nil {
+		p.validations.Lock()
+		p.validations.classes[class.Name] = &classValidation{resourceVersion: class.ResourceVersion, err: err, reported: map[types.UID]string{}}
+		p.validations.Unlock()
+	}
+	return err
+}
+
+// firstReport tells if the invalid parameters of this version of the claim and of its class weren't reported yet
+func (p ovirtProvisioner) firstReport(class *storagev1.StorageClass, claim *v1.PersistentVolumeClaim) bool {
+	p.validations.Lock()
+	defer p.validations.Unlock()
+	cached, ok := p.validations.classes[class.Name]
+	if !ok || cached.resourceVersion != class.ResourceVersion {
+		return true
+	}
+	if version, reported := cached.reported[claim.UID]; reported && version == claim.ResourceVersion {
+		return false
+	}
+	cached.reported[claim.UID] = claim.ResourceVersion
+	return true
+}
+
+// ShouldProvision implements the Qualifier of the provision controller: a claim of a StorageClass
+// with invalid parameters is not provisioned, the problems are recorded as an event of the claim.
+// A claim of another provisioner is left to the controller.
+func (p ovirtProvisioner) ShouldProvision(claim *v1.PersistentVolumeClaim) bool {
+	if claim.Annotations[annStorageProvisioner] != ProvisionerName || p.client == nil {
+		return true
+	}
+	className := claimClass(claim)
+	class, err := p.client.StorageV1().StorageClasses().Get(className, metav1.GetOptions{})
+	if err != nil {
+		// the controller fails the provisioning with the same error
+		glog.Warningf("Failed getting StorageClass %s of claim %s/%s: %v", className, claim.Namespace, claim.Name, err)
+		return true
+	}
+	err = p.validateClass(class)
+	if err == nil {
+		err = validateClaimAnnotations(claim.Annotations)
+	}
+	if _, invalid := err.(validationError); !invalid {
+		if err != nil {
+			// the engine can't tell, the provisioning tries again
+			glog.Warningf("Failed validating StorageClass %s of claim %s/%s with the engine: %v", className, claim.Namespace, claim.Name, err)
+		}
+		return true
+	}
+	if !p.firstReport(class, claim) {
+		return false
+	}
+	glog.Warningf("Not provisioning claim %s/%s of StorageClass %s: %v", claim.Namespace, claim.Name, className, err)
+	if p.recorder != nil {
+		p.recorder.Event(claimReference(claim), v1.EventTypeWarning, reasonInvalidParameters, err.Error())
+	}
+	return false
+}
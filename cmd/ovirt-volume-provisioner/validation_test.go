@@ -0,0 +1,236 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/ovirt/ovirt-openshift-extensions/internal"
+)
+
+func (f *fakeOvirt) GetDiskProfile(id string) (internal.DiskProfile, error) {
+	profiles := map[string]string{"gold-id": "data1-id", "silver-id": "data3-id"}
+	domainId, ok := profiles[id]
+	if !ok {
+		return internal.DiskProfile{}, internal.NotFound{}
+	}
+	return internal.DiskProfile{Id: id, Name: strings.TrimSuffix(id, "-id"), StorageDomain: &internal.Reference{Id: domainId}}, nil
+}
+
+func TestValidateParameters(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		err        string
+	}{
+		{"valid", map[string]string{parameterStorageDomainName: "data1", parameterFsType: "xfs", parameterDiskThinProvisioning: "false"}, ""},
+		{"disk name", map[string]string{parameterDiskNameTemplate: "${cluster}-${pvc.namespace}-${pvc.name}"}, ""},
+		{"misspelled parameter", map[string]string{"ovirtStorageDomian": "data1"}, "unknown parameter ovirtStorageDomian"},
+		{"thin provisioning", map[string]string{parameterDiskThinProvisioning: "maybe"}, "invalid value 'maybe' for parameter ovirtDiskThinProvisioning"},
+		{"fsType", map[string]string{parameterFsType: "btrfs"}, "unsupported parameter fsType 'btrfs'"},
+		{"disk format", map[string]string{parameterDiskFormat: "vmdk"}, "invalid format 'vmdk'"},
+		{"description", map[string]string{parameterDiskDescription: "${pvc.uid}"}, "the supported variables are"},
+		{"disk name", map[string]string{parameterDiskNameTemplate: "${pvc.namespace}-${pvc.uid}"}, "invalid parameter ovirtDiskNameTemplate '${pvc.namespace}-${pvc.uid}'"},
+		{"policy", map[string]string{parameterStorageDomainPolicy: "random"}, "invalid parameter ovirtStorageDomainPolicy 'random'"},
+		{"reclaim mode", map[string]string{parameterReclaimMode: "keep"}, "invalid parameter ovirtReclaimMode 'keep'"},
+		{"sizes", map[string]string{parameterMinSize: "10Gi", parameterMaxSize: "1Gi"}, "minSize is larger than maxSize"},
+		{"source", map[string]string{parameterSourceDiskId: "golden-id", parameterSourceDiskName: "golden"}, "ovirtSourceDiskId can't be set with"},
+		{"all the problems", map[string]string{parameterFsType: "btrfs", parameterMaxSize: "big"},
+			"unsupported parameter fsType 'btrfs', expected one of ext2, ext3, ext4, xfs; invalid parameter maxSize 'big', expected a size like 10Gi"},
+	}
+	for _, test := range tests {
+		err := validateParameters(test.parameters)
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: expected error '%s', got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestValidateWithEngine(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		err        string
+	}{
+		{"valid", map[string]string{parameterStorageDomainName: "data1,data3", parameterArchiveStorageDomain: "data3"}, ""},
+		{"misspelled domain", map[string]string{parameterStorageDomainName: "dta1"}, "storage domain dta1 of parameter ovirtStorageDomain doesn't exist"},
+		// the status of a domain is checked by the provisioning of each claim
+		{"inactive domain", map[string]string{parameterStorageDomainName: "data2"}, ""},
+		{"iso domain", map[string]string{parameterStorageDomainName: "iso2"}, "iso2 of parameter ovirtStorageDomain is a iso domain"},
+		{"regex", map[string]string{parameterStorageDomainRegex: "fast-.*"}, "no data storage domain matches"},
+		{"matching regex", map[string]string{parameterStorageDomainRegex: "data.*"}, ""},
+		{"archive domain", map[string]string{parameterArchiveStorageDomain: "iso2"}, "storage domain iso2 of parameter ovirtArchiveStorageDomain is not a data domain"},
+		{"disk profile", map[string]string{parameterStorageDomainName: "data1", parameterDiskProfileId: "gold-id"}, ""},
+		{"missing disk profile", map[string]string{parameterDiskProfileId: "bronze-id"}, "disk profile bronze-id of parameter ovirtDiskProfileId doesn't exist"},
+		{"disk profile of another domain", map[string]string{parameterStorageDomainName: "data1", parameterDiskProfileId: "silver-id"},
+			"disk profile silver of parameter ovirtDiskProfileId doesn't belong to storage domain data1"},
+	}
+	p := NewOvirtProvisioner(newFakeOvirt(), nil, nil).(*ovirtProvisioner)
+	for _, test := range tests {
+		err := p.validateWithEngine(test.parameters)
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: expected error '%s', got %v", test.name, test.err, err)
+		}
+		if _, invalid := err.(validationError); err != nil && !invalid {
+			t.Errorf("%s: expected a validation error, got %v", test.name, err)
+		}
+	}
+}
+
+// kubeWithStorageClasses serves the StorageClasses by name
+func kubeWithStorageClasses(t *testing.T, classes map[string]map[string]string) (kubernetes.Interface, func()) {
+	routes := map[string]http.HandlerFunc{}
+	for name, params := range classes {
+		class, _ := json.Marshal(storagev1.StorageClass{
+			TypeMeta:    metav1.TypeMeta{Kind: "StorageClass", APIVersion: "storage.k8s.io/v1"},
+			ObjectMeta:  metav1.ObjectMeta{Name: name},
+			Provisioner: ProvisionerName,
+			Parameters:  params,
+		})
+		routes["/apis/storage.k8s.io/v1/storageclasses/"+name] = kubeObject(string(class))
+	}
+	return kubeWithRoutes(t, routes)
+}
+
+func TestShouldProvision(t *testing.T) {
+	client, stop := kubeWithStorageClasses(t, map[string]map[string]string{
+		"valid":   {parameterStorageDomainName: "data1"},
+		"invalid": {parameterStorageDomainName: "dta1", parameterDiskThinProvisioning: "maybe"},
+		"domain":  {parameterStorageDomainName: "dta1"},
+	})
+	defer stop()
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		event       string
+	}{
+		{"valid", map[string]string{annStorageProvisioner: ProvisionerName}, ""},
+		{"invalid", map[string]string{annStorageProvisioner: ProvisionerName},
+			"invalid value 'maybe' for parameter ovirtDiskThinProvisioning, expected true or false"},
+		{"domain", map[string]string{annStorageProvisioner: ProvisionerName},
+			"storage domain dta1 of parameter ovirtStorageDomain doesn't exist"},
+		{"invalid", map[string]string{annStorageProvisioner: "other-provisioner"}, ""},
+		{"valid", map[string]string{annStorageProvisioner: ProvisionerName, parameterSourceDiskId: "golden-id", parameterSourceTemplate: "centos"},
+			"ovirtSourceDiskId can't be set with ovirtSourceDiskName or ovirtSourceTemplate"},
+		// the controller fails the claim of a missing StorageClass
+		{"missing", map[string]string{annStorageProvisioner: ProvisionerName}, ""},
+	}
+	for _, test := range tests {
+		p := NewOvirtProvisioner(newFakeOvirt(), client, nil).(*ovirtProvisioner)
+		recorder := record.NewFakeRecorder(10)
+		p.recorder = recorder
+		className := test.name
+		claim := &v1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "claim", Namespace: "default", Annotations: test.annotations},
+			Spec:       v1.PersistentVolumeClaimSpec{StorageClassName: &className},
+		}
+
+		should := p.ShouldProvision(claim)
+		if should != (test.event == "") {
+			t.Errorf("%s: expected to provision %v, got %v", test.name, test.event == "", should)
+		}
+		if test.event == "" {
+			continue
+		}
+		expected := v1.EventTypeWarning + " " + reasonInvalidParameters + " " + test.event
+		if event := <-recorder.Events; event != expected {
+			t.Errorf("%s: expected event %q, got %q", test.name, expected, event)
+		}
+	}
+}
+
+func TestShouldProvisionValidatesClassOnce(t *testing.T) {
+	client, stop := kubeWithStorageClasses(t, map[string]map[string]string{"domain": {parameterStorageDomainName: "dta1"}})
+	defer stop()
+	ovirt := newFakeOvirt()
+	p := NewOvirtProvisioner(ovirt, client, nil).(*ovirtProvisioner)
+	recorder := record.NewFakeRecorder(10)
+	p.recorder = recorder
+	className := "domain"
+	claim := func(uid string) *v1.PersistentVolumeClaim {
+		return &v1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "claim-" + uid, Namespace: "default", UID: types.UID(uid),
+				Annotations: map[string]string{annStorageProvisioner: ProvisionerName}},
+			Spec: v1.PersistentVolumeClaimSpec{StorageClassName: &className},
+		}
+	}
+
+	for _, uid := range []string{"1", "1", "2"} {
+		if p.ShouldProvision(claim(uid)) {
+			t.Errorf("claim %s: expected the invalid class to fail it", uid)
+		}
+	}
+	if ovirt.dataCenterLookups != 1 {
+		t.Errorf("expected the class to be validated with the engine once, got %d lookups", ovirt.dataCenterLookups)
+	}
+	if len(recorder.Events) != 2 {
+		t.Errorf("expected an event of each claim, got %d", len(recorder.Events))
+	}
+}
+
+func TestProvisionRefusesInvalidParameters(t *testing.T) {
+	for _, params := range []map[string]string{{parameterDiskThinProvisioning: "maybe"}, {parameterFsType: "btrfs"}} {
+		ovirt := newFakeOvirt()
+		_, err := NewOvirtProvisioner(ovirt, nil, nil).Provision(volumeOptions(params, nil))
+		if err == nil || ovirt.created {
+			t.Errorf("expected %v to fail the provisioning, got %v", params, err)
+		}
+	}
+}
+
+func TestProvisionAfterStorageDomainMaintenance(t *testing.T) {
+	client, stop := kubeWithStorageClasses(t, map[string]map[string]string{"maintenance": {parameterStorageDomainName: "data2"}})
+	defer stop()
+	ovirt := newFakeOvirt()
+	p := NewOvirtProvisioner(ovirt, client, nil).(*ovirtProvisioner)
+	p.recorder = record.NewFakeRecorder(10)
+	className := "maintenance"
+	claim := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "claim", Namespace: "default", UID: "1",
+			Annotations: map[string]string{annStorageProvisioner: ProvisionerName}},
+		Spec: v1.PersistentVolumeClaimSpec{StorageClassName: &className},
+	}
+	options := volumeOptions(map[string]string{parameterStorageDomainName: "data2"}, nil)
+	// the claim is provisioned apart from the kubernetes objects of its class
+	provisioner := NewOvirtProvisioner(ovirt, nil, nil)
+
+	if !p.ShouldProvision(claim) {
+		t.Fatal("expected a domain in maintenance to leave the class valid")
+	}
+	_, err := provisioner.Provision(options)
+	if err == nil || !strings.Contains(err.Error(), "data2 is maintenance") || ovirt.created {
+		t.Fatalf("expected the domain in maintenance to fail the provisioning, got %v", err)
+	}
+
+	ovirt.dataCenters["dc2-id"][1].Status = internal.StorageDomainStatusActive
+	if !p.ShouldProvision(claim) {
+		t.Error("expected the class to stay valid")
+	}
+	if _, err := provisioner.Provision(options); err != nil || !ovirt.created {
+		t.Errorf("expected the active domain to provision the claim, got %v", err)
+	}
+}
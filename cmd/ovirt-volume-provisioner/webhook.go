@@ -0,0 +1,104 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/golang/glog"
+	"k8s.io/api/admission/v1beta1"
+	"k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// webhookPath is where the validating admission webhook is served
+const webhookPath = "/validate"
+
+// serveWebhook serves the validating admission webhook of the StorageClasses of the provisioner
+// and of the annotations of the claims, over TLS
+func serveWebhook(p *ovirtProvisioner, addr string, certFile string, keyFile string) error {
+	mux := http.NewServeMux()
+	mux.Handle(webhookPath, admissionHandler{p})
+	glog.Infof("Serving the validating admission webhook on %s%s", addr, webhookPath)
+	return (&http.Server{Addr: addr, Handler: mux}).ListenAndServeTLS(certFile, keyFile)
+}
+
+// admissionHandler answers the AdmissionReviews of the api server
+type admissionHandler struct {
+	provisioner *ovirtProvisioner
+}
+
+func (h admissionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	review := v1beta1.AdmissionReview{}
+	err := json.NewDecoder(r.Body).Decode(&review)
+	if err != nil || review.Request == nil {
+		http.Error(w, fmt.Sprintf("invalid AdmissionReview: %v", err), http.StatusBadRequest)
+		return
+	}
+	response := &v1beta1.AdmissionResponse{UID: review.Request.UID, Allowed: true}
+	err = h.review(review.Request)
+	if err != nil {
+		glog.Infof("Rejecting %s %s: %v", review.Request.Kind.Kind, review.Request.Name, err)
+		response.Allowed = false
+		response.Result = &metav1.Status{Status: metav1.StatusFailure, Reason: metav1.StatusReasonInvalid, Message: err.Error()}
+	}
+	review.Response = response
+	review.Request = nil
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(review)
+	if err != nil {
+		glog.Errorf("Failed writing the AdmissionReview response: %v", err)
+	}
+}
+
+// review returns the problems of the object of the request. A StorageClass of another provisioner
+// and any other object are allowed. When the engine can't be asked, the StorageClass is allowed,
+// the provisioner validates it again on every claim.
+func (h admissionHandler) review(request *v1beta1.AdmissionRequest) error {
+	switch {
+	case request.Kind.Group == storagev1.GroupName && request.Kind.Kind == "StorageClass":
+		class := storagev1.StorageClass{}
+		err := json.Unmarshal(request.Object.Raw, &class)
+		if err != nil {
+			return fmt.Errorf("invalid StorageClass: %s", err)
+		}
+		if class.Provisioner != ProvisionerName {
+			return nil
+		}
+		err = validateParameters(class.Parameters)
+		if err != nil {
+			return err
+		}
+		err = h.provisioner.validateWithEngine(class.Parameters)
+		if _, invalid := err.(validationError); !invalid && err != nil {
+			glog.Warningf("Failed validating StorageClass %s with the engine, it is allowed: %v", class.Name, err)
+			return nil
+		}
+		return err
+	case request.Kind.Group == v1.GroupName && request.Kind.Kind == "PersistentVolumeClaim":
+		claim := v1.PersistentVolumeClaim{}
+		err := json.Unmarshal(request.Object.Raw, &claim)
+		if err != nil {
+			return fmt.Errorf("invalid PersistentVolumeClaim: %s", err)
+		}
+		return validateClaimAnnotations(claim.Annotations)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"k8s.io/api/admission/v1beta1"
+	"k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// admit sends the object to the webhook and returns its response
+func admit(t *testing.T, kind metav1.GroupVersionKind, object interface{}) *v1beta1.AdmissionResponse {
+	raw, err := json.Marshal(object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := json.Marshal(v1beta1.AdmissionReview{Request: &v1beta1.AdmissionRequest{
+		UID: "request-uid", Kind: kind, Operation: v1beta1.Create, Object: runtime.RawExtension{Raw: raw},
+	}})
+	w := httptest.NewRecorder()
+	handler := admissionHandler{NewOvirtProvisioner(newFakeOvirt(), nil, nil).(*ovirtProvisioner)}
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, webhookPath, bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the review to succeed, got %d %s", w.Code, w.Body)
+	}
+	review := v1beta1.AdmissionReview{}
+	err = json.Unmarshal(w.Body.Bytes(), &review)
+	if err != nil || review.Response == nil || review.Response.UID != "request-uid" {
+		t.Fatalf("expected the response of the request, got %s %v", w.Body, err)
+	}
+	return review.Response
+}
+
+func TestWebhookStorageClasses(t *testing.T) {
+	kind := metav1.GroupVersionKind{Group: "storage.k8s.io", Version: "v1", Kind: "StorageClass"}
+	tests := []struct {
+		name        string
+		provisioner string
+		parameters  map[string]string
+		err         string
+	}{
+		{"valid", ProvisionerName, map[string]string{parameterStorageDomainName: "data1"}, ""},
+		{"invalid", ProvisionerName, map[string]string{parameterStorageDomainName: "data1", parameterDiskThinProvisioning: "maybe"},
+			"invalid value 'maybe' for parameter ovirtDiskThinProvisioning"},
+		{"missing domain", ProvisionerName, map[string]string{parameterStorageDomainName: "dta1"}, "storage domain dta1"},
+		{"of another provisioner", "kubernetes.io/cinder", map[string]string{"type": "fast"}, ""},
+	}
+	for _, test := range tests {
+		response := admit(t, kind, storagev1.StorageClass{
+			ObjectMeta:  metav1.ObjectMeta{Name: "ovirt"},
+			Provisioner: test.provisioner,
+			Parameters:  test.parameters,
+		})
+		if response.Allowed != (test.err == "") {
+			t.Errorf("%s: expected allowed %v, got %v", test.name, test.err == "", response.Allowed)
+		}
+		if test.err != "" && (response.Result == nil || !strings.Contains(response.Result.Message, test.err)) {
+			t.Errorf("%s: expected the message '%s', got %v", test.name, test.err, response.Result)
+		}
+	}
+}
+
+func TestWebhookClaims(t *testing.T) {
+	kind := metav1.GroupVersionKind{Version: "v1", Kind: "PersistentVolumeClaim"}
+	tests := []struct {
+		annotations []string
+		allowed     bool
+	}{
+		{[]string{parameterSourceDiskId}, true},
+		{[]string{parameterSourceTemplate, parameterSourceDiskName}, true},
+		{[]string{parameterSourceDiskId, parameterSourceDiskName}, false},
+	}
+	for _, test := range tests {
+		claim := v1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "claim", Annotations: map[string]string{}}}
+		for _, key := range test.annotations {
+			claim.Annotations[key] = "golden"
+		}
+		if response := admit(t, kind, claim); response.Allowed != test.allowed {
+			t.Errorf("claim annotated %v: expected allowed %v, got %v", test.annotations, test.allowed, response.Allowed)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/ovirt/ovirt-openshift-extensions/internal"
+)
+
+const (
+	// the PV of an imported image is handled like one of the provisioner
+	provisionerName         = "ovirt-volume-provisioner"
+	annProvisionedBy        = "pv.kubernetes.io/provisioned-by"
+	flexvolumeDriver        = "ovirt/ovirt-flexvolume-driver"
+	flexOptionVolumeId      = "volumeID"
+	flexOptionStorageDomain = "ovirtStorageDomain"
+	flexOptionEngineUrl     = "ovirtEngineUrl"
+
+	// importedPrefix starts the description of a disk the whole image was uploaded to, followed by its sha256
+	importedPrefix = "ovirt-volume-transfer import sha256:"
+)
+
+// diskPollInterval is the interval between polls of the new disk till the engine allocates it
+var diskPollInterval = 5 * time.Second
+
+func importImage(args []string) error {
+	options := transferOptions{}
+	flags := options.flags("import")
+	flags.Parse(args)
+	if flags.NArg() != 2 || options.storageDomain == "" {
+		flags.Usage()
+		os.Exit(1)
+	}
+	imagePath, claim := flags.Arg(0), flags.Arg(1)
+	if options.stateFile == "" {
+		options.stateFile = imagePath + ".transfer"
+	}
+	namespace, name, err := parseClaim(claim)
+	if err != nil {
+		return err
+	}
+	client, err := options.kubeClient()
+	if err != nil {
+		return err
+	}
+	ovirt, err := options.login()
+	if err != nil {
+		return err
+	}
+	image, err := os.Open(imagePath)
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+
+	sum, err := importVolume(client, ovirt, image, namespace, name, options)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s  %s\n", sum, imagePath)
+	return nil
+}
+
+// importName is the name of the PV and the disk an image is imported to for the claim
+func importName(namespace string, name string) string {
+	return "import-" + namespace + "-" + name
+}
+
+// importVolume uploads the image into a new disk of its format and virtual size, and binds a new PV
+// of the disk to the claim, which is created when it doesn't exist. The disk is marked with the
+// sha256 of the image once it is uploaded, so a run after a failure resumes the upload into the
+// same disk, or only creates the PV, of the same image.
+func importVolume(client kubernetes.Interface, ovirt internal.OvirtApi, image *os.File, namespace string, name string, options transferOptions) (string, error) {
+	claim, err := client.CoreV1().PersistentVolumeClaims(namespace).Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		claim, err = nil, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if claim != nil && claim.Spec.VolumeName != "" {
+		return "", fmt.Errorf("PVC %s/%s is bound to PV %s, upload to it instead", namespace, name, claim.Spec.VolumeName)
+	}
+	pvName := importName(namespace, name)
+	_, err = client.CoreV1().PersistentVolumes().Get(pvName, metav1.GetOptions{})
+	if err == nil {
+		return "", fmt.Errorf("PV %s exists, the image was imported already", pvName)
+	}
+	if !apierrors.IsNotFound(err) {
+		return "", err
+	}
+
+	info, err := internal.InspectImage(image)
+	if err != nil {
+		return "", err
+	}
+	size := info.VirtualSize
+	if claim != nil {
+		requested := claim.Spec.Resources.Requests[v1.ResourceStorage]
+		if requested.Value() > size {
+			size = requested.Value()
+		}
+	}
+
+	disk, err := importDisk(ovirt, pvName, info, size, options.storageDomain)
+	if err != nil {
+		return "", err
+	}
+	var sum string
+	if strings.HasPrefix(disk.Description, importedPrefix) {
+		sum, err = checkImported(image, disk)
+	} else {
+		sum, err = uploadToDisk(ovirt, disk.Id, image, info, options)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	pv := importedVolume(ovirt, disk, claim, namespace, name, options)
+	fmt.Fprintf(os.Stderr, "creating PV %s of disk %s for %s/%s\n", pv.Name, disk.Id, namespace, name)
+	_, err = client.CoreV1().PersistentVolumes().Create(pv)
+	if err != nil {
+		return "", err
+	}
+	if claim == nil {
+		_, err = client.CoreV1().PersistentVolumeClaims(namespace).Create(importedClaim(pv, namespace, name))
+	}
+	return sum, err
+}
+
+// importDisk returns the disk of an earlier run of the import, or creates it. A qcow2 image
+// needs a cow disk, which is allocated as big as the image on block storage.
+func importDisk(ovirt internal.OvirtApi, diskName string, info internal.ImageInfo, size int64, storageDomain string) (internal.Disk, error) {
+	existing, err := ovirt.GetDiskByName(diskName)
+	if err != nil {
+		return internal.Disk{}, err
+	}
+	for _, disk := range existing.Disks {
+		if disk.Name != diskName {
+			continue
+		}
+		if disk.Format != info.Format {
+			return internal.Disk{}, fmt.Errorf("disk %s (%s) of an earlier import is of format %s, the image is %s, remove it to start over",
+				disk.Name, disk.Id, disk.Format, info.Format)
+		}
+		fmt.Fprintf(os.Stderr, "using disk %s (%s) of an earlier import\n", disk.Name, disk.Id)
+		return waitForDisk(ovirt, disk.Id)
+	}
+
+	diskOptions := internal.DiskOptions{
+		Name:             diskName,
+		StorageDomain:    storageDomain,
+		SizeInBytes:      size,
+		Format:           info.Format,
+		ThinProvisioning: info.Format == "cow",
+	}
+	if info.Format == "cow" {
+		diskOptions.InitialSizeInBytes = info.Size
+	}
+	fmt.Fprintf(os.Stderr, "creating %s disk %s of %d bytes on storage domain %s\n", info.Format, diskName, size, storageDomain)
+	disk, err := ovirt.CreateUnattachedDisk(diskOptions)
+	if err != nil {
+		return internal.Disk{}, err
+	}
+	return waitForDisk(ovirt, disk.Id)
+}
+
+// waitForDisk polls the new disk till the storage allocated it
+func waitForDisk(ovirt internal.OvirtApi, diskId string) (internal.Disk, error) {
+	deadline := time.Now().Add(internal.DefaultCopyTimeout)
+	for {
+		disk, err := ovirt.GetDiskById(diskId)
+		if err != nil {
+			return disk, err
+		}
+		switch {
+		case disk.Status == internal.DiskStatusOk:
+			return disk, nil
+		case disk.Status != "locked":
+			return disk, fmt.Errorf("disk %s is %s", diskId, disk.Status)
+		case time.Now().After(deadline):
+			return disk, fmt.Errorf("disk %s is still locked after %s", diskId, internal.DefaultCopyTimeout)
+		}
+		time.Sleep(diskPollInterval)
+	}
+}
+
+// uploadToDisk uploads the image, verifies it when asked and marks the disk with its sha256
+func uploadToDisk(ovirt internal.OvirtApi, diskId string, image *os.File, info internal.ImageInfo, options transferOptions) (string, error) {
+	fmt.Fprintf(os.Stderr, "uploading %s to disk %s\n", image.Name(), diskId)
+	sum, err := internal.UploadImage(ovirt, diskId, image, options.transfer())
+	if err != nil {
+		return "", err
+	}
+	if options.verify {
+		fmt.Fprintf(os.Stderr, "verifying disk %s\n", diskId)
+		err = internal.VerifyImage(ovirt, diskId, info.Size, sum, options.transfer())
+		if err != nil {
+			return "", err
+		}
+	}
+	_, err = ovirt.UpdateDisk(diskId, internal.DiskUpdate{Description: importedPrefix + sum})
+	return sum, err
+}
+
+// checkImported makes sure the image uploaded by an earlier run is the same image
+func checkImported(image *os.File, disk internal.Disk) (string, error) {
+	_, err := image.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(hash, image)
+	if err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if disk.Description != importedPrefix+sum {
+		return "", fmt.Errorf("disk %s (%s) holds another image, sha256 %s, remove it to start over",
+			disk.Name, disk.Id, strings.TrimPrefix(disk.Description, importedPrefix))
+	}
+	fmt.Fprintf(os.Stderr, "disk %s holds the image already\n", disk.Id)
+	return sum, nil
+}
+
+// importedVolume is the PV of the disk, bound to the claim. It has the class and the access
+// modes of the claim when it exists.
+func importedVolume(ovirt internal.OvirtApi, disk internal.Disk, claim *v1.PersistentVolumeClaim, namespace string, name string, options transferOptions) *v1.PersistentVolume {
+	engineUrl := ovirt.GetConnectionDetails().Url
+	claimRef := &v1.ObjectReference{Kind: "PersistentVolumeClaim", Namespace: namespace, Name: name}
+	storageClass := options.storageClass
+	accessModes := []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce}
+	if claim != nil {
+		claimRef.UID = claim.UID
+		if claim.Spec.StorageClassName != nil {
+			storageClass = *claim.Spec.StorageClassName
+		}
+		if len(claim.Spec.AccessModes) > 0 {
+			accessModes = claim.Spec.AccessModes
+		}
+	}
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: importName(namespace, name),
+			Annotations: map[string]string{
+				annProvisionedBy:          provisionerName,
+				internal.AnnVolumeID:      disk.Id,
+				internal.AnnStorageDomain: options.storageDomain,
+			},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimPolicy(options.reclaimPolicy),
+			AccessModes:                   accessModes,
+			StorageClassName:              storageClass,
+			ClaimRef:                      claimRef,
+			Capacity: v1.ResourceList{
+				v1.ResourceStorage: *resource.NewQuantity(int64(disk.ProvisionedSize), resource.BinarySI),
+			},
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				FlexVolume: &v1.FlexPersistentVolumeSource{
+					Driver: flexvolumeDriver,
+					FSType: options.fsType,
+					Options: map[string]string{
+						flexOptionVolumeId:      disk.Id,
+						flexOptionStorageDomain: options.storageDomain,
+						flexOptionEngineUrl:     engineUrl,
+					},
+				},
+			},
+		},
+	}
+}
+
+// importedClaim is a new claim bound to the PV
+func importedClaim(pv *v1.PersistentVolume, namespace string, name string) *v1.PersistentVolumeClaim {
+	storageClass := pv.Spec.StorageClassName
+	return &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec: v1.PersistentVolumeClaimSpec{
+			AccessModes: pv.Spec.AccessModes,
+			// an empty class, rather than none, keeps the default class away
+			StorageClassName: &storageClass,
+			VolumeName:       pv.Name,
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{v1.ResourceStorage: pv.Spec.Capacity[v1.ResourceStorage]},
+			},
+		},
+	}
+}
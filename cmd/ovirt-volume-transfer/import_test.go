@@ -0,0 +1,259 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/ovirt/ovirt-openshift-extensions/internal"
+)
+
+// fakeKube keeps the objects posted to it by their path
+type fakeKube struct {
+	sync.Mutex
+	objects map[string][]byte
+	// failCreate fails the creation of the objects of the path
+	failCreate string
+}
+
+func (f *fakeKube) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+		if o, ok := f.objects[r.URL.Path]; ok {
+			w.Write(o)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404}`))
+	case http.MethodPost:
+		if r.URL.Path == f.failCreate {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","code":500}`))
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		o := struct {
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+		}{}
+		json.Unmarshal(b, &o)
+		f.objects[r.URL.Path+"/"+o.Metadata.Name] = b
+		w.WriteHeader(http.StatusCreated)
+		w.Write(b)
+	}
+}
+
+// fakeEngine creates disks and takes the images uploaded to them, any other call panics
+type fakeEngine struct {
+	internal.OvirtApi
+	disks   map[string]*internal.Disk
+	images  map[string][]byte
+	options []internal.DiskOptions
+	uploads int
+}
+
+func (f *fakeEngine) GetDiskByName(name string) (internal.DiskResult, error) {
+	result := internal.DiskResult{}
+	for _, d := range f.disks {
+		if d.Name == name {
+			result.Disks = append(result.Disks, *d)
+		}
+	}
+	return result, nil
+}
+
+func (f *fakeEngine) GetDiskById(diskId string) (internal.Disk, error) {
+	return *f.disks[diskId], nil
+}
+
+func (f *fakeEngine) CreateUnattachedDisk(options internal.DiskOptions) (internal.Disk, error) {
+	f.options = append(f.options, options)
+	id := fmt.Sprintf("disk%d", len(f.options))
+	f.disks[id] = &internal.Disk{Id: id, Name: options.Name, Format: options.Format, ProvisionedSize: uint64(options.SizeInBytes), Status: "ok"}
+	return *f.disks[id], nil
+}
+
+func (f *fakeEngine) UpdateDisk(diskId string, update internal.DiskUpdate) (internal.Disk, error) {
+	f.disks[diskId].Description = update.Description
+	return *f.disks[diskId], nil
+}
+
+func (f *fakeEngine) StartImageTransfer(diskId string, direction string) (internal.ImageTransfer, error) {
+	f.uploads++
+	return internal.ImageTransfer{Id: "t1", Phase: internal.TransferPhaseTransferring, TransferUrl: diskId}, nil
+}
+
+func (f *fakeEngine) PutImageChunk(transferUrl string, offset int64, length int64, total int64, data io.Reader) error {
+	b, _ := ioutil.ReadAll(data)
+	f.images[transferUrl] = append(f.images[transferUrl][:offset], b...)
+	return nil
+}
+
+func (f *fakeEngine) FinalizeImageTransfer(transferId string, diskId string) error {
+	return nil
+}
+
+func (f *fakeEngine) GetConnectionDetails() internal.Connection {
+	return internal.Connection{Url: "https://engine/ovirt-engine/api"}
+}
+
+func newImportTest(t *testing.T, objects map[string]string) (kubernetes.Interface, *fakeKube, *fakeEngine) {
+	kube := &fakeKube{objects: map[string][]byte{}}
+	for p, o := range objects {
+		kube.objects[p] = []byte(o)
+	}
+	server := httptest.NewServer(kube)
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, kube, &fakeEngine{disks: map[string]*internal.Disk{}, images: map[string][]byte{}}
+}
+
+// qcow2Image writes a qcow2 header of the virtual size
+func qcow2Image(t *testing.T, dir string, virtualSize uint64) *os.File {
+	content := make([]byte, 1024)
+	copy(content, []byte{'Q', 'F', 'I', 0xfb})
+	binary.BigEndian.PutUint64(content[24:], virtualSize)
+	content[1000] = 1
+	path := filepath.Join(dir, "image.qcow2")
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func importOptions(dir string) transferOptions {
+	return transferOptions{storageDomain: "data1", fsType: "ext4", reclaimPolicy: "Retain", stateFile: filepath.Join(dir, "state")}
+}
+
+func TestImportVolume(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "import")
+	defer os.RemoveAll(dir)
+	image := qcow2Image(t, dir, 1<<30)
+	defer image.Close()
+	client, kube, engine := newImportTest(t, nil)
+
+	sum, err := importVolume(client, engine, image, "db", "data", importOptions(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadFile(image.Name())
+	expected := sha256.Sum256(content)
+	if sum != hex.EncodeToString(expected[:]) {
+		t.Errorf("unexpected checksum %s", sum)
+	}
+	options := engine.options[0]
+	if options.Name != "import-db-data" || options.Format != "cow" || options.SizeInBytes != 1<<30 || options.InitialSizeInBytes != 1024 {
+		t.Errorf("expected a cow disk of the virtual size, got %+v", options)
+	}
+	if !bytes.Equal(engine.images["disk1"], content) || engine.disks["disk1"].Description != importedPrefix+sum {
+		t.Errorf("expected the image uploaded to the marked disk, got %+v", engine.disks["disk1"])
+	}
+
+	pv := v1.PersistentVolume{}
+	json.Unmarshal(kube.objects["/api/v1/persistentvolumes/import-db-data"], &pv)
+	if pv.Annotations[internal.AnnVolumeID] != "disk1" || pv.Spec.FlexVolume.Options[flexOptionVolumeId] != "disk1" ||
+		pv.Spec.ClaimRef.Namespace != "db" || pv.Spec.ClaimRef.Name != "data" {
+		t.Errorf("expected a PV of the disk bound to the claim, got %+v", pv)
+	}
+	claim := v1.PersistentVolumeClaim{}
+	json.Unmarshal(kube.objects["/api/v1/namespaces/db/persistentvolumeclaims/data"], &claim)
+	if claim.Spec.VolumeName != "import-db-data" {
+		t.Errorf("expected a claim of the PV, got %+v", claim)
+	}
+}
+
+func TestImportVolumeAfterFailure(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "import")
+	defer os.RemoveAll(dir)
+	image := qcow2Image(t, dir, 1<<30)
+	defer image.Close()
+	client, kube, engine := newImportTest(t, map[string]string{
+		"/api/v1/namespaces/db/persistentvolumeclaims/data": `{"metadata":{"name":"data","namespace":"db","uid":"uid1"},
+			"spec":{"storageClassName":"ovirt","resources":{"requests":{"storage":"2Gi"}}},"status":{"phase":"Pending"}}`,
+	})
+	kube.failCreate = "/api/v1/persistentvolumes"
+
+	if _, err := importVolume(client, engine, image, "db", "data", importOptions(dir)); err == nil {
+		t.Fatal("expected the first run to fail creating the PV")
+	}
+	kube.failCreate = ""
+	if _, err := importVolume(client, engine, image, "db", "data", importOptions(dir)); err != nil {
+		t.Fatal(err)
+	}
+	if len(engine.options) != 1 || engine.uploads != 1 {
+		t.Errorf("expected the disk of the first run, got %d disks and %d uploads", len(engine.options), engine.uploads)
+	}
+	if engine.options[0].SizeInBytes != 2<<30 {
+		t.Errorf("expected a disk of the requested size, got %d", engine.options[0].SizeInBytes)
+	}
+	pv := v1.PersistentVolume{}
+	json.Unmarshal(kube.objects["/api/v1/persistentvolumes/import-db-data"], &pv)
+	if pv.Spec.StorageClassName != "ovirt" || pv.Spec.ClaimRef.UID != "uid1" {
+		t.Errorf("expected a PV of the class bound to the claim, got %+v", pv.Spec)
+	}
+}
+
+func TestImportVolumeRefusals(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "import")
+	defer os.RemoveAll(dir)
+	image := qcow2Image(t, dir, 1<<30)
+	defer image.Close()
+
+	client, _, engine := newImportTest(t, map[string]string{
+		"/api/v1/namespaces/db/persistentvolumeclaims/data": `{"spec":{"volumeName":"pv1"},"status":{"phase":"Bound"}}`,
+	})
+	_, err := importVolume(client, engine, image, "db", "data", importOptions(dir))
+	if err == nil || !strings.Contains(err.Error(), "bound") {
+		t.Errorf("expected a bound claim to be refused, got %v", err)
+	}
+
+	// the disk of an earlier run holds another image
+	client, _, engine = newImportTest(t, nil)
+	engine.disks["disk1"] = &internal.Disk{Id: "disk1", Name: "import-db-data", Format: "cow", Status: "ok", Description: importedPrefix + "0123"}
+	_, err = importVolume(client, engine, image, "db", "data", importOptions(dir))
+	if err == nil || !strings.Contains(err.Error(), "another image") {
+		t.Errorf("expected a disk of another image to be refused, got %v", err)
+	}
+}
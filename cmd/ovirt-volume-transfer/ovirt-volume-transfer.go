@@ -0,0 +1,303 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/ovirt/ovirt-openshift-extensions/internal"
+)
+
+const usage = `Usage:
+  ovirt-volume-transfer upload [options] <image file> <namespace>/<claim>
+      upload a raw or qcow2 image into the disk of the claim
+  ovirt-volume-transfer import [options] <image file> <namespace>/<claim>
+      upload a raw or qcow2 image into a new disk and bind a new PV of it to the claim
+  ovirt-volume-transfer download [options] <namespace>/<claim> <image file>
+      download the disk of the claim to a file
+
+The claim must be bound to a PV of the ovirt-volume-provisioner, and must not be used
+by a pod while its disk is transferred.
+
+Options:
+`
+
+// transferOptions are the flags of both subcommands
+type transferOptions struct {
+	kubeconfig string
+	master     string
+	ovirtConf  string
+	chunkSize  int64
+	retries    int
+	proxy      bool
+	// upload and import only
+	stateFile string
+	verify    bool
+	// import only
+	storageDomain string
+	storageClass  string
+	fsType        string
+	reclaimPolicy string
+}
+
+func (o *transferOptions) flags(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flags.PrintDefaults()
+	}
+	flags.StringVar(&o.kubeconfig, "kubeconfig", os.Getenv("KUBECONFIG"), "Absolute path to the kubeconfig file")
+	flags.StringVar(&o.master, "master", "", "Master URL to build a client config from")
+	flags.StringVar(&o.ovirtConf, "ovirt-conf", ovirtConfPath(), "The oVirt connection config, as used by the provisioner")
+	flags.Int64Var(&o.chunkSize, "chunk-size", internal.DefaultChunkSize, "The size of every transfer request")
+	flags.IntVar(&o.retries, "retries", internal.DefaultRetries, "How many times a failed chunk is sent")
+	flags.BoolVar(&o.proxy, "proxy", false, "Transfer through the imageio proxy of the engine instead of the host")
+	if name == "upload" || name == "import" {
+		flags.StringVar(&o.stateFile, "state-file", "", "The progress of the upload, to resume it. Defaults to <image file>.transfer")
+		flags.BoolVar(&o.verify, "verify", true, "Download the uploaded image and compare its checksum")
+	}
+	if name == "import" {
+		flags.StringVar(&o.storageDomain, "storage-domain", "", "The storage domain of the new disk")
+		flags.StringVar(&o.storageClass, "storage-class", "", "The StorageClass of the new PV, the one of the claim when it exists")
+		flags.StringVar(&o.fsType, "fs-type", "ext4", "The file system of the image")
+		flags.StringVar(&o.reclaimPolicy, "reclaim-policy", string(v1.PersistentVolumeReclaimRetain), "The reclaim policy of the new PV")
+	}
+	return flags
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(1)
+	}
+	var err error
+	switch os.Args[1] {
+	case "upload":
+		err = upload(os.Args[2:])
+	case "download":
+		err = download(os.Args[2:])
+	case "import":
+		err = importImage(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func upload(args []string) error {
+	options := transferOptions{}
+	flags := options.flags("upload")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	imagePath, claim := flags.Arg(0), flags.Arg(1)
+	if options.stateFile == "" {
+		options.stateFile = imagePath + ".transfer"
+	}
+
+	ovirt, diskId, err := options.connect(claim)
+	if err != nil {
+		return err
+	}
+	image, err := os.Open(imagePath)
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+
+	fmt.Fprintf(os.Stderr, "uploading %s to disk %s of %s\n", imagePath, diskId, claim)
+	sum, err := internal.UploadImage(ovirt, diskId, image, options.transfer())
+	if err != nil {
+		return err
+	}
+	if options.verify {
+		stat, err := image.Stat()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "verifying disk %s\n", diskId)
+		err = internal.VerifyImage(ovirt, diskId, stat.Size(), sum, options.transfer())
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Printf("%s  %s\n", sum, imagePath)
+	return nil
+}
+
+func download(args []string) error {
+	options := transferOptions{}
+	flags := options.flags("download")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	claim, imagePath := flags.Arg(0), flags.Arg(1)
+
+	ovirt, diskId, err := options.connect(claim)
+	if err != nil {
+		return err
+	}
+	// a failed download doesn't leave a partial image behind
+	tmp, err := os.Create(filepath.Join(filepath.Dir(imagePath), "."+filepath.Base(imagePath)+".part"))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	fmt.Fprintf(os.Stderr, "downloading disk %s of %s to %s\n", diskId, claim, imagePath)
+	sum, _, err := internal.DownloadImage(ovirt, diskId, tmp, options.transfer())
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), imagePath)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s  %s\n", sum, imagePath)
+	return nil
+}
+
+func (o *transferOptions) transfer() internal.TransferOptions {
+	return internal.TransferOptions{
+		ChunkSize: o.chunkSize,
+		Retries:   o.retries,
+		UseProxy:  o.proxy,
+		StateFile: o.stateFile,
+		Progress:  progress(os.Stderr),
+	}
+}
+
+// connect resolves the disk of the claim and logs in to the engine
+func (o *transferOptions) connect(claim string) (internal.OvirtApi, string, error) {
+	namespace, name, err := parseClaim(claim)
+	if err != nil {
+		return nil, "", err
+	}
+	client, err := o.kubeClient()
+	if err != nil {
+		return nil, "", err
+	}
+	diskId, err := diskOfClaim(client, namespace, name)
+	if err != nil {
+		return nil, "", err
+	}
+	ovirt, err := o.login()
+	return ovirt, diskId, err
+}
+
+func (o *transferOptions) kubeClient() (kubernetes.Interface, error) {
+	config, err := clientcmd.BuildConfigFromFlags(o.master, o.kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// login connects to the engine with the oVirt connection config
+func (o *transferOptions) login() (internal.OvirtApi, error) {
+	file, err := os.Open(o.ovirtConf)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	ovirt, err := internal.NewOvirt(file)
+	if err != nil {
+		return nil, err
+	}
+	return ovirt, ovirt.Authenticate()
+}
+
+// parseClaim splits <namespace>/<claim>, a claim with no namespace is in the default one
+func parseClaim(claim string) (string, string, error) {
+	parts := strings.Split(claim, "/")
+	switch {
+	case len(parts) == 1 && parts[0] != "":
+		return metav1.NamespaceDefault, parts[0], nil
+	case len(parts) == 2 && parts[0] != "" && parts[1] != "":
+		return parts[0], parts[1], nil
+	}
+	return "", "", fmt.Errorf("invalid claim '%s', expected <namespace>/<claim>", claim)
+}
+
+// diskOfClaim returns the disk id of the PV the claim is bound to
+func diskOfClaim(client kubernetes.Interface, namespace string, name string) (string, error) {
+	claim, err := client.CoreV1().PersistentVolumeClaims(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	if claim.Status.Phase != v1.ClaimBound || claim.Spec.VolumeName == "" {
+		return "", fmt.Errorf("PVC %s/%s is not bound", namespace, name)
+	}
+	pv, err := client.CoreV1().PersistentVolumes().Get(claim.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	diskId := pv.Annotations[internal.AnnVolumeID]
+	if diskId == "" {
+		return "", fmt.Errorf("PV %s has no %s annotation, it was not provisioned by ovirt-volume-provisioner", pv.Name, internal.AnnVolumeID)
+	}
+	return diskId, nil
+}
+
+// progress prints the percentage done whenever it changes
+func progress(out io.Writer) func(done int64, total int64) {
+	last := int64(-1)
+	return func(done int64, total int64) {
+		if total == 0 {
+			return
+		}
+		percent := done * 100 / total
+		if percent != last {
+			last = percent
+			fmt.Fprintf(out, "\r%3d%% %d/%d", percent, done, total)
+			if done == total {
+				fmt.Fprintln(out)
+			}
+		}
+	}
+}
+
+func ovirtConfPath() string {
+	value, exist := os.LookupEnv("OVIRT_API_CONF")
+	if exist {
+		return value
+	}
+	return "/etc/ovirt/ovirt-api.conf"
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/ovirt/ovirt-openshift-extensions/internal"
+)
+
+func TestParseClaim(t *testing.T) {
+	tests := []struct {
+		claim     string
+		namespace string
+		name      string
+		valid     bool
+	}{
+		{"db/data", "db", "data", true},
+		{"data", "default", "data", true},
+		{"", "", "", false},
+		{"db/", "", "", false},
+		{"a/b/c", "", "", false},
+	}
+	for _, test := range tests {
+		namespace, name, err := parseClaim(test.claim)
+		if (err == nil) != test.valid || namespace != test.namespace || name != test.name {
+			t.Errorf("%s: got %s %s %v", test.claim, namespace, name, err)
+		}
+	}
+}
+
+func TestDiskOfClaim(t *testing.T) {
+	objects := map[string]string{
+		"/api/v1/namespaces/db/persistentvolumeclaims/data":    `{"spec":{"volumeName":"pv1"},"status":{"phase":"Bound"}}`,
+		"/api/v1/namespaces/db/persistentvolumeclaims/pending": `{"status":{"phase":"Pending"}}`,
+		"/api/v1/namespaces/db/persistentvolumeclaims/nfs":     `{"spec":{"volumeName":"pv2"},"status":{"phase":"Bound"}}`,
+		"/api/v1/persistentvolumes/pv1":                        `{"metadata":{"name":"pv1","annotations":{"` + internal.AnnVolumeID + `":"disk1"}}}`,
+		"/api/v1/persistentvolumes/pv2":                        `{"metadata":{"name":"pv2"}}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		o, ok := objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","message":"not found","code":404}`))
+			return
+		}
+		w.Write([]byte(o))
+	}))
+	defer server.Close()
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diskId, err := diskOfClaim(client, "db", "data")
+	if err != nil || diskId != "disk1" {
+		t.Errorf("expected disk1, got %s %v", diskId, err)
+	}
+	for claim, errMessage := range map[string]string{"pending": "not bound", "nfs": "not provisioned", "missing": "not found"} {
+		_, err := diskOfClaim(client, "db", claim)
+		if err == nil || !strings.Contains(err.Error(), errMessage) {
+			t.Errorf("%s: expected an error with '%s', got %v", claim, errMessage, err)
+		}
+	}
+}
+
+func TestProgress(t *testing.T) {
+	var out bytes.Buffer
+	p := progress(&out)
+	p(1, 200)
+	p(2, 200)
+	p(200, 200)
+	if out.String() != "\r  0% 1/200\r  1% 2/200\r100% 200/200\n" {
+		t.Errorf("unexpected progress %q", out.String())
+	}
+}
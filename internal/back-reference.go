@@ -0,0 +1,63 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// BackReference ties a disk to the kubernetes objects of its volume, for the admins of the engine
+// and for the lookups of the flex driver. It is kept as JSON in the description of the disk, since
+// oVirt can't label disks. ClusterId tells apart the disks of the kubernetes clusters sharing the
+// engine, Provisioner is the identity of the provisioner which created the disk and ClaimUID the UID
+// of the claim it was created for. ReclaimPolicy is the one of the PV, the disk of a Retain PV
+// outlives it.
+type BackReference struct {
+	ClusterId     string `json:"clusterId,omitempty"`
+	Provisioner   string `json:"provisioner,omitempty"`
+	Namespace     string `json:"namespace,omitempty"`
+	Claim         string `json:"pvc,omitempty"`
+	ClaimUID      string `json:"claimUid,omitempty"`
+	Volume        string `json:"pv,omitempty"`
+	StorageClass  string `json:"storageClass,omitempty"`
+	ReclaimPolicy string `json:"reclaimPolicy,omitempty"`
+}
+
+// WithBackReference appends the back reference to a disk description
+func WithBackReference(description string, ref BackReference) string {
+	b, _ := json.Marshal(ref)
+	if description == "" {
+		return string(b)
+	}
+	return description + " " + string(b)
+}
+
+// BackReferenceOf returns the back reference in the description of the disk, and false when it has none.
+// The names of kubernetes objects have no spaces, so the reference is a single field of the description.
+func BackReferenceOf(disk Disk) (BackReference, bool) {
+	for _, field := range strings.Fields(disk.Description) {
+		if !strings.HasPrefix(field, "{") {
+			continue
+		}
+		ref := BackReference{}
+		if json.Unmarshal([]byte(field), &ref) == nil && ref != (BackReference{}) {
+			return ref, true
+		}
+	}
+	return BackReference{}, false
+}
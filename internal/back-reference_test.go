@@ -0,0 +1,46 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"testing"
+)
+
+func TestBackReference(t *testing.T) {
+	ref := BackReference{ClusterId: "prod", Namespace: "default", Claim: "claim", ClaimUID: "uid", Volume: "pvc-1", StorageClass: "ovirt"}
+	tests := []struct {
+		description string
+		marked      string
+	}{
+		{"", `{"clusterId":"prod","namespace":"default","pvc":"claim","claimUid":"uid","pv":"pvc-1","storageClass":"ovirt"}`},
+		{"db {data}", `db {data} {"clusterId":"prod","namespace":"default","pvc":"claim","claimUid":"uid","pv":"pvc-1","storageClass":"ovirt"}`},
+	}
+	for _, test := range tests {
+		disk := Disk{Description: WithBackReference(test.description, ref)}
+		if disk.Description != test.marked {
+			t.Errorf("expected '%s', got '%s'", test.marked, disk.Description)
+		}
+		if found, ok := BackReferenceOf(disk); !ok || found != ref {
+			t.Errorf("expected the back reference %+v, got %+v %v", ref, found, ok)
+		}
+	}
+	for _, description := range []string{"{not json}", "{}", "db"} {
+		if _, ok := BackReferenceOf(Disk{Description: description}); ok {
+			t.Errorf("expected no back reference in '%s'", description)
+		}
+	}
+}
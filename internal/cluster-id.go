@@ -0,0 +1,31 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+// ClusterIdOf returns the cluster ID in the back reference of the disk, or "" when it has none
+func ClusterIdOf(disk Disk) string {
+	ref, _ := BackReferenceOf(disk)
+	return ref.ClusterId
+}
+
+// IsForeignDisk tells if the disk was created for another cluster. Disks without a cluster ID
+// aren't foreign to any cluster, they may be used by the name of their volume but they are
+// only cleaned up by a cluster without an ID.
+func IsForeignDisk(disk Disk, clusterId string) bool {
+	id := ClusterIdOf(disk)
+	return id != "" && id != clusterId
+}
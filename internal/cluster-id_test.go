@@ -0,0 +1,60 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestClusterId(t *testing.T) {
+	tests := []struct {
+		description string
+		clusterId   string
+	}{
+		{"", ""},
+		{`{"clusterId":"prod"}`, "prod"},
+		{`default/claim {"clusterId":"prod","pv":"pvc-1"}`, "prod"},
+		{`default/claim {"pv":"pvc-1"}`, ""},
+		{"default/claim cluster=prod", ""},
+	}
+	for _, test := range tests {
+		if id := ClusterIdOf(Disk{Description: test.description}); id != test.clusterId {
+			t.Errorf("expected '%s' of cluster '%s', got cluster '%s'", test.description, test.clusterId, id)
+		}
+	}
+}
+
+func TestIsForeignDisk(t *testing.T) {
+	disks := []Disk{{Id: "prod"}, {Id: "test"}, {Id: "unmarked"}}
+	for i := range disks {
+		if disks[i].Id != "unmarked" {
+			disks[i].Description = WithBackReference("", BackReference{ClusterId: disks[i].Id})
+		}
+	}
+	for clusterId, foreign := range map[string]string{"prod": "test", "test": "prod", "": "prod,test"} {
+		var found []string
+		for _, d := range disks {
+			if IsForeignDisk(d, clusterId) {
+				found = append(found, d.Id)
+			}
+		}
+		if strings.Join(found, ",") != foreign {
+			t.Errorf("expected the disks foreign to cluster '%s' to be %s, got %v", clusterId, foreign, found)
+		}
+	}
+}
@@ -18,6 +18,7 @@ package internal
 
 import (
 	"encoding/json"
+	"io"
 	"strings"
 )
 
@@ -39,6 +40,7 @@ type OvirtApi interface {
 	Authenticate() error
 	Get(path string) ([]byte, error)
 	Post(path string, data interface{}) (string, error)
+	Put(path string, data interface{}) (string, error)
 	Delete(path string) ([]byte, error)
 	GetVM(name string) (VM, error)
 	GetVMById(id string) (VM, error)
@@ -46,15 +48,46 @@ type OvirtApi interface {
 	GetDiskAttachment(vmId, diskId string) (DiskAttachment, error)
 	GetDiskAttachments(vmId string) ([]DiskAttachment, error)
 	DetachDiskFromVM(vmId string, diskId string) error
+	ActivateDiskAttachment(vmId string, diskId string) error
+	DeactivateDiskAttachment(vmId string, diskId string) error
 	GetDiskByName(diskName string) (DiskResult, error)
-	CreateUnattachedDisk(diskName string, storageDomainName string, sizeIbBytes int64, readOnly bool, thinProvisioning bool) (Disk, error)
+	GetDiskById(diskId string) (Disk, error)
+	GetTemplateDisks(templateName string) ([]Disk, error)
+	SearchDisks(query string) ([]Disk, error)
+	UpdateDisk(diskId string, update DiskUpdate) (Disk, error)
+	MoveDisk(diskId string, storageDomainName string) error
+	CreateUnattachedDisk(options DiskOptions) (Disk, error)
 	CreateDisk(
 		diskName string,
 		storageDomainName string,
 		readOnly bool,
 		vmId string,
 		diskId string,
-		diskInterface string) (DiskAttachment, error)
+		diskInterface string,
+		passDiscard bool) (DiskAttachment, error)
+	CreateDiskSnapshot(diskId string, description string) (Snapshot, error)
+	GetDiskSnapshot(vmId string, snapshotId string, diskId string) (Snapshot, error)
+	ListDiskSnapshots(diskId string) ([]Snapshot, error)
+	DeleteDiskSnapshot(vmId string, snapshotId string) error
+	RestoreDiskSnapshot(snapshot Snapshot, diskName string, diskDescription string, storageDomainName string, sizeInBytes int64, thinProvisioning bool) (Disk, error)
+	CopyDisk(diskId string, diskName string, diskDescription string, storageDomainName string, sizeInBytes int64, thinProvisioning bool) (Disk, error)
+	ExtendDisk(diskId string, sizeInBytes int64) (Disk, error)
+	StartImageTransfer(diskId string, direction string) (ImageTransfer, error)
+	GetImageTransfer(transferId string) (ImageTransfer, error)
+	FinalizeImageTransfer(transferId string, diskId string) error
+	CancelImageTransfer(transferId string) error
+	PutImageChunk(transferUrl string, offset int64, length int64, total int64, data io.Reader) error
+	GetImageChunk(transferUrl string, offset int64, length int64) (io.ReadCloser, error)
+	GetImageSize(transferUrl string) (int64, error)
+	GetStorageDomainBy(name string) (StorageDomain, error)
+	GetCluster(clusterId string) (Cluster, error)
+	GetClusterByName(name string) (Cluster, error)
+	GetDataCenter(dataCenterId string) (DataCenter, error)
+	GetDataCenterByName(name string) (DataCenter, error)
+	GetDataCenters() ([]DataCenter, error)
+	GetDataCenterStorageDomains(dataCenterId string) ([]StorageDomain, error)
+	GetQuotaStorageLimits(dataCenterId string, quotaId string) ([]QuotaStorageLimit, error)
+	GetDiskProfile(id string) (DiskProfile, error)
 	GetConnectionDetails() Connection
 }
 
@@ -86,6 +119,13 @@ type AttachRequest struct {
 	Secret     string `json:"kubernetes.io/secret,omitempty"`
 	VolumeId   string `json:"volumeID,omitempty"`
 	CustomSize string `json:"size,omitempty"`
+	// DeleteOnDetach marks an inline volume as scratch space, the disk created
+	// on attach is removed once it is detached
+	DeleteOnDetach bool `json:"deleteOnDetach,string,omitempty"`
+	// DiskInterface and PassDiscard are the properties of the disk attachment,
+	// set by the provisioner out of the StorageClass
+	DiskInterface string `json:"ovirtDiskInterface,omitempty"`
+	PassDiscard   bool   `json:"ovirtDiskPassDiscard,string,omitempty"`
 }
 
 func AttachRequestFrom(s string) (AttachRequest, error) {
@@ -0,0 +1,100 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	DefaultDetachTimeout  = 60 * time.Second
+	DefaultDetachInterval = 2 * time.Second
+)
+
+// DetachOptions controls the deactivate-then-detach flow
+type DetachOptions struct {
+	// Timeout is how long to wait for the engine to confirm the deactivation
+	Timeout time.Duration
+	// Interval between polls of the attachment
+	Interval time.Duration
+	// Force removes the attachment even if the deactivation failed, timed out or the device is busy
+	Force bool
+}
+
+// DetachDiskGracefully hot unplugs the disk, waits for the engine to report the attachment
+// inactive and only then removes the attachment. A disk which is not attached is ignored.
+// Unless forced, a busy device or a deactivation that doesn't complete in time fails the detach
+// and leaves the disk attached.
+func DetachDiskGracefully(ovirt OvirtApi, vmId string, diskId string, options DetachOptions) error {
+	if options.Timeout == 0 {
+		options.Timeout = DefaultDetachTimeout
+	}
+	if options.Interval == 0 {
+		options.Interval = DefaultDetachInterval
+	}
+
+	attachment, err := ovirt.GetDiskAttachment(vmId, diskId)
+	if err != nil {
+		if _, notFound := err.(NotFound); notFound {
+			return nil
+		}
+		return err
+	}
+
+	if attachment.Active {
+		err = deactivate(ovirt, vmId, diskId, options)
+		if err != nil {
+			if !options.Force {
+				return err
+			}
+			logErrorf("force detaching disk %s from VM %s: %s", diskId, vmId, err)
+		}
+	}
+
+	err = ovirt.DetachDiskFromVM(vmId, diskId)
+	if _, notFound := err.(NotFound); notFound {
+		return nil
+	}
+	return err
+}
+
+// deactivate hot unplugs the disk and waits for the attachment to become inactive
+func deactivate(ovirt OvirtApi, vmId string, diskId string, options DetachOptions) error {
+	err := ovirt.DeactivateDiskAttachment(vmId, diskId)
+	if err != nil {
+		if IsDeviceBusy(err) {
+			return fmt.Errorf("refusing to detach disk %s from VM %s, the device is busy: %s", diskId, vmId, err)
+		}
+		return err
+	}
+
+	deadline := time.Now().Add(options.Timeout)
+	for {
+		attachment, err := ovirt.GetDiskAttachment(vmId, diskId)
+		if err != nil {
+			return err
+		}
+		if !attachment.Active {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("disk %s is still active on VM %s after %s", diskId, vmId, options.Timeout)
+		}
+		time.Sleep(options.Interval)
+	}
+}
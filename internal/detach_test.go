@@ -0,0 +1,148 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// attachmentHandler serves a single disk attachment, which becomes inactive after
+// a deactivation unless stuck is set, and records the calls on it
+type attachmentHandler struct {
+	active      bool
+	stuck       bool
+	busy        bool
+	deactivated bool
+	deleted     bool
+	putBody     string
+}
+
+func (a *attachmentHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case http.MethodGet:
+		if a.deleted {
+			http.NotFound(writer, request)
+			return
+		}
+		fmt.Fprintf(writer, `{"id": "%s", "active": "%v", "interface": "virtio_scsi"}`, diskId, a.active)
+	case http.MethodPut:
+		b, _ := ioutil.ReadAll(request.Body)
+		a.putBody = string(b)
+		if a.busy {
+			writer.WriteHeader(http.StatusConflict)
+			writer.Write([]byte(`{"reason": "Operation Failed", "detail": "[Cannot hot unplug disk, the device is busy]"}`))
+			return
+		}
+		a.deactivated = true
+		if !a.stuck {
+			a.active = false
+		}
+		writer.Write([]byte(`{}`))
+	case http.MethodDelete:
+		a.deleted = true
+		writer.Write([]byte(`{}`))
+	}
+}
+
+func mockAttachment(handler *attachmentHandler) MockOvirt {
+	api := NewMockOvirt()
+	api.ServeMux.Handle("/vms/"+vmId+"/diskattachments/"+diskId, handler)
+	return api
+}
+
+var quickDetach = DetachOptions{Timeout: 50 * time.Millisecond, Interval: 10 * time.Millisecond}
+
+var _ = Describe("Graceful detach", func() {
+
+	It("deactivates the disk before removing the attachment", func() {
+		handler := &attachmentHandler{active: true}
+		api := mockAttachment(handler)
+		err := DetachDiskGracefully(api, vmId, diskId, quickDetach)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(handler.putBody).To(MatchJSON(`{"active": "false"}`))
+		Expect(handler.deactivated).To(BeTrue())
+		Expect(handler.deleted).To(BeTrue())
+	})
+
+	It("skips the deactivation of an inactive attachment", func() {
+		handler := &attachmentHandler{active: false}
+		api := mockAttachment(handler)
+		err := DetachDiskGracefully(api, vmId, diskId, quickDetach)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(handler.deactivated).To(BeFalse())
+		Expect(handler.deleted).To(BeTrue())
+	})
+
+	It("ignores a disk which is not attached", func() {
+		handler := &attachmentHandler{deleted: true}
+		api := mockAttachment(handler)
+		err := DetachDiskGracefully(api, vmId, diskId, quickDetach)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("refuses to detach a busy device", func() {
+		handler := &attachmentHandler{active: true, busy: true}
+		api := mockAttachment(handler)
+		err := DetachDiskGracefully(api, vmId, diskId, quickDetach)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("busy"))
+		Expect(handler.deleted).To(BeFalse())
+	})
+
+	It("fails when the deactivation times out", func() {
+		handler := &attachmentHandler{active: true, stuck: true}
+		api := mockAttachment(handler)
+		err := DetachDiskGracefully(api, vmId, diskId, quickDetach)
+		Expect(err).To(HaveOccurred())
+		Expect(handler.deleted).To(BeFalse())
+	})
+
+	It("detaches a busy device when forced", func() {
+		handler := &attachmentHandler{active: true, busy: true}
+		api := mockAttachment(handler)
+		options := quickDetach
+		options.Force = true
+		err := DetachDiskGracefully(api, vmId, diskId, options)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(handler.deleted).To(BeTrue())
+	})
+})
+
+var _ = Describe("Engine faults", func() {
+	It("reports the busy device with the fault detail", func() {
+		handler := &attachmentHandler{busy: true}
+		api := mockAttachment(handler)
+		err := api.DeactivateDiskAttachment(vmId, diskId)
+		Expect(err).To(BeAssignableToTypeOf(Fault{}))
+		Expect(IsDeviceBusy(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("Cannot hot unplug disk"))
+	})
+
+	It("activates an attachment", func() {
+		handler := &attachmentHandler{}
+		api := mockAttachment(handler)
+		err := api.ActivateDiskAttachment(vmId, diskId)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(handler.putBody).To(MatchJSON(`{"active": "true"}`))
+	})
+})
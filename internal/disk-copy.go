@@ -0,0 +1,151 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	// DiskStatusOk is the status of a disk which is ready to be used
+	DiskStatusOk = "ok"
+
+	// DefaultCopyTimeout is how long CopyDisk waits for the engine, copies of big disks are slow
+	DefaultCopyTimeout = 30 * time.Minute
+)
+
+// diskPollInterval is the interval between polls of a disk the engine is working on
+var diskPollInterval = 5 * time.Second
+
+// CopyDisk copies the disk to a new disk of the name and the description on the storage domain,
+// waits for the engine to complete the copy and grows the copy to sizeInBytes. A copy keeps the format of its source,
+// so the source must have the format of a new disk on that storage domain, and can't be
+// bigger than sizeInBytes.
+func (ovirt *Ovirt) CopyDisk(diskId string, diskName string, diskDescription string, storageDomainName string, sizeInBytes int64, thinProvisioning bool) (Disk, error) {
+	source, err := ovirt.GetDiskById(diskId)
+	if err != nil {
+		return Disk{}, err
+	}
+	if int64(source.ProvisionedSize) > sizeInBytes {
+		return Disk{}, fmt.Errorf("the requested size %d is smaller than the size %d of disk %s",
+			sizeInBytes, source.ProvisionedSize, diskId)
+	}
+	format, _, err := ovirt.DefaultDiskParamsBy(storageDomainName, thinProvisioning)
+	if err != nil {
+		return Disk{}, err
+	}
+	if source.Format != format {
+		return Disk{}, fmt.Errorf("disk %s is of format %s, it can't be copied to a %s disk on storage domain %s",
+			diskId, source.Format, format, storageDomainName)
+	}
+
+	// disks of that name which exist before the copy, i.e of an earlier attempt, aren't the copy
+	existing, err := ovirt.GetDiskByName(diskName)
+	if err != nil {
+		return Disk{}, err
+	}
+	request := map[string]interface{}{
+		"storage_domain": map[string]string{"name": storageDomainName},
+		"disk":           map[string]string{"name": diskName, "description": diskDescription},
+	}
+	post, err := ovirt.Post("disks/"+diskId+"/copy", request)
+	if err != nil {
+		return Disk{}, err
+	}
+	action := struct {
+		Disk Disk `json:"disk"`
+	}{}
+	err = json.Unmarshal([]byte(post), &action)
+	if err != nil {
+		return Disk{}, err
+	}
+
+	copied, err := ovirt.waitForDisk(func() (Disk, error) {
+		if action.Disk.Id != "" {
+			return ovirt.GetDiskById(action.Disk.Id)
+		}
+		return ovirt.copyOf(diskId, diskName, existing.Disks)
+	}, DefaultCopyTimeout)
+	if err != nil {
+		return Disk{}, err
+	}
+	if int64(copied.ProvisionedSize) >= sizeInBytes {
+		return copied, nil
+	}
+	return ovirt.ExtendDisk(copied.Id, sizeInBytes)
+}
+
+// copyOf returns the disk named diskName which is neither the source disk nor one of the
+// existing disks, or an empty disk if the engine didn't register it yet. It finds the copy
+// of an engine which doesn't return it in the copy action.
+func (ovirt *Ovirt) copyOf(sourceId string, diskName string, existing []Disk) (Disk, error) {
+	result, err := ovirt.GetDiskByName(diskName)
+	if err != nil {
+		return Disk{}, err
+	}
+	for _, d := range result.Disks {
+		if d.Id != sourceId && d.Name == diskName && !containsDisk(existing, d.Id) {
+			return d, nil
+		}
+	}
+	return Disk{}, nil
+}
+
+func containsDisk(disks []Disk, diskId string) bool {
+	for _, d := range disks {
+		if d.Id == diskId {
+			return true
+		}
+	}
+	return false
+}
+
+// ExtendDisk grows a floating disk to sizeInBytes and waits for the engine to complete it
+func (ovirt *Ovirt) ExtendDisk(diskId string, sizeInBytes int64) (Disk, error) {
+	request := map[string]string{"provisioned_size": strconv.FormatInt(sizeInBytes, 10)}
+	_, err := ovirt.Put("disks/"+diskId, request)
+	if err != nil {
+		return Disk{}, err
+	}
+	return ovirt.waitForDisk(func() (Disk, error) { return ovirt.GetDiskById(diskId) }, DefaultCopyTimeout)
+}
+
+// waitForDisk polls the disk till it is ok. A disk the engine failed on, i.e an illegal one,
+// fails the wait.
+func (ovirt *Ovirt) waitForDisk(get func() (Disk, error), timeout time.Duration) (Disk, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		disk, err := get()
+		if err != nil {
+			return Disk{}, err
+		}
+		switch disk.Status {
+		case DiskStatusOk:
+			return disk, nil
+		case "", "locked":
+		default:
+			return disk, fmt.Errorf("disk %s is in status '%s'", disk.Id, disk.Status)
+		}
+		if time.Now().After(deadline) {
+			return disk, fmt.Errorf("disk %s is not ready after %s", disk.Id, timeout)
+		}
+		time.Sleep(diskPollInterval)
+	}
+}
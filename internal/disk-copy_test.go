@@ -0,0 +1,155 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const copyId = "7ab2fe0e-3c1f-4c3b-9f39-4c61c1f1b2c7"
+
+// copyHandler serves a source disk and the copy the engine makes of it
+type copyHandler struct {
+	sourceFormat string
+	copyStatus   string
+	copied       bool
+	copyBody     string
+	extendBody   string
+	copySize     int64
+	// leftover is a disk of the copy name made before the copy
+	leftover bool
+	// returnsCopy is an engine returning the copy in the copy action
+	returnsCopy bool
+}
+
+func (c *copyHandler) mock() MockOvirt {
+	api := NewMockOvirt()
+	api.Handle("/disks/"+diskId, genericRequestHandlerFunc(
+		fmt.Sprintf(`{"id": "%s", "name": "source", "format": "%s", "provisioned_size": "1073741824", "status": "ok"}`, diskId, c.sourceFormat)))
+	api.Handle("/disks/"+diskId+"/copy", func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		c.copyBody = string(b)
+		c.copied = true
+		if c.returnsCopy {
+			w.Write([]byte(`{"status": "complete", "disk": {"id": "` + copyId + `"}}`))
+			return
+		}
+		w.Write([]byte(`{"status": "complete"}`))
+	})
+	api.Handle("/disks", func(w http.ResponseWriter, r *http.Request) {
+		if c.returnsCopy {
+			w.Write([]byte(`{}`))
+			return
+		}
+		var disks []string
+		if c.leftover {
+			disks = append(disks, `{"id": "leftover", "name": "pv1", "format": "raw", "provisioned_size": "1073741824", "status": "ok"}`)
+		}
+		if c.copied {
+			disks = append(disks, fmt.Sprintf(`{"id": "%s", "name": "pv1", "format": "raw", "provisioned_size": "%d", "status": "%s"}`,
+				copyId, c.copySize, c.copyStatus))
+		}
+		fmt.Fprintf(w, `{"disk": [%s]}`, strings.Join(disks, ","))
+	})
+	api.Handle("/disks/"+copyId, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			b, _ := ioutil.ReadAll(r.Body)
+			c.extendBody = string(b)
+			c.copySize = 2147483648
+		}
+		fmt.Fprintf(w, `{"id": "%s", "name": "pv1", "format": "raw", "provisioned_size": "%d", "status": "ok"}`, copyId, c.copySize)
+	})
+	return api
+}
+
+func init() {
+	diskPollInterval = time.Millisecond
+}
+
+func TestOvirt_CopyDisk(t *testing.T) {
+	handler := &copyHandler{sourceFormat: "raw", copyStatus: "ok", copySize: 1073741824}
+	api := handler.mock()
+
+	disk, err := api.CopyDisk(diskId, "pv1", "claim", "data1", 2147483648, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if disk.Id != copyId || disk.ProvisionedSize != 2147483648 {
+		t.Errorf("expected the copy to be extended, got %+v", disk)
+	}
+	if !strings.Contains(handler.copyBody, `"storage_domain":{"name":"data1"}`) ||
+		!strings.Contains(handler.copyBody, `"disk":{"description":"claim","name":"pv1"}`) {
+		t.Errorf("expected a copy named and described to data1, got %s", handler.copyBody)
+	}
+	if handler.extendBody != `{"provisioned_size":"2147483648"}` {
+		t.Errorf("unexpected extend request %s", handler.extendBody)
+	}
+}
+
+func TestOvirt_CopyDiskOfTheSameSize(t *testing.T) {
+	handler := &copyHandler{sourceFormat: "raw", copyStatus: "ok", copySize: 1073741824}
+	api := handler.mock()
+
+	_, err := api.CopyDisk(diskId, "pv1", "claim", "data1", 1073741824, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if handler.extendBody != "" {
+		t.Errorf("expected no extend, got %s", handler.extendBody)
+	}
+}
+
+func TestOvirt_CopyDiskFindsTheCopy(t *testing.T) {
+	for _, handler := range []*copyHandler{
+		{sourceFormat: "raw", copyStatus: "ok", copySize: 1073741824, returnsCopy: true},
+		{sourceFormat: "raw", copyStatus: "ok", copySize: 1073741824, leftover: true},
+	} {
+		api := handler.mock()
+		disk, err := api.CopyDisk(diskId, "pv1", "claim", "data1", 1073741824, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if disk.Id != copyId {
+			t.Errorf("expected the copy %s, got %+v", copyId, disk)
+		}
+	}
+}
+
+func TestOvirt_CopyDiskRefusals(t *testing.T) {
+	tests := []struct {
+		name       string
+		handler    *copyHandler
+		size       int64
+		errMessage string
+	}{
+		{"smaller size", &copyHandler{sourceFormat: "raw", copyStatus: "ok"}, 1024, "smaller"},
+		{"incompatible format", &copyHandler{sourceFormat: "cow", copyStatus: "ok"}, 2147483648, "format cow"},
+		{"failed copy", &copyHandler{sourceFormat: "raw", copyStatus: "illegal"}, 2147483648, "illegal"},
+	}
+	for _, test := range tests {
+		api := test.handler.mock()
+		_, err := api.CopyDisk(diskId, "pv1", "claim", "data1", test.size, false)
+		if err == nil || !strings.Contains(err.Error(), test.errMessage) {
+			t.Errorf("%s: expected an error with '%s', got %v", test.name, test.errMessage, err)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	DefaultDiskInterface = "virtio_scsi"
+
+	QcowVersionV2 = "qcow2_v2"
+	QcowVersionV3 = "qcow2_v3"
+
+	DiskBackupIncremental = "incremental"
+)
+
+// DiskInterfaces are the interfaces a disk can be attached with
+var DiskInterfaces = []string{"virtio", "virtio_scsi", "sata"}
+
+// qcowCompat maps the qemu compat levels to the engine qcow versions
+var qcowCompat = map[string]string{
+	"0.10":        QcowVersionV2,
+	"1.1":         QcowVersionV3,
+	QcowVersionV2: QcowVersionV2,
+	QcowVersionV3: QcowVersionV3,
+}
+
+// DiskOptions are the properties of a new unattached disk. Only the name, the storage
+// domain and the size are mandatory.
+type DiskOptions struct {
+	Name             string
+	StorageDomain    string
+	SizeInBytes      int64
+	ReadOnly         bool
+	ThinProvisioning bool
+	// Format is raw or cow, when empty it is chosen by the storage domain type and ThinProvisioning
+	Format          DiskFormat
+	QcowVersion     string
+	Description     string
+	WipeAfterDelete bool
+	DiskProfileId   string
+	QuotaId         string
+	// IncrementalBackup enables incremental backup of the disk, it must be a cow disk
+	IncrementalBackup bool
+	// InitialSizeInBytes is the allocation of a cow disk on block storage, 0 for the default of the engine
+	InitialSizeInBytes int64
+}
+
+// Validate checks the options which don't depend on the engine
+func (o DiskOptions) Validate() error {
+	if o.Name == "" {
+		return fmt.Errorf("a disk must have a name")
+	}
+	if o.SizeInBytes <= 0 {
+		return fmt.Errorf("invalid size %d for disk %s", o.SizeInBytes, o.Name)
+	}
+	switch o.Format {
+	case "", "raw", "cow":
+	default:
+		return fmt.Errorf("invalid format '%s' for disk %s, expected raw or cow", o.Format, o.Name)
+	}
+	if o.QcowVersion != "" && o.QcowVersion != QcowVersionV2 && o.QcowVersion != QcowVersionV3 {
+		return fmt.Errorf("invalid qcow version '%s' for disk %s", o.QcowVersion, o.Name)
+	}
+	if o.Format == "raw" && (o.QcowVersion != "" || o.IncrementalBackup) {
+		return fmt.Errorf("a raw disk can't have a qcow version or incremental backup, disk %s", o.Name)
+	}
+	return nil
+}
+
+// QcowVersionOf returns the engine qcow version of a qemu compat level, 0.10 or 1.1
+func QcowVersionOf(compat string) (string, error) {
+	version, ok := qcowCompat[compat]
+	if !ok {
+		return "", fmt.Errorf("invalid qcow compat level '%s', expected 0.10 or 1.1", compat)
+	}
+	return version, nil
+}
+
+// ValidateDiskInterface returns an error if the disk can't be attached with the interface
+func ValidateDiskInterface(diskInterface string) error {
+	for _, i := range DiskInterfaces {
+		if i == diskInterface {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid disk interface '%s', expected one of %v", diskInterface, DiskInterfaces)
+}
+
+// diskFormatOf returns the format and sparseness of the disk. An explicit format must be
+// supported by the storage domain: a thin raw disk can only be on a file domain.
+func (ovirt *Ovirt) diskFormatOf(options DiskOptions) (DiskFormat, Sparse, error) {
+	if options.Format == "" {
+		return ovirt.DefaultDiskParamsBy(options.StorageDomain, options.ThinProvisioning)
+	}
+	if options.Format == "raw" && options.ThinProvisioning {
+		domain, err := ovirt.GetStorageDomainBy(options.StorageDomain)
+		if err != nil {
+			return "", false, err
+		}
+		if domain.Storage.Type == "iscsi" || domain.Storage.Type == "fcp" {
+			return "", false, fmt.Errorf("a thin provisioned raw disk can't be created on the %s storage domain %s",
+				domain.Storage.Type, options.StorageDomain)
+		}
+	}
+	return options.Format, Sparse(options.ThinProvisioning), nil
+}
+
+// GetDiskProfile returns the disk profile of the id
+func (ovirt *Ovirt) GetDiskProfile(id string) (DiskProfile, error) {
+	r, err := ovirt.Get("diskprofiles/" + id)
+	if err != nil {
+		return DiskProfile{}, err
+	}
+	profile := DiskProfile{}
+	err = json.Unmarshal(r, &profile)
+	return profile, err
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func mockDiskCreation(domainType string, body *map[string]interface{}) MockOvirt {
+	api := NewMockOvirt()
+	api.Handle("/storagedomains", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"storage_domain": [{"name": "data1", "storage": {"type": "%s"}}] }`, domainType)
+	})
+	api.Handle("/disks", func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(b, body)
+		fmt.Fprintf(w, `{"id": "%s", "status": "locked"}`, diskId)
+	})
+	return api
+}
+
+func TestCreateUnattachedDiskWithOptions(t *testing.T) {
+	body := map[string]interface{}{}
+	api := mockDiskCreation("nfs", &body)
+	_, err := api.CreateUnattachedDisk(DiskOptions{
+		Name:              "disk1",
+		StorageDomain:     "data1",
+		SizeInBytes:       1024,
+		ThinProvisioning:  true,
+		Format:            "cow",
+		QcowVersion:       QcowVersionV3,
+		Description:       "a disk",
+		WipeAfterDelete:   true,
+		DiskProfileId:     "profile-id",
+		QuotaId:           "quota-id",
+		IncrementalBackup: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"format":            "cow",
+		"sparse":            "true",
+		"qcow_version":      QcowVersionV3,
+		"description":       "a disk",
+		"wipe_after_delete": "true",
+		"backup":            DiskBackupIncremental,
+	}
+	for key, value := range expected {
+		if body[key] != value {
+			t.Errorf("expected %s %v, got %v", key, value, body[key])
+		}
+	}
+	if fmt.Sprint(body["disk_profile"]) != "map[id:profile-id]" || fmt.Sprint(body["quota"]) != "map[id:quota-id]" {
+		t.Errorf("expected the disk profile and the quota, got %v %v", body["disk_profile"], body["quota"])
+	}
+}
+
+func TestCreateUnattachedDiskRefusesFormat(t *testing.T) {
+	tests := []struct {
+		name       string
+		domainType string
+		options    DiskOptions
+		errMessage string
+	}{
+		{"thin raw on block", "iscsi", DiskOptions{SizeInBytes: 1024, Format: "raw", ThinProvisioning: true}, "thin provisioned raw"},
+		{"backup of a file domain thin disk", "nfs", DiskOptions{SizeInBytes: 1024, ThinProvisioning: true, IncrementalBackup: true}, "raw disk"},
+		{"qcow version of a preallocated disk", "iscsi", DiskOptions{SizeInBytes: 1024, QcowVersion: QcowVersionV2}, "raw disk"},
+		{"no size", "nfs", DiskOptions{Format: "cow"}, "invalid size"},
+	}
+	for _, test := range tests {
+		body := map[string]interface{}{}
+		api := mockDiskCreation(test.domainType, &body)
+		test.options.Name = "disk1"
+		test.options.StorageDomain = "data1"
+		_, err := api.CreateUnattachedDisk(test.options)
+		if err == nil || !strings.Contains(err.Error(), test.errMessage) {
+			t.Errorf("%s: expected an error with '%s', got %v", test.name, test.errMessage, err)
+		}
+		if len(body) != 0 {
+			t.Errorf("%s: expected no disk", test.name)
+		}
+	}
+}
+
+func TestGetDiskProfile(t *testing.T) {
+	api := NewMockOvirt()
+	api.Handle("/diskprofiles/profile-id", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"id": "profile-id", "name": "gold", "storage_domain": {"id": "data1-id"}}`)
+	})
+	profile, err := api.GetDiskProfile("profile-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.Name != "gold" || profile.StorageDomain == nil || profile.StorageDomain.Id != "data1-id" {
+		t.Errorf("expected profile gold of domain data1-id, got %+v", profile)
+	}
+}
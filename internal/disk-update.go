@@ -0,0 +1,72 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"encoding/json"
+	"net/url"
+	"strconv"
+)
+
+// DiskUpdate holds the properties of a disk to change, an empty one is left as is
+type DiskUpdate struct {
+	Name            string
+	Description     string
+	WipeAfterDelete *bool
+}
+
+// SearchDisks returns the disks matching the engine search query, i.e name=archived-*
+func (ovirt *Ovirt) SearchDisks(query string) ([]Disk, error) {
+	r, err := ovirt.Get("disks?search=" + url.QueryEscape(query))
+	if err != nil {
+		return nil, err
+	}
+	result := DiskResult{}
+	err = json.Unmarshal(r, &result)
+	return result.Disks, err
+}
+
+// UpdateDisk changes the properties of a floating disk
+func (ovirt *Ovirt) UpdateDisk(diskId string, update DiskUpdate) (Disk, error) {
+	request := map[string]string{}
+	if update.Name != "" {
+		request["name"] = update.Name
+	}
+	if update.Description != "" {
+		request["description"] = update.Description
+	}
+	if update.WipeAfterDelete != nil {
+		request["wipe_after_delete"] = strconv.FormatBool(*update.WipeAfterDelete)
+	}
+	r, err := ovirt.Put("disks/"+diskId, request)
+	if err != nil {
+		return Disk{}, err
+	}
+	disk := Disk{}
+	err = json.Unmarshal([]byte(r), &disk)
+	return disk, err
+}
+
+// MoveDisk starts moving a floating disk to another storage domain, the disk is locked till
+// the engine completes it
+func (ovirt *Ovirt) MoveDisk(diskId string, storageDomainName string) error {
+	request := map[string]interface{}{
+		"storage_domain": map[string]string{"name": storageDomainName},
+	}
+	_, err := ovirt.Post("disks/"+diskId+"/move", request)
+	return err
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestOvirt_UpdateDisk(t *testing.T) {
+	api := NewMockOvirt()
+	var body string
+	api.Handle("/disks/"+diskId, func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		fmt.Fprintf(w, `{"id": "%s", "name": "archived-pv1", "wipe_after_delete": "true"}`, diskId)
+	})
+
+	wipe := true
+	disk, err := api.UpdateDisk(diskId, DiskUpdate{Name: "archived-pv1", WipeAfterDelete: &wipe})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != `{"name":"archived-pv1","wipe_after_delete":"true"}` {
+		t.Errorf("unexpected update request %s", body)
+	}
+	if disk.Name != "archived-pv1" || !disk.WipeAfterDelete {
+		t.Errorf("expected the updated disk, got %+v", disk)
+	}
+}
+
+func TestOvirt_MoveDisk(t *testing.T) {
+	api := NewMockOvirt()
+	var body string
+	api.Handle("/disks/"+diskId+"/move", func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		w.Write([]byte(`{"status": "complete"}`))
+	})
+
+	err := api.MoveDisk(diskId, "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != `{"storage_domain":{"name":"archive"}}` {
+		t.Errorf("unexpected move request %s", body)
+	}
+}
+
+func TestOvirt_SearchDisks(t *testing.T) {
+	api := NewMockOvirt()
+	var query string
+	api.Handle("/disks", func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query().Get("search")
+		fmt.Fprintf(w, `{"disk": [{"id": "%s", "name": "archived-pv1"}]}`, diskId)
+	})
+
+	disks, err := api.SearchDisks("name=archived-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query != "name=archived-*" || len(disks) != 1 || disks[0].Id != diskId {
+		t.Errorf("unexpected disks %+v of query %s", disks, query)
+	}
+}
@@ -0,0 +1,362 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+const (
+	DefaultChunkSize = 8 * 1024 * 1024
+	DefaultRetries   = 3
+)
+
+// retryInterval is the pause before retrying a failed chunk
+var retryInterval = 2 * time.Second
+
+// qcow2Magic starts every qcow2 image, the virtual size is at offset 24
+var qcow2Magic = []byte{'Q', 'F', 'I', 0xfb}
+
+// TransferOptions controls the streaming of an image
+type TransferOptions struct {
+	// ChunkSize is the size of every http request
+	ChunkSize int64
+	// Retries of a failed chunk before giving up
+	Retries int
+	// UseProxy sends the data through the imageio proxy of the engine instead of the host daemon
+	UseProxy bool
+	// StateFile keeps the progress of an upload, a failed upload resumes from it
+	StateFile string
+	// Progress is called after every chunk
+	Progress func(done int64, total int64)
+}
+
+func (o *TransferOptions) defaults() {
+	if o.ChunkSize <= 0 {
+		o.ChunkSize = DefaultChunkSize
+	}
+	if o.Retries <= 0 {
+		o.Retries = DefaultRetries
+	}
+	if o.Progress == nil {
+		o.Progress = func(int64, int64) {}
+	}
+}
+
+func (o *TransferOptions) url(transfer ImageTransfer) string {
+	if o.UseProxy || transfer.TransferUrl == "" {
+		return transfer.ProxyUrl
+	}
+	return transfer.TransferUrl
+}
+
+// ImageInfo describes a local image
+type ImageInfo struct {
+	Format DiskFormat
+	// Size of the image file
+	Size int64
+	// VirtualSize is the size of the disk the image holds
+	VirtualSize int64
+}
+
+// InspectImage tells a qcow2 image, which goes to a cow disk, from a raw one
+func InspectImage(image *os.File) (ImageInfo, error) {
+	stat, err := image.Stat()
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	info := ImageInfo{Format: "raw", Size: stat.Size(), VirtualSize: stat.Size()}
+	header := make([]byte, 32)
+	n, err := image.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return info, err
+	}
+	if n == len(header) && bytes.Equal(header[:4], qcow2Magic) {
+		info.Format = "cow"
+		info.VirtualSize = int64(binary.BigEndian.Uint64(header[24:32]))
+	}
+	return info, nil
+}
+
+// uploadState is the progress of an upload, persisted after every chunk. Sha256 is the checksum
+// of the part of the image sent, a resume checks the image still has it.
+type uploadState struct {
+	DiskId     string `json:"diskId"`
+	TransferId string `json:"transferId"`
+	Size       int64  `json:"size"`
+	Offset     int64  `json:"offset"`
+	Sha256     string `json:"sha256,omitempty"`
+}
+
+func readUploadState(file string) (uploadState, error) {
+	state := uploadState{}
+	if file == "" {
+		return state, nil
+	}
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	return state, json.Unmarshal(b, &state)
+}
+
+func writeUploadState(file string, state uploadState) error {
+	if file == "" {
+		return nil
+	}
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// UploadImage writes the image into the disk and returns its sha256. The image format must match the
+// disk format and fit into it, and the disk must not be attached. When the state file holds an upload of
+// the same image to the same disk whose transfer is still open, the upload resumes where it stopped,
+// unless the part of the image sent before changed since.
+func UploadImage(ovirt OvirtApi, diskId string, image *os.File, options TransferOptions) (string, error) {
+	options.defaults()
+	info, err := InspectImage(image)
+	if err != nil {
+		return "", err
+	}
+	disk, err := ovirt.GetDiskById(diskId)
+	if err != nil {
+		return "", err
+	}
+	if disk.Format != info.Format {
+		return "", fmt.Errorf("a %s image can't be uploaded to disk %s of format %s", info.Format, diskId, disk.Format)
+	}
+	if info.VirtualSize > int64(disk.ProvisionedSize) {
+		return "", fmt.Errorf("the image size %d is bigger than the size %d of disk %s", info.VirtualSize, disk.ProvisionedSize, diskId)
+	}
+	if disk.Vms != nil && len(disk.Vms.Vms) > 0 {
+		return "", fmt.Errorf("disk %s is attached to VM %s, it is in use", diskId, disk.Vms.Vms[0].Id)
+	}
+
+	transfer, state, err := resumeUpload(ovirt, diskId, info.Size, options.StateFile)
+	if err != nil {
+		return "", err
+	}
+	if transfer.Id == "" {
+		transfer, err = ovirt.StartImageTransfer(diskId, TransferDirectionUpload)
+		if err != nil {
+			return "", err
+		}
+		state = uploadState{DiskId: diskId, TransferId: transfer.Id, Size: info.Size}
+		err = writeUploadState(options.StateFile, state)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// the checksum covers the whole image, the part sent before a resume is read again
+	sum := sha256.New()
+	_, err = io.Copy(sum, io.NewSectionReader(image, 0, state.Offset))
+	if err != nil {
+		return "", err
+	}
+	if state.Sha256 != "" && state.Sha256 != hex.EncodeToString(sum.Sum(nil)) {
+		return "", fmt.Errorf("the image changed since the upload stopped at offset %d, remove the state file %s to start over",
+			state.Offset, options.StateFile)
+	}
+
+	url := options.url(transfer)
+	buf := make([]byte, options.ChunkSize)
+	for state.Offset < info.Size {
+		length := options.ChunkSize
+		if info.Size-state.Offset < length {
+			length = info.Size - state.Offset
+		}
+		chunk := buf[:length]
+		_, err = image.ReadAt(chunk, state.Offset)
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		err = retry(options.Retries, func() error {
+			return ovirt.PutImageChunk(url, state.Offset, length, info.Size, bytes.NewReader(chunk))
+		})
+		if err != nil {
+			return "", fmt.Errorf("upload stopped at offset %d of %d: %s", state.Offset, info.Size, err)
+		}
+		sum.Write(chunk)
+		state.Offset += length
+		state.Sha256 = hex.EncodeToString(sum.Sum(nil))
+		err = writeUploadState(options.StateFile, state)
+		if err != nil {
+			return "", err
+		}
+		options.Progress(state.Offset, info.Size)
+	}
+
+	err = ovirt.FinalizeImageTransfer(transfer.Id, diskId)
+	if err != nil {
+		return "", err
+	}
+	if options.StateFile != "" {
+		os.Remove(options.StateFile)
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// resumeUpload returns the open transfer of a previous upload of the image to the disk and its state,
+// or an empty transfer if there is none. A stale transfer is cancelled.
+func resumeUpload(ovirt OvirtApi, diskId string, size int64, stateFile string) (ImageTransfer, uploadState, error) {
+	state, err := readUploadState(stateFile)
+	if err != nil || state.TransferId == "" {
+		return ImageTransfer{}, state, err
+	}
+	if state.DiskId != diskId || state.Size != size {
+		return ImageTransfer{}, state, fmt.Errorf("state file %s belongs to an upload of another image or disk, remove it to start over", stateFile)
+	}
+	transfer, err := ovirt.GetImageTransfer(state.TransferId)
+	if err == nil && transfer.Phase == TransferPhaseTransferring {
+		logInfof("resuming image transfer %s of disk %s at offset %d", transfer.Id, diskId, state.Offset)
+		return transfer, state, nil
+	}
+	if err == nil {
+		ovirt.CancelImageTransfer(state.TransferId)
+	}
+	return ImageTransfer{}, uploadState{}, nil
+}
+
+// DownloadImage writes the image of the disk to out and returns its sha256 and size. A raw disk is
+// downloaded up to its provisioned size, a cow disk up to the image size the transfer reports, the
+// actual size of a cow disk is the allocation on the storage which may be bigger than the image.
+func DownloadImage(ovirt OvirtApi, diskId string, out io.Writer, options TransferOptions) (string, int64, error) {
+	disk, err := ovirt.GetDiskById(diskId)
+	if err != nil {
+		return "", 0, err
+	}
+	if disk.Vms != nil && len(disk.Vms.Vms) > 0 {
+		return "", 0, fmt.Errorf("disk %s is attached to VM %s, it is in use", diskId, disk.Vms.Vms[0].Id)
+	}
+	size := int64(disk.ProvisionedSize)
+	if disk.Format == "cow" {
+		size = imageSizeOfTransfer
+	}
+
+	sum := sha256.New()
+	written, err := download(ovirt, diskId, size, io.MultiWriter(out, sum), options)
+	if err != nil {
+		return "", written, err
+	}
+	return hex.EncodeToString(sum.Sum(nil)), written, nil
+}
+
+// VerifyImage downloads the first size bytes of the disk and compares their sha256 to the expected one
+func VerifyImage(ovirt OvirtApi, diskId string, size int64, expectedSha256 string, options TransferOptions) error {
+	sum := sha256.New()
+	written, err := download(ovirt, diskId, size, sum, options)
+	if err != nil {
+		return err
+	}
+	actual := hex.EncodeToString(sum.Sum(nil))
+	if written != size || actual != expectedSha256 {
+		return fmt.Errorf("checksum mismatch of disk %s: expected sha256 %s of %d bytes, got %s of %d bytes",
+			diskId, expectedSha256, size, actual, written)
+	}
+	return nil
+}
+
+// imageSizeOfTransfer is the size to download the whole image the transfer reports
+const imageSizeOfTransfer = -1
+
+// download reads up to size bytes of the disk in a download transfer, a shorter image ends it early
+func download(ovirt OvirtApi, diskId string, size int64, out io.Writer, options TransferOptions) (int64, error) {
+	options.defaults()
+	transfer, err := ovirt.StartImageTransfer(diskId, TransferDirectionDownload)
+	if err != nil {
+		return 0, err
+	}
+
+	url := options.url(transfer)
+	if size == imageSizeOfTransfer {
+		size, err = ovirt.GetImageSize(url)
+		if err != nil {
+			ovirt.CancelImageTransfer(transfer.Id)
+			return 0, err
+		}
+	}
+	var offset int64
+	var buf bytes.Buffer
+	for offset < size {
+		length := options.ChunkSize
+		if size-offset < length {
+			length = size - offset
+		}
+		buf.Reset()
+		err = retry(options.Retries, func() error {
+			buf.Reset()
+			r, err := ovirt.GetImageChunk(url, offset, length)
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			_, err = io.Copy(&buf, r)
+			return err
+		})
+		if err != nil {
+			ovirt.CancelImageTransfer(transfer.Id)
+			return offset, fmt.Errorf("download stopped at offset %d of %d: %s", offset, size, err)
+		}
+		n, err := buf.WriteTo(out)
+		offset += n
+		if err != nil {
+			ovirt.CancelImageTransfer(transfer.Id)
+			return offset, err
+		}
+		options.Progress(offset, size)
+		if n < length {
+			break
+		}
+	}
+	return offset, ovirt.FinalizeImageTransfer(transfer.Id, diskId)
+}
+
+func retry(attempts int, f func() error) error {
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			logErrorf("retrying after: %s", err)
+			time.Sleep(retryInterval)
+		}
+		err = f()
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
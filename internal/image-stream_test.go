@@ -0,0 +1,344 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeImageio is an engine serving a single disk and its image transfers, and the
+// imageio daemon the data goes through
+type fakeImageio struct {
+	api       MockOvirt
+	format    string
+	data      []byte
+	phase     string
+	started   int
+	cancelled int
+	// failures is the number of writes to fail at failOffset
+	failures   int
+	failOffset int64
+	attached   bool
+	// actualSize is the allocation the engine reports, the image size if 0
+	actualSize int
+}
+
+func newFakeImageio(format string, size int) *fakeImageio {
+	f := &fakeImageio{api: NewMockOvirt(), format: format, data: make([]byte, size)}
+	f.api.Handle("/disks/"+diskId, func(w http.ResponseWriter, r *http.Request) {
+		vms := ""
+		if f.attached {
+			vms = fmt.Sprintf(`, "vms": {"vm": [{"id": "%s"}]}`, vmId)
+		}
+		actualSize := f.actualSize
+		if actualSize == 0 {
+			actualSize = len(f.data)
+		}
+		fmt.Fprintf(w, `{"id": "%s", "format": "%s", "provisioned_size": "%d", "actual_size": "%d", "status": "ok"%s}`,
+			diskId, f.format, len(f.data), actualSize, vms)
+	})
+	f.api.Handle("/imagetransfers", func(w http.ResponseWriter, r *http.Request) {
+		f.started++
+		f.phase = TransferPhaseTransferring
+		fmt.Fprintf(w, `{"id": "t%d", "phase": "initializing", "transfer_url": "%s/images/t%d"}`, f.started, f.api.Connection.Url, f.started)
+	})
+	f.api.Handle("/imagetransfers/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.Split(strings.TrimPrefix(r.URL.Path, "/imagetransfers/"), "/")[0]
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/finalize"):
+			f.phase = TransferPhaseFinishedSuccess
+		case strings.HasSuffix(r.URL.Path, "/cancel"):
+			f.cancelled++
+			f.phase = "cancelled"
+		}
+		if id != fmt.Sprintf("t%d", f.started) {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `{"id": "%s", "phase": "%s", "transfer_url": "%s/images/%s"}`, id, f.phase, f.api.Connection.Url, id)
+	})
+	f.api.Handle("/images/", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPut:
+			var start, end, total int64
+			fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total)
+			b, _ := ioutil.ReadAll(r.Body)
+			if f.failures > 0 && start == f.failOffset {
+				f.failures--
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			copy(f.data[start:], b)
+		case http.MethodGet:
+			var start, end int64
+			fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end)
+			if end >= int64(len(f.data)) {
+				end = int64(len(f.data)) - 1
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(f.data)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(f.data[start : end+1])
+		}
+	})
+	return f
+}
+
+func attachedFakeImageio() *fakeImageio {
+	f := newFakeImageio("raw", 8192)
+	f.attached = true
+	return f
+}
+
+func quickTransfer(stateFile string) TransferOptions {
+	retryInterval = 0
+	diskPollInterval = 0
+	return TransferOptions{ChunkSize: 1000, Retries: 2, StateFile: stateFile}
+}
+
+func writeImage(t *testing.T, dir string, content []byte) *os.File {
+	path := filepath.Join(dir, "image")
+	err := ioutil.WriteFile(path, content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func imageContent(size int) []byte {
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	return content
+}
+
+func sha256Of(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestUploadImage(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "upload")
+	defer os.RemoveAll(dir)
+	content := imageContent(4500)
+	image := writeImage(t, dir, content)
+	defer image.Close()
+	fake := newFakeImageio("raw", 8192)
+	// a single transient failure is retried
+	fake.failures, fake.failOffset = 1, 2000
+
+	sum, err := UploadImage(fake.api, diskId, image, quickTransfer(filepath.Join(dir, "state")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != sha256Of(content) {
+		t.Errorf("unexpected checksum %s", sum)
+	}
+	if !bytes.Equal(fake.data[:len(content)], content) || fake.phase != TransferPhaseFinishedSuccess {
+		t.Errorf("expected the image on the disk and the transfer finalized, phase %s", fake.phase)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "state")); !os.IsNotExist(err) {
+		t.Errorf("expected the state file to be removed")
+	}
+
+	err = VerifyImage(fake.api, diskId, int64(len(content)), sum, quickTransfer(""))
+	if err != nil {
+		t.Errorf("expected the verification to pass: %s", err)
+	}
+	fake.data[10]++
+	err = VerifyImage(fake.api, diskId, int64(len(content)), sum, quickTransfer(""))
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("expected a checksum mismatch, got %v", err)
+	}
+}
+
+func TestUploadImageResumes(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "upload")
+	defer os.RemoveAll(dir)
+	content := imageContent(4500)
+	image := writeImage(t, dir, content)
+	defer image.Close()
+	fake := newFakeImageio("raw", 8192)
+	fake.failures, fake.failOffset = 2, 3000
+	stateFile := filepath.Join(dir, "state")
+
+	_, err := UploadImage(fake.api, diskId, image, quickTransfer(stateFile))
+	if err == nil || !strings.Contains(err.Error(), "offset 3000") {
+		t.Fatalf("expected the upload to stop at offset 3000, got %v", err)
+	}
+	state, _ := readUploadState(stateFile)
+	if state.Offset != 3000 || state.TransferId != "t1" {
+		t.Fatalf("unexpected state %+v", state)
+	}
+
+	sum, err := UploadImage(fake.api, diskId, image, quickTransfer(stateFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fake.started != 1 {
+		t.Errorf("expected the upload to resume the first transfer, started %d", fake.started)
+	}
+	if sum != sha256Of(content) || !bytes.Equal(fake.data[:len(content)], content) {
+		t.Errorf("expected the whole image after the resume")
+	}
+}
+
+func TestUploadImageRefusesChangedImage(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "upload")
+	defer os.RemoveAll(dir)
+	content := imageContent(4500)
+	image := writeImage(t, dir, content)
+	defer image.Close()
+	fake := newFakeImageio("raw", 8192)
+	fake.failures, fake.failOffset = 2, 3000
+	stateFile := filepath.Join(dir, "state")
+	if _, err := UploadImage(fake.api, diskId, image, quickTransfer(stateFile)); err == nil {
+		t.Fatal("expected the upload to stop")
+	}
+
+	content[10]++
+	changed := writeImage(t, dir, content)
+	defer changed.Close()
+	_, err := UploadImage(fake.api, diskId, changed, quickTransfer(stateFile))
+	if err == nil || !strings.Contains(err.Error(), "image changed") {
+		t.Fatalf("expected the resume of a changed image to fail, got %v", err)
+	}
+	if fake.started != 1 || fake.cancelled != 0 {
+		t.Errorf("expected the transfer left as is, started %d cancelled %d", fake.started, fake.cancelled)
+	}
+}
+
+func TestUploadImageRestartsStaleTransfer(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "upload")
+	defer os.RemoveAll(dir)
+	content := imageContent(2500)
+	image := writeImage(t, dir, content)
+	defer image.Close()
+	fake := newFakeImageio("raw", 8192)
+	stateFile := filepath.Join(dir, "state")
+	writeUploadState(stateFile, uploadState{DiskId: diskId, TransferId: "t0", Size: 2500, Offset: 2000})
+
+	_, err := UploadImage(fake.api, diskId, image, quickTransfer(stateFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fake.data[:len(content)], content) {
+		t.Errorf("expected the upload to start over")
+	}
+}
+
+func TestUploadImageRefusals(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "upload")
+	defer os.RemoveAll(dir)
+	qcow2 := make([]byte, 512)
+	copy(qcow2, qcow2Magic)
+	binary.BigEndian.PutUint64(qcow2[24:], 4096)
+
+	tests := []struct {
+		name       string
+		content    []byte
+		disk       *fakeImageio
+		errMessage string
+	}{
+		{"qcow2 to raw", qcow2, newFakeImageio("raw", 8192), "a cow image"},
+		{"raw to cow", imageContent(100), newFakeImageio("cow", 8192), "a raw image"},
+		{"too big", imageContent(9000), newFakeImageio("raw", 8192), "bigger"},
+		{"qcow2 too big", qcow2, newFakeImageio("cow", 1024), "bigger"},
+		{"attached", imageContent(100), attachedFakeImageio(), "in use"},
+	}
+
+	for _, test := range tests {
+		image := writeImage(t, dir, test.content)
+		_, err := UploadImage(test.disk.api, diskId, image, quickTransfer(""))
+		image.Close()
+		if err == nil || !strings.Contains(err.Error(), test.errMessage) {
+			t.Errorf("%s: expected an error with '%s', got %v", test.name, test.errMessage, err)
+		}
+		if test.disk.started != 0 {
+			t.Errorf("%s: expected no transfer", test.name)
+		}
+	}
+}
+
+func TestDownloadImage(t *testing.T) {
+	fake := newFakeImageio("raw", 4500)
+	copy(fake.data, imageContent(4500))
+
+	var out bytes.Buffer
+	sum, size, err := DownloadImage(fake.api, diskId, &out, quickTransfer(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 4500 || sum != sha256Of(fake.data) || !bytes.Equal(out.Bytes(), fake.data) {
+		t.Errorf("unexpected download of %d bytes", size)
+	}
+	if fake.phase != TransferPhaseFinishedSuccess {
+		t.Errorf("expected the transfer to be finalized, phase %s", fake.phase)
+	}
+}
+
+func TestDownloadCowImage(t *testing.T) {
+	fake := newFakeImageio("cow", 4500)
+	copy(fake.data, imageContent(4500))
+	// the engine refreshes the actual size periodically, it lags behind the image
+	fake.actualSize = 1000
+
+	var out bytes.Buffer
+	sum, size, err := DownloadImage(fake.api, diskId, &out, quickTransfer(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 4500 || sum != sha256Of(fake.data) {
+		t.Errorf("expected the download of the 4500 bytes image, got %d bytes", size)
+	}
+}
+
+func TestInspectImage(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "inspect")
+	defer os.RemoveAll(dir)
+	qcow2 := make([]byte, 512)
+	copy(qcow2, qcow2Magic)
+	binary.BigEndian.PutUint64(qcow2[24:], 1<<30)
+
+	image := writeImage(t, dir, qcow2)
+	info, err := InspectImage(image)
+	image.Close()
+	if err != nil || info.Format != "cow" || info.VirtualSize != 1<<30 || info.Size != 512 {
+		t.Errorf("unexpected qcow2 info %+v %v", info, err)
+	}
+
+	image = writeImage(t, dir, []byte("tiny"))
+	info, err = InspectImage(image)
+	image.Close()
+	if err != nil || info.Format != "raw" || info.VirtualSize != 4 {
+		t.Errorf("unexpected raw info %+v %v", info, err)
+	}
+}
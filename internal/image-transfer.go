@@ -0,0 +1,196 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// Image transfers move disk images through the imageio daemon of a host, or through the
+// imageio proxy of the engine. The engine creates a transfer with a ticket for the disk, the
+// data is read or written with plain http range requests on the transfer url, and the
+// transfer is finalized to release the disk.
+
+const (
+	TransferDirectionUpload   = "upload"
+	TransferDirectionDownload = "download"
+
+	TransferPhaseInitializing    = "initializing"
+	TransferPhaseTransferring    = "transferring"
+	TransferPhaseFinishedSuccess = "finished_success"
+	TransferPhaseFinishedFailure = "finished_failure"
+
+	// DefaultTransferTimeout is how long to wait for the engine to move a transfer to its next phase
+	DefaultTransferTimeout = 5 * time.Minute
+)
+
+// StartImageTransfer creates a transfer of the disk and waits for it to be ready for the data
+func (ovirt *Ovirt) StartImageTransfer(diskId string, direction string) (ImageTransfer, error) {
+	request := map[string]interface{}{
+		"disk":      map[string]string{"id": diskId},
+		"direction": direction,
+	}
+	post, err := ovirt.Post("imagetransfers", request)
+	if err != nil {
+		return ImageTransfer{}, err
+	}
+	transfer := ImageTransfer{}
+	err = json.Unmarshal([]byte(post), &transfer)
+	if err != nil {
+		return transfer, err
+	}
+
+	deadline := time.Now().Add(DefaultTransferTimeout)
+	for transfer.Phase != TransferPhaseTransferring {
+		if transfer.Phase != TransferPhaseInitializing && transfer.Phase != "" {
+			return transfer, fmt.Errorf("image transfer %s of disk %s is in phase %s", transfer.Id, diskId, transfer.Phase)
+		}
+		if time.Now().After(deadline) {
+			return transfer, fmt.Errorf("image transfer %s of disk %s is not ready after %s", transfer.Id, diskId, DefaultTransferTimeout)
+		}
+		time.Sleep(diskPollInterval)
+		transfer, err = ovirt.GetImageTransfer(transfer.Id)
+		if err != nil {
+			return transfer, err
+		}
+	}
+	return transfer, nil
+}
+
+func (ovirt *Ovirt) GetImageTransfer(transferId string) (ImageTransfer, error) {
+	r, err := ovirt.Get("imagetransfers/" + transferId)
+	transfer := ImageTransfer{}
+	if err != nil {
+		return transfer, err
+	}
+	err = json.Unmarshal(r, &transfer)
+	return transfer, err
+}
+
+// FinalizeImageTransfer completes the transfer and waits for the engine to verify the image and
+// release the disk. Some engines remove a finished transfer, then the disk status tells the result.
+func (ovirt *Ovirt) FinalizeImageTransfer(transferId string, diskId string) error {
+	_, err := ovirt.Post("imagetransfers/"+transferId+"/finalize", map[string]string{})
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(DefaultTransferTimeout)
+	for {
+		transfer, err := ovirt.GetImageTransfer(transferId)
+		if _, notFound := err.(NotFound); notFound {
+			_, err = ovirt.waitForDisk(func() (Disk, error) { return ovirt.GetDiskById(diskId) }, DefaultTransferTimeout)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		switch transfer.Phase {
+		case TransferPhaseFinishedSuccess:
+			return nil
+		case TransferPhaseFinishedFailure:
+			return fmt.Errorf("the engine failed image transfer %s of disk %s", transferId, diskId)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("image transfer %s is still in phase %s after %s", transferId, transfer.Phase, DefaultTransferTimeout)
+		}
+		time.Sleep(diskPollInterval)
+	}
+}
+
+// CancelImageTransfer aborts the transfer, an upload leaves the disk in an illegal state
+func (ovirt *Ovirt) CancelImageTransfer(transferId string) error {
+	_, err := ovirt.Post("imagetransfers/"+transferId+"/cancel", map[string]string{})
+	return err
+}
+
+// PutImageChunk writes the data at the offset of the image, the total is the size of the whole image
+func (ovirt *Ovirt) PutImageChunk(transferUrl string, offset int64, length int64, total int64, data io.Reader) error {
+	r, err := http.NewRequest(http.MethodPut, transferUrl, io.LimitReader(data, length))
+	if err != nil {
+		return err
+	}
+	r.ContentLength = length
+	r.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, total))
+	client := ovirt.httpClient()
+	resp, err := client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("failed writing bytes %d-%d: %s %s", offset, offset+length-1, resp.Status, b)
+	}
+	return nil
+}
+
+// GetImageChunk reads length bytes from the offset of the image. The caller closes the reader.
+func (ovirt *Ovirt) GetImageChunk(transferUrl string, offset int64, length int64) (io.ReadCloser, error) {
+	r, err := http.NewRequest(http.MethodGet, transferUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	client := ovirt.httpClient()
+	resp, err := client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("failed reading bytes %d-%d: %s %s", offset, offset+length-1, resp.Status, b)
+	}
+	return resp.Body, nil
+}
+
+// GetImageSize returns the length of the image the transfer serves, as imageio reports it in the
+// total of the Content-Range of a ranged read, or in the Content-Length of a whole read.
+func (ovirt *Ovirt) GetImageSize(transferUrl string) (int64, error) {
+	r, err := http.NewRequest(http.MethodGet, transferUrl, nil)
+	if err != nil {
+		return 0, err
+	}
+	r.Header.Set("Range", "bytes=0-0")
+	client := ovirt.httpClient()
+	resp, err := client.Do(r)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+		var start, end, total int64
+		_, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total)
+		if err != nil {
+			return 0, fmt.Errorf("failed reading the image size of Content-Range '%s': %s", resp.Header.Get("Content-Range"), err)
+		}
+		return total, nil
+	case resp.StatusCode < 300 && resp.ContentLength >= 0:
+		return resp.ContentLength, nil
+	case resp.StatusCode < 300:
+		return 0, fmt.Errorf("the transfer %s reports no image size", transferUrl)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	return 0, fmt.Errorf("failed reading the image size: %s %s", resp.Status, b)
+}
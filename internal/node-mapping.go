@@ -0,0 +1,229 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/api/core/v1"
+)
+
+// MappingStrategy is the way a kubernetes node is mapped to its ovirt VM
+type MappingStrategy string
+
+const (
+	// MapBySystemUUID uses the node's SystemUUID, which is the VM id for VMs created by ovirt
+	MapBySystemUUID MappingStrategy = "systemUUID"
+	// MapByProviderID uses the node's spec.providerID, in the form of ovirt://<vm-id>
+	MapByProviderID MappingStrategy = "providerID"
+	// MapByVMName expects the node name to be the VM name
+	MapByVMName MappingStrategy = "vmName"
+	// MapByFQDN expects the node name to be the FQDN of the VM, as reported by the guest agent
+	MapByFQDN MappingStrategy = "fqdn"
+	// MapByAnnotation reads the VM id from a node annotation
+	MapByAnnotation MappingStrategy = "annotation"
+	// MapByLabel reads the VM id from a node label
+	MapByLabel MappingStrategy = "label"
+	// MapByCustomProperty looks for the VM with a custom property set to the node name
+	MapByCustomProperty MappingStrategy = "customProperty"
+)
+
+// DefaultNodeMappingCacheTTL is how long a resolved node is trusted
+const DefaultNodeMappingCacheTTL = 10 * time.Minute
+
+// NodeMappingConfig selects the mapping strategy. Key is the annotation, the label or
+// the custom property name for the strategies which need one.
+type NodeMappingConfig struct {
+	Strategy MappingStrategy
+	Key      string
+	CacheTTL time.Duration
+}
+
+// NodeGetter fetches a kubernetes node by its name
+type NodeGetter func(nodeName string) (*v1.Node, error)
+
+// NodeNotMapped is returned when the node can't be resolved to a VM
+type NodeNotMapped struct {
+	NodeName string
+	Strategy MappingStrategy
+}
+
+func (n NodeNotMapped) Error() string {
+	return fmt.Sprintf("node %s could not be mapped to a VM using the %s strategy", n.NodeName, n.Strategy)
+}
+
+// NodeMapper resolves kubernetes node names to ovirt VM ids, and caches the results.
+// Strategies which rely on the node object use the NodeGetter, so no kubernetes access
+// is needed for the ones that only query ovirt.
+type NodeMapper struct {
+	config  NodeMappingConfig
+	ovirt   OvirtApi
+	getNode NodeGetter
+
+	mutex  sync.Mutex
+	vmIds  map[string]string
+	expiry map[string]time.Time
+}
+
+// NewNodeMapper validates the config and creates a mapper. An empty strategy defaults to systemUUID.
+func NewNodeMapper(config NodeMappingConfig, ovirt OvirtApi, getNode NodeGetter) (*NodeMapper, error) {
+	if config.Strategy == "" {
+		config.Strategy = MapBySystemUUID
+	}
+	switch config.Strategy {
+	case MapBySystemUUID, MapByProviderID, MapByVMName, MapByFQDN:
+	case MapByAnnotation, MapByLabel, MapByCustomProperty:
+		if config.Key == "" {
+			return nil, fmt.Errorf("node mapping strategy %s requires a key", config.Strategy)
+		}
+	default:
+		return nil, fmt.Errorf("unknown node mapping strategy '%s'", config.Strategy)
+	}
+	if config.CacheTTL == 0 {
+		config.CacheTTL = DefaultNodeMappingCacheTTL
+	}
+	return &NodeMapper{
+		config:  config,
+		ovirt:   ovirt,
+		getNode: getNode,
+		vmIds:   map[string]string{},
+		expiry:  map[string]time.Time{},
+	}, nil
+}
+
+// Strategy returns the strategy in use
+func (m *NodeMapper) Strategy() MappingStrategy {
+	return m.config.Strategy
+}
+
+// VMId returns the ovirt VM id of the node. Only the cache is locked, the nodes are resolved
+// concurrently, so a slow resolution doesn't hold the call-outs of the other nodes.
+func (m *NodeMapper) VMId(nodeName string) (string, error) {
+	m.mutex.Lock()
+	id, ok := m.vmIds[nodeName]
+	cached := ok && time.Now().Before(m.expiry[nodeName])
+	m.mutex.Unlock()
+	if cached {
+		return id, nil
+	}
+
+	id, err := m.resolve(nodeName)
+	if err != nil {
+		return "", err
+	}
+	if id == "" {
+		return "", NodeNotMapped{NodeName: nodeName, Strategy: m.config.Strategy}
+	}
+	m.mutex.Lock()
+	m.vmIds[nodeName] = id
+	m.expiry[nodeName] = time.Now().Add(m.config.CacheTTL)
+	m.mutex.Unlock()
+	return id, nil
+}
+
+// Forget drops the cached mapping of the node, i.e when the VM was not found by that id
+func (m *NodeMapper) Forget(nodeName string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.vmIds, nodeName)
+	delete(m.expiry, nodeName)
+}
+
+func (m *NodeMapper) resolve(nodeName string) (string, error) {
+	switch m.config.Strategy {
+	case MapByVMName:
+		vm, err := m.ovirt.GetVM(nodeName)
+		return vm.Id, err
+	case MapByFQDN:
+		vms, err := m.searchVMs("fqdn=" + nodeName)
+		for _, vm := range vms {
+			if vm.Fqdn == nodeName {
+				return vm.Id, err
+			}
+		}
+		return "", err
+	case MapByCustomProperty:
+		return m.resolveByCustomProperty(nodeName)
+	}
+
+	if m.getNode == nil {
+		return "", fmt.Errorf("node mapping strategy %s needs access to the kubernetes nodes", m.config.Strategy)
+	}
+	node, err := m.getNode(nodeName)
+	if err != nil {
+		return "", err
+	}
+	switch m.config.Strategy {
+	case MapBySystemUUID:
+		// the system UUID may be reported in upper case
+		return strings.ToLower(node.Status.NodeInfo.SystemUUID), nil
+	case MapByProviderID:
+		return VMIdFromProviderID(node.Spec.ProviderID), nil
+	case MapByAnnotation:
+		return node.Annotations[m.config.Key], nil
+	case MapByLabel:
+		return node.Labels[m.config.Key], nil
+	}
+	return "", nil
+}
+
+// searchVMs returns the VMs the engine finds by the search, an empty search returns all of them
+func (m *NodeMapper) searchVMs(search string) ([]VM, error) {
+	if search == "" {
+		return m.ovirt.GetVMs("vms")
+	}
+	return m.ovirt.GetVMs("vms?search=" + url.QueryEscape(search))
+}
+
+// resolveByCustomProperty finds the VM whose custom property is the node name. The engine search
+// has no custom properties, so the VMs are listed and every node found is cached, to list them once
+// for all the nodes in the cache TTL.
+func (m *NodeMapper) resolveByCustomProperty(nodeName string) (string, error) {
+	vms, err := m.searchVMs("")
+	if err != nil {
+		return "", err
+	}
+	id := ""
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, vm := range vms {
+		for _, p := range vm.CustomProperties.CustomProperties {
+			if p.Name != m.config.Key || p.Value == "" {
+				continue
+			}
+			if p.Value == nodeName {
+				id = vm.Id
+			}
+			m.vmIds[p.Value] = vm.Id
+			m.expiry[p.Value] = time.Now().Add(m.config.CacheTTL)
+		}
+	}
+	return id, nil
+}
+
+// VMIdFromProviderID strips the scheme of a provider ID, ovirt://<vm-id>
+func VMIdFromProviderID(providerID string) string {
+	i := strings.Index(providerID, "://")
+	if i < 0 {
+		return providerID
+	}
+	return providerID[i+3:]
+}
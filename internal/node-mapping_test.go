@@ -0,0 +1,190 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"errors"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var testNode = v1.Node{
+	ObjectMeta: metav1.ObjectMeta{
+		Name:        "node1.example.com",
+		Annotations: map[string]string{"ovirt.org/vm-id": "annotated-vm-id"},
+		Labels:      map[string]string{"ovirt.org/vm-id": "labeled-vm-id"},
+	},
+	Spec: v1.NodeSpec{ProviderID: "ovirt://provider-vm-id"},
+	Status: v1.NodeStatus{
+		NodeInfo: v1.NodeSystemInfo{SystemUUID: "12345678-1234-1234-1234-123456789ABC"},
+	},
+}
+
+const testVms = `{ "vm": [
+	{ "id": "vm-id-1", "name": "vm1", "fqdn": "node1.example.com",
+	  "custom_properties": { "custom_property": [{"name": "k8s_node", "value": "node1"}] } },
+	{ "id": "vm-id-2", "name": "vm2", "fqdn": "node2.example.com" }
+]}`
+
+func countingNodeGetter(calls *int) NodeGetter {
+	return func(nodeName string) (*v1.Node, error) {
+		*calls++
+		if nodeName != testNode.Name {
+			return nil, errors.New("node not found")
+		}
+		return &testNode, nil
+	}
+}
+
+var _ = Describe("Node mapping", func() {
+
+	Context("strategies reading the node", func() {
+		var calls int
+
+		BeforeEach(func() {
+			calls = 0
+		})
+
+		expectVMId := func(strategy MappingStrategy, key string, expected string) {
+			mapper, err := NewNodeMapper(NodeMappingConfig{Strategy: strategy, Key: key}, nil, countingNodeGetter(&calls))
+			Expect(err).NotTo(HaveOccurred())
+			id, err := mapper.VMId(testNode.Name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(id).To(Equal(expected))
+		}
+
+		It("defaults to the lower cased system UUID", func() {
+			expectVMId("", "", "12345678-1234-1234-1234-123456789abc")
+		})
+		It("strips the scheme of the provider ID", func() {
+			expectVMId(MapByProviderID, "", "provider-vm-id")
+		})
+		It("reads the annotation", func() {
+			expectVMId(MapByAnnotation, "ovirt.org/vm-id", "annotated-vm-id")
+		})
+		It("reads the label", func() {
+			expectVMId(MapByLabel, "ovirt.org/vm-id", "labeled-vm-id")
+		})
+
+		It("caches the result", func() {
+			mapper, _ := NewNodeMapper(NodeMappingConfig{}, nil, countingNodeGetter(&calls))
+			mapper.VMId(testNode.Name)
+			mapper.VMId(testNode.Name)
+			Expect(calls).To(Equal(1))
+
+			mapper.Forget(testNode.Name)
+			mapper.VMId(testNode.Name)
+			Expect(calls).To(Equal(2))
+		})
+
+		It("resolves the nodes concurrently", func() {
+			resolving := make(chan struct{})
+			release := make(chan struct{})
+			mapper, _ := NewNodeMapper(NodeMappingConfig{}, nil, func(nodeName string) (*v1.Node, error) {
+				if nodeName == "slow" {
+					close(resolving)
+					<-release
+				}
+				return &testNode, nil
+			})
+			go mapper.VMId("slow")
+			<-resolving
+			// the slow node doesn't hold the others
+			_, err := mapper.VMId(testNode.Name)
+			close(release)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("fails with NodeNotMapped when the annotation is missing", func() {
+			mapper, _ := NewNodeMapper(NodeMappingConfig{Strategy: MapByAnnotation, Key: "missing"}, nil, countingNodeGetter(&calls))
+			_, err := mapper.VMId(testNode.Name)
+			Expect(err).To(BeAssignableToTypeOf(NodeNotMapped{}))
+		})
+	})
+
+	Context("strategies querying ovirt", func() {
+		It("maps by the VM name", func() {
+			api := CreateMockOvirtClient(func(writer http.ResponseWriter, request *http.Request) {
+				Expect(request.URL.Query().Get("search")).To(Equal("name=vm2"))
+				writer.Write([]byte(`{ "vm": [{ "id": "vm-id-2", "name": "vm2" }]}`))
+			})
+			mapper, _ := NewNodeMapper(NodeMappingConfig{Strategy: MapByVMName}, &api, nil)
+			id, err := mapper.VMId("vm2")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(id).To(Equal("vm-id-2"))
+		})
+
+		It("maps by the VM fqdn", func() {
+			api := CreateMockOvirtClient(func(writer http.ResponseWriter, request *http.Request) {
+				Expect(request.URL.Query().Get("search")).To(Equal("fqdn=node2.example.com"))
+				writer.Write([]byte(testVms))
+			})
+			mapper, _ := NewNodeMapper(NodeMappingConfig{Strategy: MapByFQDN}, &api, nil)
+			id, err := mapper.VMId("node2.example.com")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(id).To(Equal("vm-id-2"))
+		})
+
+		It("maps by a VM custom property", func() {
+			api := CreateMockOvirtClient(genericRequestHandlerFunc(testVms))
+			mapper, _ := NewNodeMapper(NodeMappingConfig{Strategy: MapByCustomProperty, Key: "k8s_node"}, &api, nil)
+			id, err := mapper.VMId("node1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(id).To(Equal("vm-id-1"))
+		})
+
+		It("lists the VMs once for all the nodes of a custom property", func() {
+			listings := 0
+			api := CreateMockOvirtClient(func(writer http.ResponseWriter, request *http.Request) {
+				listings++
+				writer.Write([]byte(`{ "vm": [
+					{ "id": "vm-id-1", "custom_properties": { "custom_property": [{"name": "k8s_node", "value": "node1"}] } },
+					{ "id": "vm-id-2", "custom_properties": { "custom_property": [{"name": "k8s_node", "value": "node2"}] } }
+				]}`))
+			})
+			mapper, _ := NewNodeMapper(NodeMappingConfig{Strategy: MapByCustomProperty, Key: "k8s_node"}, &api, nil)
+			first, err := mapper.VMId("node1")
+			Expect(err).NotTo(HaveOccurred())
+			second, err := mapper.VMId("node2")
+			Expect(err).NotTo(HaveOccurred())
+			Expect([]string{first, second}).To(Equal([]string{"vm-id-1", "vm-id-2"}))
+			Expect(listings).To(Equal(1))
+		})
+
+		It("fails with NodeNotMapped when no VM matches", func() {
+			api := CreateMockOvirtClient(genericRequestHandlerFunc(testVms))
+			mapper, _ := NewNodeMapper(NodeMappingConfig{Strategy: MapByFQDN}, &api, nil)
+			_, err := mapper.VMId("node3.example.com")
+			Expect(err).To(BeAssignableToTypeOf(NodeNotMapped{}))
+		})
+	})
+
+	Context("config validation", func() {
+		It("fails on an unknown strategy", func() {
+			_, err := NewNodeMapper(NodeMappingConfig{Strategy: "bogus"}, nil, nil)
+			Expect(err).To(HaveOccurred())
+		})
+		It("fails when the key is missing", func() {
+			_, err := NewNodeMapper(NodeMappingConfig{Strategy: MapByLabel}, nil, nil)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -17,6 +17,7 @@ limitations under the License.
 package internal
 
 import (
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
@@ -30,6 +31,7 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -44,6 +46,9 @@ type Ovirt struct {
 	Connection Connection
 	client     http.Client
 	token      Token
+	// auth guards the client and the token, which a re-authentication replaces while
+	// the agent serves call-outs concurrently
+	auth sync.RWMutex
 }
 
 type Connection struct {
@@ -52,6 +57,8 @@ type Connection struct {
 	Password string
 	Insecure bool
 	CAFile   string
+	// ClusterId tells the disks of the kubernetes clusters sharing the engine apart, see BackReference
+	ClusterId string
 }
 
 type Token struct {
@@ -75,6 +82,7 @@ func NewOvirt(configReader io.Reader) (OvirtApi, error) {
 	o.Connection.Password = viper.GetString("password")
 	o.Connection.Insecure = viper.GetBool("insecure")
 	o.Connection.CAFile = viper.GetString("cafile")
+	o.Connection.ClusterId = viper.GetString("clusterId")
 	return &o, nil
 }
 
@@ -83,6 +91,13 @@ func (ovirt *Ovirt) GetConnectionDetails() Connection {
 }
 
 func (ovirt *Ovirt) Authenticate() error {
+	ovirt.auth.Lock()
+	defer ovirt.auth.Unlock()
+	return ovirt.authenticate()
+}
+
+// authenticate sets up the client and the token, the caller holds the auth lock
+func (ovirt *Ovirt) authenticate() error {
 	ovirtEngineUrl, err := url.Parse(ovirt.Connection.Url)
 	if err != nil {
 		return err
@@ -132,14 +147,20 @@ func persistToken(ovirt *Ovirt) {
 	j, _ := json.Marshal(ovirt.token)
 	err := ioutil.WriteFile(tokenStore, j, 0600)
 	if err != nil {
-		logErrorf(fmt.Sprintf("error persisting token %s", err))
+		logErrorf("error persisting token %s", err)
 	}
 }
 
 // isTokenValid tries a simple GET / with the oauth token
-// returns true for 200 ok, otherwise false
+// returns true for 200 ok, otherwise false. The caller holds the auth lock.
 func isTokenValid(ovirt *Ovirt) bool {
-	resp, err := ovirt.clientDo(http.MethodGet, ovirt.Connection.Url, strings.NewReader(""))
+	r, err := http.NewRequest(http.MethodGet, ovirt.Connection.Url, nil)
+	if err != nil {
+		return false
+	}
+	r.Header.Set("Accept", "application/json")
+	r.Header.Set("Authorization", "Bearer "+ovirt.token.Value)
+	resp, err := ovirt.client.Do(r)
 
 	if err != nil {
 		return false
@@ -163,17 +184,49 @@ func (ovirt *Ovirt) GetDiskByName(diskName string) (DiskResult, error) {
 	return diskResult, err
 }
 
-func (ovirt *Ovirt) CreateUnattachedDisk(diskName string, storageDomainName string, sizeIbBytes int64, readOnly bool, thinProvisioning bool) (Disk, error) {
-	format, sparse, err := ovirt.DefaultDiskParamsBy(storageDomainName, thinProvisioning)
+func (ovirt *Ovirt) GetDiskById(diskId string) (Disk, error) {
+	r, err := ovirt.Get("disks/" + diskId)
+	disk := Disk{}
+	if err != nil {
+		return disk, err
+	}
+	err = json.Unmarshal(r, &disk)
+	return disk, err
+}
+
+// CreateUnattachedDisk creates a floating disk, it is locked till the storage allocates it
+func (ovirt *Ovirt) CreateUnattachedDisk(options DiskOptions) (Disk, error) {
+	err := options.Validate()
 	if err != nil {
 		return Disk{}, err
 	}
+	format, sparse, err := ovirt.diskFormatOf(options)
+	if err != nil {
+		return Disk{}, err
+	}
+	if format != "cow" && (options.QcowVersion != "" || options.IncrementalBackup) {
+		return Disk{}, fmt.Errorf("disk %s on storage domain %s is a %s disk, it can't have a qcow version or incremental backup",
+			options.Name, options.StorageDomain, format)
+	}
 	disk := Disk{
-		Name:            diskName,
-		ProvisionedSize: uint64(sizeIbBytes),
+		Name:            options.Name,
+		Description:     options.Description,
+		ProvisionedSize: uint64(options.SizeInBytes),
 		Format:          format,
-		StorageDomains:  StorageDomains{[]StorageDomain{{Name: storageDomainName}}},
+		StorageDomains:  StorageDomains{[]StorageDomain{{Name: options.StorageDomain}}},
 		Sparse:          sparse,
+		WipeAfterDelete: options.WipeAfterDelete,
+		QcowVersion:     options.QcowVersion,
+		InitialSize:     uint64(options.InitialSizeInBytes),
+	}
+	if options.DiskProfileId != "" {
+		disk.DiskProfile = &Reference{Id: options.DiskProfileId}
+	}
+	if options.QuotaId != "" {
+		disk.Quota = &Reference{Id: options.QuotaId}
+	}
+	if options.IncrementalBackup {
+		disk.Backup = DiskBackupIncremental
 	}
 
 	post, err := ovirt.Post("disks", disk)
@@ -214,7 +267,8 @@ func (ovirt *Ovirt) CreateDisk(
 	readOnly bool,
 	vmId string,
 	diskId string,
-	diskInterface string) (DiskAttachment, error) {
+	diskInterface string,
+	passDiscard bool) (DiskAttachment, error) {
 
 	a := DiskAttachment{
 		Active: true,
@@ -225,13 +279,14 @@ func (ovirt *Ovirt) CreateDisk(
 				[]StorageDomain{{Name: storageDomainName}},
 			},
 		},
-		ReadOnly: readOnly,
+		ReadOnly:    readOnly,
+		PassDiscard: passDiscard,
 	}
 	if diskInterface != "" {
 		a.Interface = diskInterface
 	}
 	if diskInterface == "" {
-		a.Interface = "virtio_scsi"
+		a.Interface = DefaultDiskInterface
 	}
 	if diskId != "" {
 		a.Disk.Id = diskId
@@ -268,7 +323,33 @@ type NotFound struct {
 }
 
 func (n NotFound) Error() string {
-	return fmt.Sprintf("No resource at " + n.response.Request.URL.Path)
+	return "No resource at " + n.response.Request.URL.Path
+}
+
+// Fault is a failure reported by the engine, with its reason and detail
+type Fault struct {
+	Status string `json:"-"`
+	Code   int    `json:"-"`
+	Reason string `json:"reason"`
+	Detail string `json:"detail"`
+}
+
+func (f Fault) Error() string {
+	if f.Detail == "" {
+		return f.Status
+	}
+	return fmt.Sprintf("%s: %s %s", f.Status, f.Reason, f.Detail)
+}
+
+// IsDeviceBusy returns true if the engine refused the operation because the guest is
+// still using the device, i.e a hot unplug of a mounted disk
+func IsDeviceBusy(err error) bool {
+	fault, ok := err.(Fault)
+	if !ok {
+		return false
+	}
+	detail := strings.ToLower(fault.Detail)
+	return fault.Code == http.StatusConflict || strings.Contains(detail, "busy") || strings.Contains(detail, "in use")
 }
 
 func translateError(response http.Response) error {
@@ -276,7 +357,14 @@ func translateError(response http.Response) error {
 	case 404:
 		return NotFound{response: response}
 	}
-	return errors.New(response.Status)
+	fault := Fault{Status: response.Status, Code: response.StatusCode}
+	if response.Body != nil {
+		b, err := ioutil.ReadAll(response.Body)
+		if err == nil {
+			json.Unmarshal(b, &fault)
+		}
+	}
+	return fault
 }
 
 func (ovirt *Ovirt) Post(path string, data interface{}) (string, error) {
@@ -301,6 +389,28 @@ func (ovirt *Ovirt) Post(path string, data interface{}) (string, error) {
 	return string(b), err
 }
 
+func (ovirt *Ovirt) Put(path string, data interface{}) (string, error) {
+	d, err := json.Marshal(data)
+	if err != nil {
+		// failed json conversion
+		return "", err
+	}
+	resp, err := ovirt.clientDo(http.MethodPut, path, strings.NewReader(string(d)))
+
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode > 300 {
+		return "", translateError(*resp)
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	return string(b), err
+}
+
 func (ovirt *Ovirt) Delete(path string) ([]byte, error) {
 	resp, err := ovirt.clientDo(http.MethodDelete, path, strings.NewReader(""))
 
@@ -311,7 +421,7 @@ func (ovirt *Ovirt) Delete(path string) ([]byte, error) {
 	defer resp.Body.Close()
 
 	if resp.StatusCode > 200 {
-		return nil, errors.New(resp.Status)
+		return nil, translateError(*resp)
 	}
 
 	b, err := ioutil.ReadAll(resp.Body)
@@ -363,8 +473,9 @@ func (ovirt *Ovirt) GetDiskAttachment(vmId, diskId string) (DiskAttachment, erro
 	return d, err
 }
 
+// GetDiskAttachments returns the disk attachments of the VM, with their disks
 func (ovirt *Ovirt) GetDiskAttachments(vmId string) ([]DiskAttachment, error) {
-	s, err := ovirt.Get("vms/" + vmId + "/diskattachments/")
+	s, err := ovirt.Get("vms/" + vmId + "/diskattachments?follow=disk")
 	result := DiskAttachmentResult{}
 	if err != nil {
 		return result.DiskAttachments, err
@@ -373,11 +484,67 @@ func (ovirt *Ovirt) GetDiskAttachments(vmId string) ([]DiskAttachment, error) {
 	return result.DiskAttachments, err
 }
 
+// GetTemplateDisks returns the disks of the template with the name
+func (ovirt *Ovirt) GetTemplateDisks(templateName string) ([]Disk, error) {
+	s, err := ovirt.Get("templates?search=" + url.QueryEscape("name="+templateName))
+	if err != nil {
+		return nil, err
+	}
+	templates := TemplateResult{}
+	err = json.Unmarshal(s, &templates)
+	if err != nil {
+		return nil, err
+	}
+	var template *Template
+	for i, t := range templates.Templates {
+		if t.Name == templateName {
+			template = &templates.Templates[i]
+		}
+	}
+	if template == nil {
+		return nil, ErrNotExist
+	}
+
+	s, err = ovirt.Get("templates/" + template.Id + "/diskattachments")
+	if err != nil {
+		return nil, err
+	}
+	attachments := DiskAttachmentResult{}
+	err = json.Unmarshal(s, &attachments)
+	if err != nil {
+		return nil, err
+	}
+	// the attachments reference the disks by id only
+	disks := make([]Disk, 0, len(attachments.DiskAttachments))
+	for _, a := range attachments.DiskAttachments {
+		disk, err := ovirt.GetDiskById(a.Disk.Id)
+		if err != nil {
+			return nil, err
+		}
+		disks = append(disks, disk)
+	}
+	return disks, nil
+}
+
+// DetachDiskFromVM removes the disk attachment from the VM. The disk should be deactivated first,
+// see DetachDiskGracefully
 func (ovirt *Ovirt) DetachDiskFromVM(vmId string, diskId string) error {
 	_, err := ovirt.Delete("vms/" + vmId + "/diskattachments/" + diskId)
 	return err
 }
 
+// ActivateDiskAttachment hot plugs an attached, inactive disk
+func (ovirt *Ovirt) ActivateDiskAttachment(vmId string, diskId string) error {
+	_, err := ovirt.Put("vms/"+vmId+"/diskattachments/"+diskId, map[string]string{"active": "true"})
+	return err
+}
+
+// DeactivateDiskAttachment hot unplugs the disk from the VM and keeps it attached
+func (ovirt *Ovirt) DeactivateDiskAttachment(vmId string, diskId string) error {
+	_, err := ovirt.Put("vms/"+vmId+"/diskattachments/"+diskId, map[string]string{"active": "false"})
+	return err
+}
+
 func readCaCertPool(ovirt *Ovirt) (*x509.CertPool, error) {
 	caCert, err := ioutil.ReadFile(ovirt.Connection.CAFile)
 	if err != nil {
@@ -454,38 +621,79 @@ func fetchToken(ovirtEngineUrl url.URL, username string, password string, client
 	return t, nil
 }
 
+// clientDo calls the api with the token. A request the engine rejects for its token is sent
+// once more after re-authenticating.
 func (ovirt *Ovirt) clientDo(method string, url string, payload io.Reader) (*http.Response, error) {
 	url = fmt.Sprintf("%s/%s", ovirt.Connection.Url, url)
+	// the payload is sent twice when the request is retried
+	body, err := ioutil.ReadAll(payload)
+	if err != nil {
+		return nil, err
+	}
+	resp, token, err := ovirt.do(method, url, body)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	resp.Body.Close()
+	// invalid token, probably expired due to inactivity or
+	// ovirt-engine has restarted. ovirt-engine doesn't support
+	// fully persistent oauth tokens
+	logInfof("ovirt api rejected the token, re-authenticating...")
+	err = ovirt.reauthenticate(token)
+	if err != nil {
+		return nil, err
+	}
+	resp, _, err = ovirt.do(method, url, body)
+	return resp, err
+}
+
+// do sends a single request with the current token, and returns the token it used
+func (ovirt *Ovirt) do(method string, url string, body []byte) (*http.Response, string, error) {
 	logInfof("calling ovirt api url: %s", url)
-	r, _ := http.NewRequest(method, url, payload)
+	r, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, "", err
+	}
+	ovirt.auth.RLock()
+	client, token := ovirt.client, ovirt.token.Value
+	ovirt.auth.RUnlock()
 	r.Header.Set("Accept", "application/json")
 	r.Header.Add("Content-Type", "application/json")
-	r.Header.Set("Authorization", "Bearer "+ovirt.token.Value)
+	r.Header.Set("Authorization", "Bearer "+token)
 
-	resp, err := ovirt.client.Do(r)
+	resp, err := client.Do(r)
 
 	if err != nil {
 		logErrorf("failed to call ovirt api: %s", err)
-		return resp, err
+		return resp, token, err
 	}
-
 	if resp.StatusCode >= 300 {
-		logInfof("failed to call ovirt api with response: %s", resp.Body)
-		if resp.StatusCode == 401 {
-			// invalid token, probably expired due to inactivity or
-			// ovirt-engine has restarted. ovirt-engine doesn't support
-			// fully persistent oauth tokens
-			logInfof("ovirt api rejected the token, re-authenticating...")
-			err := os.Remove(tokenStore)
-			if err != nil {
-				logInfof("failed to remove the old token file %s", err)
-			}
-			ovirt.token.Value = ""
-			ovirt.Authenticate()
-		}
+		logInfof("failed to call ovirt api with response: %s", resp.Status)
+	}
+	return resp, token, nil
+}
+
+// reauthenticate replaces the rejected token. Of the concurrent calls rejected with the same
+// token only the first one fetches a new token, the others use it.
+func (ovirt *Ovirt) reauthenticate(rejected string) error {
+	ovirt.auth.Lock()
+	defer ovirt.auth.Unlock()
+	if ovirt.token.Value != rejected {
+		return nil
+	}
+	err := os.Remove(tokenStore)
+	if err != nil {
+		logInfof("failed to remove the old token file %s", err)
 	}
+	ovirt.token.Value = ""
+	return ovirt.authenticate()
+}
 
-	return resp, err
+// httpClient returns the client of the last authentication
+func (ovirt *Ovirt) httpClient() http.Client {
+	ovirt.auth.RLock()
+	defer ovirt.auth.RUnlock()
+	return ovirt.client
 }
 
 // GetStorageDomainBy returns a storage domain type by name
@@ -24,6 +24,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -42,6 +43,7 @@ username=user@abcde123213
 password=123444
 insecure=true
 cafile=
+clusterId=prod
 `
 	ovirt, e := NewOvirt(strings.NewReader(conf))
 	if e != nil {
@@ -62,6 +64,9 @@ cafile=
 	if ovirt.GetConnectionDetails().CAFile != "" {
 		t.Errorf("failed parsing cafile")
 	}
+	if ovirt.GetConnectionDetails().ClusterId != "prod" {
+		t.Errorf("failed parsing clusterId")
+	}
 }
 
 var _ = Describe("Authentication tests", func() {
@@ -141,7 +146,47 @@ var _ = Describe("Authentication tests", func() {
 		})
 
 		Context("on 401 unauthorized", func() {
-			It("catches it and reauthenticate", func() {})
+			AfterEach(func() {
+				os.Remove("/tmp/ovirt-flexdriver.token")
+			})
+
+			It("catches it and reauthenticate", func() {
+				var mu sync.Mutex
+				logins := 0
+				api := NewMockOvirt()
+				api.token.Value = "expired"
+				api.Handle(tokenUrl, func(w http.ResponseWriter, r *http.Request) {
+					mu.Lock()
+					logins++
+					mu.Unlock()
+					fmt.Fprintf(w, `{ "access_token": "renewed", "exp": "%v", "token_type": "Bearer"}`, time.Now().Add(time.Hour).UnixNano())
+				})
+				api.Handle("/vms/"+vmId, func(w http.ResponseWriter, r *http.Request) {
+					if r.Header.Get("Authorization") != "Bearer renewed" {
+						w.WriteHeader(http.StatusUnauthorized)
+						return
+					}
+					w.Write([]byte(`{"id": "` + vmId + `"}`))
+				})
+				api.Handle("/", func(w http.ResponseWriter, r *http.Request) {})
+
+				var wg sync.WaitGroup
+				errs := make(chan error, 10)
+				for i := 0; i < 10; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						_, err := api.GetVMById(vmId)
+						errs <- err
+					}()
+				}
+				wg.Wait()
+				close(errs)
+				for err := range errs {
+					Expect(err).NotTo(HaveOccurred())
+				}
+				Expect(logins).To(Equal(1))
+			})
 		})
 	})
 
@@ -159,12 +204,12 @@ var _ = Describe("API calls on resources", func() {
 				underTest, errRead = ioutil.ReadAll(request.Body)
 			})
 
-			_, _ = api.CreateUnattachedDisk(
-				"disk1",
-				"data1",
-				19999,
-				false,
-				false)
+			_, _ = api.CreateUnattachedDisk(DiskOptions{
+				Name:             "disk1",
+				StorageDomain:    "data1",
+				SizeInBytes:      19999,
+				ThinProvisioning: false,
+			})
 
 			req := make(map[string]interface{})
 			err := json.Unmarshal(underTest, &req)
@@ -200,12 +245,12 @@ var _ = Describe("API calls on resources", func() {
 				underTest, errRead = ioutil.ReadAll(request.Body)
 			})
 
-			_, _ = api.CreateUnattachedDisk(
-				"disk1",
-				"data1",
-				19999,
-				false,
-				true)
+			_, _ = api.CreateUnattachedDisk(DiskOptions{
+				Name:             "disk1",
+				StorageDomain:    "data1",
+				SizeInBytes:      19999,
+				ThinProvisioning: true,
+			})
 
 			req := make(map[string]interface{})
 			err := json.Unmarshal(underTest, &req)
@@ -452,13 +497,23 @@ var testAttachRequest = `
 func TestAttachRequestFrom(t *testing.T) {
 	request, e := AttachRequestFrom(testAttachRequest)
 	if e != nil {
-		t.Errorf(e.Error())
+		t.Error(e)
 	}
 	if request.Size != "1G" {
 		t.Errorf("expected size is %v got %v", "1G", request.Size)
 	}
 }
 
+func TestAttachRequestFromDeleteOnDetach(t *testing.T) {
+	request, e := AttachRequestFrom(`{"kubernetes.io/pvOrVolumeName":"scratch", "deleteOnDetach":"true"}`)
+	if e != nil {
+		t.Error(e)
+	}
+	if !request.DeleteOnDetach {
+		t.Errorf("expected deleteOnDetach to be true")
+	}
+}
+
 func TestByteSizeFormatting(t *testing.T) {
 	// ovirt api supports bytes. Lets expand with some literals
 
@@ -472,7 +527,7 @@ func TestByteSizeFormatting(t *testing.T) {
 
 func genericRequestHandlerFunc(json string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, json)
+		fmt.Fprint(w, json)
 	}
 }
 
@@ -489,14 +544,13 @@ func TestOvirt_CreateUnattachedDisk(t *testing.T) {
       }
     `
 	api := CreateMockOvirtClient(genericRequestHandlerFunc(createResponse))
-	_, e := api.CreateUnattachedDisk(
-		"pvc-d69b93df-7e96-11e8-b3fa-001a4a160100",
-		"iscidomain",
-		1073741824,
-		false,
-		false)
+	_, e := api.CreateUnattachedDisk(DiskOptions{
+		Name:          "pvc-d69b93df-7e96-11e8-b3fa-001a4a160100",
+		StorageDomain: "iscidomain",
+		SizeInBytes:   1073741824,
+	})
 	if e != nil {
-		t.Errorf(e.Error())
+		t.Error(e)
 	}
 }
 
@@ -519,9 +573,10 @@ func TestOvirt_Attach(t *testing.T) {
 		false,
 		"some-vm-id",
 		"disk-uuid",
-		"")
+		"",
+		false)
 	if e != nil {
-		t.Errorf(e.Error())
+		t.Error(e)
 	}
 }
 
@@ -530,6 +585,65 @@ func TestOvirt_DetachDiskFromVM(t *testing.T) {
 	api := CreateMockOvirtClient(genericRequestHandlerFunc(detachResponse))
 	e := api.DetachDiskFromVM(vmId, diskId)
 	if e != nil {
-		t.Errorf(e.Error())
+		t.Error(e)
+	}
+}
+
+func TestOvirt_GetDiskById(t *testing.T) {
+	getResponse := `
+      {
+        "id": "0138c56c-1937-461b-98e1-a1c5c82ae082",
+        "name":"scratch",
+        "description":"some description",
+        "provisioned_size":"1073741824",
+        "status": "ok",
+        "format":"raw",
+        "storage_domains": { "storage_domain": [{"name":"nfsdomain"}] }
+      }
+    `
+	api := CreateMockOvirtClient(genericRequestHandlerFunc(getResponse))
+	disk, e := api.GetDiskById("0138c56c-1937-461b-98e1-a1c5c82ae082")
+	if e != nil {
+		t.Error(e)
+	}
+	if disk.Status != "ok" {
+		t.Errorf("expected status ok got %s", disk.Status)
+	}
+	if disk.Description != "some description" {
+		t.Errorf("expected description 'some description' got %s", disk.Description)
+	}
+}
+
+func TestOvirt_GetTemplateDisks(t *testing.T) {
+	api := NewMockOvirt()
+	api.Handle("/templates", genericRequestHandlerFunc(`{"template": [{"id": "t1", "name": "centos"}]}`))
+	api.Handle("/templates/t1/diskattachments", genericRequestHandlerFunc(`{"disk_attachment": [{"disk": {"id": "`+diskId+`"}}]}`))
+	api.Handle("/disks/"+diskId, genericRequestHandlerFunc(`{"id": "`+diskId+`", "name": "centos-disk"}`))
+
+	disks, err := api.GetTemplateDisks("centos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(disks) != 1 || disks[0].Name != "centos-disk" {
+		t.Errorf("expected the centos disk, got %+v", disks)
+	}
+
+	_, err = api.GetTemplateDisks("other")
+	if err != ErrNotExist {
+		t.Errorf("expected ErrNotExist for a missing template, got %v", err)
+	}
+}
+
+func TestOvirt_GetTemplateDisksEscapesTheName(t *testing.T) {
+	api := NewMockOvirt()
+	var search string
+	api.Handle("/templates", func(w http.ResponseWriter, r *http.Request) {
+		search = r.URL.Query().Get("search")
+		w.Write([]byte(`{"template": []}`))
+	})
+
+	api.GetTemplateDisks("centos 7&x=1")
+	if search != "name=centos 7&x=1" {
+		t.Errorf("expected the search of the whole template name, got '%s'", search)
 	}
 }
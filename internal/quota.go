@@ -0,0 +1,53 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"encoding/json"
+)
+
+// QuotaModeEnabled is the quota mode of a data center which refuses disks over their quota,
+// in audit mode the engine only logs them
+const QuotaModeEnabled = "enabled"
+
+// GetQuotaStorageLimits returns the storage limits of a quota of the data center
+func (ovirt *Ovirt) GetQuotaStorageLimits(dataCenterId string, quotaId string) ([]QuotaStorageLimit, error) {
+	r, err := ovirt.Get("datacenters/" + dataCenterId + "/quotas/" + quotaId + "/quotastoragelimits")
+	if err != nil {
+		return nil, err
+	}
+	result := QuotaStorageLimitResult{}
+	err = json.Unmarshal(r, &result)
+	return result.Limits, err
+}
+
+// StorageLimitOf returns the limit of the quota on the storage domain, which is either set on the
+// domain or on all the domains of the data center. It returns false when the quota has no such limit.
+func StorageLimitOf(limits []QuotaStorageLimit, storageDomainId string) (QuotaStorageLimit, bool) {
+	var global *QuotaStorageLimit
+	for i, l := range limits {
+		if l.StorageDomain == nil {
+			global = &limits[i]
+		} else if l.StorageDomain.Id == storageDomainId {
+			return l, true
+		}
+	}
+	if global != nil {
+		return *global, true
+	}
+	return QuotaStorageLimit{}, false
+}
@@ -0,0 +1,48 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"testing"
+)
+
+func TestGetQuotaStorageLimits(t *testing.T) {
+	api := NewMockOvirt()
+	api.Handle("/datacenters/dc1-id/quotas/quota1-id/quotastoragelimits", genericRequestHandlerFunc(`{"quota_storage_limit": [
+		{"id": "l1", "limit": "-1", "usage": "3.5"},
+		{"id": "l2", "limit": "100", "usage": "42.25", "storage_domain": {"id": "sd1-id"}}]}`))
+	limits, err := api.GetQuotaStorageLimits("dc1-id", "quota1-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(limits) != 2 || limits[0].Limit != -1 || limits[1].Limit != 100 || limits[1].Usage != 42.25 {
+		t.Fatalf("unexpected limits %+v", limits)
+	}
+
+	limit, ok := StorageLimitOf(limits, "sd1-id")
+	if !ok || limit.Id != "l2" {
+		t.Errorf("expected the limit of the domain, got %+v", limit)
+	}
+	limit, ok = StorageLimitOf(limits, "sd2-id")
+	if !ok || limit.Id != "l1" {
+		t.Errorf("expected the global limit, got %+v", limit)
+	}
+	_, ok = StorageLimitOf(limits[1:], "sd2-id")
+	if ok {
+		t.Errorf("expected no limit on another domain")
+	}
+}
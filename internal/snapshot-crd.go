@@ -0,0 +1,236 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"encoding/json"
+	"path"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+// The kubernetes volume snapshot CRDs, snapshot.storage.k8s.io/v1alpha1. The vendored
+// client-go has neither their types nor a dynamic client, so the types are declared
+// here with the fields we use, and accessed with a plain rest client.
+const (
+	SnapshotGroup   = "snapshot.storage.k8s.io"
+	SnapshotVersion = "v1alpha1"
+
+	// SnapshotDeletionPolicyDelete removes the oVirt snapshot with its VolumeSnapshotContent
+	SnapshotDeletionPolicyDelete = "Delete"
+	// SnapshotDeletionPolicyRetain keeps the oVirt snapshot
+	SnapshotDeletionPolicyRetain = "Retain"
+)
+
+// AnnVolumeID is the annotation of a provisioned PV holding the id of its disk
+const AnnVolumeID = "ovirt.external-storage.incubator.kubernetes.io/VolumeID"
+
+// AnnStorageDomain is the annotation of a provisioned PV holding the name of the storage domain of its disk
+const AnnStorageDomain = "ovirt.external-storage.incubator.kubernetes.io/StorageDomain"
+
+// TypedReference points to an object in the same namespace, i.e the source of a VolumeSnapshot
+// or the dataSource of a PVC
+type TypedReference struct {
+	APIGroup *string `json:"apiGroup,omitempty"`
+	Kind     string  `json:"kind"`
+	Name     string  `json:"name"`
+}
+
+type VolumeSnapshotClass struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Snapshotter       string            `json:"snapshotter"`
+	Parameters        map[string]string `json:"parameters,omitempty"`
+}
+
+type VolumeSnapshot struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              VolumeSnapshotSpec   `json:"spec"`
+	Status            VolumeSnapshotStatus `json:"status,omitempty"`
+}
+
+type VolumeSnapshotSpec struct {
+	Source                  *TypedReference `json:"source,omitempty"`
+	SnapshotContentName     string          `json:"snapshotContentName,omitempty"`
+	VolumeSnapshotClassName *string         `json:"snapshotClassName,omitempty"`
+}
+
+type VolumeSnapshotStatus struct {
+	CreationTime *metav1.Time         `json:"creationTime,omitempty"`
+	RestoreSize  *resource.Quantity   `json:"restoreSize,omitempty"`
+	ReadyToUse   bool                 `json:"readyToUse"`
+	Error        *VolumeSnapshotError `json:"error,omitempty"`
+}
+
+type VolumeSnapshotError struct {
+	Time    *metav1.Time `json:"time,omitempty"`
+	Message string       `json:"message,omitempty"`
+}
+
+type VolumeSnapshotList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []VolumeSnapshot `json:"items"`
+}
+
+type VolumeSnapshotContent struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              VolumeSnapshotContentSpec `json:"spec"`
+}
+
+type VolumeSnapshotContentSpec struct {
+	// the CRD defines only a CSI source, the snapshotter stands for the CSI driver
+	CSI                     *SnapshotSource     `json:"csiVolumeSnapshotSource,omitempty"`
+	VolumeSnapshotRef       *v1.ObjectReference `json:"volumeSnapshotRef,omitempty"`
+	PersistentVolumeRef     *v1.ObjectReference `json:"persistentVolumeRef,omitempty"`
+	VolumeSnapshotClassName *string             `json:"snapshotClassName,omitempty"`
+	DeletionPolicy          *string             `json:"deletionPolicy,omitempty"`
+}
+
+type SnapshotSource struct {
+	Driver         string `json:"driver"`
+	SnapshotHandle string `json:"snapshotHandle"`
+	// CreationTime in nanoseconds since the epoch
+	CreationTime *int64 `json:"creationTime,omitempty"`
+	// RestoreSize in bytes
+	RestoreSize *int64 `json:"restoreSize,omitempty"`
+}
+
+type VolumeSnapshotContentList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []VolumeSnapshotContent `json:"items"`
+}
+
+// SnapshotClient reads and writes the snapshot CRDs
+type SnapshotClient struct {
+	client rest.Interface
+}
+
+// NewSnapshotClient uses a rest client of any group, i.e the CoreV1 client of a clientset,
+// since every request sets its absolute path
+func NewSnapshotClient(client rest.Interface) *SnapshotClient {
+	return &SnapshotClient{client: client}
+}
+
+func snapshotPath(namespace string, resource string, name string) string {
+	p := path.Join("/apis", SnapshotGroup, SnapshotVersion)
+	if namespace != "" {
+		p = path.Join(p, "namespaces", namespace)
+	}
+	return path.Join(p, resource, name)
+}
+
+func (c *SnapshotClient) get(p string, into interface{}) error {
+	b, err := c.client.Get().AbsPath(p).DoRaw()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, into)
+}
+
+func (c *SnapshotClient) put(p string, object interface{}, into interface{}) error {
+	body, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+	b, err := c.client.Put().AbsPath(p).SetHeader("Content-Type", "application/json").Body(body).DoRaw()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, into)
+}
+
+func (c *SnapshotClient) GetVolumeSnapshotClass(name string) (*VolumeSnapshotClass, error) {
+	class := &VolumeSnapshotClass{}
+	return class, c.get(snapshotPath("", "volumesnapshotclasses", name), class)
+}
+
+func (c *SnapshotClient) GetVolumeSnapshot(namespace string, name string) (*VolumeSnapshot, error) {
+	snapshot := &VolumeSnapshot{}
+	return snapshot, c.get(snapshotPath(namespace, "volumesnapshots", name), snapshot)
+}
+
+// ListVolumeSnapshots lists the snapshots of all namespaces
+func (c *SnapshotClient) ListVolumeSnapshots() ([]VolumeSnapshot, error) {
+	list := &VolumeSnapshotList{}
+	return list.Items, c.get(snapshotPath("", "volumesnapshots", ""), list)
+}
+
+func (c *SnapshotClient) UpdateVolumeSnapshot(snapshot *VolumeSnapshot) (*VolumeSnapshot, error) {
+	updated := &VolumeSnapshot{}
+	return updated, c.put(snapshotPath(snapshot.Namespace, "volumesnapshots", snapshot.Name), snapshot, updated)
+}
+
+func (c *SnapshotClient) GetVolumeSnapshotContent(name string) (*VolumeSnapshotContent, error) {
+	content := &VolumeSnapshotContent{}
+	return content, c.get(snapshotPath("", "volumesnapshotcontents", name), content)
+}
+
+func (c *SnapshotClient) UpdateVolumeSnapshotContent(content *VolumeSnapshotContent) (*VolumeSnapshotContent, error) {
+	updated := &VolumeSnapshotContent{}
+	return updated, c.put(snapshotPath("", "volumesnapshotcontents", content.Name), content, updated)
+}
+
+func (c *SnapshotClient) ListVolumeSnapshotContents() ([]VolumeSnapshotContent, error) {
+	list := &VolumeSnapshotContentList{}
+	return list.Items, c.get(snapshotPath("", "volumesnapshotcontents", ""), list)
+}
+
+func (c *SnapshotClient) CreateVolumeSnapshotContent(content *VolumeSnapshotContent) (*VolumeSnapshotContent, error) {
+	content.APIVersion = SnapshotGroup + "/" + SnapshotVersion
+	content.Kind = "VolumeSnapshotContent"
+	body, err := json.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	b, err := c.client.Post().AbsPath(snapshotPath("", "volumesnapshotcontents", "")).
+		SetHeader("Content-Type", "application/json").Body(body).DoRaw()
+	if err != nil {
+		return nil, err
+	}
+	created := &VolumeSnapshotContent{}
+	return created, json.Unmarshal(b, created)
+}
+
+func (c *SnapshotClient) DeleteVolumeSnapshotContent(name string) error {
+	_, err := c.client.Delete().AbsPath(snapshotPath("", "volumesnapshotcontents", name)).DoRaw()
+	return err
+}
+
+// DataSourceOf reads the dataSource of the claim. The vendored PersistentVolumeClaimSpec predates
+// the field, so the claim is fetched again as raw json.
+func DataSourceOf(client rest.Interface, claim *v1.PersistentVolumeClaim) (*TypedReference, error) {
+	b, err := client.Get().
+		AbsPath("/api/v1/namespaces", claim.Namespace, "persistentvolumeclaims", claim.Name).
+		DoRaw()
+	if err != nil {
+		return nil, err
+	}
+	raw := struct {
+		Spec struct {
+			DataSource *TypedReference `json:"dataSource"`
+		} `json:"spec"`
+	}{}
+	err = json.Unmarshal(b, &raw)
+	return raw.Spec.DataSource, err
+}
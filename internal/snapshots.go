@@ -0,0 +1,271 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// oVirt takes snapshots of VMs, a disk snapshot is a VM snapshot that includes
+// only that disk. That is why the disk must be attached to a VM to be snapshotted,
+// and why a snapshot is identified by the VM id and the snapshot id. The engine
+// doesn't detach a disk of a VM snapshot, so a snapshot is kept as a floating disk
+// restored out of it, and the VM snapshot is removed once the disk is made.
+
+// ErrDiskNotAttached is returned when snapshotting a disk which no VM holds
+var ErrDiskNotAttached = fmt.Errorf("the disk is not attached to any VM, oVirt snapshots only disks of VMs")
+
+// SnapshotStatusOk is the status of a snapshot which is ready to be used
+const SnapshotStatusOk = "ok"
+
+// CreateDiskSnapshot takes a snapshot of the VM holding the disk, including only that disk.
+// The snapshot is locked till the engine completes it, see GetDiskSnapshot.
+func (ovirt *Ovirt) CreateDiskSnapshot(diskId string, description string) (Snapshot, error) {
+	disk, err := ovirt.GetDiskById(diskId)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if disk.Vms == nil || len(disk.Vms.Vms) == 0 {
+		return Snapshot{}, ErrDiskNotAttached
+	}
+	vmId := disk.Vms.Vms[0].Id
+
+	request := map[string]interface{}{
+		"description":         description,
+		"persist_memorystate": "false",
+		"disk_attachments": map[string]interface{}{
+			"disk_attachment": []map[string]interface{}{
+				{"disk": map[string]string{"id": diskId}},
+			},
+		},
+	}
+	post, err := ovirt.Post("vms/"+vmId+"/snapshots", request)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	snapshot := Snapshot{}
+	err = json.Unmarshal([]byte(post), &snapshot)
+	snapshot.VmId = vmId
+	snapshot.DiskId = diskId
+	return snapshot, err
+}
+
+// GetDiskSnapshot fetches the snapshot, to follow its status
+func (ovirt *Ovirt) GetDiskSnapshot(vmId string, snapshotId string, diskId string) (Snapshot, error) {
+	r, err := ovirt.Get("vms/" + vmId + "/snapshots/" + snapshotId)
+	snapshot := Snapshot{}
+	if err != nil {
+		return snapshot, err
+	}
+	err = json.Unmarshal(r, &snapshot)
+	snapshot.VmId = vmId
+	snapshot.DiskId = diskId
+	return snapshot, err
+}
+
+// ListDiskSnapshots lists the snapshots of the VMs holding the disk which include the disk
+func (ovirt *Ovirt) ListDiskSnapshots(diskId string) ([]Snapshot, error) {
+	disk, err := ovirt.GetDiskById(diskId)
+	if err != nil {
+		return nil, err
+	}
+	if disk.Vms == nil {
+		return nil, nil
+	}
+
+	var snapshots []Snapshot
+	for _, vm := range disk.Vms.Vms {
+		r, err := ovirt.Get("vms/" + vm.Id + "/snapshots")
+		if err != nil {
+			return nil, err
+		}
+		result := SnapshotResult{}
+		err = json.Unmarshal(r, &result)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range result.Snapshots {
+			// the active snapshot is the current state of the VM
+			if s.Type == "active" {
+				continue
+			}
+			included, err := ovirt.snapshotIncludesDisk(vm.Id, s.Id, diskId)
+			if err != nil {
+				return nil, err
+			}
+			if included {
+				s.VmId = vm.Id
+				s.DiskId = diskId
+				snapshots = append(snapshots, s)
+			}
+		}
+	}
+	return snapshots, nil
+}
+
+func (ovirt *Ovirt) snapshotIncludesDisk(vmId string, snapshotId string, diskId string) (bool, error) {
+	r, err := ovirt.Get("vms/" + vmId + "/snapshots/" + snapshotId + "/disks")
+	if err != nil {
+		return false, err
+	}
+	result := DiskResult{}
+	err = json.Unmarshal(r, &result)
+	if err != nil {
+		return false, err
+	}
+	for _, d := range result.Disks {
+		if d.Id == diskId {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// DeleteDiskSnapshot removes the snapshot, a snapshot which doesn't exist is ignored
+func (ovirt *Ovirt) DeleteDiskSnapshot(vmId string, snapshotId string) error {
+	_, err := ovirt.Delete("vms/" + vmId + "/snapshots/" + snapshotId)
+	if _, notFound := err.(NotFound); notFound {
+		return nil
+	}
+	return err
+}
+
+// restoreVmPrefix names the VMs cloned out of a snapshot to restore its disk
+const restoreVmPrefix = "restore-"
+
+// RestoreDiskSnapshot creates a new floating disk out of the disk image in the snapshot,
+// the snapshots taken by CreateDiskSnapshot hold that single disk. The engine restores
+// a disk only by cloning a VM out of the snapshot, so a VM is cloned holding a copy of the
+// disk in the storage domain, the copy is renamed and described and detached, and the VM is removed.
+// The snapshot and its disk are left untouched.
+func (ovirt *Ovirt) RestoreDiskSnapshot(snapshot Snapshot, diskName string, diskDescription string, storageDomainName string, sizeInBytes int64, thinProvisioning bool) (Disk, error) {
+	format, sparse, err := ovirt.DefaultDiskParamsBy(storageDomainName, thinProvisioning)
+	if err != nil {
+		return Disk{}, err
+	}
+	vm, err := ovirt.GetVMById(snapshot.VmId)
+	if err != nil {
+		return Disk{}, err
+	}
+	// a clone left by an interrupted restore holds the name
+	stale, err := ovirt.GetVM(restoreVmPrefix + snapshot.Id)
+	if err != nil {
+		return Disk{}, err
+	}
+	if stale.Id != "" {
+		if _, err := ovirt.Delete("vms/" + stale.Id); err != nil {
+			return Disk{}, err
+		}
+	}
+
+	request := map[string]interface{}{
+		"name":    restoreVmPrefix + snapshot.Id,
+		"cluster": map[string]string{"id": vm.Cluster.Id},
+		"snapshots": map[string]interface{}{
+			"snapshot": []map[string]string{{"id": snapshot.Id}},
+		},
+		"disk_attachments": map[string]interface{}{
+			"disk_attachment": []map[string]interface{}{{
+				"disk": map[string]interface{}{
+					"id":     snapshot.DiskId,
+					"format": format,
+					"sparse": strconv.FormatBool(bool(sparse)),
+					"storage_domains": map[string]interface{}{
+						"storage_domain": []map[string]string{{"name": storageDomainName}},
+					},
+				},
+			}},
+		},
+	}
+	post, err := ovirt.Post("vms", request)
+	if err != nil {
+		return Disk{}, err
+	}
+	clone := VM{}
+	err = json.Unmarshal([]byte(post), &clone)
+	if err != nil {
+		return Disk{}, err
+	}
+
+	disk, err := ovirt.waitForDisk(func() (Disk, error) { return ovirt.diskOfClone(clone.Id) }, DefaultCopyTimeout)
+	if err == nil {
+		disk, err = ovirt.UpdateDisk(disk.Id, DiskUpdate{Name: diskName, Description: diskDescription})
+	}
+	if err == nil {
+		err = ovirt.DetachDiskFromVM(clone.Id, disk.Id)
+	}
+	// removing the clone before the detach removes its disk as well
+	if _, e := ovirt.Delete("vms/" + clone.Id); e != nil && err == nil {
+		err = e
+	}
+	if err != nil {
+		return Disk{}, err
+	}
+	if uint64(sizeInBytes) > disk.ProvisionedSize {
+		return ovirt.ExtendDisk(disk.Id, sizeInBytes)
+	}
+	return disk, nil
+}
+
+// diskOfClone returns the single disk of a VM cloned out of a snapshot, locked till the
+// engine completes the clone
+func (ovirt *Ovirt) diskOfClone(vmId string) (Disk, error) {
+	vm, err := ovirt.GetVMById(vmId)
+	if err != nil {
+		return Disk{}, err
+	}
+	attachments, err := ovirt.GetDiskAttachments(vmId)
+	if err != nil {
+		return Disk{}, err
+	}
+	if vm.Status == "image_locked" || len(attachments) == 0 {
+		return Disk{Status: "locked"}, nil
+	}
+	if len(attachments) != 1 {
+		return Disk{}, fmt.Errorf("VM %s cloned out of a snapshot holds %d disks, expected one", vmId, len(attachments))
+	}
+	return attachments[0].Disk, nil
+}
+
+// SnapshotHandle encodes the snapshot as a single string, to be kept in a kubernetes object.
+// A snapshot kept as a disk is the id of the disk.
+func SnapshotHandle(snapshot Snapshot) string {
+	if snapshot.KeptAsDisk() {
+		return snapshot.DiskId
+	}
+	return strings.Join([]string{snapshot.VmId, snapshot.Id, snapshot.DiskId}, "/")
+}
+
+// SnapshotFromHandle decodes a handle created by SnapshotHandle
+func SnapshotFromHandle(handle string) (Snapshot, error) {
+	parts := strings.Split(handle, "/")
+	if len(parts) == 1 && parts[0] != "" {
+		return Snapshot{DiskId: parts[0]}, nil
+	}
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return Snapshot{}, fmt.Errorf("invalid snapshot handle '%s', expected <disk id> or <vm id>/<snapshot id>/<disk id>", handle)
+	}
+	return Snapshot{VmId: parts[0], Id: parts[1], DiskId: parts[2]}, nil
+}
+
+// KeptAsDisk tells if the snapshot is a floating disk rather than a VM snapshot
+func (s Snapshot) KeptAsDisk() bool {
+	return s.VmId == ""
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestOvirt_CreateDiskSnapshot(t *testing.T) {
+	api := NewMockOvirt()
+	api.Handle("/disks/"+diskId, genericRequestHandlerFunc(`{"id": "`+diskId+`", "vms": {"vm": [{"id": "`+vmId+`"}]}}`))
+	var request map[string]interface{}
+	api.Handle("/vms/"+vmId+"/snapshots", func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(b, &request)
+		w.Write([]byte(`{"id": "snap1", "description": "desc", "snapshot_status": "locked"}`))
+	})
+
+	snapshot, err := api.CreateDiskSnapshot(diskId, "desc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Id != "snap1" || snapshot.VmId != vmId || snapshot.DiskId != diskId || snapshot.Status != "locked" {
+		t.Errorf("unexpected snapshot %+v", snapshot)
+	}
+	attachments, _ := json.Marshal(request["disk_attachments"])
+	if string(attachments) != `{"disk_attachment":[{"disk":{"id":"`+diskId+`"}}]}` {
+		t.Errorf("expected the snapshot to include only the disk, got %s", attachments)
+	}
+}
+
+func TestOvirt_CreateDiskSnapshotOfFloatingDisk(t *testing.T) {
+	api := NewMockOvirt()
+	api.Handle("/disks/"+diskId, genericRequestHandlerFunc(`{"id": "`+diskId+`"}`))
+
+	_, err := api.CreateDiskSnapshot(diskId, "desc")
+	if err != ErrDiskNotAttached {
+		t.Errorf("expected ErrDiskNotAttached, got %v", err)
+	}
+}
+
+func TestOvirt_ListDiskSnapshots(t *testing.T) {
+	api := NewMockOvirt()
+	api.Handle("/disks/"+diskId, genericRequestHandlerFunc(`{"id": "`+diskId+`", "vms": {"vm": [{"id": "`+vmId+`"}]}}`))
+	api.Handle("/vms/"+vmId+"/snapshots", genericRequestHandlerFunc(`{"snapshot": [
+		{"id": "active", "snapshot_type": "active"},
+		{"id": "snap1", "snapshot_type": "regular"},
+		{"id": "snap2", "snapshot_type": "regular"}]}`))
+	api.Handle("/vms/"+vmId+"/snapshots/snap1/disks", genericRequestHandlerFunc(`{"disk": [{"id": "`+diskId+`"}]}`))
+	api.Handle("/vms/"+vmId+"/snapshots/snap2/disks", genericRequestHandlerFunc(`{"disk": [{"id": "other"}]}`))
+
+	snapshots, err := api.ListDiskSnapshots(diskId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 1 || snapshots[0].Id != "snap1" || snapshots[0].VmId != vmId {
+		t.Errorf("expected only snap1, got %+v", snapshots)
+	}
+}
+
+func TestOvirt_DeleteMissingDiskSnapshot(t *testing.T) {
+	api := NewMockOvirt()
+	api.Handle("/vms/"+vmId+"/snapshots/snap1", http.NotFound)
+
+	err := api.DeleteDiskSnapshot(vmId, "snap1")
+	if err != nil {
+		t.Errorf("expected a missing snapshot to be ignored, got %v", err)
+	}
+}
+
+func TestOvirt_RestoreDiskSnapshot(t *testing.T) {
+	api := NewMockOvirt()
+	var cloneRequest map[string]interface{}
+	var renameBody string
+	var calls []string
+	api.Handle("/vms/"+vmId, genericRequestHandlerFunc(`{"id": "`+vmId+`", "cluster": {"id": "cluster1"}}`))
+	api.Handle("/vms", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			b, _ := ioutil.ReadAll(r.Body)
+			json.Unmarshal(b, &cloneRequest)
+			w.Write([]byte(`{"id": "clone1", "status": "image_locked"}`))
+			return
+		}
+		w.Write([]byte(`{"vm": []}`))
+	})
+	api.Handle("/vms/clone1", func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		w.Write([]byte(`{"id": "clone1", "status": "down"}`))
+	})
+	api.Handle("/vms/clone1/diskattachments", genericRequestHandlerFunc(
+		`{"disk_attachment": [{"id": "copy1", "disk": {"id": "copy1", "provisioned_size": "1073741824", "status": "ok"}}]}`))
+	api.Handle("/vms/clone1/diskattachments/copy1", func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, r.Method+" "+r.URL.Path)
+	})
+	api.Handle("/disks/copy1", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			b, _ := ioutil.ReadAll(r.Body)
+			renameBody = string(b)
+		}
+		w.Write([]byte(`{"id": "copy1", "name": "pv1", "provisioned_size": "1073741824", "status": "ok"}`))
+	})
+
+	disk, err := api.RestoreDiskSnapshot(Snapshot{VmId: vmId, Id: "snap1", DiskId: diskId}, "pv1", "claim", "data1", 1073741824, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if disk.Id != "copy1" || disk.Name != "pv1" {
+		t.Errorf("unexpected disk %+v", disk)
+	}
+	request, _ := json.Marshal(cloneRequest)
+	expected := `{"cluster":{"id":"cluster1"},` +
+		`"disk_attachments":{"disk_attachment":[{"disk":{"format":"raw","id":"` + diskId + `","sparse":"false",` +
+		`"storage_domains":{"storage_domain":[{"name":"data1"}]}}}]},` +
+		`"name":"restore-snap1","snapshots":{"snapshot":[{"id":"snap1"}]}}`
+	if string(request) != expected {
+		t.Errorf("expected the VM clone request %s, got %s", expected, request)
+	}
+	if renameBody != `{"description":"claim","name":"pv1"}` {
+		t.Errorf("expected the disk to be renamed, got %s", renameBody)
+	}
+	// the disk is detached before the clone is removed, else it is removed with it
+	last := calls[len(calls)-2:]
+	if last[0] != "DELETE /vms/clone1/diskattachments/copy1" || last[1] != "DELETE /vms/clone1" {
+		t.Errorf("expected a detach and the clone removal, got %v", calls)
+	}
+}
+
+func TestSnapshotHandle(t *testing.T) {
+	for _, snapshot := range []Snapshot{{Id: "snap1", VmId: vmId, DiskId: diskId}, {DiskId: diskId}} {
+		parsed, err := SnapshotFromHandle(SnapshotHandle(snapshot))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed != snapshot || parsed.KeptAsDisk() != (snapshot.VmId == "") {
+			t.Errorf("expected %+v, got %+v", snapshot, parsed)
+		}
+	}
+
+	for _, handle := range []string{"", vmId + "/snap1", vmId + "//" + diskId} {
+		_, err := SnapshotFromHandle(handle)
+		if err == nil {
+			t.Errorf("expected handle '%s' to be invalid", handle)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+)
+
+// The topology of kubernetes is mapped to oVirt: a zone is an oVirt cluster and a region is
+// a data center. A disk on a storage domain of a data center can be attached to the VMs
+// of every cluster of that data center.
+
+const StorageDomainStatusActive = "active"
+
+// Topology is the cluster and data center of a VM
+type Topology struct {
+	Zone         string
+	Region       string
+	DataCenterId string
+}
+
+func (ovirt *Ovirt) GetCluster(clusterId string) (Cluster, error) {
+	cluster := Cluster{}
+	r, err := ovirt.Get("clusters/" + clusterId)
+	if err != nil {
+		return cluster, err
+	}
+	err = json.Unmarshal(r, &cluster)
+	return cluster, err
+}
+
+// GetClusterByName returns ErrNotExist when there is no such cluster
+func (ovirt *Ovirt) GetClusterByName(name string) (Cluster, error) {
+	r, err := ovirt.Get("clusters?search=" + url.QueryEscape("name="+name))
+	if err != nil {
+		return Cluster{}, err
+	}
+	result := ClusterResult{}
+	err = json.Unmarshal(r, &result)
+	if err != nil {
+		return Cluster{}, err
+	}
+	for _, c := range result.Clusters {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+	return Cluster{}, ErrNotExist
+}
+
+func (ovirt *Ovirt) GetDataCenter(dataCenterId string) (DataCenter, error) {
+	dataCenter := DataCenter{}
+	r, err := ovirt.Get("datacenters/" + dataCenterId)
+	if err != nil {
+		return dataCenter, err
+	}
+	err = json.Unmarshal(r, &dataCenter)
+	return dataCenter, err
+}
+
+// GetDataCenterByName returns ErrNotExist when there is no such data center
+func (ovirt *Ovirt) GetDataCenterByName(name string) (DataCenter, error) {
+	r, err := ovirt.Get("datacenters?search=" + url.QueryEscape("name="+name))
+	if err != nil {
+		return DataCenter{}, err
+	}
+	result := DataCenterResult{}
+	err = json.Unmarshal(r, &result)
+	if err != nil {
+		return DataCenter{}, err
+	}
+	for _, dc := range result.DataCenters {
+		if dc.Name == name {
+			return dc, nil
+		}
+	}
+	return DataCenter{}, ErrNotExist
+}
+
+func (ovirt *Ovirt) GetDataCenters() ([]DataCenter, error) {
+	r, err := ovirt.Get("datacenters")
+	if err != nil {
+		return nil, err
+	}
+	result := DataCenterResult{}
+	err = json.Unmarshal(r, &result)
+	return result.DataCenters, err
+}
+
+// GetDataCenterStorageDomains returns the storage domains attached to the data center, with their status in it
+func (ovirt *Ovirt) GetDataCenterStorageDomains(dataCenterId string) ([]StorageDomain, error) {
+	r, err := ovirt.Get("datacenters/" + dataCenterId + "/storagedomains")
+	if err != nil {
+		return nil, err
+	}
+	result := StorageDomains{}
+	err = json.Unmarshal(r, &result)
+	return result.Domains, err
+}
+
+// VMTopology returns the cluster and the data center the VM runs in
+func VMTopology(ovirt OvirtApi, vmId string) (Topology, error) {
+	vm, err := ovirt.GetVMById(vmId)
+	if err != nil {
+		return Topology{}, err
+	}
+	if vm.Cluster.Id == "" {
+		return Topology{}, fmt.Errorf("VM %s has no cluster", vmId)
+	}
+	cluster, err := ovirt.GetCluster(vm.Cluster.Id)
+	if err != nil {
+		return Topology{}, err
+	}
+	return clusterTopology(ovirt, cluster)
+}
+
+// ZoneTopology returns the topology of a zone, the name of an oVirt cluster
+func ZoneTopology(ovirt OvirtApi, zone string) (Topology, error) {
+	cluster, err := ovirt.GetClusterByName(zone)
+	if err != nil {
+		return Topology{}, fmt.Errorf("failed getting the cluster of zone %s: %s", zone, err)
+	}
+	return clusterTopology(ovirt, cluster)
+}
+
+// RegionTopology returns the topology of a region, the name of an oVirt data center
+func RegionTopology(ovirt OvirtApi, region string) (Topology, error) {
+	dataCenter, err := ovirt.GetDataCenterByName(region)
+	if err != nil {
+		return Topology{}, fmt.Errorf("failed getting the data center of region %s: %s", region, err)
+	}
+	return Topology{Region: dataCenter.Name, DataCenterId: dataCenter.Id}, nil
+}
+
+func clusterTopology(ovirt OvirtApi, cluster Cluster) (Topology, error) {
+	if cluster.DataCenter.Id == "" {
+		return Topology{}, fmt.Errorf("cluster %s is not in a data center", cluster.Name)
+	}
+	dataCenter, err := ovirt.GetDataCenter(cluster.DataCenter.Id)
+	if err != nil {
+		return Topology{}, err
+	}
+	return Topology{Zone: cluster.Name, Region: dataCenter.Name, DataCenterId: dataCenter.Id}, nil
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2019 oVirt-maintainers
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"testing"
+)
+
+func mockTopology() MockOvirt {
+	api := NewMockOvirt()
+	api.Handle("/vms/"+vmId, genericRequestHandlerFunc(`{"id": "`+vmId+`", "name": "node1", "cluster": {"id": "cluster1-id"}}`))
+	api.Handle("/clusters/cluster1-id", genericRequestHandlerFunc(`{"id": "cluster1-id", "name": "cluster1", "data_center": {"id": "dc1-id"}}`))
+	api.Handle("/clusters", genericRequestHandlerFunc(`{"cluster": [{"id": "cluster1-id", "name": "cluster1", "data_center": {"id": "dc1-id"}}]}`))
+	api.Handle("/datacenters/dc1-id", genericRequestHandlerFunc(`{"id": "dc1-id", "name": "dc1", "status": "up"}`))
+	api.Handle("/datacenters", genericRequestHandlerFunc(`{"data_center": [{"id": "dc1-id", "name": "dc1"}]}`))
+	api.Handle("/datacenters/dc1-id/storagedomains", genericRequestHandlerFunc(
+		`{"storage_domain": [{"id": "sd1-id", "name": "data1", "type": "data", "status": "active", "storage": {"type": "nfs"},
+			"comment": "gold", "available": "107374182400", "used": "10737418240"}]}`))
+	return api
+}
+
+func TestVMTopology(t *testing.T) {
+	api := mockTopology()
+	topology, err := VMTopology(api, vmId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Topology{Zone: "cluster1", Region: "dc1", DataCenterId: "dc1-id"}
+	if topology != expected {
+		t.Errorf("expected %+v, got %+v", expected, topology)
+	}
+
+	topology, err = ZoneTopology(api, "cluster1")
+	if err != nil || topology != expected {
+		t.Errorf("expected the topology of the zone %+v, got %+v %v", expected, topology, err)
+	}
+	_, err = ZoneTopology(api, "cluster2")
+	if err == nil {
+		t.Errorf("expected an error for a missing cluster")
+	}
+	topology, err = RegionTopology(api, "dc1")
+	if err != nil || topology.DataCenterId != "dc1-id" || topology.Zone != "" {
+		t.Errorf("unexpected topology of the region %+v %v", topology, err)
+	}
+}
+
+func TestGetDataCenterStorageDomains(t *testing.T) {
+	api := mockTopology()
+	domains, err := api.GetDataCenterStorageDomains("dc1-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(domains) != 1 || domains[0].Name != "data1" || domains[0].Status != StorageDomainStatusActive || domains[0].Type != "data" ||
+		domains[0].Comment != "gold" || domains[0].Available != 100<<30 || domains[0].Used != 10<<30 {
+		t.Errorf("unexpected domains %+v", domains)
+	}
+}
+
+func TestGetDataCenters(t *testing.T) {
+	api := mockTopology()
+	dataCenters, err := api.GetDataCenters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dataCenters) != 1 || dataCenters[0].Id != "dc1-id" || dataCenters[0].Name != "dc1" {
+		t.Errorf("unexpected data centers %+v", dataCenters)
+	}
+}
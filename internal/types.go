@@ -45,11 +45,27 @@ type Disk struct {
 	Name            string         `json:"name"`
 	ActualSize      uint64         `json:"actual_size,omitempty,string"`
 	ProvisionedSize uint64         `json:"provisioned_size,string"`
+	// InitialSize is the allocation of a new cow disk on block storage, i.e to upload an image into
+	InitialSize     uint64         `json:"initial_size,omitempty,string"`
 	Status          string         `json:"status,omitempty"`
+	Description     string         `json:"description,omitempty"`
 	Format          DiskFormat     `json:"format"`
 	StorageDomains  StorageDomains `json:"storage_domains"`
 	Sparse  		Sparse         `json:"sparse,string"`
+	WipeAfterDelete bool           `json:"wipe_after_delete,string,omitempty"`
+	QcowVersion     string         `json:"qcow_version,omitempty"`
+	DiskProfile     *Reference     `json:"disk_profile,omitempty"`
+	Quota           *Reference     `json:"quota,omitempty"`
+	Backup          string         `json:"backup,omitempty"`
+	// Shareable disks can be attached to several VMs at once
+	Shareable       bool           `json:"shareable,string,omitempty"`
+	// Vms are the VMs the disk is attached to, as reported by the engine
+	Vms             *VMResult      `json:"vms,omitempty"`
+}
 
+// Reference links to another engine resource by its id
+type Reference struct {
+	Id string `json:"id"`
 }
 
 type DiskResult struct {
@@ -61,8 +77,17 @@ type StorageDomains struct {
 }
 
 type StorageDomain struct {
+	Id   string `json:"id,omitempty"`
 	Name string `json:"name"`
 	Storage struct{  Type string `json:"type,omitempty"`} `json:"storage,omitempty,"`
+	// Type is data, iso or export, and Status is reported only in the scope of a data center
+	Type        string             `json:"type,omitempty"`
+	Status      string             `json:"status,omitempty"`
+	DataCenters *DataCenterResult  `json:"data_centers,omitempty"`
+	Comment     string             `json:"comment,omitempty"`
+	Available   uint64             `json:"available,omitempty,string"`
+	Used        uint64             `json:"used,omitempty,string"`
+	Committed   uint64             `json:"committed,omitempty,string"`
 }
 
 type VM struct {
@@ -71,6 +96,13 @@ type VM struct {
 	Fqdn string `json:"fqdn"`
 	Nics struct { Nics []Nic `json:"nic"` } `json:"nics"`
 	Status string `json:"status"`
+	Cluster Reference `json:"cluster"`
+	CustomProperties struct { CustomProperties []CustomProperty `json:"custom_property"` } `json:"custom_properties"`
+}
+
+type CustomProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
 }
 
 type Nic struct {
@@ -93,3 +125,81 @@ type VMResult struct {
 	Vms []VM `json:"vm"`
 }
 
+// ImageTransfer is a transfer of the image of a disk through imageio
+type ImageTransfer struct {
+	Id          string `json:"id,omitempty"`
+	Phase       string `json:"phase,omitempty"`
+	Direction   string `json:"direction,omitempty"`
+	TransferUrl string `json:"transfer_url,omitempty"`
+	ProxyUrl    string `json:"proxy_url,omitempty"`
+}
+
+type Template struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type TemplateResult struct {
+	Templates []Template `json:"template"`
+}
+
+// Snapshot is a VM snapshot. The ones taken by CreateDiskSnapshot hold a single disk.
+// A snapshot kept as a disk, see SnapshotHandle, has no VmId and no Id, its DiskId is the
+// floating disk holding the image.
+type Snapshot struct {
+	Id          string `json:"id,omitempty"`
+	Description string `json:"description,omitempty"`
+	Status      string `json:"snapshot_status,omitempty"`
+	Type        string `json:"snapshot_type,omitempty"`
+	Date        int64  `json:"date,omitempty"`
+	// VmId and DiskId are not part of the engine representation, they are
+	// set by the snapshot api calls
+	VmId   string `json:"-"`
+	DiskId string `json:"-"`
+}
+
+type SnapshotResult struct {
+	Snapshots []Snapshot `json:"snapshot"`
+}
+
+// Cluster is an oVirt cluster, the VMs of a cluster reach the storage domains of its data center
+type Cluster struct {
+	Id         string    `json:"id"`
+	Name       string    `json:"name"`
+	DataCenter Reference `json:"data_center"`
+}
+
+type ClusterResult struct {
+	Clusters []Cluster `json:"cluster"`
+}
+
+type DataCenter struct {
+	Id        string `json:"id"`
+	Name      string `json:"name,omitempty"`
+	Status    string `json:"status,omitempty"`
+	QuotaMode string `json:"quota_mode,omitempty"`
+}
+
+type DataCenterResult struct {
+	DataCenters []DataCenter `json:"data_center"`
+}
+
+// QuotaStorageLimit is the storage limit of a quota in GiB, on a storage domain or on all of them when
+// it has no storage domain. A limit of -1 is unlimited.
+type QuotaStorageLimit struct {
+	Id            string     `json:"id,omitempty"`
+	Limit         int64      `json:"limit,string"`
+	Usage         float64    `json:"usage,omitempty,string"`
+	StorageDomain *Reference `json:"storage_domain,omitempty"`
+}
+
+type QuotaStorageLimitResult struct {
+	Limits []QuotaStorageLimit `json:"quota_storage_limit"`
+}
+
+// DiskProfile sets the QoS of the disks of its storage domain
+type DiskProfile struct {
+	Id            string     `json:"id"`
+	Name          string     `json:"name,omitempty"`
+	StorageDomain *Reference `json:"storage_domain,omitempty"`
+}